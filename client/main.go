@@ -1,15 +1,19 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"log/slog"
 	"os"
 	"os/exec"
-
-	"golang.org/x/sys/unix"
+	"strings"
+	"text/tabwriter"
+	"time"
 
 	"gotty-piko-client/src"
 
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 )
 
 func main() {
@@ -38,6 +42,14 @@ func MakeMainCmd() *cobra.Command {
 		daemon        bool
 		pidFile       string
 		tmuxSession   string
+		logLevel      string
+		logFormat     string
+		logMaxSize    int
+		logMaxFiles   int
+		allowUsers    string
+		multiHost     bool
+		configFile    string
+		profile       string
 	)
 
 	cmd := &cobra.Command{
@@ -51,8 +63,18 @@ Examples:
   gottyp --remote=piko.example.com:8088
   gottyp --remote=piko.example.com:8088 --session myterm --tmux=true
   gottyp --remote=piko.example.com:8088 --auth=false
-  gottyp --remote=piko.example.com:8088 --notify-webhook=https://open.feishu.cn/...`,
+  gottyp --remote=piko.example.com:8088 --notify-webhook=https://open.feishu.cn/...
+  gottyp --profile work
+
+Settings are taken from command line flags, then environment variables (GOTTYP_ and
+the flag name in upper case, e.g. GOTTYP_UPSTREAM_KEY, or REMOTE, AUTH_NAME and
+UPSTREAM_KEY without the prefix), then the profile in ~/.config/gottyp/config.yaml,
+then the defaults. Run "gottyp config" to see the effective settings.`,
 		RunE: func(cmd *cobra.Command, args []string) error {
+			if _, _, _, err := loadSettings(cmd.Flags(), configFile, profile); err != nil {
+				return err
+			}
+
 			config := &src.Config{
 				Session:       session,
 				AuthName:      authName,
@@ -70,32 +92,74 @@ Examples:
 				Daemon:        daemon,
 				PidFile:       pidFile,
 				TmuxSession:   tmuxSession,
+				LogLevel:      logLevel,
+				LogFormat:     logFormat,
+				LogMaxSize:    logMaxSize,
+				LogMaxFiles:   logMaxFiles,
+				AllowUsers:    allowUsers,
+				MultiHost:     multiHost,
 			}
 
 			if err := config.Validate(); err != nil {
 				return err
 			}
 
+			logOutput := src.NewRedactor(os.Stderr)
+			logOutput.Add(config.Pass, config.UpstreamKey)
+			logger, err := src.NewLogger(logOutput, config.LogLevel, config.LogFormat)
+			if err != nil {
+				return err
+			}
+			slog.SetDefault(logger)
+
 			manager := src.NewServiceManager(config)
+			if !src.IsDaemonized() {
+				if err := src.CheckRunning(config.Session); err != nil {
+					return err
+				}
+				if err := manager.CheckSession(); err != nil {
+					return err
+				}
+			}
 
 			if config.Daemon {
-				staticIndex := manager.PrintInfo()
-				if err := src.Daemonize(staticIndex, config.PidFile, config.Session, config.AuthName, config.Pass); err != nil {
+				staticIndex, err := manager.PrintInfo()
+				if err != nil {
+					return err
+				}
+				if err := src.Daemonize(staticIndex, config.PidFile, config.Session, config.AuthName, config.Pass, manager.SessionSecret()); err != nil {
 					return fmt.Errorf("failed to daemonize: %v", err)
 				}
-			} else {
-				manager.PrintInfo()
+			} else if _, err := manager.PrintInfo(); err != nil {
+				return err
 			}
 
+			logOutput.Add(manager.SessionSecret())
+			var logFile *src.LogFile
 			if src.IsDaemonized() {
-				f, err := os.OpenFile("/tmp/gottyp.log", os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+				if err := src.EnsureRuntimeDir(); err != nil {
+					return err
+				}
+				logFile, err = src.OpenLogFile(src.RuntimePath(config.Session, ".log"), int64(config.LogMaxSize)<<20, config.LogMaxFiles)
 				if err == nil {
-					unix.Dup2(int(f.Fd()), int(os.Stdout.Fd()))
-					unix.Dup2(int(f.Fd()), int(os.Stderr.Fd()))
+					logOutput = src.NewRedactor(logFile)
+					logOutput.Add(config.Pass, config.UpstreamKey, manager.SessionSecret())
+					logFile.Capture(logOutput)
+					if logger, err := src.NewLogger(logOutput, config.LogLevel, config.LogFormat); err == nil {
+						slog.SetDefault(logger)
+					}
 				}
 			}
 
-			if err := manager.Start(); err != nil {
+			err = manager.Start()
+			if manager.Restarting() {
+				if logFile != nil {
+					logFile.Detach()
+				}
+				return manager.Reexec()
+			}
+			src.RemovePidFile(config.PidFile)
+			if err != nil {
 				return err
 			}
 
@@ -112,15 +176,28 @@ Examples:
 	cmd.Flags().StringVar(&tmuxSession, "tmux-session", "", "Attach to a specific tmux session by name (overrides auto-generated session name)")
 	cmd.Flags().StringVar(&pass, "pass", "", "Auth password (auto-generated if not set)")
 	cmd.Flags().BoolVar(&auth, "auth", true, "Enable Basic Authentication")
-	cmd.Flags().StringVar(&upstreamKey, "upstream-key", "", "API key token to authenticate with the Piko server")
+	cmd.Flags().StringVar(&upstreamKey, "upstream-key", "", "Shared upstream key, or a user key issued by the server, to authenticate with the Piko server")
 	cmd.Flags().BoolVar(&enableNotify, "enable-notify", true, "Enable notify-send interception")
 	cmd.Flags().StringVar(&notifyWebhook, "notify-webhook", "", "Webhook URL to forward notifications to (Feishu compatible)")
 	cmd.Flags().StringVar(&staticIndex, "static-index", ".", "Local directory to serve as static files at /files/")
 	cmd.Flags().StringVar(&attachPort, "attach-port", "", "Map a local port to /port/ path (e.g. 3000)")
 	cmd.Flags().BoolVar(&daemon, "daemon", true, "Run as daemon (background process)")
-	cmd.Flags().StringVar(&pidFile, "pid-file", "/tmp/gottyp.pid", "PID file path for daemon mode")
+	cmd.Flags().StringVar(&pidFile, "pid-file", "", "PID file path for daemon mode (default: {runtime dir}/{session}.pid)")
+	cmd.Flags().StringVar(&logLevel, "log-level", "info", "Log level (debug, info, warn, error)")
+	cmd.Flags().StringVar(&logFormat, "log-format", "text", "Log format (text, json)")
+	cmd.Flags().IntVar(&logMaxSize, "log-max-size", 10, "Rotate the daemon log when it exceeds this many MB")
+	cmd.Flags().IntVar(&logMaxFiles, "log-max-files", 5, "Number of rotated daemon logs to keep")
+	cmd.Flags().StringVar(&allowUsers, "allow-users", "", "Comma separated users allowed to open the session when the server uses OIDC login (e.g. alice@example.com,@example.com)")
+	cmd.Flags().BoolVar(&multiHost, "multi-host", false, "Let other clients with the same upstream key connect to this session")
+	cmd.PersistentFlags().StringVar(&configFile, "config", "", "Config file with named profiles (default: ~/.config/gottyp/config.yaml)")
+	cmd.PersistentFlags().StringVar(&profile, "profile", "", "Profile of the config file to use (default: the profile named by default:)")
 
 	cmd.AddCommand(tmuxCmd())
+	cmd.AddCommand(statusCmd())
+	cmd.AddCommand(stopCmd())
+	cmd.AddCommand(restartCmd())
+	cmd.AddCommand(logsCmd())
+	cmd.AddCommand(configCmd(cmd, &configFile, &profile))
 
 	return cmd
 }
@@ -145,7 +222,13 @@ func tmuxCmd() *cobra.Command {
 		Short:   "Kill all tmux sessions and gottyp daemons",
 		Aliases: []string{"kill"},
 		RunE: func(cmd *cobra.Command, args []string) error {
-			src.KillAllDaemons()
+			stopped, err := src.StopAll()
+			for _, session := range stopped {
+				fmt.Printf("Stopped %s\n", session)
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%v\n", err)
+			}
 			return runTmux("kill-server")
 		},
 	})
@@ -153,6 +236,247 @@ func tmuxCmd() *cobra.Command {
 	return cmd
 }
 
+func statusCmd() *cobra.Command {
+	var jsonOutput bool
+
+	cmd := &cobra.Command{
+		Use:   "status [session]",
+		Short: "Show running gottyp daemons, or the details of one session",
+		Args:  cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			statuses, err := src.ListStatus()
+			if err != nil {
+				return err
+			}
+			if len(args) == 1 {
+				matched := statuses[:0]
+				for _, status := range statuses {
+					if status.Session == args[0] {
+						matched = append(matched, status)
+					}
+				}
+				if len(matched) == 0 {
+					return fmt.Errorf("no running gottyp for session %s", args[0])
+				}
+				statuses = matched
+			}
+
+			if jsonOutput {
+				enc := json.NewEncoder(os.Stdout)
+				enc.SetIndent("", "  ")
+				return enc.Encode(statuses)
+			}
+			if len(statuses) == 0 {
+				fmt.Println("No running gottyp")
+				return nil
+			}
+			if len(args) == 1 {
+				for _, status := range statuses {
+					printStatus(status)
+				}
+				return nil
+			}
+
+			w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+			fmt.Fprintln(w, "SESSION\tPID\tSTATE\tBROWSERS\tUPTIME\tPORT\tTMUX\tREMOTE")
+			for _, status := range statuses {
+				fmt.Fprintf(w, "%s\t%d\t%s\t%d\t%s\t%d\t%s\t%s\n", status.Session, status.PID, status.State,
+					status.Browsers, since(status.StartedAt), status.GottyPort, orDash(status.TmuxSession), status.Remote)
+			}
+			return w.Flush()
+		},
+	}
+	cmd.Flags().BoolVar(&jsonOutput, "json", false, "Print the status as JSON")
+
+	return cmd
+}
+
+func stopCmd() *cobra.Command {
+	var all bool
+
+	cmd := &cobra.Command{
+		Use:   "stop [session]",
+		Short: "Stop the gottyp daemon of a session, or all of them with --all",
+		Args:  cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if all {
+				stopped, err := src.StopAll()
+				for _, session := range stopped {
+					fmt.Printf("Stopped %s\n", session)
+				}
+				if err == nil && len(stopped) == 0 {
+					fmt.Println("No running gottyp")
+				}
+				return err
+			}
+			if len(args) != 1 {
+				return fmt.Errorf("give a session to stop, or --all")
+			}
+
+			pid, err := src.StopDaemon(args[0])
+			if err != nil {
+				return err
+			}
+			fmt.Printf("Stopped %s (pid %d)\n", args[0], pid)
+			return nil
+		},
+	}
+	cmd.Flags().BoolVar(&all, "all", false, "Stop every running gottyp of this user")
+
+	return cmd
+}
+
+func restartCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "restart <session>",
+		Short: "Restart the gottyp daemon of a session with the same options and credentials",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			status, err := src.RestartDaemon(args[0])
+			if err != nil {
+				return err
+			}
+			fmt.Printf("Restarted %s (pid %d)\n", status.Session, status.PID)
+			return nil
+		},
+	}
+}
+
+func logsCmd() *cobra.Command {
+	var (
+		follow bool
+		lines  int
+	)
+
+	cmd := &cobra.Command{
+		Use:   "logs <session>",
+		Short: "Show the log of a gottyp daemon",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return src.TailSessionLog(args[0], lines, follow, os.Stdout)
+		},
+	}
+	cmd.Flags().BoolVarP(&follow, "follow", "f", false, "Keep printing new log lines")
+	cmd.Flags().IntVarP(&lines, "lines", "n", 50, "Number of lines to show, all when 0")
+
+	return cmd
+}
+
+func configCmd(root *cobra.Command, configFile, profile *string) *cobra.Command {
+	return &cobra.Command{
+		Use:   "config",
+		Short: "Show the effective settings and where each one comes from",
+		Long: `Show the settings gottyp would start with, without command line flags, and
+where each one comes from: an environment variable, the profile or the default.
+
+The config file (~/.config/gottyp/config.yaml, or --config) holds named profiles
+whose keys are the flag names:
+
+  default: work
+  profiles:
+    work:
+      remote: https://piko.example.com
+      upstream-key: ...
+      attach-port: 3000
+    home:
+      remote: http://192.168.1.10:8088
+      tmux: false`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			flags := root.LocalNonPersistentFlags()
+			file, name, sources, err := loadSettings(flags, *configFile, *profile)
+			if err != nil {
+				return err
+			}
+
+			path := file.Path
+			if _, err := os.Stat(path); err != nil {
+				path += " (not found)"
+			}
+			fmt.Printf("Config file: %s\n", path)
+			if names := file.ProfileNames(); len(names) > 0 {
+				fmt.Printf("Profile:     %s (available: %s)\n", orDash(name), strings.Join(names, ", "))
+			} else {
+				fmt.Printf("Profile:     %s\n", orDash(name))
+			}
+			fmt.Println()
+
+			w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+			fmt.Fprintln(w, "SETTING\tVALUE\tSOURCE")
+			flags.VisitAll(func(flag *pflag.Flag) {
+				source, ok := sources[flag.Name]
+				if !ok {
+					return
+				}
+				value := flag.Value.String()
+				if (flag.Name == "pass" || flag.Name == "upstream-key") && value != "" {
+					value = "[REDACTED]"
+				}
+				switch source {
+				case src.SourceEnv:
+					env, _ := src.LookupEnv(flag.Name)
+					source += " " + env
+				case src.SourceProfile:
+					source += " " + name
+				}
+				fmt.Fprintf(w, "%s\t%s\t%s\n", flag.Name, orDash(value), source)
+			})
+			return w.Flush()
+		},
+	}
+}
+
+// loadSettings 读取配置文件中选用的配置，并按 命令行参数 > 环境变量 > 配置 >
+// 默认值 的优先级设置 flags，返回配置文件、配置名和每个参数的来源
+func loadSettings(flags *pflag.FlagSet, configFile, profile string) (*src.ConfigFile, string, map[string]string, error) {
+	file, err := src.LoadConfigFile(configFile)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	name, values, err := file.Profile(profile)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	sources, err := src.ApplySettings(flags, values, "config", "profile")
+	if err != nil {
+		return nil, "", nil, fmt.Errorf("profile %s in %s: %w", name, file.Path, err)
+	}
+	return file, name, sources, nil
+}
+
+func printStatus(status src.Status) {
+	state := status.State
+	if status.ConnectedAt != nil {
+		state += " for " + since(*status.ConnectedAt)
+	}
+
+	fmt.Println("========================================")
+	fmt.Printf("Session:    %s (pid %d)\n", status.Session, status.PID)
+	fmt.Printf("Remote URL: %s\n", status.URL)
+	if status.Username != "" {
+		fmt.Printf("Username:   %s\n", status.Username)
+		fmt.Printf("Password:   %s\n", status.Password)
+	}
+	fmt.Printf("State:      %s\n", state)
+	fmt.Printf("Uptime:     %s\n", since(status.StartedAt))
+	fmt.Printf("Browsers:   %d\n", status.Browsers)
+	fmt.Printf("Gotty Port: %d\n", status.GottyPort)
+	fmt.Printf("Tmux:       %s\n", orDash(status.TmuxSession))
+	fmt.Println("========================================")
+}
+
+// since 返回从 t 到现在的时长，精确到秒
+func since(t time.Time) string {
+	return time.Since(t).Round(time.Second).String()
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
 func runTmux(args ...string) error {
 	bin, err := exec.LookPath("tmux")
 	if err != nil {
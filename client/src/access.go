@@ -0,0 +1,134 @@
+package src
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// sessionAccess 服务器返回的会话访问配置
+type sessionAccess struct {
+	Mode         string   `json:"mode"`
+	Secret       string   `json:"secret"`
+	AllowedUsers []string `json:"allowed_users"`
+}
+
+// setupAccess 启动时注册会话访问控制。设置了 --allow-users 或服务器启用了会话
+// 访问控制时，未注册的会话无法访问，无法注册即返回错误
+func (sm *ServiceManager) setupAccess() error {
+	var err error
+	if sm.config.UpstreamKey == "" {
+		err = errors.New("--upstream-key is required to register the session")
+	} else {
+		err = sm.registerAccess()
+	}
+	if err == nil {
+		return nil
+	}
+
+	if len(sm.config.AllowedUsers()) > 0 {
+		return fmt.Errorf("failed to register session access for --allow-users: %w", err)
+	}
+	mode, modeErr := serverAccessMode(sm.config.RemoteURL())
+	if modeErr != nil {
+		slog.Debug("Failed to get session access mode", "error", modeErr)
+	}
+	if mode == "secret" || mode == "oidc" {
+		return fmt.Errorf("server requires session access registration (%s mode): %w", mode, err)
+	}
+	if sm.config.UpstreamKey == "" {
+		slog.Debug("No upstream key, skipping session access registration")
+		return nil
+	}
+	slog.Warn("Failed to register session access", "error", err)
+	return nil
+}
+
+// serverAccessMode 返回服务器的会话访问控制模式
+func serverAccessMode(remote string) (string, error) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(strings.TrimSuffix(remote, "/") + "/health")
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("health check: %s", resp.Status)
+	}
+	var health struct {
+		SessionAuth string `json:"session_auth"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&health); err != nil {
+		return "", err
+	}
+	return health.SessionAuth, nil
+}
+
+// registerAccess 向服务器注册会话的访问控制（允许的用户），并获取会话密钥。
+// 已有会话密钥时一并提交，服务器保留该密钥，已打印的地址继续有效。
+// 服务器需要 upstream token 证明会话归属，所以没有 upstream-key 时跳过。
+func (sm *ServiceManager) registerAccess() error {
+	if sm.config.UpstreamKey == "" {
+		slog.Debug("No upstream key, skipping session access registration")
+		return nil
+	}
+
+	token, err := upstreamToken(sm.config.UpstreamKey, sm.config.Session)
+	if err != nil {
+		return err
+	}
+
+	access, err := requestAccess(sm.config.RemoteURL(), sm.config.Session, token, sm.config.AllowedUsers(), sm.SessionSecret())
+	if err != nil {
+		return err
+	}
+	if secret := sm.SessionSecret(); secret != "" && access.Secret != "" && access.Secret != secret {
+		slog.Warn("Session secret was revoked, run gottyp status for the new session URL", "session", sm.config.Session)
+	}
+	sm.mu.Lock()
+	sm.access = access
+	sm.mu.Unlock()
+	slog.Debug("Registered session access", "mode", access.Mode, "allowed_users", access.AllowedUsers)
+	return nil
+}
+
+func requestAccess(remote, session, token string, allowedUsers []string, secret string) (*sessionAccess, error) {
+	body, err := json.Marshal(map[string]interface{}{"allowed_users": allowedUsers, "secret": secret})
+	if err != nil {
+		return nil, err
+	}
+
+	endpoint := strings.TrimSuffix(remote, "/") + "/api/v1/sessions/" + url.PathEscape(session) + "/access"
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	var access sessionAccess
+	if err := json.NewDecoder(resp.Body).Decode(&access); err != nil {
+		return nil, err
+	}
+	return &access, nil
+}
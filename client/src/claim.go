@@ -0,0 +1,153 @@
+package src
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// randomSuffix 匹配默认会话名末尾的随机部分
+var randomSuffix = regexp.MustCompile(`-[0-9a-f]{4}$`)
+
+// sessionClaim 服务器对会话名的检查结果
+type sessionClaim struct {
+	// status 为 http.StatusConflict（已被其他客户端连接）或
+	// http.StatusForbidden（为其他用户保留）
+	status int
+	reason string
+}
+
+// CheckSession 在启动前检查会话名是否可用。会话名被占用时，在交互式终端中提示
+// 改用新的会话名；否则为其他用户保留的会话名直接报错，已被连接的会话名只记录警告，
+// 由服务器在连接时拒绝或标记冲突。
+func (sm *ServiceManager) CheckSession() error {
+	for {
+		claim, err := sm.claimSession()
+		if err != nil {
+			slog.Warn("Failed to check session name", "session", sm.config.Session, "error", err)
+			return nil
+		}
+		if claim == nil {
+			return nil
+		}
+
+		if !isInteractive() {
+			if claim.status == http.StatusForbidden {
+				return fmt.Errorf("%s, pick another name with --session", claim.reason)
+			}
+			slog.Warn("Session name already in use, pick another name with --session or share it with --multi-host", "session", sm.config.Session, "reason", claim.reason)
+			return nil
+		}
+
+		suggestion := renameSession(sm.config.Session)
+		fmt.Printf("%s.\nUse %s instead? [Y/n/other name]: ", claim.reason, suggestion)
+		answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		switch answer = strings.TrimSpace(answer); strings.ToLower(answer) {
+		case "", "y", "yes":
+			sm.config.Session = suggestion
+		case "n", "no":
+			if claim.status == http.StatusForbidden {
+				return fmt.Errorf("%s", claim.reason)
+			}
+			return nil
+		default:
+			sm.config.Session = answer
+		}
+	}
+}
+
+// claimSession 询问服务器当前会话名是否可用，可用时返回 nil。服务器不支持该检查时
+// 也返回 nil。
+func (sm *ServiceManager) claimSession() (*sessionClaim, error) {
+	query := url.Values{}
+	if sm.config.MultiHost {
+		query.Set("multi_host", "true")
+	}
+	endpoint := strings.TrimSuffix(sm.config.RemoteURL(), "/") + "/api/v1/sessions/" + url.PathEscape(sm.config.Session) + "/claim?" + query.Encode()
+	req, err := http.NewRequest(http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	if sm.config.UpstreamKey != "" {
+		token, err := upstreamToken(sm.config.UpstreamKey, sm.config.Session)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusNotFound:
+		return nil, nil
+	case http.StatusConflict, http.StatusForbidden:
+		var body struct {
+			Error string `json:"error"`
+		}
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		reason := strings.TrimSpace(string(msg))
+		if json.Unmarshal(msg, &body) == nil && body.Error != "" {
+			reason = body.Error
+		}
+		return &sessionClaim{status: resp.StatusCode, reason: capitalize(reason)}, nil
+	default:
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+}
+
+// upstreamURL 返回 piko 上游连接的 URL，带上客户端实例 ID，使服务器能识别重连，
+// 以及是否允许同一用户的其他客户端共享会话
+func (sm *ServiceManager) upstreamURL() (*url.URL, error) {
+	u, err := url.Parse(sm.config.RemoteURL())
+	if err != nil {
+		return nil, err
+	}
+	query := u.Query()
+	query.Set("instance", sm.instance)
+	if sm.config.MultiHost {
+		query.Set("multi_host", "true")
+	}
+	u.RawQuery = query.Encode()
+	return u, nil
+}
+
+// renameSession 生成新的会话名：替换默认会话名末尾的随机部分，或追加随机后缀
+func renameSession(session string) string {
+	suffix := "-" + generateRandomString(4)
+	if randomSuffix.MatchString(session) {
+		return randomSuffix.ReplaceAllString(session, suffix)
+	}
+	return session + suffix
+}
+
+// isInteractive 判断标准输入是否为终端（/dev/null 也是字符设备，需排除）
+func isInteractive() bool {
+	info, err := os.Stdin.Stat()
+	if err != nil || info.Mode()&os.ModeCharDevice == 0 {
+		return false
+	}
+	null, err := os.Stat(os.DevNull)
+	return err != nil || !os.SameFile(info, null)
+}
+
+func capitalize(s string) string {
+	if s == "" {
+		return s
+	}
+	return strings.ToUpper(s[:1]) + s[1:]
+}
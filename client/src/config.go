@@ -31,54 +31,44 @@ type Config struct {
 	PidFile       string
 	TmuxSession   string
 	UpstreamKey   string
-}
-
-// NewConfig 创建新的配置实例
-func NewConfig() *Config {
-	return &Config{
-		AuthName:      getEnvOrDefault("AUTH_NAME", ""),
-		Session:       getEnvOrDefault("SESSION", ""),
-		Remote:        getEnvOrDefault("REMOTE", ""),
-		GottyPort:     0,
-		Terminal:      getEnvOrDefault("TERMINAL", ""),
-		AutoExit:      getEnvBoolOrDefault("AUTO_EXIT", true),
-		Tmux:          getEnvBoolOrDefault("TMUX", true),
-		Pass:          getEnvOrDefault("PASS", ""),
-		Auth:          getEnvBoolOrDefault("AUTH", true),
-		EnableNotify:  getEnvBoolOrDefault("ENABLE_NOTIFY", true),
-		NotifyWebhook: getEnvOrDefault("NOTIFY_WEBHOOK", ""),
-		StaticIndex:   getEnvOrDefault("STATIC_INDEX", "."),
-		AttachPort:    getEnvOrDefault("ATTACH_PORT", ""),
-		Daemon:        getEnvBoolOrDefault("DAEMON", true),
-		PidFile:       getEnvOrDefault("PID_FILE", "/tmp/gottyp.pid"),
-		TmuxSession:   getEnvOrDefault("TMUX_SESSION", ""),
-		UpstreamKey:   getEnvOrDefault("UPSTREAM_KEY", ""),
-	}
+	LogLevel      string
+	LogFormat     string
+	LogMaxSize    int
+	LogMaxFiles   int
+	AllowUsers    string
+	MultiHost     bool
 }
 
 // Validate 验证配置
 func (c *Config) Validate() error {
+	// 守护进程使用父进程确定的会话名，父进程可能已改用新的会话名
+	if inherited.Session != "" {
+		c.Session = inherited.Session
+	}
 	if c.Session == "" {
-		if s := os.Getenv("GOTTYP_SESSION"); s != "" {
-			c.Session = s
-		} else {
-			c.Session = generateDefaultSession()
-		}
+		c.Session = generateDefaultSession()
+	}
+	// 服务器用 {会话}:{端口} 命名端口转发的 endpoint
+	if strings.Contains(c.Session, ":") {
+		return fmt.Errorf("session name %q must not contain ':'", c.Session)
+	}
+	if c.PidFile == "" {
+		c.PidFile = RuntimePath(c.Session, ".pid")
 	}
 	if c.Remote == "" {
 		return fmt.Errorf("remote server address is required")
 	}
 	if c.Auth {
 		if c.AuthName == "" {
-			if n := os.Getenv("GOTTYP_AUTH_NAME"); n != "" {
-				c.AuthName = n
+			if inherited.AuthName != "" {
+				c.AuthName = inherited.AuthName
 			} else {
 				c.AuthName = generateRandomString(8)
 			}
 		}
 		if c.Pass == "" {
-			if p := os.Getenv("GOTTYP_PASS"); p != "" {
-				c.Pass = p
+			if inherited.Pass != "" {
+				c.Pass = inherited.Pass
 			} else {
 				c.Pass = generateRandomString(10)
 			}
@@ -100,6 +90,25 @@ func (c *Config) GetRemoteHost() string {
 	return host
 }
 
+// RemoteURL 获取远程服务器 URL，未指定协议时使用 http
+func (c *Config) RemoteURL() string {
+	if strings.HasPrefix(c.Remote, "http") {
+		return c.Remote
+	}
+	return fmt.Sprintf("http://%s", c.Remote)
+}
+
+// AllowedUsers 获取允许访问会话的用户列表（逗号分隔）
+func (c *Config) AllowedUsers() []string {
+	users := []string{}
+	for _, user := range strings.Split(c.AllowUsers, ",") {
+		if user = strings.TrimSpace(user); user != "" {
+			users = append(users, user)
+		}
+	}
+	return users
+}
+
 // GetRemotePort 获取远程端口
 func (c *Config) GetRemotePort() int {
 	// 解析 remote 参数，格式: host:port
@@ -133,34 +142,6 @@ func isPortAvailable(port int) bool {
 	return true
 }
 
-// getEnvOrDefault 获取环境变量或默认值
-func getEnvOrDefault(key, defaultValue string) string {
-	if value := os.Getenv(key); value != "" {
-		return value
-	}
-	return defaultValue
-}
-
-// getEnvIntOrDefault 获取整数环境变量或默认值
-func getEnvIntOrDefault(key string, defaultValue int) int {
-	if value := os.Getenv(key); value != "" {
-		if intValue, err := strconv.Atoi(value); err == nil {
-			return intValue
-		}
-	}
-	return defaultValue
-}
-
-// getEnvBoolOrDefault 获取布尔环境变量或默认值
-func getEnvBoolOrDefault(key string, defaultValue bool) bool {
-	if value := os.Getenv(key); value != "" {
-		if boolValue, err := strconv.ParseBool(value); err == nil {
-			return boolValue
-		}
-	}
-	return defaultValue
-}
-
 func generateRandomString(length int) string {
 	b := make([]byte, length)
 	rand.Read(b)
@@ -0,0 +1,194 @@
+package src
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+	"time"
+)
+
+// Status 运行中的 gottyp 的状态，由控制 socket 的 GET /status 返回
+type Status struct {
+	PID         int        `json:"pid"`
+	Session     string     `json:"session"`
+	Remote      string     `json:"remote"`
+	URL         string     `json:"url"`
+	Username    string     `json:"username,omitempty"`
+	Password    string     `json:"password,omitempty"`
+	GottyPort   int        `json:"gotty_port"`
+	TmuxSession string     `json:"tmux_session,omitempty"`
+	State       string     `json:"state"`
+	ConnectedAt *time.Time `json:"connected_at,omitempty"`
+	StartedAt   time.Time  `json:"started_at"`
+	Browsers    int64      `json:"browsers"`
+	Daemon      bool       `json:"daemon"`
+}
+
+// startControl 在运行时目录下监听 {session}.sock，服务停止时关闭并删除
+func (sm *ServiceManager) startControl() error {
+	if err := EnsureRuntimeDir(); err != nil {
+		return err
+	}
+	path := RuntimePath(sm.config.Session, ".sock")
+	if err := CheckRunning(sm.config.Session); err != nil {
+		return err
+	}
+	os.Remove(path)
+
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+	// socket 返回会话密码，只允许当前用户连接
+	if err := os.Chmod(path, 0600); err != nil {
+		ln.Close()
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /status", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(sm.status())
+	})
+	mux.HandleFunc("POST /restart", func(w http.ResponseWriter, r *http.Request) {
+		slog.Info("Restart requested through the control socket")
+		sm.restarting.Store(true)
+		w.WriteHeader(http.StatusAccepted)
+		// 先返回响应，再停止服务
+		go sm.cancel()
+	})
+	srv := &http.Server{Handler: mux}
+
+	context.AfterFunc(sm.ctx, func() {
+		srv.Close()
+	})
+	go func() {
+		if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+			slog.Warn("Control socket failed", "path", path, "error", err)
+		}
+	}()
+	slog.Debug("Control socket listening", "path", path)
+	return nil
+}
+
+// status 返回当前的运行状态
+func (sm *ServiceManager) status() Status {
+	sm.mu.Lock()
+	state, connectedAt := sm.upstreamState, sm.connectedAt
+	sm.mu.Unlock()
+
+	status := Status{
+		PID:         os.Getpid(),
+		Session:     sm.config.Session,
+		Remote:      sm.config.RemoteURL(),
+		URL:         sm.sessionURL(),
+		GottyPort:   sm.config.GottyPort,
+		TmuxSession: sm.tmuxSession,
+		State:       string(state),
+		StartedAt:   sm.startedAt,
+		Browsers:    sm.browsers.Load(),
+		Daemon:      IsDaemonized(),
+	}
+	if sm.config.Auth {
+		status.Username = sm.config.AuthName
+		status.Password = sm.config.Pass
+	}
+	if state == stateConnected {
+		status.ConnectedAt = &connectedAt
+	}
+	return status
+}
+
+// ListStatus 查询运行时目录下所有运行中的 gottyp，按会话名排序。已退出进程
+// 留下的 socket 会被删除
+func ListStatus() ([]Status, error) {
+	if err := CheckRuntimeDir(); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return []Status{}, nil
+		}
+		return nil, err
+	}
+	paths, err := filepath.Glob(filepath.Join(RuntimeDir(), "*.sock"))
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := []Status{}
+	for _, path := range paths {
+		status, err := queryStatus(path)
+		if err != nil {
+			if isStaleSocket(err) {
+				os.Remove(path)
+			} else {
+				slog.Warn("Failed to query gottyp", "socket", path, "error", err)
+			}
+			continue
+		}
+		statuses = append(statuses, *status)
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		if statuses[i].Session != statuses[j].Session {
+			return statuses[i].Session < statuses[j].Session
+		}
+		return statuses[i].PID < statuses[j].PID
+	})
+	return statuses, nil
+}
+
+// controlClient 返回通过控制 socket 访问 gottyp 的 HTTP 客户端
+func controlClient(path string) *http.Client {
+	return &http.Client{
+		Timeout: 2 * time.Second,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", path)
+			},
+		},
+	}
+}
+
+// queryStatus 通过控制 socket 查询一个 gottyp 的状态
+func queryStatus(path string) (*Status, error) {
+	resp, err := controlClient(path).Get("http://gottyp/status")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s", resp.Status)
+	}
+	var status Status
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// requestRestart 通过控制 socket 请求 gottyp 重新启动
+func requestRestart(path string) error {
+	resp, err := controlClient(path).Post("http://gottyp/restart", "", nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusAccepted {
+		return fmt.Errorf("%s", resp.Status)
+	}
+	return nil
+}
+
+// isStaleSocket 判断连接失败是否因为 socket 已没有进程监听
+func isStaleSocket(err error) bool {
+	return errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ENOENT)
+}
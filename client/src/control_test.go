@@ -0,0 +1,157 @@
+package src
+
+import (
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startTestControl starts the control socket of a session in a temp runtime
+// directory, stopping it when the test ends
+func startTestControl(t *testing.T, config *Config) (*ServiceManager, string) {
+	t.Helper()
+	sm := NewServiceManager(config)
+	t.Cleanup(sm.cancel)
+	if err := sm.startControl(); err != nil {
+		t.Fatalf("startControl() error = %v", err)
+	}
+	return sm, RuntimePath(config.Session, ".sock")
+}
+
+// staleSocket leaves a socket nobody listens on, as a killed gottyp does
+func staleSocket(t *testing.T, session string) string {
+	t.Helper()
+	path := RuntimePath(session, ".sock")
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+	ln.Close()
+	return path
+}
+
+func TestControlStatus(t *testing.T) {
+	t.Setenv("XDG_RUNTIME_DIR", t.TempDir())
+	sm, path := startTestControl(t, &Config{
+		Session:   "alice",
+		Remote:    "example.com:8088",
+		GottyPort: 8080,
+		Auth:      true,
+		AuthName:  "alice",
+		Pass:      "secret",
+	})
+	connectedAt := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	sm.mu.Lock()
+	sm.upstreamState, sm.connectedAt = stateConnected, connectedAt
+	sm.mu.Unlock()
+	sm.browsers.Store(2)
+
+	// The socket hands out the session password, so only its user may
+	// connect
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Fatalf("socket mode = %#o, want 0600", perm)
+	}
+
+	status, err := queryStatus(path)
+	if err != nil {
+		t.Fatalf("queryStatus() error = %v", err)
+	}
+	if status.PID != os.Getpid() || status.Session != "alice" || status.Remote != "http://example.com:8088" || status.URL != "https://example.com/alice/" {
+		t.Fatalf("queryStatus() = %+v", status)
+	}
+	if status.GottyPort != 8080 || status.Username != "alice" || status.Password != "secret" || status.Browsers != 2 {
+		t.Fatalf("queryStatus() = %+v", status)
+	}
+	if status.State != string(stateConnected) || status.ConnectedAt == nil || !status.ConnectedAt.Equal(connectedAt) {
+		t.Fatalf("queryStatus() state = %s connected at %v, want connected at %v", status.State, status.ConnectedAt, connectedAt)
+	}
+
+	sm.mu.Lock()
+	sm.upstreamState = stateReconnecting
+	sm.mu.Unlock()
+	if status, err := queryStatus(path); err != nil || status.State != string(stateReconnecting) || status.ConnectedAt != nil {
+		t.Fatalf("queryStatus() while reconnecting = %+v, %v", status, err)
+	}
+}
+
+func TestControlAlreadyRunning(t *testing.T) {
+	t.Setenv("XDG_RUNTIME_DIR", t.TempDir())
+	_, path := startTestControl(t, &Config{Session: "alice"})
+
+	other := NewServiceManager(&Config{Session: "alice"})
+	defer other.cancel()
+	if err := other.startControl(); err == nil || !strings.Contains(err.Error(), "already running") {
+		t.Fatalf("second startControl() error = %v, want the session already running", err)
+	}
+	if _, err := queryStatus(path); err != nil {
+		t.Fatalf("queryStatus() after a refused start error = %v", err)
+	}
+
+	// A socket left behind by a killed gottyp is replaced
+	staleSocket(t, "bob")
+	startTestControl(t, &Config{Session: "bob"})
+}
+
+func TestControlRestart(t *testing.T) {
+	t.Setenv("XDG_RUNTIME_DIR", t.TempDir())
+	sm, path := startTestControl(t, &Config{Session: "alice"})
+
+	if err := requestRestart(path); err != nil {
+		t.Fatalf("requestRestart() error = %v", err)
+	}
+	select {
+	case <-sm.ctx.Done():
+	case <-time.After(2 * time.Second):
+		t.Fatal("service not stopped after a restart request")
+	}
+	if !sm.restarting.Load() {
+		t.Fatal("restart not recorded")
+	}
+
+	// Stopping the service closes and removes the socket
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("socket kept after the service stopped")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err := queryStatus(path); !isStaleSocket(err) {
+		t.Fatalf("queryStatus() of a stopped gottyp error = %v, want a stale socket", err)
+	}
+	if err := requestRestart(path); err == nil {
+		t.Fatal("requestRestart() of a stopped gottyp succeeded")
+	}
+}
+
+func TestListStatus(t *testing.T) {
+	t.Setenv("XDG_RUNTIME_DIR", t.TempDir())
+	startTestControl(t, &Config{Session: "carol"})
+	startTestControl(t, &Config{Session: "alice"})
+	stale := staleSocket(t, "bob")
+
+	statuses, err := ListStatus()
+	if err != nil {
+		t.Fatalf("ListStatus() error = %v", err)
+	}
+	var sessions []string
+	for _, status := range statuses {
+		sessions = append(sessions, status.Session)
+	}
+	if strings.Join(sessions, ",") != "alice,carol" {
+		t.Fatalf("ListStatus() sessions = %v, want alice and carol", sessions)
+	}
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Fatalf("stale socket kept: %v", err)
+	}
+}
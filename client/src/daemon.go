@@ -1,19 +1,90 @@
 package src
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"syscall"
+	"time"
 )
 
-func Daemonize(staticIndex string, pidFile string, sessionID string, authName string, pass string) error {
-	if syscall.Getppid() == 1 {
+// stopTimeout 等待守护进程退出的时间
+const stopTimeout = 10 * time.Second
+
+// 向守护进程和重启后的进程交接状态的环境变量，与参数对应的 GOTTYP_ 变量分开
+const (
+	envDaemonized    = internalEnvPrefix + "DAEMONIZED"
+	envStaticIndex   = internalEnvPrefix + "STATIC_INDEX"
+	envSession       = internalEnvPrefix + "SESSION"
+	envAuthName      = internalEnvPrefix + "AUTH_NAME"
+	envPass          = internalEnvPrefix + "PASS"
+	envSessionSecret = internalEnvPrefix + "SESSION_SECRET"
+	envInstance      = internalEnvPrefix + "INSTANCE"
+)
+
+// handoff 是 Daemonize 交给守护进程、Reexec 交给重启后进程的状态
+type handoff struct {
+	Daemonized  bool
+	StaticIndex string
+	Session     string
+	AuthName    string
+	Pass        string
+	Secret      string
+	Instance    string
+}
+
+// inherited 是本进程接手的状态，不是由 Daemonize 或 Reexec 启动时为空
+var inherited = takeHandoff()
+
+// takeHandoff 读取交接的状态并从环境变量中删除，终端里的 shell 以及在其中
+// 运行的 gottyp 不会继承
+func takeHandoff() handoff {
+	h := handoff{
+		Daemonized:  os.Getenv(envDaemonized) == "1",
+		StaticIndex: os.Getenv(envStaticIndex),
+		Session:     os.Getenv(envSession),
+		AuthName:    os.Getenv(envAuthName),
+		Pass:        os.Getenv(envPass),
+		Secret:      os.Getenv(envSessionSecret),
+		Instance:    os.Getenv(envInstance),
+	}
+	for _, name := range []string{envDaemonized, envStaticIndex, envSession, envAuthName, envPass, envSessionSecret, envInstance} {
+		os.Unsetenv(name)
+	}
+	return h
+}
+
+// environ 返回把 h 交给新进程的环境变量
+func (h handoff) environ() []string {
+	env := append(os.Environ(),
+		envStaticIndex+"="+h.StaticIndex,
+		envSession+"="+h.Session,
+		envAuthName+"="+h.AuthName,
+		envPass+"="+h.Pass,
+		envSessionSecret+"="+h.Secret,
+	)
+	if h.Daemonized {
+		env = append(env, envDaemonized+"=1")
+	}
+	if h.Instance != "" {
+		env = append(env, envInstance+"="+h.Instance)
+	}
+	return env
+}
+
+func Daemonize(staticIndex string, pidFile string, sessionID string, authName string, pass string, secret string) error {
+	if IsDaemonized() {
 		return nil
 	}
 
+	if err := EnsureRuntimeDir(); err != nil {
+		return err
+	}
+
 	self, err := os.Executable()
 	if err != nil {
 		return fmt.Errorf("failed to get executable path: %w", err)
@@ -30,17 +101,21 @@ func Daemonize(staticIndex string, pidFile string, sessionID string, authName st
 	cmd.Stdin = nil
 	cmd.Stdout = nil
 	cmd.Stderr = nil
-	cmd.Env = append(os.Environ(),
-		"GOTTYP_DAEMONIZED=1",
-		"GOTTYP_STATIC_INDEX="+staticIndex,
-		"GOTTYP_SESSION="+sessionID,
-		"GOTTYP_AUTH_NAME="+authName,
-		"GOTTYP_PASS="+pass,
-	)
+	cmd.Env = handoff{
+		Daemonized:  true,
+		StaticIndex: staticIndex,
+		Session:     sessionID,
+		AuthName:    authName,
+		Pass:        pass,
+		Secret:      secret,
+	}.environ()
 	if err := cmd.Start(); err != nil {
 		return fmt.Errorf("failed to start daemon: %w", err)
 	}
 
+	if err := os.MkdirAll(filepath.Dir(pidFile), 0700); err != nil {
+		return fmt.Errorf("failed to create pid file directory: %w", err)
+	}
 	pidData := strconv.Itoa(cmd.Process.Pid) + "\n"
 	if err := os.WriteFile(pidFile, []byte(pidData), 0644); err != nil {
 		return fmt.Errorf("failed to write pid file: %w", err)
@@ -51,28 +126,164 @@ func Daemonize(staticIndex string, pidFile string, sessionID string, authName st
 }
 
 func IsDaemonized() bool {
-	return os.Getenv("GOTTYP_DAEMONIZED") == "1"
+	return inherited.Daemonized
 }
 
-func KillAllDaemons() {
-	out, err := exec.Command("pgrep", "-f", "gottyp").Output()
+// RuntimeDir 返回当前用户的运行时目录，存放每个会话的 pid 文件、日志和控制
+// socket：$XDG_RUNTIME_DIR/gottyp，未设置时为临时目录下的 gottyp-{uid}
+func RuntimeDir() string {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, "gottyp")
+	}
+	return filepath.Join(os.TempDir(), fmt.Sprintf("gottyp-%d", os.Getuid()))
+}
+
+// EnsureRuntimeDir 创建运行时目录，并确认它是当前用户所有、权限为 0700 的
+// 目录。临时目录下的 gottyp-{uid} 可能被其他用户抢先创建或替换为符号链接，
+// 这时拒绝使用
+func EnsureRuntimeDir() error {
+	if err := os.MkdirAll(RuntimeDir(), 0700); err != nil {
+		return fmt.Errorf("failed to create runtime directory: %w", err)
+	}
+	return CheckRuntimeDir()
+}
+
+// CheckRuntimeDir 确认运行时目录是当前用户所有、权限为 0700 的目录
+func CheckRuntimeDir() error {
+	dir := RuntimeDir()
+	info, err := os.Lstat(dir)
 	if err != nil {
-		return
+		return err
 	}
-	for _, line := range strings.Split(string(out), "\n") {
-		line = strings.TrimSpace(line)
-		if line == "" {
-			continue
+	if !info.IsDir() {
+		return fmt.Errorf("runtime directory %s is not a directory", dir)
+	}
+	if stat, ok := info.Sys().(*syscall.Stat_t); !ok || int(stat.Uid) != os.Getuid() {
+		return fmt.Errorf("runtime directory %s is not owned by the current user", dir)
+	}
+	if perm := info.Mode().Perm(); perm != 0700 {
+		return fmt.Errorf("runtime directory %s has mode %#o, want 0700", dir, perm)
+	}
+	return nil
+}
+
+// RuntimePath 返回会话在运行时目录下的文件，ext 为 .pid、.log 或 .sock
+func RuntimePath(session, ext string) string {
+	return filepath.Join(RuntimeDir(), session+ext)
+}
+
+// RemovePidFile 删除本进程写入的 pid 文件，文件已属于其他进程时保留
+func RemovePidFile(pidFile string) {
+	if pid, err := readPidFile(pidFile); err == nil && pid == os.Getpid() {
+		os.Remove(pidFile)
+	}
+}
+
+func readPidFile(pidFile string) (int, error) {
+	data, err := os.ReadFile(pidFile)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(data)))
+}
+
+// CheckRunning 检查会话是否已有 gottyp 在运行
+func CheckRunning(session string) error {
+	status, err := queryStatus(RuntimePath(session, ".sock"))
+	if err != nil {
+		return nil
+	}
+	return fmt.Errorf("session %s is already running (pid %d), stop it with: gottyp stop %s", session, status.PID, session)
+}
+
+// StopDaemon 停止会话的 gottyp。只向通过控制 socket 确认过的进程发送 SIGTERM，
+// 并等待其退出
+func StopDaemon(session string) (int, error) {
+	status, err := runningStatus(session)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := syscall.Kill(status.PID, syscall.SIGTERM); err != nil {
+		return status.PID, fmt.Errorf("failed to stop %s (pid %d): %w", session, status.PID, err)
+	}
+	deadline := time.Now().Add(stopTimeout)
+	for processAlive(status.PID) {
+		if time.Now().After(deadline) {
+			return status.PID, fmt.Errorf("%s (pid %d) did not exit within %s", session, status.PID, stopTimeout)
 		}
-		pid, err := strconv.Atoi(line)
-		if err != nil {
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	pidFile := RuntimePath(session, ".pid")
+	if pid, err := readPidFile(pidFile); err == nil && pid == status.PID {
+		os.Remove(pidFile)
+	}
+	return status.PID, nil
+}
+
+// StopAll 停止所有运行中的 gottyp，返回已停止的会话
+func StopAll() ([]string, error) {
+	statuses, err := ListStatus()
+	if err != nil {
+		return nil, err
+	}
+
+	var stopped []string
+	var errs []error
+	for _, status := range statuses {
+		if _, err := StopDaemon(status.Session); err != nil {
+			errs = append(errs, err)
 			continue
 		}
-		if pid == os.Getpid() {
-			continue
+		stopped = append(stopped, status.Session)
+	}
+	return stopped, errors.Join(errs...)
+}
+
+// RestartDaemon 让会话的 gottyp 以相同的参数、会话名和账号密码重新启动，
+// 进程号不变。返回重启后的状态。
+func RestartDaemon(session string) (*Status, error) {
+	status, err := runningStatus(session)
+	if err != nil {
+		return nil, err
+	}
+
+	path := RuntimePath(session, ".sock")
+	if err := requestRestart(path); err != nil {
+		return nil, fmt.Errorf("failed to restart %s: %w", session, err)
+	}
+
+	deadline := time.Now().Add(stopTimeout)
+	for time.Now().Before(deadline) {
+		time.Sleep(200 * time.Millisecond)
+		restarted, err := queryStatus(path)
+		if err == nil && restarted.PID == status.PID && restarted.StartedAt.After(status.StartedAt) {
+			return restarted, nil
 		}
-		syscall.Kill(pid, syscall.SIGTERM)
-		fmt.Printf("killed gottyp daemon (pid %d)\n", pid)
 	}
-	_ = os.Remove("/tmp/gottyp.pid")
+	return nil, fmt.Errorf("%s (pid %d) did not come back within %s", session, status.PID, stopTimeout)
+}
+
+// runningStatus 通过控制 socket 确认会话的 gottyp 在运行，并清理已退出进程
+// 留下的 pid 文件
+func runningStatus(session string) (*Status, error) {
+	status, err := queryStatus(RuntimePath(session, ".sock"))
+	if err == nil && status.Session == session {
+		return status, nil
+	}
+
+	if isStaleSocket(err) {
+		os.Remove(RuntimePath(session, ".sock"))
+	}
+	if pid, pidErr := readPidFile(RuntimePath(session, ".pid")); pidErr == nil && !processAlive(pid) {
+		os.Remove(RuntimePath(session, ".pid"))
+	}
+	return nil, fmt.Errorf("no running gottyp for session %s", session)
+}
+
+// processAlive 判断进程是否存在
+func processAlive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || errors.Is(err, syscall.EPERM)
 }
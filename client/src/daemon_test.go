@@ -0,0 +1,113 @@
+package src
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestEnsureRuntimeDir(t *testing.T) {
+	tests := []struct {
+		name    string
+		prepare func(t *testing.T, dir string)
+		wantErr bool
+	}{
+		{name: "created", prepare: func(t *testing.T, dir string) {}},
+		{name: "existing", prepare: func(t *testing.T, dir string) {
+			if err := os.Mkdir(dir, 0700); err != nil {
+				t.Fatal(err)
+			}
+		}},
+		{name: "readable by others", wantErr: true, prepare: func(t *testing.T, dir string) {
+			if err := os.Mkdir(dir, 0700); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Chmod(dir, 0755); err != nil {
+				t.Fatal(err)
+			}
+		}},
+		{name: "symlink", wantErr: true, prepare: func(t *testing.T, dir string) {
+			target := filepath.Join(t.TempDir(), "elsewhere")
+			if err := os.Mkdir(target, 0700); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Symlink(target, dir); err != nil {
+				t.Fatal(err)
+			}
+		}},
+		{name: "file", wantErr: true, prepare: func(t *testing.T, dir string) {
+			if err := os.WriteFile(dir, nil, 0600); err != nil {
+				t.Fatal(err)
+			}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("XDG_RUNTIME_DIR", t.TempDir())
+			tt.prepare(t, RuntimeDir())
+
+			err := EnsureRuntimeDir()
+			if tt.wantErr != (err != nil) {
+				t.Fatalf("EnsureRuntimeDir() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestListStatusChecksRuntimeDir(t *testing.T) {
+	t.Setenv("XDG_RUNTIME_DIR", t.TempDir())
+	if statuses, err := ListStatus(); err != nil || len(statuses) != 0 {
+		t.Fatalf("ListStatus() without a runtime directory = %v, %v", statuses, err)
+	}
+
+	if err := os.Mkdir(RuntimeDir(), 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(RuntimeDir(), 0777); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ListStatus(); err == nil {
+		t.Fatal("ListStatus() trusted a runtime directory writable by others")
+	}
+}
+
+func TestTakeHandoff(t *testing.T) {
+	want := handoff{
+		Daemonized:  true,
+		StaticIndex: "/srv/files",
+		Session:     "alice-1",
+		AuthName:    "alice",
+		Pass:        "pass",
+		Secret:      "secret",
+		Instance:    "instance",
+	}
+	for _, kv := range want.environ()[len(os.Environ()):] {
+		name, value, _ := strings.Cut(kv, "=")
+		t.Setenv(name, value)
+	}
+
+	if got := takeHandoff(); got != want {
+		t.Fatalf("takeHandoff() = %+v, want %+v", got, want)
+	}
+	// A gottyp started in the terminal's shell must not take them over
+	for _, name := range []string{envDaemonized, envStaticIndex, envSession, envAuthName, envPass, envSessionSecret, envInstance} {
+		if value, ok := os.LookupEnv(name); ok {
+			t.Errorf("%s=%s left in the environment", name, value)
+		}
+	}
+	if got := takeHandoff(); got != (handoff{}) {
+		t.Fatalf("takeHandoff() a second time = %+v, want nothing", got)
+	}
+}
+
+func TestTakeHandoffKeepsSettings(t *testing.T) {
+	// GOTTYP_SESSION is the --session setting of the user, not a handoff
+	t.Setenv("GOTTYP_SESSION", "bob-1")
+	if got := takeHandoff(); got != (handoff{}) {
+		t.Fatalf("takeHandoff() = %+v, want nothing", got)
+	}
+	if os.Getenv("GOTTYP_SESSION") != "bob-1" {
+		t.Fatal("session setting removed from the environment")
+	}
+}
@@ -0,0 +1,120 @@
+package src
+
+import (
+	"context"
+	"fmt"
+	"io"
+	stdlog "log"
+	"log/slog"
+	"sort"
+	"strings"
+
+	"github.com/andydunstall/piko/pkg/log"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// NewLogger 创建结构化日志记录器，level 为 debug、info、warn 或 error，
+// format 为 text 或 json
+func NewLogger(w io.Writer, level, format string) (*slog.Logger, error) {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("invalid log level %q", level)
+	}
+	opts := &slog.HandlerOptions{Level: lvl}
+
+	switch format {
+	case "", "text":
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	default:
+		return nil, fmt.Errorf("invalid log format %q", format)
+	}
+}
+
+// pikoLogger 把 piko 客户端的日志写入 slog，与 gottyp 自身日志格式一致
+type pikoLogger struct {
+	logger    *slog.Logger
+	subsystem string
+	attrs     []slog.Attr
+}
+
+// newPikoLogger 创建写入 logger 的 piko 日志记录器。piko 的 debug 日志会打印
+// 包括 Authorization 在内的完整请求头，因此最低只记录 info 级别
+func newPikoLogger(logger *slog.Logger) log.Logger {
+	return &pikoLogger{logger: logger, subsystem: "main"}
+}
+
+func (l *pikoLogger) Subsystem() string {
+	return l.subsystem
+}
+
+func (l *pikoLogger) WithSubsystem(s string) log.Logger {
+	clone := *l
+	clone.subsystem = s
+	return &clone
+}
+
+func (l *pikoLogger) With(fields ...zap.Field) log.Logger {
+	clone := *l
+	clone.attrs = append(append([]slog.Attr(nil), l.attrs...), fieldAttrs(fields)...)
+	return &clone
+}
+
+func (l *pikoLogger) Debug(msg string, fields ...zap.Field) {}
+
+func (l *pikoLogger) Info(msg string, fields ...zap.Field) {
+	l.log(slog.LevelInfo, msg, fields)
+}
+
+func (l *pikoLogger) Warn(msg string, fields ...zap.Field) {
+	l.log(slog.LevelWarn, msg, fields)
+}
+
+func (l *pikoLogger) Error(msg string, fields ...zap.Field) {
+	l.log(slog.LevelError, msg, fields)
+}
+
+func (l *pikoLogger) Sync() error {
+	return nil
+}
+
+func (l *pikoLogger) StdLogger(level zapcore.Level) *stdlog.Logger {
+	lvl := slog.LevelWarn
+	if level >= zapcore.ErrorLevel {
+		lvl = slog.LevelError
+	}
+	return slog.NewLogLogger(l.logger.With("subsystem", l.subsystem).Handler(), lvl)
+}
+
+func (l *pikoLogger) log(level slog.Level, msg string, fields []zap.Field) {
+	// piko 的访问日志会打印包括凭据在内的请求头，不记录
+	if strings.HasSuffix(l.subsystem, ".access") {
+		return
+	}
+	attrs := make([]slog.Attr, 0, 1+len(l.attrs)+len(fields))
+	attrs = append(attrs, slog.String("subsystem", l.subsystem))
+	attrs = append(attrs, l.attrs...)
+	attrs = append(attrs, fieldAttrs(fields)...)
+	l.logger.LogAttrs(context.Background(), level, msg, attrs...)
+}
+
+// fieldAttrs 把 zap 字段按键名排序转换为 slog 属性
+func fieldAttrs(fields []zap.Field) []slog.Attr {
+	if len(fields) == 0 {
+		return nil
+	}
+	enc := zapcore.NewMapObjectEncoder()
+	for _, field := range fields {
+		field.AddTo(enc)
+	}
+	attrs := make([]slog.Attr, 0, len(enc.Fields))
+	for key, value := range enc.Fields {
+		attrs = append(attrs, slog.Any(key, value))
+	}
+	sort.Slice(attrs, func(i, j int) bool {
+		return attrs[i].Key < attrs[j].Key
+	})
+	return attrs
+}
@@ -0,0 +1,269 @@
+package src
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// redacted 替换日志中凭据的文本
+const redacted = "[REDACTED]"
+
+// Redactor 把写入的内容中的凭据（密码、会话密钥、upstream key）替换为
+// [REDACTED] 后再写入 w
+type Redactor struct {
+	w io.Writer
+
+	mu      sync.RWMutex
+	secrets []string
+}
+
+// NewRedactor 创建写入 w 的 Redactor
+func NewRedactor(w io.Writer) *Redactor {
+	return &Redactor{w: w}
+}
+
+// Add 添加需要隐藏的凭据，忽略空值
+func (r *Redactor) Add(secrets ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, secret := range secrets {
+		if secret != "" {
+			r.secrets = append(r.secrets, secret)
+		}
+	}
+}
+
+func (r *Redactor) Write(p []byte) (int, error) {
+	r.mu.RLock()
+	out := p
+	for _, secret := range r.secrets {
+		out = bytes.ReplaceAll(out, []byte(secret), []byte(redacted))
+	}
+	r.mu.RUnlock()
+
+	if _, err := r.w.Write(out); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// LogFile 按大小轮转的日志文件：超过 maxSize 字节时把 {path} 依次改名为
+// {path}.1、{path}.2……，只保留 maxFiles 个旧文件
+type LogFile struct {
+	path     string
+	maxSize  int64
+	maxFiles int
+
+	mu   sync.Mutex
+	file *os.File
+}
+
+// OpenLogFile 打开（或创建）只有当前用户可读写的日志文件
+func OpenLogFile(path string, maxSize int64, maxFiles int) (*LogFile, error) {
+	l := &LogFile{path: path, maxSize: maxSize, maxFiles: maxFiles}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *LogFile) open() error {
+	file, err := os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	// 旧版本创建的日志文件可能对所有人可读
+	file.Chmod(0600)
+	l.file = file
+	return nil
+}
+
+func (l *LogFile) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if info, err := l.file.Stat(); err == nil && l.maxSize > 0 && info.Size()+int64(len(p)) > l.maxSize {
+		if err := l.rotate(); err != nil {
+			fmt.Fprintf(l.file, "failed to rotate log: %v\n", err)
+		}
+	}
+	return l.file.Write(p)
+}
+
+// rotate 轮转日志文件，调用时需持有 mu
+func (l *LogFile) rotate() error {
+	os.Remove(fmt.Sprintf("%s.%d", l.path, l.maxFiles))
+	for i := l.maxFiles - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", l.path, i), fmt.Sprintf("%s.%d", l.path, i+1))
+	}
+	if l.maxFiles > 0 {
+		if err := os.Rename(l.path, l.path+".1"); err != nil {
+			return err
+		}
+	} else if err := os.Truncate(l.path, 0); err != nil {
+		return err
+	}
+
+	old := l.file
+	if err := l.open(); err != nil {
+		l.file = old
+		return err
+	}
+	old.Close()
+	return nil
+}
+
+// Capture 把标准输出和标准错误逐行写入 w（通常是写入本文件的 Redactor），
+// 使 gotty、tmux 等子进程和 panic 的输出也隐藏凭据。进程崩溃退出时，管道中
+// 尚未写入的最后几行可能丢失
+func (l *LogFile) Capture(w io.Writer) error {
+	r, pw, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	for _, f := range []*os.File{os.Stdout, os.Stderr} {
+		if err := unix.Dup2(int(pw.Fd()), int(f.Fd())); err != nil {
+			return err
+		}
+	}
+	pw.Close()
+
+	go func() {
+		reader := bufio.NewReader(r)
+		for {
+			// 按行写入，凭据不会被拆到两次写入中
+			line, err := reader.ReadBytes('\n')
+			if len(line) > 0 {
+				w.Write(line)
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// Detach 让标准输出和标准错误指向 /dev/null。管道的读取端在 exec 时关闭，
+// 重新执行 gottyp 前需要调用，否则新进程写标准输出时会收到 SIGPIPE；新进程
+// 调用 Capture 之前的输出不会未经隐藏就写入日志
+func (l *LogFile) Detach() error {
+	null, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer null.Close()
+	for _, f := range []*os.File{os.Stdout, os.Stderr} {
+		if err := unix.Dup2(int(null.Fd()), int(f.Fd())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tailLog 输出日志文件的最后 lines 行；follow 为 true 时继续输出新写入的内容，
+// 并跟随日志轮转
+func tailLog(path string, lines int, follow bool, w io.Writer) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	// 轮转后 file 指向新文件
+	defer func() {
+		file.Close()
+	}()
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return err
+	}
+	w.Write(lastLines(data, lines))
+	if !follow {
+		return nil
+	}
+
+	offset := int64(len(data))
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := file.Read(buf)
+		if n > 0 {
+			w.Write(buf[:n])
+			offset += int64(n)
+			continue
+		}
+		if err != nil && err != io.EOF {
+			return err
+		}
+
+		time.Sleep(500 * time.Millisecond)
+		// 日志已轮转：从新文件的开头继续
+		info, statErr := os.Stat(path)
+		current, _ := file.Stat()
+		if statErr == nil && current != nil && (!os.SameFile(info, current) || info.Size() < offset) {
+			next, err := os.Open(path)
+			if err != nil {
+				continue
+			}
+			file.Close()
+			file, offset = next, 0
+		}
+	}
+}
+
+// lastLines 返回 data 的最后 n 行
+func lastLines(data []byte, n int) []byte {
+	if n <= 0 {
+		return data
+	}
+	end := len(data)
+	if end > 0 && data[end-1] == '\n' {
+		end--
+	}
+	start := end
+	for count := 0; start > 0; start-- {
+		if data[start-1] == '\n' {
+			if count++; count == n {
+				break
+			}
+		}
+	}
+	return data[start:]
+}
+
+// logPath 返回会话的日志文件，会话未知时列出已有日志的会话
+func logPath(session string) (string, error) {
+	path := RuntimePath(session, ".log")
+	if _, err := os.Stat(path); err == nil {
+		return path, nil
+	}
+
+	var sessions []string
+	entries, _ := os.ReadDir(RuntimeDir())
+	for _, entry := range entries {
+		if name, ok := strings.CutSuffix(entry.Name(), ".log"); ok {
+			sessions = append(sessions, name)
+		}
+	}
+	if len(sessions) == 0 {
+		return "", fmt.Errorf("no log for session %s", session)
+	}
+	return "", fmt.Errorf("no log for session %s, logs exist for: %s", session, strings.Join(sessions, ", "))
+}
+
+// TailSessionLog 输出会话的日志，参见 tailLog
+func TailSessionLog(session string, lines int, follow bool, w io.Writer) error {
+	path, err := logPath(session)
+	if err != nil {
+		return err
+	}
+	return tailLog(path, lines, follow, w)
+}
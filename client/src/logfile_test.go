@@ -0,0 +1,239 @@
+package src
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// captureEnv makes the test binary run captureChild instead of the tests, as
+// Capture redirects the standard output of the whole process
+const captureEnv = "GOTTYP_TEST_CAPTURE"
+
+func TestMain(m *testing.M) {
+	if path := os.Getenv(captureEnv); path != "" {
+		captureChild(path)
+		return
+	}
+	os.Exit(m.Run())
+}
+
+func captureChild(path string) {
+	logFile, err := OpenLogFile(path, 0, 0)
+	if err != nil {
+		panic(err)
+	}
+	redactor := NewRedactor(logFile)
+	redactor.Add("hunter2")
+	if err := logFile.Capture(redactor); err != nil {
+		panic(err)
+	}
+
+	fmt.Println("stdout password=hunter2")
+	fmt.Fprintln(os.Stderr, "stderr password=hunter2")
+	cmd := exec.Command("sh", "-c", "echo child password=hunter2 >&2")
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	cmd.Run()
+
+	// Wait for the pipe to be copied into the log
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if data, _ := os.ReadFile(path); bytes.Count(data, []byte("\n")) == 3 {
+			os.Exit(0)
+		}
+	}
+	os.Exit(1)
+}
+
+func TestCaptureRedactsStderr(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "demo.log")
+	cmd := exec.Command(os.Args[0])
+	cmd.Env = append(os.Environ(), captureEnv+"="+path)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("capture: %v: %s", err, out)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	log := string(data)
+	if strings.Contains(log, "hunter2") {
+		t.Fatalf("log contains the password:\n%s", log)
+	}
+	for _, line := range []string{"stdout password=[REDACTED]", "stderr password=[REDACTED]", "child password=[REDACTED]"} {
+		if !strings.Contains(log, line) {
+			t.Errorf("log is missing %q:\n%s", line, log)
+		}
+	}
+}
+
+func TestRedactor(t *testing.T) {
+	var buf bytes.Buffer
+	r := NewRedactor(&buf)
+	r.Add("secret", "", "key")
+
+	n, err := r.Write([]byte("secret and key, not secre\n"))
+	if err != nil || n != 26 {
+		t.Fatalf("Write() = %d, %v", n, err)
+	}
+	if got, want := buf.String(), "[REDACTED] and [REDACTED], not secre\n"; got != want {
+		t.Fatalf("redacted %q, want %q", got, want)
+	}
+}
+
+func TestLogFileRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "demo.log")
+	logFile, err := OpenLogFile(path, 20, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 1; i <= 5; i++ {
+		// Each line fills half a file
+		fmt.Fprintf(logFile, "line %d...\n", i)
+	}
+
+	want := map[string]string{
+		path:        "line 5...\n",
+		path + ".1": "line 3...\nline 4...\n",
+		path + ".2": "line 1...\nline 2...\n",
+	}
+	for name, content := range want {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != content {
+			t.Errorf("%s = %q, want %q", filepath.Base(name), data, content)
+		}
+		info, err := os.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if perm := info.Mode().Perm(); perm != 0600 {
+			t.Errorf("%s has mode %#o, want 0600", filepath.Base(name), perm)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Fatal("more old logs kept than maxFiles")
+	}
+}
+
+func TestLogFileRotationWithoutOldFiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "demo.log")
+	logFile, err := OpenLogFile(path, 20, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 3; i++ {
+		fmt.Fprintf(logFile, "line %d...\n", i)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "line 3...\n" {
+		t.Fatalf("log = %q, want only the last line", data)
+	}
+	if _, err := os.Stat(path + ".1"); !os.IsNotExist(err) {
+		t.Fatal("old log kept with maxFiles 0")
+	}
+}
+
+func TestLastLines(t *testing.T) {
+	tests := []struct {
+		data string
+		n    int
+		want string
+	}{
+		{"a\nb\nc\n", 2, "b\nc\n"},
+		{"a\nb\nc", 2, "b\nc"},
+		{"a\nb\nc\n", 5, "a\nb\nc\n"},
+		{"a\nb\nc\n", 0, "a\nb\nc\n"},
+		{"", 3, ""},
+		{"\n\n", 1, "\n"},
+	}
+	for _, tt := range tests {
+		if got := string(lastLines([]byte(tt.data), tt.n)); got != tt.want {
+			t.Errorf("lastLines(%q, %d) = %q, want %q", tt.data, tt.n, got, tt.want)
+		}
+	}
+}
+
+// syncBuffer is a bytes.Buffer safe to read while tailLog writes to it
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestTailLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "demo.log")
+	if err := os.WriteFile(path, []byte("one\ntwo\nthree\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	if err := tailLog(path, 2, false, &out); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "two\nthree\n" {
+		t.Fatalf("tailLog() = %q", out.String())
+	}
+
+	if err := tailLog(filepath.Join(t.TempDir(), "missing.log"), 2, false, &out); err == nil {
+		t.Fatal("tailLog() of a missing log succeeded")
+	}
+}
+
+func TestTailLogFollowsRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "demo.log")
+	logFile, err := OpenLogFile(path, 30, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintln(logFile, "before")
+
+	// tailLog follows until the test binary exits
+	out := &syncBuffer{}
+	go tailLog(path, 10, true, out)
+
+	waitForOutput := func(want string) {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); !strings.Contains(out.String(), want); time.Sleep(20 * time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatalf("tail output %q is missing %q", out.String(), want)
+			}
+		}
+	}
+	waitForOutput("before\n")
+
+	fmt.Fprintln(logFile, "appended")
+	waitForOutput("appended\n")
+
+	// Rotates: the file only holds 30 bytes
+	fmt.Fprintln(logFile, "after rotation")
+	waitForOutput("after rotation\n")
+
+	if got := out.String(); got != "before\nappended\nafter rotation\n" {
+		t.Fatalf("tail output = %q", got)
+	}
+}
@@ -0,0 +1,214 @@
+package src
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+
+	"github.com/spf13/pflag"
+	"gopkg.in/yaml.v3"
+)
+
+// 参数值的来源，优先级从高到低
+const (
+	SourceFlag    = "flag"
+	SourceEnv     = "env"
+	SourceProfile = "profile"
+	SourceDefault = "default"
+)
+
+// ConfigFile 客户端配置文件。profiles 中每个命名配置的键与命令行参数同名
+// （如 upstream-key），default 指定未使用 --profile 时的配置
+type ConfigFile struct {
+	Path     string                            `yaml:"-"`
+	Default  string                            `yaml:"default"`
+	Profiles map[string]map[string]interface{} `yaml:"profiles"`
+}
+
+// ConfigPath 返回默认的配置文件路径：$XDG_CONFIG_HOME/gottyp/config.yaml，
+// 未设置时为 ~/.config/gottyp/config.yaml
+func ConfigPath() string {
+	dir := os.Getenv("XDG_CONFIG_HOME")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return ""
+		}
+		dir = filepath.Join(home, ".config")
+	}
+	return filepath.Join(dir, "gottyp", "config.yaml")
+}
+
+// LoadConfigFile 读取配置文件。path 为空时读取默认路径，默认的配置文件不存在
+// 时返回空配置
+func LoadConfigFile(path string) (*ConfigFile, error) {
+	explicit := path != ""
+	if !explicit {
+		path = ConfigPath()
+	}
+	file := &ConfigFile{Path: path}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) && !explicit {
+		return file, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read config file: %w", err)
+	}
+	if err := yaml.Unmarshal(data, file); err != nil {
+		return nil, fmt.Errorf("parse config file %s: %w", path, err)
+	}
+
+	if file.hasCredentials() && runtime.GOOS != "windows" {
+		if info, err := os.Stat(path); err == nil && info.Mode().Perm()&0077 != 0 {
+			fmt.Fprintf(os.Stderr, "Warning: %s holds credentials and is readable by other users, run: chmod 600 %s\n", path, path)
+		}
+	}
+	return file, nil
+}
+
+// ProfileNames 返回配置文件中的配置名，按名称排序
+func (f *ConfigFile) ProfileNames() []string {
+	names := make([]string, 0, len(f.Profiles))
+	for name := range f.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Profile 返回名为 name 的配置及实际使用的配置名，name 为空时使用 default
+// 指定的配置，两者都为空时不使用配置。值以参数名为键，列表以逗号连接
+func (f *ConfigFile) Profile(name string) (string, map[string]string, error) {
+	if name == "" {
+		name = f.Default
+	}
+	if name == "" {
+		return "", nil, nil
+	}
+	settings, ok := f.Profiles[name]
+	if !ok {
+		if len(f.Profiles) == 0 {
+			return "", nil, fmt.Errorf("profile %s not found, %s has no profiles", name, f.Path)
+		}
+		return "", nil, fmt.Errorf("profile %s not found in %s, available: %s", name, f.Path, strings.Join(f.ProfileNames(), ", "))
+	}
+
+	values := make(map[string]string, len(settings))
+	for key, value := range settings {
+		key = strings.ToLower(strings.ReplaceAll(key, "_", "-"))
+		switch value := value.(type) {
+		case nil:
+		case []interface{}:
+			items := make([]string, len(value))
+			for i, item := range value {
+				items[i] = fmt.Sprint(item)
+			}
+			values[key] = strings.Join(items, ",")
+		case map[string]interface{}:
+			return "", nil, fmt.Errorf("profile %s: %s must not be a table", name, key)
+		default:
+			values[key] = fmt.Sprint(value)
+		}
+	}
+	return name, values, nil
+}
+
+// hasCredentials 判断是否有配置保存了密码或 upstream key
+func (f *ConfigFile) hasCredentials() bool {
+	for _, settings := range f.Profiles {
+		for key := range settings {
+			switch strings.ToLower(strings.ReplaceAll(key, "_", "-")) {
+			case "pass", "upstream-key":
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// envPrefix 是参数对应的环境变量的前缀，避免误读 TMUX、TERMINAL 等其他程序
+// 设置的同名变量
+const envPrefix = "GOTTYP_"
+
+// internalEnvPrefix 是 gottyp 交接给守护进程和重启后进程的环境变量的前缀（见
+// handoff），它们不是参数，LookupEnv 不读取
+const internalEnvPrefix = envPrefix + "INTERNAL_"
+
+// envAliases 是不带前缀也读取的环境变量，兼容文档和 Docker 镜像中的用法
+var envAliases = map[string]string{
+	"remote":       "REMOTE",
+	"auth-name":    "AUTH_NAME",
+	"upstream-key": "UPSTREAM_KEY",
+}
+
+// EnvName 返回参数对应的环境变量名，如 --upstream-key 对应 GOTTYP_UPSTREAM_KEY
+func EnvName(flag string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flag, "-", "_"))
+}
+
+// LookupEnv 返回设置了参数的环境变量及其值：先查 EnvName，再查不带前缀的
+// 别名，都未设置时返回空值
+func LookupEnv(flag string) (name, value string) {
+	for _, name := range []string{EnvName(flag), envAliases[flag]} {
+		if name == "" || strings.HasPrefix(name, internalEnvPrefix) {
+			continue
+		}
+		if value := os.Getenv(name); value != "" {
+			return name, value
+		}
+	}
+	return "", ""
+}
+
+// ApplySettings 按 命令行参数 > 环境变量 > 配置 > 默认值 的优先级设置 flags 中
+// 除 skip 以外的参数，返回每个参数值的来源。环境变量见 LookupEnv，无法解析的
+// 值被忽略，配置中无法解析或不存在的参数返回错误
+func ApplySettings(flags *pflag.FlagSet, profile map[string]string, skip ...string) (map[string]string, error) {
+	skipped := map[string]bool{"help": true}
+	for _, name := range skip {
+		skipped[name] = true
+	}
+
+	var errs []error
+	keys := make([]string, 0, len(profile))
+	for key := range profile {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if flags.Lookup(key) == nil || skipped[key] {
+			errs = append(errs, fmt.Errorf("unknown setting %s", key))
+		}
+	}
+
+	sources := map[string]string{}
+	flags.VisitAll(func(flag *pflag.Flag) {
+		if skipped[flag.Name] {
+			return
+		}
+		if flag.Changed {
+			sources[flag.Name] = SourceFlag
+			return
+		}
+		if _, value := LookupEnv(flag.Name); value != "" && flag.Value.Set(value) == nil {
+			sources[flag.Name] = SourceEnv
+			return
+		}
+		if value, ok := profile[flag.Name]; ok {
+			if err := flag.Value.Set(value); err != nil {
+				errs = append(errs, fmt.Errorf("invalid %s: %w", flag.Name, err))
+				return
+			}
+			sources[flag.Name] = SourceProfile
+			return
+		}
+		sources[flag.Name] = SourceDefault
+	})
+	return sources, errors.Join(errs...)
+}
@@ -0,0 +1,219 @@
+package src
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/spf13/pflag"
+)
+
+func TestApplySettingsEnv(t *testing.T) {
+	flags := pflag.NewFlagSet("gottyp", pflag.ContinueOnError)
+	flags.String("remote", "https://default.example.com", "")
+	flags.String("upstream-key", "", "")
+	flags.String("terminal", "", "")
+	flags.Bool("tmux", true, "")
+	flags.String("session", "", "")
+	flags.String("auth-name", "", "")
+
+	t.Setenv("REMOTE", "https://alias.example.com")
+	t.Setenv("UPSTREAM_KEY", "alias-key")
+	t.Setenv("GOTTYP_UPSTREAM_KEY", "prefixed-key")
+	// Set by other programs, not meant for gottyp
+	t.Setenv("TERMINAL", "xterm")
+	t.Setenv("TMUX", "/tmp/tmux-1000/default,1234,0")
+	t.Setenv("SESSION", "other")
+	t.Setenv("GOTTYP_TMUX", "false")
+	t.Setenv("GOTTYP_AUTH_NAME", "")
+	if err := flags.Parse([]string{"--session", "flag-session"}); err != nil {
+		t.Fatal(err)
+	}
+
+	sources, err := ApplySettings(flags, map[string]string{"terminal": "zsh"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		flag   string
+		value  string
+		source string
+	}{
+		{"remote", "https://alias.example.com", SourceEnv},
+		{"upstream-key", "prefixed-key", SourceEnv},
+		{"terminal", "zsh", SourceProfile},
+		{"tmux", "false", SourceEnv},
+		{"session", "flag-session", SourceFlag},
+		{"auth-name", "", SourceDefault},
+	}
+	for _, tt := range tests {
+		if got := flags.Lookup(tt.flag).Value.String(); got != tt.value || sources[tt.flag] != tt.source {
+			t.Errorf("%s = %q from %s, want %q from %s", tt.flag, got, sources[tt.flag], tt.value, tt.source)
+		}
+	}
+
+	if name, _ := LookupEnv("upstream-key"); name != "GOTTYP_UPSTREAM_KEY" {
+		t.Errorf("LookupEnv(upstream-key) = %s, want the prefixed variable first", name)
+	}
+	if name, _ := LookupEnv("remote"); name != "REMOTE" {
+		t.Errorf("LookupEnv(remote) = %s, want the REMOTE alias", name)
+	}
+}
+
+func TestApplySettingsPrecedence(t *testing.T) {
+	tests := []struct {
+		name    string
+		flag    string
+		env     string
+		profile string
+		value   string
+		source  string
+	}{
+		{name: "flag over everything", flag: "flag", env: "env", profile: "profile", value: "flag", source: SourceFlag},
+		{name: "env over profile", env: "env", profile: "profile", value: "env", source: SourceEnv},
+		{name: "profile over default", profile: "profile", value: "profile", source: SourceProfile},
+		{name: "default", value: "default", source: SourceDefault},
+		{name: "empty env is unset", env: "", profile: "profile", value: "profile", source: SourceProfile},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			flags := pflag.NewFlagSet("gottyp", pflag.ContinueOnError)
+			flags.String("terminal", "default", "")
+			var args []string
+			if tt.flag != "" {
+				args = []string{"--terminal", tt.flag}
+			}
+			if err := flags.Parse(args); err != nil {
+				t.Fatal(err)
+			}
+			t.Setenv("GOTTYP_TERMINAL", tt.env)
+			profile := map[string]string{}
+			if tt.profile != "" {
+				profile["terminal"] = tt.profile
+			}
+
+			sources, err := ApplySettings(flags, profile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := flags.Lookup("terminal").Value.String(); got != tt.value || sources["terminal"] != tt.source {
+				t.Fatalf("terminal = %q from %s, want %q from %s", got, sources["terminal"], tt.value, tt.source)
+			}
+		})
+	}
+}
+
+func TestApplySettingsErrors(t *testing.T) {
+	flags := pflag.NewFlagSet("gottyp", pflag.ContinueOnError)
+	flags.Int("gotty-port", 8080, "")
+	flags.Bool("tmux", true, "")
+	flags.String("profile", "", "")
+
+	// An unparseable variable is ignored, the profile applies instead
+	t.Setenv("GOTTYP_TMUX", "maybe")
+	sources, err := ApplySettings(flags, map[string]string{"tmux": "false"}, "profile")
+	if err != nil || flags.Lookup("tmux").Value.String() != "false" || sources["tmux"] != SourceProfile {
+		t.Fatalf("tmux = %s from %s (%v), want false from the profile", flags.Lookup("tmux").Value, sources["tmux"], err)
+	}
+
+	_, err = ApplySettings(flags, map[string]string{"gotty-port": "many", "colour": "red", "profile": "other"}, "profile")
+	for _, want := range []string{"invalid gotty-port", "unknown setting colour", "unknown setting profile"} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("ApplySettings() error = %v, want %q", err, want)
+		}
+	}
+}
+
+func TestLookupEnvSkipsHandoff(t *testing.T) {
+	t.Setenv(envSession, "handed-over")
+	if name, value := LookupEnv("session"); name != "" || value != "" {
+		t.Fatalf("LookupEnv(session) = %s=%s, want the handoff ignored", name, value)
+	}
+	if name, _ := LookupEnv("internal-session"); name != "" {
+		t.Fatalf("LookupEnv(internal-session) = %s, want internal variables skipped", name)
+	}
+}
+
+func TestConfigFileProfile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	data := `default: work
+profiles:
+  work:
+    remote: https://work.example.com
+    Upstream_Key: work-key
+    allow-users: [alice@example.com, "@example.com"]
+    gotty-port: 9000
+    tmux: false
+    terminal:
+  home:
+    remote: https://home.example.com
+  broken:
+    remote:
+      host: example.com
+`
+	if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	file, err := LoadConfigFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		profile  string
+		wantName string
+		want     map[string]string
+		wantErr  string
+	}{
+		{name: "default profile", wantName: "work", want: map[string]string{
+			"remote":       "https://work.example.com",
+			"upstream-key": "work-key",
+			"allow-users":  "alice@example.com,@example.com",
+			"gotty-port":   "9000",
+			"tmux":         "false",
+		}},
+		{name: "named profile", profile: "home", wantName: "home", want: map[string]string{"remote": "https://home.example.com"}},
+		{name: "missing profile", profile: "office", wantErr: "available: broken, home, work"},
+		{name: "table value", profile: "broken", wantErr: "remote must not be a table"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name, values, err := file.Profile(tt.profile)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Profile(%q) error = %v, want %q", tt.profile, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if name != tt.wantName || !reflect.DeepEqual(values, tt.want) {
+				t.Fatalf("Profile(%q) = %s %v, want %s %v", tt.profile, name, values, tt.wantName, tt.want)
+			}
+		})
+	}
+
+	// Without a default, no profile is used
+	empty := &ConfigFile{Path: path}
+	if name, values, err := empty.Profile(""); name != "" || values != nil || err != nil {
+		t.Fatalf("Profile() without a default = %q %v %v", name, values, err)
+	}
+	if _, _, err := empty.Profile("work"); err == nil || !strings.Contains(err.Error(), "has no profiles") {
+		t.Fatalf("Profile(work) of an empty file error = %v", err)
+	}
+}
+
+func TestLoadConfigFileMissing(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	if file, err := LoadConfigFile(""); err != nil || len(file.Profiles) != 0 {
+		t.Fatalf("LoadConfigFile() without the default file = %v, %v, want an empty config", file, err)
+	}
+	if _, err := LoadConfigFile(filepath.Join(t.TempDir(), "missing.yaml")); err == nil {
+		t.Fatal("LoadConfigFile() of a missing explicit file succeeded")
+	}
+}
@@ -3,17 +3,19 @@ package src
 import (
 	"context"
 	"fmt"
+	"log/slog"
 	"net/url"
 	"os"
 	"os/signal"
 	"runtime"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/andydunstall/piko/agent/config"
 	"github.com/andydunstall/piko/agent/reverseproxy"
-	"github.com/andydunstall/piko/client"
 	"github.com/andydunstall/piko/pkg/log"
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/oklog/run"
@@ -26,46 +28,148 @@ type ServiceManager struct {
 	config *Config
 	ctx    context.Context
 	cancel context.CancelFunc
+	access *sessionAccess
+	// instance 本进程的随机 ID，服务器据此把重连与其他客户端区分开
+	instance string
+	// startedAt 服务启动时间
+	startedAt time.Time
+	// tmuxSession 终端所在的 tmux 会话，未使用 tmux 时为空
+	tmuxSession string
+	// browsers 打开的终端 WebSocket 数
+	browsers atomic.Int64
+	// restarting 由 gottyp restart 设置，服务停止后以相同参数重新执行
+	restarting atomic.Bool
+
+	mu sync.Mutex
+	// upstreamState 与 piko 服务器的连接状态，connectedAt 为最近一次连接成功的时间
+	upstreamState upstreamState
+	connectedAt   time.Time
 }
 
 // NewServiceManager 创建新的服务管理器
 func NewServiceManager(config *Config) *ServiceManager {
 	ctx, cancel := context.WithCancel(context.Background())
 	return &ServiceManager{
-		config: config,
-		ctx:    ctx,
-		cancel: cancel,
+		config:    config,
+		ctx:       ctx,
+		cancel:    cancel,
+		instance:  instanceID(),
+		startedAt: time.Now(),
 	}
 }
 
-// Start 启动所有服务
-func (sm *ServiceManager) PrintInfo() string {
+// instanceID 返回本进程的实例 ID。gottyp restart 重新执行时沿用之前的 ID，
+// 服务器把它当作同一客户端的重连
+func instanceID() string {
+	if inherited.Instance != "" {
+		return inherited.Instance
+	}
+	return generateRandomString(16)
+}
+
+// PrintInfo 选择端口、注册会话访问控制并打印连接信息，返回静态文件目录
+func (sm *ServiceManager) PrintInfo() (string, error) {
 	sm.config.GottyPort = sm.config.FindAvailablePort()
 	if sm.config.StaticIndex == "." {
 		if cwd, err := os.Getwd(); err == nil {
 			sm.config.StaticIndex = cwd
 		}
 	}
-	sm.printInfo()
-	return sm.config.StaticIndex
+	sm.inheritAccess()
+	// 守护进程和重启后不再注册，否则会轮换已打印的会话密钥
+	if !IsDaemonized() && sm.access == nil {
+		if err := sm.setupAccess(); err != nil {
+			return "", err
+		}
+	}
+	// 守护进程的标准输出是日志，不打印账号密码
+	if !IsDaemonized() {
+		sm.printInfo()
+	}
+	return sm.config.StaticIndex, nil
 }
 
 func (sm *ServiceManager) Start() error {
 	if sm.config.GottyPort == 0 {
 		sm.config.GottyPort = sm.config.FindAvailablePort()
 	}
-	if env := os.Getenv("GOTTYP_STATIC_INDEX"); env != "" {
-		sm.config.StaticIndex = env
+	if inherited.StaticIndex != "" {
+		sm.config.StaticIndex = inherited.StaticIndex
 	}
+	sm.inheritAccess()
 	return sm.startServices()
 }
 
+// inheritAccess 使用父进程或重启前注册的会话密钥
+func (sm *ServiceManager) inheritAccess() {
+	if inherited.Secret != "" && sm.access == nil {
+		sm.access = &sessionAccess{Secret: inherited.Secret}
+	}
+}
+
+// Restarting 判断服务是否因 gottyp restart 而停止
+func (sm *ServiceManager) Restarting() bool {
+	return sm.restarting.Load()
+}
+
+// Reexec 以相同的参数重新执行 gottyp，沿用会话名、账号密码、会话密钥和实例 ID，
+// 进程号不变
+func (sm *ServiceManager) Reexec() error {
+	self, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to get executable path: %w", err)
+	}
+
+	env := handoff{
+		Daemonized:  IsDaemonized(),
+		StaticIndex: sm.config.StaticIndex,
+		Session:     sm.config.Session,
+		AuthName:    sm.config.AuthName,
+		Pass:        sm.config.Pass,
+		Secret:      sm.SessionSecret(),
+		Instance:    sm.instance,
+	}.environ()
+	slog.Info("Restarting", "session", sm.config.Session)
+	return syscall.Exec(self, os.Args, env)
+}
+
+// SessionSecret 返回服务器签发的会话密钥，未注册访问控制时为空
+func (sm *ServiceManager) SessionSecret() string {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	if sm.access == nil {
+		return ""
+	}
+	return sm.access.Secret
+}
+
+// tokenQuery 返回带会话密钥的 URL 查询字符串
+func (sm *ServiceManager) tokenQuery() string {
+	if secret := sm.SessionSecret(); secret != "" {
+		return "?gottyp_token=" + url.QueryEscape(secret)
+	}
+	return ""
+}
+
+// sessionURL 返回浏览器打开会话的地址
+func (sm *ServiceManager) sessionURL() string {
+	return fmt.Sprintf("https://%s/%s/%s", sm.config.GetRemoteHost(), sm.config.Session, sm.tokenQuery())
+}
+
 func (sm *ServiceManager) printInfo() {
 	remoteHost := sm.config.GetRemoteHost()
 	sessionPath := "/" + sm.config.Session + "/"
+	tokenQuery := sm.tokenQuery()
 
 	fmt.Println("========================================")
-	fmt.Printf("Remote URL: https://%s%s\n", remoteHost, sessionPath)
+	fmt.Printf("Remote URL: %s\n", sm.sessionURL())
+	if sm.access != nil && sm.access.Mode == "oidc" {
+		allowed := "server default"
+		if len(sm.access.AllowedUsers) > 0 {
+			allowed = strings.Join(sm.access.AllowedUsers, ", ")
+		}
+		fmt.Printf("Login:      OIDC (allowed: %s)\n", allowed)
+	}
 	if sm.config.Auth {
 		fmt.Printf("Username:   %s\n", sm.config.AuthName)
 		fmt.Printf("Password:   %s\n", sm.config.Pass)
@@ -74,7 +178,7 @@ func (sm *ServiceManager) printInfo() {
 		fmt.Printf("Port Proxy: https://%s%sport/%s\n", remoteHost, sessionPath, sm.config.AttachPort)
 	}
 	if sm.config.StaticIndex != "" {
-		fmt.Printf("Files:      https://%s%sfiles/\n", remoteHost, sessionPath)
+		fmt.Printf("Files:      https://%s%sfiles/%s\n", remoteHost, sessionPath, tokenQuery)
 	}
 	fmt.Println("========================================")
 }
@@ -85,23 +189,26 @@ func (sm *ServiceManager) startServices() error {
 
 	// 启动 piko 服务
 	g.Add(func() error {
-		err := sm.startPiko()
-		if err != nil {
-			fmt.Printf("启动piko失败:%v\n", err)
-			return err
+		err := sm.runPiko()
+		if err != nil && sm.ctx.Err() == nil {
+			slog.Error("Failed to run piko", "error", err)
 		}
-		// 等待 context 取消
-		<-sm.ctx.Done()
-		return sm.ctx.Err()
+		return err
 	}, func(error) {
-		// piko 服务会在 context 取消时自动停止
+		// piko 连接会在 context 取消时断开
+		sm.cancel()
 	})
 
+	// 控制 socket，供 gottyp status 查询运行状态
+	if err := sm.startControl(); err != nil {
+		return fmt.Errorf("failed to start control socket: %w", err)
+	}
+
 	// 启动 gotty 服务
 	g.Add(func() error {
 		err := sm.startGotty()
 		if err != nil {
-			fmt.Printf("启动gotty失败:%v\n", err)
+			slog.Error("Failed to start gotty", "error", err)
 			return err
 		}
 		// 等待 context 取消
@@ -126,7 +233,7 @@ func (sm *ServiceManager) startServices() error {
 
 		select {
 		case sig := <-c:
-			fmt.Printf("\nReceived signal %v, shutting down...\n", sig)
+			slog.Info("Received signal, shutting down", "signal", sig.String())
 			sm.cancel() // 立即取消 context
 			return nil
 		case <-sm.ctx.Done():
@@ -144,7 +251,7 @@ func (sm *ServiceManager) startServices() error {
 
 			select {
 			case <-timeoutCtx.Done():
-				fmt.Printf("\n⏰ 服务运行时间达到24小时，正在停止...\n")
+				slog.Info("Service has run for 24 hours, stopping")
 				sm.cancel()
 				return nil
 			case <-sm.ctx.Done():
@@ -160,12 +267,12 @@ func (sm *ServiceManager) startServices() error {
 
 // Wait 等待服务运行（已废弃，使用 Start 方法）
 func (sm *ServiceManager) Wait() {
-	fmt.Printf("⚠️  Wait 方法已废弃，请使用 Start 方法\n")
+	slog.Warn("Wait is deprecated, use Start")
 }
 
 // Stop 停止所有服务
 func (sm *ServiceManager) Stop() {
-	fmt.Printf("✅ 服务已停止\n")
+	slog.Info("Service stopped")
 }
 
 func (sm *ServiceManager) startGotty() error {
@@ -213,12 +320,13 @@ func (sm *ServiceManager) startGotty() error {
 			if sessionName == "" {
 				sessionName = "gotty-" + sm.config.Session
 			}
+			sm.tmuxSession = sessionName
 			cmd := "tmux"
 			args := []string{"new", "-A", "-s", sessionName, sm.getShell()}
 			factory, err = localcommand.NewFactory(cmd, args, backendOptions)
-			fmt.Printf("✅ 使用 tmux 保持会话\n")
+			slog.Info("Using tmux to keep the session", "tmux_session", sessionName)
 		} else {
-			fmt.Printf("ℹ️  tmux not found, using plain shell. Install tmux for a better persistent session experience.\n")
+			slog.Info("tmux not found, using plain shell. Install tmux for a better persistent session experience")
 			factory, err = localcommand.NewFactory(sm.getShell(), []string{}, backendOptions)
 		}
 	} else {
@@ -237,13 +345,27 @@ func (sm *ServiceManager) startGotty() error {
 	go func() {
 		err := srv.Run(sm.ctx)
 		if err != nil && err != context.Canceled {
-			fmt.Printf("gotty 服务器运行错误: %v\n", err)
+			slog.Error("gotty server failed", "error", err)
 		}
 	}()
 
 	return nil
 }
 
+// upstreamToken 返回连接 endpointID 的 upstream token。服务器签发的用户密钥
+// 本身就是 JWT，原样使用；否则把 upstream-key 当作共享 HMAC 密钥签发 token。
+func upstreamToken(upstreamKey, endpointID string) (string, error) {
+	if isUserKey(upstreamKey) {
+		return upstreamKey, nil
+	}
+	return generateJWTToken(upstreamKey, endpointID)
+}
+
+// isUserKey 判断 upstream-key 是否为服务器签发的用户密钥（JWT）
+func isUserKey(upstreamKey string) bool {
+	return strings.HasPrefix(upstreamKey, "eyJ") && strings.Count(upstreamKey, ".") == 2
+}
+
 func generateJWTToken(secretKey, endpointID string) (string, error) {
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
 		"piko": map[string]interface{}{
@@ -254,17 +376,14 @@ func generateJWTToken(secretKey, endpointID string) (string, error) {
 	return token.SignedString([]byte(secretKey))
 }
 
-func (sm *ServiceManager) startPiko() error {
-	remote := sm.config.Remote
-	if strings.HasPrefix(remote, "http") {
-		remote = sm.config.Remote
-	} else {
-		remote = fmt.Sprintf("http://%s", sm.config.Remote)
-	}
+// runPiko 连接 piko 服务器并提供 gotty 服务，连接断开后自动重连，直到服务停止
+// 或遇到无法重试的错误
+func (sm *ServiceManager) runPiko() error {
+	remote := sm.config.RemoteURL()
 	conf := &config.Config{
 		Connect: config.ConnectConfig{
 			URL:     remote,
-			Timeout: 30 * time.Second,
+			Timeout: connectTimeout,
 		},
 		Listeners: []config.ListenerConfig{
 			{
@@ -283,63 +402,26 @@ func (sm *ServiceManager) startPiko() error {
 		GracePeriod: 30 * time.Second,
 	}
 
-	// 创建日志记录器
-	logger, err := log.NewLogger("info", []string{})
-	if err != nil {
-		return fmt.Errorf("failed to create logger: %v", err)
-	}
+	// piko 日志写入 slog
+	logger := newPikoLogger(slog.Default())
 
 	if err := conf.Validate(); err != nil {
 		return fmt.Errorf("piko config validation failed: %v", err)
 	}
 
-	connectURL, err := url.Parse(conf.Connect.URL)
+	connectURL, err := sm.upstreamURL()
 	if err != nil {
 		return fmt.Errorf("failed to parse connect URL: %v", err)
 	}
-
-	// 如果有 upstream-key，生成 JWT token
-	var token string
 	if sm.config.UpstreamKey != "" {
-		jwtToken, err := generateJWTToken(sm.config.UpstreamKey, sm.config.Session)
-		if err != nil {
-			return fmt.Errorf("failed to generate JWT token: %v", err)
-		}
-		token = jwtToken
-		fmt.Printf("[piko] using upstream authentication\n")
+		slog.Info("Using upstream authentication")
 	}
 
-	// 创建上游客户端
-	upstream := &client.Upstream{
-		URL:       connectURL,
-		Token:     token,
-		TLSConfig: nil, // 不使用 TLS
-		Logger:    logger.WithSubsystem("client"),
-	}
-
-	// 为每个监听器创建连接
-	for _, listenerConfig := range conf.Listeners {
-		fmt.Printf("[piko] connecting to endpoint: %s, remote: %s\n", listenerConfig.EndpointID, remote)
-		ln, err := upstream.Listen(sm.ctx, listenerConfig.EndpointID)
-		if err != nil {
-			return fmt.Errorf("failed to listen on endpoint %s: %v", listenerConfig.EndpointID, err)
-		}
-		fmt.Printf("[piko] connected to endpoint: %s\n", listenerConfig.EndpointID)
-
-		metrics := reverseproxy.NewMetrics("proxy")
-		proxySrv := reverseproxy.NewServer(listenerConfig, metrics, logger)
-		if proxySrv == nil {
-			return fmt.Errorf("failed to create HTTP proxy server")
-		}
+	listenerConfig := conf.Listeners[0]
+	proxy := reverseproxy.NewReverseProxy(listenerConfig, logger.WithSubsystem("proxy.http"))
 
-		go func() {
-			if err := proxySrv.Serve(ln); err != nil && err != context.Canceled {
-				fmt.Printf("proxy server error: %v\n", err)
-			}
-		}()
-	}
-
-	return nil
+	slog.Info("Connecting to piko", "endpoint", listenerConfig.EndpointID, "remote", remote)
+	return sm.superviseUpstream(listenURL(connectURL, listenerConfig.EndpointID), sm.countBrowsers(proxy))
 }
 
 // getShell 根据操作系统获取对应的shell
@@ -351,7 +433,7 @@ func (sm *ServiceManager) getShell() string {
 			return sm.config.Terminal
 		}
 		// 如果指定的 terminal 不可用，输出警告并继续使用默认逻辑
-		fmt.Printf("⚠️  指定的终端 %s 不可用，将使用默认终端\n", sm.config.Terminal)
+		slog.Warn("Terminal not available, using the default shell", "terminal", sm.config.Terminal)
 	}
 
 	// 使用默认的 shell 选择逻辑
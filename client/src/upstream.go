@@ -0,0 +1,252 @@
+package src
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/andydunstall/piko/pkg/websocket"
+	"github.com/andydunstall/yamux"
+)
+
+// upstreamState 与 piko 服务器的连接状态
+type upstreamState string
+
+const (
+	stateConnecting   upstreamState = "connecting"
+	stateConnected    upstreamState = "connected"
+	stateReconnecting upstreamState = "reconnecting"
+)
+
+// minReconnectBackoff、maxReconnectBackoff 重连等待的范围，每次失败翻倍并加入随机抖动。
+// 测试中会缩短
+var (
+	minReconnectBackoff = time.Second
+	maxReconnectBackoff = time.Minute
+)
+
+const (
+	// connectTimeout 单次连接 piko 服务器的超时
+	connectTimeout = 30 * time.Second
+	// stableConnection 连接保持超过该时长后，断开时立即重连并重置退避
+	stableConnection = time.Minute
+	// pingInterval 健康检查间隔，pingTimeout 内没有响应即断开重连
+	pingInterval = 15 * time.Second
+	pingTimeout  = 10 * time.Second
+)
+
+// superviseUpstream 保持与 piko 服务器的连接：连接失败或断开后按指数退避重连，
+// 直到服务停止或服务器拒绝连接（如 token 无效、会话名被占用）
+func (sm *ServiceManager) superviseUpstream(url string, handler http.Handler) error {
+	endpoint := sm.config.Session
+	backoff := newBackoff(minReconnectBackoff, maxReconnectBackoff)
+
+	sm.setUpstreamState(stateConnecting)
+	for {
+		sess, err := sm.dialUpstream(url)
+		if err != nil {
+			if sm.ctx.Err() != nil {
+				return sm.ctx.Err()
+			}
+			var retryable *websocket.RetryableError
+			if !errors.As(err, &retryable) {
+				return upstreamError(endpoint, err)
+			}
+			wait := backoff.next()
+			slog.Warn("Failed to connect to piko, retrying", "endpoint", endpoint, "backoff", wait, "error", err)
+			if !sm.sleep(wait) {
+				return sm.ctx.Err()
+			}
+			continue
+		}
+
+		sm.setUpstreamState(stateConnected)
+		// 服务器可能已丢失注册信息（如重启后使用内存存储），每次连接后重新注册
+		go func() {
+			if err := sm.registerAccess(); err != nil {
+				slog.Warn("Failed to register session access", "error", err)
+			}
+		}()
+		connected := time.Now()
+		err = sm.serveUpstream(sess, handler)
+		if sm.ctx.Err() != nil {
+			return sm.ctx.Err()
+		}
+
+		slog.Warn("Disconnected from piko", "endpoint", endpoint, "connected_for", time.Since(connected).Round(time.Second), "error", err)
+		sm.setUpstreamState(stateReconnecting)
+		if time.Since(connected) >= stableConnection {
+			backoff.reset()
+			continue
+		}
+		// 刚连上就断开时同样退避，避免服务器反复断开连接时频繁重连
+		if !sm.sleep(backoff.next()) {
+			return sm.ctx.Err()
+		}
+	}
+}
+
+// dialUpstream 连接一次 piko 服务器，返回多路复用会话。每次连接重新生成
+// token，长时间运行后重连也不会因 token 过期被拒绝
+func (sm *ServiceManager) dialUpstream(url string) (*yamux.Session, error) {
+	var opts []websocket.DialOption
+	if sm.config.UpstreamKey != "" {
+		token, err := upstreamToken(sm.config.UpstreamKey, sm.config.Session)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate JWT token: %v", err)
+		}
+		opts = append(opts, websocket.WithToken(token))
+	}
+
+	ctx, cancel := context.WithTimeout(sm.ctx, connectTimeout)
+	defer cancel()
+	conn, err := websocket.Dial(ctx, url, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	muxConfig := yamux.DefaultConfig()
+	// 由 pingUpstream 做健康检查
+	muxConfig.EnableKeepAlive = false
+	muxConfig.ConnectionWriteTimeout = pingTimeout
+	muxConfig.LogOutput = nil
+	muxConfig.Logger = slog.NewLogLogger(slog.Default().With("subsystem", "yamux").Handler(), slog.LevelDebug)
+	return yamux.Client(conn, muxConfig)
+}
+
+// serveUpstream 在 piko 连接上提供 gotty 服务，直到连接断开或服务停止
+func (sm *ServiceManager) serveUpstream(sess *yamux.Session, handler http.Handler) error {
+	stop := context.AfterFunc(sm.ctx, func() {
+		sess.Close()
+	})
+	defer stop()
+	defer sess.Close()
+
+	go sm.pingUpstream(sess)
+	srv := &http.Server{
+		Handler:  handler,
+		ErrorLog: slog.NewLogLogger(slog.Default().With("subsystem", "proxy.http").Handler(), slog.LevelWarn),
+	}
+	return srv.Serve(sess)
+}
+
+// countBrowsers 统计打开的终端 WebSocket，即正在使用会话的浏览器数
+func (sm *ServiceManager) countBrowsers(next http.Handler) http.Handler {
+	terminal := "/" + sm.config.Session + "/ws"
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == terminal && strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+			sm.browsers.Add(1)
+			defer sm.browsers.Add(-1)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// pingUpstream 定期 ping piko 服务器，没有响应时关闭连接以触发重连
+func (sm *ServiceManager) pingUpstream(sess *yamux.Session) {
+	ticker := time.NewTicker(pingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			rtt, err := sess.Ping()
+			if err != nil {
+				if !sess.IsClosed() {
+					slog.Warn("Piko health check failed, reconnecting", "endpoint", sm.config.Session, "error", err)
+					sess.Close()
+				}
+				return
+			}
+			slog.Debug("Piko health check", "endpoint", sm.config.Session, "rtt", rtt)
+		case <-sess.CloseChan():
+			return
+		}
+	}
+}
+
+// setUpstreamState 记录连接状态的变化，并在前台运行时打印到标准输出
+// （守护进程的标准输出就是日志文件）
+func (sm *ServiceManager) setUpstreamState(state upstreamState) {
+	sm.mu.Lock()
+	if sm.upstreamState == state {
+		sm.mu.Unlock()
+		return
+	}
+	sm.upstreamState = state
+	if state == stateConnected {
+		sm.connectedAt = time.Now()
+	}
+	sm.mu.Unlock()
+
+	slog.Info("Piko connection "+string(state), "endpoint", sm.config.Session, "state", state)
+	if !IsDaemonized() {
+		fmt.Printf("[%s] Piko %s\n", time.Now().Format("15:04:05"), state)
+	}
+}
+
+// sleep 等待 d，服务停止时返回 false
+func (sm *ServiceManager) sleep(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-sm.ctx.Done():
+		return false
+	}
+}
+
+// upstreamError 把服务器拒绝连接的错误转换为给用户的提示
+func upstreamError(endpoint string, err error) error {
+	if strings.HasPrefix(err.Error(), "409: ") {
+		return fmt.Errorf("session %s is already connected by another client, pick another name with --session or share it with --multi-host", endpoint)
+	}
+	return fmt.Errorf("failed to listen on endpoint %s: %v", endpoint, err)
+}
+
+// listenURL 返回监听 endpoint 的 piko WebSocket 地址，保留 URL 中的查询参数
+func listenURL(u *url.URL, endpoint string) string {
+	listen := *u
+	listen.Path = strings.TrimSuffix(listen.Path, "/") + "/piko/v1/upstream/" + endpoint
+	switch listen.Scheme {
+	case "http":
+		listen.Scheme = "ws"
+	case "https":
+		listen.Scheme = "wss"
+	}
+	return listen.String()
+}
+
+// backoff 带随机抖动的指数退避
+type backoff struct {
+	min, max time.Duration
+	attempt  int
+}
+
+func newBackoff(min, max time.Duration) *backoff {
+	return &backoff{min: min, max: max}
+}
+
+// next 返回下一次等待时间：min 每次翻倍直到 max，再随机取其一半到全部
+func (b *backoff) next() time.Duration {
+	d := b.max
+	if b.attempt < 32 {
+		if exp := b.min << b.attempt; exp > 0 && exp < b.max {
+			d = exp
+		}
+	}
+	b.attempt++
+	return d/2 + rand.N(d/2+1)
+}
+
+func (b *backoff) reset() {
+	b.attempt = 0
+}
@@ -0,0 +1,293 @@
+package src
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/andydunstall/piko/pkg/websocket"
+	"github.com/andydunstall/yamux"
+	gorilla "github.com/gorilla/websocket"
+)
+
+func TestBackoff(t *testing.T) {
+	b := newBackoff(time.Second, time.Minute)
+	for _, want := range []time.Duration{
+		time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 16 * time.Second, 32 * time.Second,
+		time.Minute, time.Minute,
+	} {
+		if got := b.next(); got < want/2 || got > want {
+			t.Fatalf("next() = %s, want between %s and %s", got, want/2, want)
+		}
+	}
+
+	// Shifting min this far overflows
+	b.attempt = 62
+	if got := b.next(); got < 30*time.Second || got > time.Minute {
+		t.Fatalf("next() after 62 attempts = %s", got)
+	}
+
+	b.reset()
+	if got := b.next(); got < 500*time.Millisecond || got > time.Second {
+		t.Fatalf("next() after reset() = %s", got)
+	}
+}
+
+func TestBackoffJitter(t *testing.T) {
+	seen := map[time.Duration]bool{}
+	for i := 0; i < 20; i++ {
+		seen[newBackoff(time.Second, time.Minute).next()] = true
+	}
+	if len(seen) == 1 {
+		t.Fatal("clients restarted together retry at the same time")
+	}
+}
+
+// fakePiko stands in for the server: it accepts upstream connections like
+// piko and session access registrations. It can be stopped and started
+// again on the same address.
+type fakePiko struct {
+	t    *testing.T
+	addr string
+
+	// sessions receives each upstream connection
+	sessions      chan *yamux.Session
+	registrations chan string
+
+	mu     sync.Mutex
+	server *http.Server
+	open   []*yamux.Session
+	// reject answers the next rejectDials upstream connections with reject
+	reject      int
+	rejectDials int
+}
+
+func newFakePiko(t *testing.T) *fakePiko {
+	f := &fakePiko{
+		t:             t,
+		addr:          "127.0.0.1:0",
+		sessions:      make(chan *yamux.Session, 10),
+		registrations: make(chan string, 10),
+	}
+	f.start()
+	t.Cleanup(f.stop)
+	return f
+}
+
+// url returns the server URL the client is configured with
+func (f *fakePiko) url() *url.URL {
+	return &url.URL{Scheme: "http", Host: f.addr}
+}
+
+func (f *fakePiko) start() {
+	f.t.Helper()
+	ln, err := net.Listen("tcp", f.addr)
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	f.addr = ln.Addr().String()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/piko/v1/upstream/demo", f.upstream)
+	mux.HandleFunc("/api/v1/sessions/demo/access", func(w http.ResponseWriter, r *http.Request) {
+		f.registrations <- r.Header.Get("Authorization")
+		json.NewEncoder(w).Encode(sessionAccess{Mode: "open"})
+	})
+
+	f.mu.Lock()
+	f.server = &http.Server{Handler: mux}
+	f.mu.Unlock()
+	go f.server.Serve(ln)
+}
+
+func (f *fakePiko) upstream(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	if f.rejectDials > 0 {
+		f.rejectDials--
+		f.mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(f.reject)
+		json.NewEncoder(w).Encode(map[string]string{"error": http.StatusText(f.reject)})
+		return
+	}
+	f.mu.Unlock()
+
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ") {
+		http.Error(w, "no token", http.StatusUnauthorized)
+		return
+	}
+	wsConn, err := (&gorilla.Upgrader{}).Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	config := yamux.DefaultConfig()
+	config.LogOutput = io.Discard
+	sess, err := yamux.Server(websocket.New(wsConn), config)
+	if err != nil {
+		wsConn.Close()
+		return
+	}
+	f.mu.Lock()
+	f.open = append(f.open, sess)
+	f.mu.Unlock()
+	f.sessions <- sess
+}
+
+// stop kills the server and drops its upstream connections
+func (f *fakePiko) stop() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.server.Close()
+	for _, sess := range f.open {
+		sess.Close()
+	}
+	f.open = nil
+}
+
+// connected waits for the client to connect and checks it serves requests
+// over the connection
+func (f *fakePiko) connected(t *testing.T) {
+	t.Helper()
+	var sess *yamux.Session
+	select {
+	case sess = <-f.sessions:
+	case <-time.After(5 * time.Second):
+		t.Fatal("client didn't connect")
+	}
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return sess.Open()
+		},
+	}}
+	defer client.CloseIdleConnections()
+	resp, err := client.Get("http://demo/demo/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if body, _ := io.ReadAll(resp.Body); string(body) != "terminal" {
+		t.Fatalf("client served %q", body)
+	}
+}
+
+// registered waits for the client to register the session's access
+func (f *fakePiko) registered(t *testing.T) {
+	t.Helper()
+	select {
+	case auth := <-f.registrations:
+		if !strings.HasPrefix(auth, "Bearer ") {
+			t.Fatalf("registration authorized with %q", auth)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("client didn't register the session access")
+	}
+}
+
+// superviseFake runs superviseUpstream against f until the test ends
+func superviseFake(t *testing.T, f *fakePiko) (*ServiceManager, <-chan error) {
+	min, max := minReconnectBackoff, maxReconnectBackoff
+	minReconnectBackoff, maxReconnectBackoff = 10*time.Millisecond, 100*time.Millisecond
+	t.Cleanup(func() { minReconnectBackoff, maxReconnectBackoff = min, max })
+
+	sm := NewServiceManager(&Config{Session: "demo", Remote: f.url().String(), UpstreamKey: "sekrit"})
+	t.Cleanup(sm.cancel)
+	terminal := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "terminal")
+	})
+
+	done := make(chan error, 1)
+	go func() {
+		done <- sm.superviseUpstream(listenURL(f.url(), "demo"), terminal)
+	}()
+	return sm, done
+}
+
+func waitState(t *testing.T, sm *ServiceManager, want upstreamState) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		sm.mu.Lock()
+		state := sm.upstreamState
+		sm.mu.Unlock()
+		if state == want {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("upstream state = %s, want %s", state, want)
+		}
+	}
+}
+
+func TestSuperviseUpstreamReconnects(t *testing.T) {
+	piko := newFakePiko(t)
+	sm, done := superviseFake(t, piko)
+
+	piko.connected(t)
+	piko.registered(t)
+	waitState(t, sm, stateConnected)
+
+	for i := 0; i < 2; i++ {
+		piko.stop()
+		waitState(t, sm, stateReconnecting)
+		// Dials fail while the server is down
+		time.Sleep(200 * time.Millisecond)
+
+		piko.start()
+		piko.connected(t)
+		// The server may have lost the registration when it restarted
+		piko.registered(t)
+		waitState(t, sm, stateConnected)
+	}
+
+	sm.cancel()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("superviseUpstream() = %v after stopping", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("superviseUpstream() didn't return after stopping")
+	}
+}
+
+func TestSuperviseUpstreamRejected(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  int
+		dials   int
+		wantErr string
+	}{
+		{name: "unavailable", status: http.StatusServiceUnavailable, dials: 3},
+		{name: "bad token", status: http.StatusUnauthorized, dials: 1, wantErr: "failed to listen on endpoint demo: 401"},
+		{name: "session taken", status: http.StatusConflict, dials: 1, wantErr: "already connected by another client"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			piko := newFakePiko(t)
+			piko.reject, piko.rejectDials = tt.status, tt.dials
+			sm, done := superviseFake(t, piko)
+
+			if tt.wantErr == "" {
+				piko.connected(t)
+				waitState(t, sm, stateConnected)
+				return
+			}
+			select {
+			case err := <-done:
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("superviseUpstream() = %v, want %q", err, tt.wantErr)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("superviseUpstream() kept retrying")
+			}
+		})
+	}
+}
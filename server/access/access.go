@@ -0,0 +1,356 @@
+package access
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Session access modes
+const (
+	// ModeNone proxies anyone to any session, leaving authentication to the
+	// client's gotty Basic Auth
+	ModeNone = "none"
+	// ModeSecret requires the shared secret issued when the session
+	// registered
+	ModeSecret = "secret"
+	// ModeOIDC requires a login with the OIDC provider by a user on the
+	// session's allow-list
+	ModeOIDC = "oidc"
+)
+
+// Audiences of the signed cookies, so one can't be passed off as another
+const (
+	userAudience   = "gottyp-user"
+	loginAudience  = "gottyp-login"
+	ticketAudience = "gottyp-ticket"
+)
+
+// ticketTTL is how long a login ticket can be redeemed on a session host
+const ticketTTL = time.Minute
+
+// Config configures session access control
+type Config struct {
+	// Mode is ModeNone, ModeSecret or ModeOIDC
+	Mode string
+	// Key signs session secrets and login cookies. Every node of a cluster
+	// needs the same key.
+	Key []byte
+	// AllowedUsers is the allow-list of registered sessions that didn't set
+	// one. When both are empty, every user the OIDC provider logs in is
+	// allowed. Sessions that never registered are denied.
+	AllowedUsers []string
+	// LoginTTL is how long a login lasts
+	LoginTTL time.Duration
+	// OIDC configures the provider users log in with in ModeOIDC
+	OIDC OIDCConfig
+}
+
+// Registration is the access configuration a session registered
+type Registration struct {
+	SessionID    string    `json:"session_id"`
+	AllowedUsers []string  `json:"allowed_users"`
+	RegisteredAt time.Time `json:"registered_at"`
+	// Nonce identifies the current secret of the session. It is useless
+	// without the key, so it is shared with the other nodes.
+	Nonce string `json:"nonce,omitempty"`
+}
+
+// Authenticator issues and checks the credentials of session access
+type Authenticator struct {
+	config Config
+	oidc   *Provider
+	store  Store
+
+	mu            sync.RWMutex
+	registrations map[string]Registration
+}
+
+// New creates an authenticator for cfg, loading the registrations kept in
+// store
+func New(cfg Config, store Store) (*Authenticator, error) {
+	a := &Authenticator{
+		config:        cfg,
+		store:         store,
+		registrations: make(map[string]Registration),
+	}
+
+	switch cfg.Mode {
+	case "", ModeNone:
+		a.config.Mode = ModeNone
+	case ModeSecret:
+		if len(cfg.Key) == 0 {
+			return nil, errors.New("secret mode needs a key")
+		}
+	case ModeOIDC:
+		if len(cfg.Key) == 0 {
+			return nil, errors.New("oidc mode needs a key")
+		}
+		provider, err := NewProvider(cfg.OIDC)
+		if err != nil {
+			return nil, err
+		}
+		a.oidc = provider
+	default:
+		return nil, fmt.Errorf("unknown session auth mode %q", cfg.Mode)
+	}
+
+	stored, err := store.List()
+	if err != nil {
+		return nil, fmt.Errorf("load registrations: %w", err)
+	}
+	for _, reg := range stored {
+		a.registrations[reg.SessionID] = reg
+	}
+	return a, nil
+}
+
+// Mode returns the access mode
+func (a *Authenticator) Mode() string {
+	return a.config.Mode
+}
+
+// LoginTTL returns how long a login lasts
+func (a *Authenticator) LoginTTL() time.Duration {
+	return a.config.LoginTTL
+}
+
+// OIDC returns the OIDC provider, nil unless the mode is ModeOIDC
+func (a *Authenticator) OIDC() *Provider {
+	return a.oidc
+}
+
+// Register records the allow-list of a session and issues a new secret for
+// it, revoking the previous one. A client registering again with its current
+// secret, e.g. after reconnecting, keeps it.
+func (a *Authenticator) Register(sessionID string, allowedUsers []string, secret string) (Registration, string, error) {
+	nonce, ok := a.currentNonce(sessionID, secret)
+	if !ok {
+		nonce = randomString(12)
+	}
+	reg := Registration{
+		SessionID:    sessionID,
+		AllowedUsers: normalizeUsers(allowedUsers),
+		RegisteredAt: time.Now(),
+		Nonce:        nonce,
+	}
+	if err := a.Restore(reg); err != nil {
+		return Registration{}, "", err
+	}
+	return reg, nonce + "." + a.secretMAC(sessionID, nonce), nil
+}
+
+// Restore records a registration made on another node, unless the session
+// has registered again since
+func (a *Authenticator) Restore(reg Registration) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if local, exists := a.registrations[reg.SessionID]; exists && local.RegisteredAt.After(reg.RegisteredAt) {
+		return nil
+	}
+	if err := a.store.Save(reg); err != nil {
+		return fmt.Errorf("save registration: %w", err)
+	}
+	a.registrations[reg.SessionID] = reg
+	return nil
+}
+
+// Registration returns the registration of a session
+func (a *Authenticator) Registration(sessionID string) (Registration, bool) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	reg, exists := a.registrations[sessionID]
+	return reg, exists
+}
+
+// VerifySecret checks a session secret. Only the latest secret a session
+// registered is accepted, so registering again revokes the previous one.
+func (a *Authenticator) VerifySecret(sessionID, secret string) bool {
+	nonce, mac, ok := strings.Cut(secret, ".")
+	if !ok || nonce == "" {
+		return false
+	}
+	if !hmac.Equal([]byte(mac), []byte(a.secretMAC(sessionID, nonce))) {
+		return false
+	}
+	reg, exists := a.Registration(sessionID)
+	return exists && reg.Nonce != "" && hmac.Equal([]byte(nonce), []byte(reg.Nonce))
+}
+
+// currentNonce returns the nonce of a secret signed for a session that is
+// still its latest secret, or was issued before the registration was lost
+func (a *Authenticator) currentNonce(sessionID, secret string) (string, bool) {
+	nonce, mac, ok := strings.Cut(secret, ".")
+	if !ok || nonce == "" || !hmac.Equal([]byte(mac), []byte(a.secretMAC(sessionID, nonce))) {
+		return "", false
+	}
+	reg, exists := a.Registration(sessionID)
+	return nonce, !exists || reg.Nonce == nonce
+}
+
+func (a *Authenticator) secretMAC(sessionID, nonce string) string {
+	mac := hmac.New(sha256.New, a.config.Key)
+	mac.Write([]byte("gottyp-session\n" + sessionID + "\n" + nonce))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Allowed reports whether a logged in user may access a session: the session
+// must be registered and the user on its allow-list, or on the default
+// allow-list if the session registered none
+func (a *Authenticator) Allowed(sessionID, user string) bool {
+	reg, exists := a.Registration(sessionID)
+	if !exists {
+		return false
+	}
+	list := a.config.AllowedUsers
+	if len(reg.AllowedUsers) > 0 {
+		list = reg.AllowedUsers
+	}
+	if len(list) == 0 {
+		return true
+	}
+	return MatchUser(list, user)
+}
+
+// MatchUser reports whether a user is on an allow-list. Entries are user
+// names matched case-insensitively, "@example.com" for every user of a
+// domain, or "*" for everyone.
+func MatchUser(list []string, user string) bool {
+	user = strings.ToLower(user)
+	for _, entry := range list {
+		entry = strings.ToLower(entry)
+		switch {
+		case entry == "*", entry == user:
+			return true
+		case strings.HasPrefix(entry, "@") && strings.HasSuffix(user, entry):
+			return true
+		}
+	}
+	return false
+}
+
+func normalizeUsers(users []string) []string {
+	list := []string{}
+	for _, user := range users {
+		if user = strings.TrimSpace(user); user != "" {
+			list = append(list, user)
+		}
+	}
+	return list
+}
+
+type userClaims struct {
+	jwt.RegisteredClaims
+}
+
+// SignUser returns the login cookie of a user
+func (a *Authenticator) SignUser(user string) (string, error) {
+	now := time.Now()
+	claims := userClaims{jwt.RegisteredClaims{
+		Subject:   user,
+		Audience:  jwt.ClaimStrings{userAudience},
+		IssuedAt:  jwt.NewNumericDate(now),
+		ExpiresAt: jwt.NewNumericDate(now.Add(a.config.LoginTTL)),
+	}}
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(a.config.Key)
+}
+
+// ParseUser returns the user of a login cookie
+func (a *Authenticator) ParseUser(cookie string) (string, bool) {
+	var claims userClaims
+	if err := a.parse(cookie, userAudience, &claims); err != nil || claims.Subject == "" {
+		return "", false
+	}
+	return claims.Subject, true
+}
+
+type ticketClaims struct {
+	Session string `json:"session"`
+	jwt.RegisteredClaims
+}
+
+// SignTicket returns a short-lived ticket handing a user's login to the host
+// of one session, which can't read the login cookie of the main host
+func (a *Authenticator) SignTicket(user, sessionID string) (string, error) {
+	now := time.Now()
+	claims := ticketClaims{sessionID, jwt.RegisteredClaims{
+		Subject:   user,
+		Audience:  jwt.ClaimStrings{ticketAudience},
+		IssuedAt:  jwt.NewNumericDate(now),
+		ExpiresAt: jwt.NewNumericDate(now.Add(ticketTTL)),
+	}}
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(a.config.Key)
+}
+
+// ParseTicket returns the user of a ticket issued for a session
+func (a *Authenticator) ParseTicket(ticket, sessionID string) (string, bool) {
+	var claims ticketClaims
+	if err := a.parse(ticket, ticketAudience, &claims); err != nil || claims.Subject == "" || claims.Session != sessionID {
+		return "", false
+	}
+	return claims.Subject, true
+}
+
+// LoginState is kept in a cookie while the user logs in with the OIDC
+// provider
+type LoginState struct {
+	State    string `json:"state"`
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"verifier"`
+	// Redirect is where the user goes once logged in
+	Redirect string `json:"redirect"`
+	jwt.RegisteredClaims
+}
+
+// NewLoginState starts a login redirecting to redirect afterwards
+func NewLoginState(redirect string) *LoginState {
+	return &LoginState{
+		State:    randomString(16),
+		Nonce:    randomString(16),
+		Verifier: randomString(32),
+		Redirect: redirect,
+	}
+}
+
+// SignLoginState returns the cookie holding a login state, valid for ttl
+func (a *Authenticator) SignLoginState(state *LoginState, ttl time.Duration) (string, error) {
+	state.Audience = jwt.ClaimStrings{loginAudience}
+	state.ExpiresAt = jwt.NewNumericDate(time.Now().Add(ttl))
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, state).SignedString(a.config.Key)
+}
+
+// ParseLoginState returns the login state of a cookie
+func (a *Authenticator) ParseLoginState(cookie string) (*LoginState, bool) {
+	var state LoginState
+	if err := a.parse(cookie, loginAudience, &state); err != nil {
+		return nil, false
+	}
+	return &state, true
+}
+
+func (a *Authenticator) parse(token, audience string, claims jwt.Claims) error {
+	_, err := jwt.ParseWithClaims(token, claims, func(*jwt.Token) (interface{}, error) {
+		return a.config.Key, nil
+	},
+		jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}),
+		jwt.WithAudience(audience),
+		jwt.WithExpirationRequired(),
+	)
+	return err
+}
+
+// randomString returns n random bytes encoded as base64url
+func randomString(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
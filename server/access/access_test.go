@@ -0,0 +1,189 @@
+package access
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestAuthenticator(t *testing.T, mode string, store Store) *Authenticator {
+	t.Helper()
+	a, err := New(Config{Mode: mode, Key: []byte("test-key"), LoginTTL: time.Hour}, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func TestVerifySecret(t *testing.T) {
+	a := newTestAuthenticator(t, ModeSecret, NewMemoryStore())
+
+	if a.VerifySecret("demo", "nonce.mac") {
+		t.Fatal("unregistered session accepted a secret")
+	}
+
+	_, first, err := a.Register("demo", nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !a.VerifySecret("demo", first) {
+		t.Fatal("registered secret rejected")
+	}
+	if a.VerifySecret("other", first) {
+		t.Fatal("secret accepted for another session")
+	}
+
+	_, kept, err := a.Register("demo", nil, first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kept != first {
+		t.Fatal("registering again with the current secret rotated it")
+	}
+
+	_, second, err := a.Register("demo", nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.VerifySecret("demo", first) || !a.VerifySecret("demo", second) {
+		t.Fatal("registering again didn't revoke the previous secret")
+	}
+	if _, secret, _ := a.Register("demo", nil, first); secret == first {
+		t.Fatal("revoked secret was restored")
+	}
+}
+
+func TestRegistrationsSurviveRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "registrations.db")
+	store, err := NewBoltStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := newTestAuthenticator(t, ModeSecret, store)
+	_, secret, err := a.Register("demo", []string{"alice"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := a.Register("other", nil, ""); err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+
+	store, err = NewBoltStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	a = newTestAuthenticator(t, ModeSecret, store)
+	if !a.VerifySecret("demo", secret) {
+		t.Fatal("secret rejected after restart")
+	}
+	if reg, ok := a.Registration("demo"); !ok || len(reg.AllowedUsers) != 1 {
+		t.Fatalf("registration after restart = %+v", reg)
+	}
+}
+
+func TestRestoreKeepsNewerRegistration(t *testing.T) {
+	a := newTestAuthenticator(t, ModeSecret, NewMemoryStore())
+	old, _, err := a.Register("demo", nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, secret, err := a.Register("demo", nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := a.Restore(old); err != nil {
+		t.Fatal(err)
+	}
+	if !a.VerifySecret("demo", secret) {
+		t.Fatal("an older registration from another node replaced the newer one")
+	}
+}
+
+func TestAllowed(t *testing.T) {
+	a, err := New(Config{
+		Mode:         ModeSecret,
+		Key:          []byte("test-key"),
+		AllowedUsers: []string{"@example.com"},
+	}, NewMemoryStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := a.Register("default", nil, ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := a.Register("alice", []string{"Alice@Example.com"}, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		session string
+		user    string
+		want    bool
+	}{
+		{"default", "bob@example.com", true},
+		{"default", "bob@evil.com", false},
+		{"alice", "alice@example.com", true},
+		{"alice", "bob@example.com", false},
+		{"unregistered", "bob@example.com", false},
+	}
+	for _, tt := range tests {
+		if got := a.Allowed(tt.session, tt.user); got != tt.want {
+			t.Errorf("Allowed(%q, %q) = %v, want %v", tt.session, tt.user, got, tt.want)
+		}
+	}
+}
+
+func TestSignedCookies(t *testing.T) {
+	a := newTestAuthenticator(t, ModeSecret, NewMemoryStore())
+
+	cookie, err := a.SignUser("alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user, ok := a.ParseUser(cookie); !ok || user != "alice@example.com" {
+		t.Fatalf("ParseUser() = %q, %v", user, ok)
+	}
+
+	state, err := a.SignLoginState(NewLoginState("/"), time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := a.ParseUser(state); ok {
+		t.Fatal("login state accepted as a login")
+	}
+
+	other := newTestAuthenticator(t, ModeSecret, NewMemoryStore())
+	other.config.Key = []byte("other-key")
+	if _, ok := other.ParseUser(cookie); ok {
+		t.Fatal("login accepted with another key")
+	}
+}
+
+func TestTickets(t *testing.T) {
+	a := newTestAuthenticator(t, ModeSecret, NewMemoryStore())
+
+	ticket, err := a.SignTicket("alice@example.com", "alice-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user, ok := a.ParseTicket(ticket, "alice-1"); !ok || user != "alice@example.com" {
+		t.Fatalf("ParseTicket() = %q, %v", user, ok)
+	}
+	if _, ok := a.ParseTicket(ticket, "bob-1"); ok {
+		t.Fatal("ticket accepted for another session")
+	}
+	if _, ok := a.ParseUser(ticket); ok {
+		t.Fatal("ticket accepted as a login")
+	}
+
+	login, err := a.SignUser("alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := a.ParseTicket(login, ""); ok {
+		t.Fatal("login accepted as a ticket")
+	}
+}
@@ -0,0 +1,258 @@
+package access
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	testClientID     = "gottyp"
+	testClientSecret = "client-secret"
+	testRedirectURL  = "https://gottyp.example.com/_auth/callback"
+)
+
+// mockIdP is a minimal OIDC provider issuing RS256 ID tokens with the
+// authorization code flow and PKCE
+type mockIdP struct {
+	server *httptest.Server
+	key    *rsa.PrivateKey
+	kid    string
+
+	mu     sync.Mutex
+	codes  map[string]mockLogin
+	claims jwt.MapClaims
+}
+
+type mockLogin struct {
+	nonce     string
+	challenge string
+}
+
+func newMockIdP(t *testing.T) *mockIdP {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp := &mockIdP{key: key, kid: "key-1", codes: make(map[string]mockLogin)}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 idp.server.URL,
+			"authorization_endpoint": idp.server.URL + "/authorize",
+			"token_endpoint":         idp.server.URL + "/token",
+			"jwks_uri":               idp.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		idp.mu.Lock()
+		defer idp.mu.Unlock()
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": idp.kid,
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(idp.key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(idp.key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", idp.token)
+	idp.server = httptest.NewServer(mux)
+	t.Cleanup(idp.server.Close)
+	return idp
+}
+
+// login follows the provider's login page as the browser would and returns
+// the authorization code
+func (idp *mockIdP) login(t *testing.T, authURL string) string {
+	t.Helper()
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := u.Query()
+	if query.Get("client_id") != testClientID || query.Get("redirect_uri") != testRedirectURL {
+		t.Fatalf("unexpected login request %s", authURL)
+	}
+	if query.Get("code_challenge_method") != "S256" {
+		t.Fatalf("login doesn't use PKCE: %s", authURL)
+	}
+
+	code := randomString(8)
+	idp.mu.Lock()
+	idp.codes[code] = mockLogin{nonce: query.Get("nonce"), challenge: query.Get("code_challenge")}
+	idp.mu.Unlock()
+	return code
+}
+
+func (idp *mockIdP) token(w http.ResponseWriter, r *http.Request) {
+	id, secret, _ := r.BasicAuth()
+	if id != testClientID || secret != testClientSecret {
+		http.Error(w, "invalid client", http.StatusUnauthorized)
+		return
+	}
+
+	idp.mu.Lock()
+	login, ok := idp.codes[r.FormValue("code")]
+	delete(idp.codes, r.FormValue("code"))
+	claims := jwt.MapClaims{
+		"iss":   idp.server.URL,
+		"aud":   testClientID,
+		"sub":   "1234",
+		"email": "alice@example.com",
+		"nonce": login.nonce,
+		"iat":   time.Now().Unix(),
+		"exp":   time.Now().Add(time.Hour).Unix(),
+	}
+	for name, value := range idp.claims {
+		claims[name] = value
+	}
+	idp.mu.Unlock()
+
+	verifier := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+	if !ok || base64.RawURLEncoding.EncodeToString(verifier[:]) != login.challenge {
+		http.Error(w, "invalid grant", http.StatusBadRequest)
+		return
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = idp.kid
+	idToken, err := token.SignedString(idp.key)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"id_token": idToken})
+}
+
+func newTestProvider(t *testing.T, idp *mockIdP) *Provider {
+	t.Helper()
+	provider, err := NewProvider(OIDCConfig{
+		Issuer:       idp.server.URL,
+		ClientID:     testClientID,
+		ClientSecret: testClientSecret,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return provider
+}
+
+func TestOIDCLogin(t *testing.T) {
+	tests := []struct {
+		name    string
+		claims  jwt.MapClaims
+		user    string
+		wantErr string
+	}{
+		{name: "valid", user: "alice@example.com"},
+		{name: "other audience", claims: jwt.MapClaims{"aud": "other"}, wantErr: "invalid id_token"},
+		{name: "other issuer", claims: jwt.MapClaims{"iss": "https://evil.example.com"}, wantErr: "invalid id_token"},
+		{name: "expired", claims: jwt.MapClaims{"exp": time.Now().Add(-time.Hour).Unix()}, wantErr: "invalid id_token"},
+		{name: "replayed nonce", claims: jwt.MapClaims{"nonce": "old"}, wantErr: "nonce mismatch"},
+		{name: "unverified email", claims: jwt.MapClaims{"email_verified": false}, wantErr: "not verified"},
+		{name: "no user claim", claims: jwt.MapClaims{"email": ""}, wantErr: "no email claim"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			idp := newMockIdP(t)
+			idp.claims = tt.claims
+			provider := newTestProvider(t, idp)
+			ctx := context.Background()
+
+			state := NewLoginState("/demo/")
+			authURL, err := provider.AuthURL(ctx, state, testRedirectURL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			code := idp.login(t, authURL)
+
+			user, err := provider.Exchange(ctx, state, code, testRedirectURL)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Exchange() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if user != tt.user {
+				t.Fatalf("Exchange() user = %q, want %q", user, tt.user)
+			}
+		})
+	}
+}
+
+func TestOIDCLoginRequiresVerifier(t *testing.T) {
+	idp := newMockIdP(t)
+	provider := newTestProvider(t, idp)
+	ctx := context.Background()
+
+	state := NewLoginState("/")
+	authURL, err := provider.AuthURL(ctx, state, testRedirectURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code := idp.login(t, authURL)
+
+	// A code intercepted on its way back can't be redeemed without the
+	// verifier kept in the login cookie
+	stolen := NewLoginState("/")
+	stolen.Nonce = state.Nonce
+	if _, err := provider.Exchange(ctx, stolen, code, testRedirectURL); err == nil {
+		t.Fatal("Exchange() accepted a code without its verifier")
+	}
+}
+
+func TestOIDCKeyRotation(t *testing.T) {
+	idp := newMockIdP(t)
+	provider := newTestProvider(t, idp)
+	ctx := context.Background()
+
+	exchange := func() error {
+		state := NewLoginState("/")
+		authURL, err := provider.AuthURL(ctx, state, testRedirectURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = provider.Exchange(ctx, state, idp.login(t, authURL), testRedirectURL)
+		return err
+	}
+	if err := exchange(); err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp.mu.Lock()
+	idp.key, idp.kid = key, "key-2"
+	idp.mu.Unlock()
+
+	// The key set was just fetched, so the new key isn't trusted yet
+	if err := exchange(); err == nil {
+		t.Fatal("Exchange() fetched the key set again right away")
+	}
+	provider.mu.Lock()
+	provider.keysFetchedAt = time.Time{}
+	provider.mu.Unlock()
+	if err := exchange(); err != nil {
+		t.Fatalf("Exchange() after key rotation: %v", err)
+	}
+}
@@ -0,0 +1,120 @@
+package access
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// registrationsBucket maps a session ID to its registration
+var registrationsBucket = []byte("registrations")
+
+// Store persists session registrations, so the allow-list and the current
+// secret of a session survive restarts
+type Store interface {
+	// Save creates or replaces the registration of a session
+	Save(reg Registration) error
+	// List returns every stored registration
+	List() ([]Registration, error)
+	// Close releases the store's resources
+	Close() error
+}
+
+// MemoryStore keeps registrations in memory only
+type MemoryStore struct {
+	registrations map[string]Registration
+	mu            sync.RWMutex
+}
+
+// NewMemoryStore creates an empty memory registration store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		registrations: make(map[string]Registration),
+	}
+}
+
+// Save creates or replaces the registration of a session
+func (s *MemoryStore) Save(reg Registration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.registrations[reg.SessionID] = reg
+	return nil
+}
+
+// List returns every stored registration
+func (s *MemoryStore) List() ([]Registration, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	result := make([]Registration, 0, len(s.registrations))
+	for _, reg := range s.registrations {
+		result = append(result, reg)
+	}
+	return result, nil
+}
+
+// Close is a no-op for the memory store
+func (s *MemoryStore) Close() error {
+	return nil
+}
+
+// BoltStore persists registrations to an embedded bbolt database
+type BoltStore struct {
+	db *bolt.DB
+}
+
+// NewBoltStore opens (or creates) the database at path
+func NewBoltStore(path string) (*BoltStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("open registration store %s: %w", path, err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(registrationsBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("init registration store: %w", err)
+	}
+
+	return &BoltStore{db: db}, nil
+}
+
+// Save creates or replaces the registration of a session
+func (s *BoltStore) Save(reg Registration) error {
+	data, err := json.Marshal(reg)
+	if err != nil {
+		return fmt.Errorf("marshal registration: %w", err)
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(registrationsBucket).Put([]byte(reg.SessionID), data)
+	})
+}
+
+// List returns every stored registration
+func (s *BoltStore) List() ([]Registration, error) {
+	var result []Registration
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(registrationsBucket).ForEach(func(k, v []byte) error {
+			var reg Registration
+			if err := json.Unmarshal(v, &reg); err != nil {
+				return nil
+			}
+			result = append(result, reg)
+			return nil
+		})
+	})
+	return result, err
+}
+
+// Close closes the database
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
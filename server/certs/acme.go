@@ -0,0 +1,63 @@
+package certs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// ACMEConfig configures automatic certificates
+type ACMEConfig struct {
+	// Domains are the host names certificates are requested for
+	Domains []string
+	// Email is the contact address of the ACME account, optional
+	Email string
+	// CacheDir keeps the account key and certificates across restarts
+	CacheDir string
+	// DirectoryURL is the ACME directory, Let's Encrypt when empty
+	DirectoryURL string
+	// CAFile is a PEM bundle trusted for the ACME directory, e.g. Pebble's
+	// test CA
+	CAFile string
+}
+
+// NewACMEManager creates an autocert manager that obtains and renews
+// certificates for the configured domains. Its TLSConfig answers TLS-ALPN-01
+// challenges; HTTP-01 challenges need its HTTPHandler on port 80.
+func NewACMEManager(cfg ACMEConfig) (*autocert.Manager, error) {
+	if len(cfg.Domains) == 0 {
+		return nil, fmt.Errorf("no ACME domains configured")
+	}
+
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(cfg.Domains...),
+		Cache:      autocert.DirCache(cfg.CacheDir),
+		Email:      cfg.Email,
+	}
+	if cfg.DirectoryURL == "" && cfg.CAFile == "" {
+		return m, nil
+	}
+
+	client := &acme.Client{DirectoryURL: cfg.DirectoryURL}
+	if cfg.CAFile != "" {
+		pem, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("read ACME CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in ACME CA file %s", cfg.CAFile)
+		}
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+		client.HTTPClient = &http.Client{Transport: transport}
+	}
+	m.Client = client
+	return m, nil
+}
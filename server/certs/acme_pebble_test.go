@@ -0,0 +1,201 @@
+//go:build pebble
+
+// These tests obtain certificates from a running Pebble, the ACME test server
+// of Let's Encrypt, started with its test configuration. pebble-challtestsrv
+// resolves every name to 127.0.0.1 for it:
+//
+//	pebble-challtestsrv -defaultIPv6 "" -http01 "" -https01 "" -tlsalpn01 "" -doh ""
+//	cd pebble && PEBBLE_VA_NOSLEEP=1 pebble -config test/config/pebble-config.json -dnsserver 127.0.0.1:8053
+//	PEBBLE_CA_FILE=pebble/test/certs/pebble.minica.pem go test -tags pebble ./certs
+//
+// Pebble validates challenges on ports 5001 (TLS-ALPN-01) and 5002
+// (HTTP-01), so those must be free.
+package certs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	// pebbleDomain resolves to 127.0.0.1 through pebble-challtestsrv.
+	// autocert refuses names without a dot, such as localhost.
+	pebbleDomain   = "gottyp.test"
+	pebbleTLSPort  = ":5001"
+	pebbleHTTPPort = ":5002"
+)
+
+// pebbleConfig returns an ACME configuration for pebbleDomain against Pebble
+func pebbleConfig(t *testing.T) ACMEConfig {
+	t.Helper()
+	caFile := os.Getenv("PEBBLE_CA_FILE")
+	if caFile == "" {
+		t.Fatal("PEBBLE_CA_FILE must point at Pebble's test/certs/pebble.minica.pem")
+	}
+	directory := os.Getenv("PEBBLE_DIRECTORY")
+	if directory == "" {
+		directory = "https://localhost:14000/dir"
+	}
+	return ACMEConfig{
+		Domains:      []string{pebbleDomain},
+		Email:        "admin@example.com",
+		CacheDir:     t.TempDir(),
+		DirectoryURL: directory,
+		CAFile:       caFile,
+	}
+}
+
+// pebbleRoots returns the root Pebble currently issues from. Pebble creates
+// a new one every time it starts.
+func pebbleRoots(t *testing.T, caFile string) *x509.CertPool {
+	t.Helper()
+	management := os.Getenv("PEBBLE_MANAGEMENT")
+	if management == "" {
+		management = "https://localhost:15000"
+	}
+	data, err := os.ReadFile(caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(data)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+
+	resp, err := client.Get(management + "/roots/0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, err = io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(data) {
+		t.Fatalf("no root in %s", data)
+	}
+	return roots
+}
+
+// orderLocation adds the order URL Pebble leaves out of finalize responses.
+// Finalizing is asynchronous in Pebble, and acme.Client polls the order at
+// the response's Location.
+type orderLocation struct {
+	http.RoundTripper
+}
+
+func (t orderLocation) RoundTrip(r *http.Request) (*http.Response, error) {
+	resp, err := t.RoundTripper.RoundTrip(r)
+	if err == nil && strings.HasPrefix(r.URL.Path, "/finalize-order/") && resp.Header.Get("Location") == "" {
+		order := *r.URL
+		order.Path = "/my-order/" + strings.TrimPrefix(r.URL.Path, "/finalize-order/")
+		resp.Header.Set("Location", order.String())
+	}
+	return resp, err
+}
+
+// serve runs handler on ln until the test ends
+func serve(t *testing.T, ln net.Listener, handler http.Handler) {
+	t.Helper()
+	// Closing the connection right after the handshake makes the server log
+	server := &http.Server{Handler: handler, ErrorLog: log.New(io.Discard, "", 0)}
+	go server.Serve(ln)
+	t.Cleanup(func() { server.Close() })
+}
+
+// handshake connects to addr and returns the certificate chain it presents
+func handshake(t *testing.T, addr string) []*x509.Certificate {
+	t.Helper()
+	// Issuing the certificate happens during the handshake
+	dialer := &net.Dialer{Timeout: time.Minute}
+	conn, err := tls.DialWithDialer(dialer, "tcp", addr, &tls.Config{ServerName: pebbleDomain, InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	return conn.ConnectionState().PeerCertificates
+}
+
+// verifyChain checks the chain is for pebbleDomain and issued by Pebble
+func verifyChain(t *testing.T, chain []*x509.Certificate, roots *x509.CertPool) {
+	t.Helper()
+	intermediates := x509.NewCertPool()
+	for _, cert := range chain[1:] {
+		intermediates.AddCert(cert)
+	}
+	if _, err := chain[0].Verify(x509.VerifyOptions{DNSName: pebbleDomain, Roots: roots, Intermediates: intermediates}); err != nil {
+		t.Fatalf("certificate not issued by Pebble for %s: %v", pebbleDomain, err)
+	}
+}
+
+func TestACMEWithPebble(t *testing.T) {
+	tests := []struct {
+		name string
+		// http01 answers HTTP-01 challenges instead of TLS-ALPN-01
+		http01 bool
+	}{
+		{name: "tls-alpn-01"},
+		{name: "http-01", http01: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := pebbleConfig(t)
+			m, err := NewACMEManager(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			m.Client.HTTPClient.Transport = orderLocation{m.Client.HTTPClient.Transport}
+			roots := pebbleRoots(t, cfg.CAFile)
+
+			// The server listens on a random port, like behind a port
+			// forward from 443. Pebble validates through pebbleTLSPort or
+			// pebbleHTTPPort.
+			ln, err := tls.Listen("tcp", "127.0.0.1:0", m.TLSConfig())
+			if err != nil {
+				t.Fatal(err)
+			}
+			serve(t, ln, http.NotFoundHandler())
+			if tt.http01 {
+				challenges, err := net.Listen("tcp", pebbleHTTPPort)
+				if err != nil {
+					t.Fatal(err)
+				}
+				// As if on port 80, where the host policy sees no port
+				handler := m.HTTPHandler(RedirectHandler(443))
+				serve(t, challenges, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					r.Host, _, _ = net.SplitHostPort(r.Host)
+					handler.ServeHTTP(w, r)
+				}))
+			} else {
+				challenges, err := tls.Listen("tcp", pebbleTLSPort, m.TLSConfig())
+				if err != nil {
+					t.Fatal(err)
+				}
+				serve(t, challenges, http.NotFoundHandler())
+			}
+
+			verifyChain(t, handshake(t, ln.Addr().String()), roots)
+
+			// A restart serves the cached certificate without asking the CA
+			cfg.DirectoryURL = "https://127.0.0.1:1/dir"
+			restarted, err := NewACMEManager(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ln, err = tls.Listen("tcp", "127.0.0.1:0", restarted.TLSConfig())
+			if err != nil {
+				t.Fatal(err)
+			}
+			serve(t, ln, http.NotFoundHandler())
+			verifyChain(t, handshake(t, ln.Addr().String()), roots)
+		})
+	}
+}
@@ -0,0 +1,54 @@
+package certs
+
+import (
+	"crypto/tls"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNewACMEManager(t *testing.T) {
+	dir := t.TempDir()
+	notPEM := filepath.Join(dir, "not.pem")
+	if err := os.WriteFile(notPEM, []byte("not a certificate"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		cfg     ACMEConfig
+		wantErr bool
+	}{
+		{name: "let's encrypt", cfg: ACMEConfig{Domains: []string{"example.com"}, CacheDir: dir}},
+		{name: "no domains", cfg: ACMEConfig{CacheDir: dir}, wantErr: true},
+		{name: "missing CA file", cfg: ACMEConfig{Domains: []string{"example.com"}, CacheDir: dir, CAFile: filepath.Join(dir, "missing.pem")}, wantErr: true},
+		{name: "CA file without certificates", cfg: ACMEConfig{Domains: []string{"example.com"}, CacheDir: dir, CAFile: notPEM}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := NewACMEManager(tt.cfg)
+			if tt.wantErr != (err != nil) {
+				t.Fatalf("NewACMEManager() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && m.Client != nil {
+				t.Fatal("NewACMEManager() replaced the Let's Encrypt client")
+			}
+		})
+	}
+}
+
+func TestACMERejectsOtherHosts(t *testing.T) {
+	dir := t.TempDir()
+	// Nothing listens there, a request to the CA fails the test
+	m, err := NewACMEManager(ACMEConfig{Domains: []string{"example.com"}, CacheDir: dir, DirectoryURL: "https://127.0.0.1:1/dir"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := m.GetCertificate(&tls.ClientHelloInfo{ServerName: "other.example.com"}); err == nil {
+		t.Fatal("certificate issued for a host not in Domains")
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Fatalf("ACME account created for a rejected host: %v", entries)
+	}
+}
@@ -0,0 +1,104 @@
+package certs
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// Reloader serves a certificate and key pair from disk and reloads it when
+// either file changes, so renewed certificates are picked up without a
+// restart
+type Reloader struct {
+	certFile string
+	keyFile  string
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	version string
+}
+
+// NewReloader loads the certificate and key pair
+func NewReloader(certFile, keyFile string) (*Reloader, error) {
+	r := &Reloader{certFile: certFile, keyFile: keyFile}
+	version, err := r.fileVersion()
+	if err != nil {
+		return nil, err
+	}
+	if err := r.reload(version); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// GetCertificate returns the current certificate, for tls.Config
+func (r *Reloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.cert, nil
+}
+
+// Watch checks the files every interval until ctx is done and reloads the
+// pair when they changed. A pair that fails to load, e.g. while only one of
+// the files has been replaced, keeps the previous certificate in use.
+func (r *Reloader) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			version, err := r.fileVersion()
+			if err != nil {
+				slog.Error("Failed to stat TLS certificate", "error", err)
+				continue
+			}
+			r.mu.RLock()
+			changed := version != r.version
+			r.mu.RUnlock()
+			if !changed {
+				continue
+			}
+			if err := r.reload(version); err != nil {
+				slog.Error("Failed to reload TLS certificate", "error", err)
+				continue
+			}
+			slog.Info("Reloaded TLS certificate", "cert", r.certFile)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (r *Reloader) reload(version string) error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("load TLS certificate: %w", err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.cert = &cert
+	r.version = version
+	return nil
+}
+
+// fileVersion identifies the current content of both files by their
+// modification time and size
+func (r *Reloader) fileVersion() (string, error) {
+	var version string
+	for _, name := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(name)
+		if err != nil {
+			return "", err
+		}
+		version += fmt.Sprintf("%d:%d;", info.ModTime().UnixNano(), info.Size())
+	}
+	return version, nil
+}
@@ -0,0 +1,182 @@
+package cluster
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"clauded-server/access"
+	"clauded-server/keys"
+	"clauded-server/notification"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Headers authenticating requests between nodes
+const (
+	timestampHeader = "X-Cluster-Timestamp"
+	signatureHeader = "X-Cluster-Signature"
+)
+
+// maxClockSkew is how old a signed request may be
+const maxClockSkew = time.Minute
+
+// sign sets the timestamp and HMAC signature headers of a request to a peer.
+// The signature covers the timestamp, method, path and body, so a captured
+// request can't be altered or replayed later.
+func (n *Node) sign(req *http.Request, body []byte) {
+	if n.config.Secret == "" {
+		return
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set(timestampHeader, timestamp)
+	req.Header.Set(signatureHeader, notification.Sign(n.config.Secret, signedPayload(timestamp, req.Method, req.URL.Path, body)))
+}
+
+func signedPayload(timestamp, method, path string, body []byte) []byte {
+	payload := []byte(timestamp + "\n" + method + "\n" + path + "\n")
+	return append(payload, body...)
+}
+
+// verify checks the signature of a request from a peer
+func (n *Node) verify(c *gin.Context) {
+	if n.config.Secret == "" {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "no cluster secret configured"})
+		return
+	}
+
+	timestamp := c.GetHeader(timestampHeader)
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || time.Since(time.Unix(unix, 0)).Abs() > maxClockSkew {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid cluster timestamp"})
+		return
+	}
+
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+	want := notification.Sign(n.config.Secret, signedPayload(timestamp, c.Request.Method, c.Request.URL.Path, body))
+	if !hmac.Equal([]byte(c.GetHeader(signatureHeader)), []byte(want)) {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid cluster signature"})
+		return
+	}
+}
+
+// routes returns the API served to the other nodes on the node endpoint
+func (n *Node) routes() http.Handler {
+	router := gin.New()
+	router.Use(gin.Recovery(), n.verify)
+
+	router.POST("/notifications", n.receiveNotification)
+	router.GET("/sessions", n.listSessions)
+	router.GET("/sessions/:id", n.getSession)
+	router.PUT("/sessions/:id/tags", n.setSessionTags)
+	router.DELETE("/sessions/:id", n.disconnectSession)
+	router.GET("/upstreams/:id", n.listUpstreams)
+	router.PUT("/registrations/:id", n.restoreRegistration)
+	router.GET("/keys", n.listKeys)
+	router.GET("/keys/:id", n.getKey)
+	router.PUT("/keys/:id", n.mergeKey)
+	return router
+}
+
+func (n *Node) receiveNotification(c *gin.Context) {
+	var notif notification.Notification
+	if err := c.ShouldBindJSON(&notif); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	n.notifs.Receive(notif)
+	c.Status(http.StatusNoContent)
+}
+
+func (n *Node) listSessions(c *gin.Context) {
+	c.JSON(http.StatusOK, n.localSessions())
+}
+
+func (n *Node) getSession(c *gin.Context) {
+	info, exists := n.localSession(c.Param("id"))
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": ErrSessionNotFound.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, info)
+}
+
+func (n *Node) listUpstreams(c *gin.Context) {
+	c.JSON(http.StatusOK, n.localUpstreams(c.Param("id")))
+}
+
+func (n *Node) setSessionTags(c *gin.Context) {
+	var tags []string
+	if err := c.ShouldBindJSON(&tags); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	id := c.Param("id")
+	if !n.sessions.SetTags(id, tags) {
+		c.JSON(http.StatusNotFound, gin.H{"error": ErrSessionNotFound.Error()})
+		return
+	}
+	info, _ := n.localSession(id)
+	c.JSON(http.StatusOK, info)
+}
+
+func (n *Node) disconnectSession(c *gin.Context) {
+	id := c.Param("id")
+	info, exists := n.localSession(id)
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": ErrSessionNotFound.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, DisconnectResult{Session: info, Connections: n.sessions.Disconnect(id)})
+}
+
+func (n *Node) restoreRegistration(c *gin.Context) {
+	var reg access.Registration
+	if err := c.ShouldBindJSON(&reg); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	reg.SessionID = c.Param("id")
+	if err := n.access.Restore(reg); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+func (n *Node) listKeys(c *gin.Context) {
+	c.JSON(http.StatusOK, n.keys.List())
+}
+
+func (n *Node) getKey(c *gin.Context) {
+	key, exists := n.keys.Get(c.Param("id"))
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": keys.ErrNotFound.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, key)
+}
+
+func (n *Node) mergeKey(c *gin.Context) {
+	var key keys.Key
+	if err := c.ShouldBindJSON(&key); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	key.ID = c.Param("id")
+	n.keys.Merge([]keys.Key{key})
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,76 @@
+package cluster
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"clauded-server/keys"
+	"clauded-server/notification"
+
+	"github.com/gin-gonic/gin"
+)
+
+func newTestNode(t *testing.T, secret string) *Node {
+	t.Helper()
+	km, err := keys.NewManager("upstream-key", keys.NewMemoryStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewNode(Config{Secret: secret}, nil, nil, nil, nil, km)
+}
+
+func TestVerify(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	tests := []struct {
+		name   string
+		sender string
+		server string
+		modify func(r *http.Request)
+		want   int
+	}{
+		{name: "signed", sender: "secret", server: "secret", want: http.StatusOK},
+		{name: "unsigned", server: "secret", want: http.StatusUnauthorized},
+		{name: "other secret", sender: "other", server: "secret", want: http.StatusUnauthorized},
+		{name: "no secret configured", sender: "secret", want: http.StatusUnauthorized},
+		{name: "unsigned without secret", want: http.StatusUnauthorized},
+		{
+			name:   "other path",
+			sender: "secret",
+			server: "secret",
+			modify: func(r *http.Request) { r.URL.Path = "/keys/other" },
+			want:   http.StatusUnauthorized,
+		},
+		{
+			name:   "replayed",
+			sender: "secret",
+			server: "secret",
+			modify: func(r *http.Request) {
+				timestamp := strconv.FormatInt(time.Now().Add(-2*maxClockSkew).Unix(), 10)
+				r.Header.Set(timestampHeader, timestamp)
+				r.Header.Set(signatureHeader, notification.Sign("secret", signedPayload(timestamp, r.Method, r.URL.Path, nil)))
+			},
+			want: http.StatusUnauthorized,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newTestNode(t, tt.server)
+			sender := newTestNode(t, tt.sender)
+
+			r := httptest.NewRequest(http.MethodGet, "/keys", nil)
+			sender.sign(r, nil)
+			if tt.modify != nil {
+				tt.modify(r)
+			}
+			w := httptest.NewRecorder()
+			server.routes().ServeHTTP(w, r)
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+		})
+	}
+}
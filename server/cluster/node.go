@@ -0,0 +1,527 @@
+package cluster
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"clauded-server/access"
+	"clauded-server/keys"
+	"clauded-server/logging"
+	"clauded-server/notification"
+	"clauded-server/proxy"
+	"clauded-server/session"
+
+	"github.com/andydunstall/piko/client"
+	pikocluster "github.com/andydunstall/piko/server/cluster"
+)
+
+// EndpointPrefix prefixes the internal piko endpoint every node listens on.
+// Nodes reach each other through piko's own cross-node routing by sending
+// requests to {EndpointPrefix}{node ID}. Sessions can't use such IDs.
+const EndpointPrefix = "clauded-node-"
+
+// ErrSessionNotFound is returned when no node knows a session
+var ErrSessionNotFound = errors.New("session not found")
+
+// Config configures a cluster node
+type Config struct {
+	// ProxyURL is the local piko proxy, e.g. http://127.0.0.1:8023
+	ProxyURL string
+	// UpstreamURL is the local piko upstream, e.g. http://127.0.0.1:8022
+	UpstreamURL string
+	// PikoKey signs the piko upstream token of the node endpoint and the
+	// piko proxy tokens of requests to other nodes, and must be the same on
+	// every node
+	PikoKey []byte
+	// Secret signs requests between nodes. Requests from other nodes are
+	// refused when it is empty.
+	Secret string
+	// SyncInterval is how often the session registry of the other nodes is
+	// pulled
+	SyncInterval time.Duration
+}
+
+// Node connects this server to the other servers of a piko cluster. It
+// fans published notifications, session registrations and upstream keys out
+// to the other nodes and merges their session registries and keys with the
+// local ones. Without other nodes, it only
+// serves the local registry.
+type Node struct {
+	config   Config
+	state    *pikocluster.State
+	sessions *session.Manager
+	notifs   *notification.Service
+	access   *access.Authenticator
+	keys     *keys.Manager
+	client   *http.Client
+
+	mu sync.RWMutex
+	// remote caches the sessions of the other nodes by node ID
+	remote map[string][]session.Info
+}
+
+// NewNode creates a cluster node for the piko cluster state
+func NewNode(cfg Config, state *pikocluster.State, sessions *session.Manager, notifs *notification.Service, auth *access.Authenticator, km *keys.Manager) *Node {
+	return &Node{
+		config:   cfg,
+		state:    state,
+		sessions: sessions,
+		notifs:   notifs,
+		access:   auth,
+		keys:     km,
+		client:   &http.Client{Timeout: 5 * time.Second},
+		remote:   make(map[string][]session.Info),
+	}
+}
+
+// ID returns the piko node ID of this server
+func (n *Node) ID() string {
+	return n.state.LocalID()
+}
+
+// IsInternalEndpoint reports whether a piko endpoint is a node endpoint
+// rather than a session
+func IsInternalEndpoint(endpointID string) bool {
+	return strings.HasPrefix(endpointID, EndpointPrefix)
+}
+
+// Run listens on the node endpoint, serving requests from the other nodes,
+// and pulls their session registries until ctx is done. Notifications
+// published on this server are forwarded while it runs.
+func (n *Node) Run(ctx context.Context) error {
+	upstreamURL, err := url.Parse(n.config.UpstreamURL)
+	if err != nil {
+		return fmt.Errorf("parse upstream URL: %w", err)
+	}
+	token, err := n.upstreamToken()
+	if err != nil {
+		return err
+	}
+
+	upstream := &client.Upstream{URL: upstreamURL, Token: token}
+	ln, err := upstream.Listen(ctx, EndpointPrefix+n.ID())
+	if err != nil {
+		return fmt.Errorf("listen on node endpoint: %w", err)
+	}
+
+	server := &http.Server{Handler: n.routes()}
+	go server.Serve(ln)
+	defer server.Close()
+
+	n.notifs.SetForwarder(n.forward)
+	defer n.notifs.SetForwarder(nil)
+	n.keys.SetFetcher(n.fetchKey)
+	defer n.keys.SetFetcher(nil)
+
+	slog.Info("Cluster node listening", "node", n.ID(), "endpoint", EndpointPrefix+n.ID())
+
+	ticker := time.NewTicker(n.config.SyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			n.sync(ctx)
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// upstreamToken returns the piko token for the node endpoint
+func (n *Node) upstreamToken() (string, error) {
+	token, err := proxy.Token(n.config.PikoKey, EndpointPrefix+n.ID(), time.Time{})
+	if err != nil {
+		return "", fmt.Errorf("sign node token: %w", err)
+	}
+	return token, nil
+}
+
+// Peers returns the IDs of the other active nodes that listen on their node
+// endpoint
+func (n *Node) Peers() []string {
+	var peers []string
+	for _, node := range n.state.Nodes() {
+		if node.ID == n.ID() || node.Status != pikocluster.NodeStatusActive {
+			continue
+		}
+		if node.Endpoints[EndpointPrefix+node.ID] > 0 {
+			peers = append(peers, node.ID)
+		}
+	}
+	sort.Strings(peers)
+	return peers
+}
+
+// forward sends a notification published on this server to every peer
+func (n *Node) forward(notif notification.Notification) {
+	for _, peer := range n.Peers() {
+		go func(peer string) {
+			ctx, cancel := context.WithTimeout(context.Background(), n.client.Timeout)
+			defer cancel()
+
+			if err := n.request(ctx, peer, http.MethodPost, "/notifications", notif, nil); err != nil {
+				slog.Warn("Failed to forward notification", "notification", notif.ID, "node", peer, "error", err)
+			}
+		}(peer)
+	}
+}
+
+// ShareRegistration sends a session registration made on this server to
+// every peer, so its allow-list applies and its previous secret is revoked
+// on every node
+func (n *Node) ShareRegistration(reg access.Registration) {
+	for _, peer := range n.Peers() {
+		go func(peer string) {
+			ctx, cancel := context.WithTimeout(context.Background(), n.client.Timeout)
+			defer cancel()
+
+			if err := n.request(ctx, peer, http.MethodPut, "/registrations/"+url.PathEscape(reg.SessionID), reg, nil); err != nil {
+				slog.Warn("Failed to share session registration", "session", reg.SessionID, "node", peer, "error", err)
+			}
+		}(peer)
+	}
+}
+
+// ShareKey sends an upstream key minted or revoked on this server to every
+// peer. Peers that miss it pick it up on their next sync.
+func (n *Node) ShareKey(key keys.Key) {
+	for _, peer := range n.Peers() {
+		go func(peer string) {
+			ctx, cancel := context.WithTimeout(context.Background(), n.client.Timeout)
+			defer cancel()
+
+			if err := n.request(ctx, peer, http.MethodPut, "/keys/"+url.PathEscape(key.ID), key, nil); err != nil {
+				slog.Warn("Failed to share upstream key", "key", key.ID, "node", peer, "error", err)
+			}
+		}(peer)
+	}
+}
+
+// fetchKey looks up an upstream key on every peer, for keys minted on
+// another node that haven't reached this one yet. A revocation wins over
+// peers that haven't seen it.
+func (n *Node) fetchKey(id string) (keys.Key, bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), n.client.Timeout)
+	defer cancel()
+
+	var (
+		mu    sync.Mutex
+		wg    sync.WaitGroup
+		found keys.Key
+		ok    bool
+	)
+	for _, peer := range n.Peers() {
+		wg.Add(1)
+		go func(peer string) {
+			defer wg.Done()
+
+			var key keys.Key
+			if err := n.request(ctx, peer, http.MethodGet, "/keys/"+url.PathEscape(id), nil, &key); err != nil {
+				return
+			}
+			mu.Lock()
+			if !ok || key.Revoked() {
+				found, ok = key, true
+			}
+			mu.Unlock()
+		}(peer)
+	}
+	wg.Wait()
+	return found, ok
+}
+
+// sync pulls the session registry and upstream keys of every peer and drops
+// nodes that left
+func (n *Node) sync(ctx context.Context) {
+	peers := n.Peers()
+	remote := make(map[string][]session.Info, len(peers))
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, peer := range peers {
+		wg.Add(1)
+		go func(peer string) {
+			defer wg.Done()
+
+			var infos []session.Info
+			if err := n.request(ctx, peer, http.MethodGet, "/sessions", nil, &infos); err != nil {
+				slog.Warn("Failed to sync sessions", "node", peer, "error", err)
+				n.mu.RLock()
+				infos = n.remote[peer]
+				n.mu.RUnlock()
+			}
+
+			var peerKeys []keys.Key
+			if err := n.request(ctx, peer, http.MethodGet, "/keys", nil, &peerKeys); err != nil {
+				slog.Warn("Failed to sync upstream keys", "node", peer, "error", err)
+			} else {
+				n.keys.Merge(peerKeys)
+			}
+
+			mu.Lock()
+			remote[peer] = infos
+			mu.Unlock()
+		}(peer)
+	}
+	wg.Wait()
+
+	n.mu.Lock()
+	n.remote = remote
+	n.mu.Unlock()
+}
+
+// Sessions returns the sessions of every node ordered by ID. The peers'
+// sessions are those pulled by the last sync, at most SyncInterval old. A
+// session connected to several nodes is listed once, preferring this node.
+func (n *Node) Sessions() []session.Info {
+	seen := make(map[string]bool)
+	var result []session.Info
+	for _, info := range n.localSessions() {
+		seen[info.ID] = true
+		result = append(result, info)
+	}
+
+	n.mu.RLock()
+	for _, infos := range n.remote {
+		for _, info := range infos {
+			if !seen[info.ID] {
+				seen[info.ID] = true
+				result = append(result, info)
+			}
+		}
+	}
+	n.mu.RUnlock()
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].ID < result[j].ID
+	})
+	return result
+}
+
+// Session returns a session from this node or the node owning it
+func (n *Node) Session(ctx context.Context, id string) (session.Info, bool) {
+	if info, exists := n.localSession(id); exists {
+		return info, true
+	}
+
+	owner, ok := n.owner(id)
+	if !ok {
+		return session.Info{}, false
+	}
+	var info session.Info
+	if err := n.request(ctx, owner, http.MethodGet, "/sessions/"+url.PathEscape(id), nil, &info); err != nil {
+		return session.Info{}, false
+	}
+	return info, true
+}
+
+// Upstreams returns the clients listening on an endpoint across the
+// cluster. Listeners that can't be identified, such as agents connected to
+// the piko upstream port directly or to an unreachable node, are returned
+// as an empty Upstream.
+func (n *Node) Upstreams(ctx context.Context, endpointID string) []session.Upstream {
+	return append(n.localUpstreams(endpointID), n.RemoteUpstreams(ctx, endpointID)...)
+}
+
+// RemoteUpstreams returns the clients listening on an endpoint through the
+// other cluster nodes, like Upstreams
+func (n *Node) RemoteUpstreams(ctx context.Context, endpointID string) []session.Upstream {
+	var result []session.Upstream
+	for _, node := range n.state.Nodes() {
+		if node.ID == n.ID() || node.Status != pikocluster.NodeStatusActive || node.Endpoints[endpointID] <= 0 {
+			continue
+		}
+
+		var upstreams []session.Upstream
+		if err := n.request(ctx, node.ID, http.MethodGet, "/upstreams/"+url.PathEscape(endpointID), nil, &upstreams); err != nil {
+			slog.Warn("Failed to look up upstreams", "endpoint", endpointID, "node", node.ID, "error", err)
+			upstreams = make([]session.Upstream, node.Endpoints[endpointID])
+		}
+		result = append(result, upstreams...)
+	}
+	return result
+}
+
+// RemoteOwnedSessions returns the connected sessions whose client connected
+// with a key of owner in the last synced registries of the peers. The
+// session manager counts those of this node.
+func (n *Node) RemoteOwnedSessions(owner string) []string {
+	var result []string
+	seen := make(map[string]bool)
+
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	for _, infos := range n.remote {
+		for _, info := range infos {
+			if info.Connected && info.Owner == owner && !seen[info.ID] {
+				seen[info.ID] = true
+				result = append(result, info.ID)
+			}
+		}
+	}
+
+	sort.Strings(result)
+	return result
+}
+
+// Tags returns the tags of a session from this node, or the last synced
+// registry of the node owning it
+func (n *Node) Tags(id string) []string {
+	if _, exists := n.sessions.Info(id); exists {
+		return n.sessions.Tags(id)
+	}
+
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	for _, infos := range n.remote {
+		for _, info := range infos {
+			if info.ID == id {
+				return append([]string(nil), info.Tags...)
+			}
+		}
+	}
+	return nil
+}
+
+// SetTags replaces the tags of a session on the node owning it
+func (n *Node) SetTags(ctx context.Context, id string, tags []string) (session.Info, error) {
+	if n.sessions.SetTags(id, tags) {
+		info, _ := n.localSession(id)
+		return info, nil
+	}
+
+	owner, ok := n.owner(id)
+	if !ok {
+		return session.Info{}, ErrSessionNotFound
+	}
+	var info session.Info
+	if err := n.request(ctx, owner, http.MethodPut, "/sessions/"+url.PathEscape(id)+"/tags", tags, &info); err != nil {
+		return session.Info{}, err
+	}
+	n.sync(ctx)
+	return info, nil
+}
+
+// DisconnectResult is the outcome of disconnecting a session
+type DisconnectResult struct {
+	Session     session.Info `json:"session"`
+	Connections int          `json:"connections"`
+}
+
+// Disconnect closes the upstream connections of a session on the node
+// owning it
+func (n *Node) Disconnect(ctx context.Context, id string) (DisconnectResult, error) {
+	if info, exists := n.localSession(id); exists {
+		return DisconnectResult{Session: info, Connections: n.sessions.Disconnect(id)}, nil
+	}
+
+	owner, ok := n.owner(id)
+	if !ok {
+		return DisconnectResult{}, ErrSessionNotFound
+	}
+	var result DisconnectResult
+	if err := n.request(ctx, owner, http.MethodDelete, "/sessions/"+url.PathEscape(id), nil, &result); err != nil {
+		return DisconnectResult{}, err
+	}
+	return result, nil
+}
+
+// owner returns the peer a session is connected to, falling back to the
+// synced registries for sessions in their disconnect grace period
+func (n *Node) owner(id string) (string, bool) {
+	if node, ok := n.state.LookupEndpoint(id); ok && node.ID != n.ID() {
+		return node.ID, true
+	}
+
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	for peer, infos := range n.remote {
+		for _, info := range infos {
+			if info.ID == id {
+				return peer, true
+			}
+		}
+	}
+	return "", false
+}
+
+func (n *Node) localUpstreams(endpointID string) []session.Upstream {
+	result := n.sessions.Upstreams(endpointID)
+	for i := len(result); i < n.state.LocalEndpointListeners(endpointID); i++ {
+		result = append(result, session.Upstream{})
+	}
+	return result
+}
+
+func (n *Node) localSessions() []session.Info {
+	infos := n.sessions.List()
+	for i := range infos {
+		infos[i].Node = n.ID()
+	}
+	return infos
+}
+
+func (n *Node) localSession(id string) (session.Info, bool) {
+	info, exists := n.sessions.Info(id)
+	info.Node = n.ID()
+	return info, exists
+}
+
+// request sends a signed request to a peer's node endpoint through the local
+// piko proxy and decodes the JSON response into out
+func (n *Node) request(ctx context.Context, peer, method, path string, in, out interface{}) error {
+	var body []byte
+	if in != nil {
+		var err error
+		if body, err = json.Marshal(in); err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, n.config.ProxyURL+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Piko-Endpoint", EndpointPrefix+peer)
+	token, err := proxy.RequestToken(n.config.PikoKey, EndpointPrefix+peer)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Piko-Authorization", "Bearer "+token)
+	if id := logging.RequestID(ctx); id != "" {
+		req.Header.Set(logging.RequestIDHeader, id)
+	}
+	n.sign(req, body)
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return ErrSessionNotFound
+	}
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("node %s: %s: %s", peer, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"clauded-server/config"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// inTempDir runs the test in a temp working directory
+func inTempDir(t *testing.T) string {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+	return dir
+}
+
+// openPath is an open function returning the path it was given
+func openPath(path string) (string, error) {
+	return path, nil
+}
+
+func TestOpenBolt(t *testing.T) {
+	inTempDir(t)
+	tests := []struct {
+		name string
+		cfg  config.Config
+		path string
+		want string
+	}{
+		{name: "node data dir", cfg: config.Config{NodeID: "node-a"}, want: filepath.Join("data", "node-a", "keys.db")},
+		{name: "other node", cfg: config.Config{NodeID: "node-b"}, want: filepath.Join("data", "node-b", "keys.db")},
+		{name: "data dir", cfg: config.Config{NodeID: "node-a", DataDir: "state"}, want: filepath.Join("state", "keys.db")},
+		{name: "path", cfg: config.Config{NodeID: "node-a"}, path: "custom.db", want: "custom.db"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := openBolt(&tt.cfg, tt.path, "keys.db", openPath)
+			if err != nil || got != tt.want {
+				t.Fatalf("openBolt() = %q, %v, want %q", got, err, tt.want)
+			}
+			if info, err := os.Stat(filepath.Dir(got)); err != nil || !info.IsDir() {
+				t.Fatalf("directory of %s not created: %v", got, err)
+			}
+		})
+	}
+}
+
+func TestOpenBoltNodeID(t *testing.T) {
+	inTempDir(t)
+	for _, id := range []string{"", ".", "..", "../node", `a\b`} {
+		if _, err := openBolt(&config.Config{NodeID: id}, "", "keys.db", openPath); err == nil || !strings.Contains(err.Error(), "set DATA_DIR") {
+			t.Errorf("openBolt() with node ID %q error = %v, want DATA_DIR asked for", id, err)
+		}
+	}
+	if _, err := openBolt(&config.Config{NodeID: "../node", DataDir: "state"}, "", "keys.db", openPath); err != nil {
+		t.Fatalf("openBolt() with DATA_DIR error = %v", err)
+	}
+}
+
+func TestOpenBoltLegacy(t *testing.T) {
+	inTempDir(t)
+	if err := os.WriteFile("keys.db", nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	cfg := &config.Config{NodeID: "node-a"}
+
+	// A database in the working directory is kept until moved
+	if got, err := openBolt(cfg, "", "keys.db", openPath); err != nil || got != "keys.db" {
+		t.Fatalf("openBolt() = %q, %v, want the database in the working directory", got, err)
+	}
+	moved := filepath.Join("data", "node-a", "keys.db")
+	if err := os.Rename("keys.db", moved); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := openBolt(cfg, "", "keys.db", openPath); err != nil || got != moved {
+		t.Fatalf("openBolt() = %q, %v, want %q", got, err, moved)
+	}
+
+	// The data dir wins once both exist
+	if err := os.WriteFile("keys.db", nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := openBolt(cfg, "", "keys.db", openPath); err != nil || got != moved {
+		t.Fatalf("openBolt() = %q, %v, want %q", got, err, moved)
+	}
+}
+
+func TestOpenBoltLocked(t *testing.T) {
+	inTempDir(t)
+	locked := func(path string) (string, error) {
+		return "", fmt.Errorf("open key store %s: %w", path, bolt.ErrTimeout)
+	}
+	_, err := openBolt(&config.Config{NodeID: "node-a"}, "", "keys.db", locked)
+	if !errors.Is(err, bolt.ErrTimeout) || !strings.Contains(err.Error(), "own NODE_ID or DATA_DIR") {
+		t.Fatalf("openBolt() error = %v, want the lock explained", err)
+	}
+}
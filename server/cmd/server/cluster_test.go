@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/andydunstall/piko/client"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// serverEnv makes the test binary run the server instead of the tests, so
+// the cluster tests can start several nodes as separate processes
+const serverEnv = "CLAUDED_TEST_SERVER"
+
+const (
+	testUpstreamKey = "upstream-key"
+	testAdminToken  = "admin-token"
+)
+
+func TestMain(m *testing.M) {
+	if os.Getenv(serverEnv) == "1" {
+		main()
+		return
+	}
+	os.Exit(m.Run())
+}
+
+// testNode is a server process listening on localhost
+type testNode struct {
+	cmd    *exec.Cmd
+	url    string
+	gossip int
+	done   chan struct{}
+
+	mu     sync.Mutex
+	output bytes.Buffer
+}
+
+func (n *testNode) Write(p []byte) (int, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.output.Write(p)
+}
+
+func (n *testNode) logs() string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.output.String()
+}
+
+// stop shuts the node down and waits for it to exit
+func (n *testNode) stop() {
+	n.cmd.Process.Signal(syscall.SIGTERM)
+	select {
+	case <-n.done:
+	case <-time.After(10 * time.Second):
+		n.cmd.Process.Kill()
+		<-n.done
+	}
+}
+
+func freePort(t *testing.T) int {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+// nodeCommand returns the command starting a server with env on free ports
+func nodeCommand(t *testing.T, env ...string) (*exec.Cmd, *testNode) {
+	t.Helper()
+	listen := freePort(t)
+	node := &testNode{
+		url:    fmt.Sprintf("http://127.0.0.1:%d", listen),
+		gossip: freePort(t),
+		done:   make(chan struct{}),
+	}
+	cmd := exec.Command(os.Args[0])
+	cmd.Dir = t.TempDir()
+	cmd.Env = append(os.Environ(),
+		serverEnv+"=1",
+		"LISTEN_PORT="+strconv.Itoa(listen),
+		"PIKO_UPSTREAM_PORT="+strconv.Itoa(freePort(t)),
+		"PIKO_PROXY_PORT="+strconv.Itoa(freePort(t)),
+		"PIKO_ADMIN_PORT="+strconv.Itoa(freePort(t)),
+		"CLUSTER_GOSSIP_PORT="+strconv.Itoa(node.gossip),
+		"CLUSTER_ADVERTISE_HOST=127.0.0.1",
+		"CLUSTER_SYNC_INTERVAL=200ms",
+		"SUBSCRIPTION_STORE=memory",
+		"KEY_STORE=memory",
+		"REGISTRATION_STORE=memory",
+		"LOG_FORMAT=text",
+	)
+	cmd.Env = append(cmd.Env, env...)
+	cmd.Stdout = node
+	cmd.Stderr = node
+	node.cmd = cmd
+	return cmd, node
+}
+
+// startNode starts a cluster node and waits until it serves requests
+func startNode(t *testing.T, env ...string) *testNode {
+	t.Helper()
+	cmd, node := nodeCommand(t, env...)
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		cmd.Wait()
+		close(node.done)
+	}()
+	t.Cleanup(func() {
+		node.stop()
+		if t.Failed() {
+			t.Logf("%s logs:\n%s", node.url, node.logs())
+		}
+	})
+
+	waitFor(t, "node to start", func() bool {
+		resp, err := http.Get(node.url + "/ready")
+		if err != nil {
+			return false
+		}
+		resp.Body.Close()
+		return resp.StatusCode == http.StatusOK
+	})
+	return node
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(20 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// sessionNodes lists the sessions of the cluster as seen by a node, by ID
+// with the node they are connected to
+func sessionNodes(t *testing.T, node *testNode) map[string]string {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, node.url+"/api/v1/sessions", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil
+	}
+	defer resp.Body.Close()
+
+	var list struct {
+		Sessions []struct {
+			ID        string `json:"id"`
+			Node      string `json:"node"`
+			Connected bool   `json:"connected"`
+		} `json:"sessions"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		t.Fatalf("decode sessions: %v", err)
+	}
+	nodes := make(map[string]string)
+	for _, info := range list.Sessions {
+		if info.Connected {
+			nodes[info.ID] = info.Node
+		}
+	}
+	return nodes
+}
+
+// listen connects an upstream for endpointID to a node, answering every
+// request with body
+func listen(t *testing.T, node *testNode, endpointID, body string) {
+	t.Helper()
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"piko": map[string]interface{}{"endpoints": []string{endpointID}},
+		"exp":  time.Now().Add(time.Hour).Unix(),
+	}).SignedString([]byte(testUpstreamKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodeURL, err := url.Parse(node.url)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	upstream := &client.Upstream{URL: nodeURL, Token: token}
+	ln, err := upstream.Listen(ctx, endpointID)
+	if err != nil {
+		t.Fatalf("listen on %s: %v", endpointID, err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go http.Serve(ln, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, body)
+	}))
+}
+
+func TestClusterNeedsSecret(t *testing.T) {
+	cmd, node := nodeCommand(t, "UPSTREAM_KEY=", "CLUSTER_SECRET=")
+	done := make(chan error, 1)
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	go func() { done <- cmd.Wait() }()
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("node without a cluster secret exited successfully")
+		}
+		if !strings.Contains(node.logs(), "Clustering needs CLUSTER_SECRET") {
+			t.Fatalf("unexpected output:\n%s", node.logs())
+		}
+	case <-time.After(10 * time.Second):
+		cmd.Process.Kill()
+		t.Fatal("node started clustering without a secret")
+	}
+}
+
+func TestClusterSessions(t *testing.T) {
+	env := []string{
+		"UPSTREAM_KEY=" + testUpstreamKey,
+		"ADMIN_TOKEN=" + testAdminToken,
+	}
+	a := startNode(t, append(env, "NODE_ID=node-a")...)
+	b := startNode(t, append(env, "NODE_ID=node-b", fmt.Sprintf("CLUSTER_JOIN=127.0.0.1:%d", a.gossip))...)
+
+	listen(t, a, "demo", "served by node-a")
+
+	// Node b lists the session from its last sync
+	var owner string
+	waitFor(t, "node-b to list the session of node-a", func() bool {
+		owner = sessionNodes(t, b)["demo"]
+		return owner != ""
+	})
+	if local := sessionNodes(t, a)["demo"]; local != owner {
+		t.Fatalf("node-b lists demo on %q, node-a on %q", owner, local)
+	}
+
+	// Requests to node b are routed to the upstream on node a
+	waitFor(t, "node-b to proxy to node-a", func() bool {
+		resp, err := http.Get(b.url + "/demo/")
+		if err != nil {
+			return false
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode == http.StatusOK && string(body) == "served by node-a"
+	})
+
+	// Once node a is gone, node b drops its sessions
+	a.stop()
+	waitFor(t, "node-b to drop the sessions of node-a", func() bool {
+		nodes := sessionNodes(t, b)
+		_, listed := nodes["demo"]
+		return nodes != nil && !listed
+	})
+}
+
+func TestClusterRejectsOtherSecret(t *testing.T) {
+	a := startNode(t, "UPSTREAM_KEY="+testUpstreamKey, "ADMIN_TOKEN="+testAdminToken, "NODE_ID=node-a")
+	b := startNode(t,
+		"UPSTREAM_KEY="+testUpstreamKey,
+		"CLUSTER_SECRET=other-secret",
+		"ADMIN_TOKEN="+testAdminToken,
+		"NODE_ID=node-b",
+		fmt.Sprintf("CLUSTER_JOIN=127.0.0.1:%d", a.gossip),
+	)
+
+	listen(t, b, "demo", "served by node-b")
+	waitFor(t, "node-b to sync", func() bool {
+		return strings.Contains(a.logs(), "Failed to sync sessions")
+	})
+	if _, listed := sessionNodes(t, a)["demo"]; listed {
+		t.Fatal("node-a accepted the sessions of a node with another cluster secret")
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"clauded-server/config"
+	"clauded-server/keys"
+
+	"github.com/spf13/pflag"
+)
+
+const keysUsage = `Usage:
+  clauded-server keys create --user USER [--prefix PREFIX] [--ttl DURATION]
+  clauded-server keys list
+  clauded-server keys revoke ID
+
+Mints, lists and revokes upstream user keys through the admin API of a
+running server.
+
+Flags:
+`
+
+// runKeys runs the keys subcommand against the admin API
+func runKeys(args []string) {
+	flags := pflag.NewFlagSet("keys", pflag.ExitOnError)
+	configFile := flags.String("config", os.Getenv("CONFIG_FILE"), "YAML or TOML config file")
+	server := flags.String("server", "", "Server URL (default http://127.0.0.1:{LISTEN_PORT})")
+	adminToken := flags.String("admin-token", "", "Bearer token for the admin API (default ADMIN_TOKEN)")
+	user := flags.String("user", "", "User the key is minted for")
+	prefix := flags.String("prefix", "", "Session prefix the key permits (default {user}-)")
+	ttl := flags.Duration("ttl", 0, "How long the key is valid, forever when 0")
+	flags.Usage = func() {
+		fmt.Fprint(os.Stderr, keysUsage)
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	cfg, err := config.Load()
+	if *configFile != "" {
+		cfg, err = config.LoadFile(*configFile)
+	}
+	if err != nil {
+		fatal("Failed to load config", "error", err)
+	}
+	if *server == "" {
+		*server = fmt.Sprintf("http://127.0.0.1:%d", cfg.ListenPort)
+	}
+	if *adminToken == "" {
+		*adminToken = cfg.AdminToken
+	}
+	api := keysAPI{server: strings.TrimSuffix(*server, "/"), token: *adminToken}
+
+	switch flags.Arg(0) {
+	case "create":
+		if *user == "" {
+			fatal("--user is required")
+		}
+		req := map[string]string{"user": *user, "prefix": *prefix}
+		if *ttl > 0 {
+			req["ttl"] = ttl.String()
+		}
+		var resp struct {
+			Key   keys.Key `json:"key"`
+			Token string   `json:"token"`
+		}
+		if err := api.do(http.MethodPost, "", req, &resp); err != nil {
+			fatal("Failed to create key", "error", err)
+		}
+		fmt.Printf("Key %s for %s, sessions %s*\n", resp.Key.ID, resp.Key.User, resp.Key.Prefix)
+		if resp.Key.ExpiresAt != nil {
+			fmt.Printf("Expires %s\n", resp.Key.ExpiresAt.Format(time.RFC3339))
+		}
+		fmt.Printf("\n%s\n\nPass it to gottyp with --upstream-key.\n", resp.Token)
+	case "list":
+		var resp struct {
+			Keys []keys.Key `json:"keys"`
+		}
+		if err := api.do(http.MethodGet, "", nil, &resp); err != nil {
+			fatal("Failed to list keys", "error", err)
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tUSER\tPREFIX\tCREATED\tEXPIRES\tREVOKED")
+		for _, key := range resp.Keys {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", key.ID, key.User, key.Prefix,
+				key.CreatedAt.Format(time.RFC3339), formatTime(key.ExpiresAt), formatTime(key.RevokedAt))
+		}
+		w.Flush()
+	case "revoke":
+		if flags.NArg() != 2 {
+			flags.Usage()
+			os.Exit(2)
+		}
+		var key keys.Key
+		if err := api.do(http.MethodDelete, "/"+url.PathEscape(flags.Arg(1)), nil, &key); err != nil {
+			fatal("Failed to revoke key", "error", err)
+		}
+		fmt.Printf("Key %s of %s revoked\n", key.ID, key.User)
+	default:
+		flags.Usage()
+		os.Exit(2)
+	}
+}
+
+// keysAPI calls the upstream key admin API
+type keysAPI struct {
+	server string
+	token  string
+}
+
+func (a keysAPI) do(method, path string, in, out any) error {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, a.server+"/api/v1/keys"+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if a.token != "" {
+		req.Header.Set("Authorization", "Bearer "+a.token)
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func formatTime(t *time.Time) string {
+	if t == nil {
+		return "-"
+	}
+	return t.Format(time.RFC3339)
+}
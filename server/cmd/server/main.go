@@ -2,50 +2,199 @@ package main
 
 import (
 	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
 	"fmt"
-	stdlog "log"
+	"log/slog"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
+	"clauded-server/access"
+	"clauded-server/certs"
+	"clauded-server/cluster"
 	"clauded-server/config"
 	"clauded-server/handlers"
+	"clauded-server/keys"
+	"clauded-server/logging"
+	"clauded-server/metrics"
 	"clauded-server/notification"
 	"clauded-server/proxy"
 	"clauded-server/session"
 
 	pikoserver "github.com/andydunstall/piko/server"
 	pikoconfig "github.com/andydunstall/piko/server/config"
-	pikolog "github.com/andydunstall/piko/pkg/log"
+	"github.com/gin-gonic/gin"
 	"github.com/oklog/run"
 	"github.com/spf13/pflag"
+	bolt "go.etcd.io/bbolt"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "keys" {
+		runKeys(os.Args[2:])
+		return
+	}
+
 	var upstreamKey string
+	var adminToken string
+	var configFile string
+	var nodeID string
+	var logLevel string
+	var listenPort, upstreamPort, proxyPort, adminPort, gossipPort int
+	var clusterJoin []string
 
+	pflag.StringVar(&configFile, "config", os.Getenv("CONFIG_FILE"), "YAML or TOML config file")
 	pflag.StringVar(&upstreamKey, "upstream-key", "", "HMAC secret key for upstream authentication")
+	pflag.StringVar(&adminToken, "admin-token", "", "Bearer token for the admin API")
+	pflag.StringVar(&logLevel, "log-level", "", "Log level (debug, info, warn, error)")
+	pflag.StringVar(&nodeID, "node-id", "", "Piko node ID of this server")
+	pflag.IntVar(&listenPort, "listen-port", 0, "HTTP service port")
+	pflag.IntVar(&upstreamPort, "piko-upstream-port", 0, "Piko upstream port")
+	pflag.IntVar(&proxyPort, "piko-proxy-port", 0, "Piko proxy port")
+	pflag.IntVar(&adminPort, "piko-admin-port", 0, "Piko admin port")
+	pflag.IntVar(&gossipPort, "cluster-gossip-port", 0, "Piko gossip port other cluster nodes join")
+	pflag.StringSliceVar(&clusterJoin, "cluster-join", nil, "Gossip addresses (host:port) of cluster nodes to join")
 	pflag.Parse()
 
 	// Load configuration
-	cfg := config.Load()
+	cfg, err := config.Load()
+	if configFile != "" {
+		cfg, err = config.LoadFile(configFile)
+	}
+	if err != nil {
+		fatal("Failed to load config", "error", err)
+	}
 
 	// Override with command line flag if provided
 	if upstreamKey != "" {
 		cfg.PikoUpstreamAuthHMACSecretKey = upstreamKey
 	}
+	if adminToken != "" {
+		cfg.AdminToken = adminToken
+	}
+	if nodeID != "" {
+		cfg.NodeID = nodeID
+	}
+	if listenPort != 0 {
+		cfg.ListenPort = listenPort
+	}
+	if upstreamPort != 0 {
+		cfg.PikoUpstreamPort = upstreamPort
+	}
+	if proxyPort != 0 {
+		cfg.PikoProxyPort = proxyPort
+	}
+	if adminPort != 0 {
+		cfg.PikoAdminPort = adminPort
+	}
+	if gossipPort != 0 {
+		cfg.ClusterGossipPort = gossipPort
+	}
+	if len(clusterJoin) > 0 {
+		cfg.ClusterJoin = clusterJoin
+	}
+	if logLevel != "" {
+		cfg.LogLevel = logLevel
+	}
+
+	// Structured logging, also used by the standard library logger
+	logger, err := logging.New(os.Stderr, cfg.LogLevel, cfg.LogFormat)
+	if err != nil {
+		fatal("Failed to set up logging", "error", err)
+	}
+	slog.SetDefault(logger)
+	if cfg.LogLevel != "debug" {
+		gin.SetMode(gin.ReleaseMode)
+	}
 
 	// Create managers
 	sessionMgr := session.NewManager()
-	notificationSvc := notification.NewService()
+	notificationStore, err := newNotificationStore(cfg)
+	if err != nil {
+		fatal("Failed to open notification store", "error", err)
+	}
+	subscriptionStore, err := newSubscriptionStore(cfg)
+	if err != nil {
+		fatal("Failed to open subscription store", "error", err)
+	}
+	webhookConfig := notification.DefaultWebhookConfig()
+	webhookConfig.Workers = cfg.WebhookWorkers
+	webhookConfig.Timeout = cfg.WebhookTimeout
+	webhookConfig.MaxAttempts = cfg.WebhookMaxAttempts
+	webhookConfig.InitialBackoff = cfg.WebhookInitialBackoff
+	webhookConfig.PublicURL = cfg.PublicURL
+	notificationSvc := notification.NewService(notificationStore, subscriptionStore, webhookConfig)
 
-	// Create proxy manager (piko proxy port is 8023)
-	proxyMgr := proxy.NewManager(8023, cfg.PikoUpstreamPort)
+	// Session access control
+	registrationStore, err := newRegistrationStore(cfg)
+	if err != nil {
+		fatal("Failed to open registration store", "error", err)
+	}
+	defer registrationStore.Close()
+	sessionAuth, err := newSessionAuth(cfg, registrationStore)
+	if err != nil {
+		fatal("Failed to set up session access control", "error", err)
+	}
+
+	if cfg.SessionCollision != handlers.CollisionReject && cfg.SessionCollision != handlers.CollisionFlag {
+		fatal("Unknown session collision policy", "policy", cfg.SessionCollision)
+	}
+	if cfg.SessionDomain != "" {
+		if u, err := url.Parse(cfg.PublicURL); err != nil || u.Scheme == "" || u.Host == "" {
+			fatal("SESSION_DOMAIN needs PUBLIC_URL, the URL of the main host", "public_url", cfg.PublicURL)
+		}
+	}
+	if (cfg.ClusterGossipPort != 0 || len(cfg.ClusterJoin) > 0) && clusterSecret(cfg) == "" {
+		fatal("Clustering needs CLUSTER_SECRET or UPSTREAM_KEY to authenticate nodes")
+	}
+
+	// Upstream user keys
+	keyStore, err := newKeyStore(cfg)
+	if err != nil {
+		fatal("Failed to open key store", "error", err)
+	}
+	defer keyStore.Close()
+	keyMgr, err := keys.NewManager(cfg.PikoUpstreamAuthHMACSecretKey, keyStore)
+	if err != nil {
+		fatal("Failed to load upstream keys", "error", err)
+	}
+
+	// Create piko server as a Go library
+	pikoKey := newPikoKey(cfg)
+	pikoSrv := startPikoServer(cfg, pikoKey, logger)
+
+	// Cluster node, merging the session registries and fanning notifications
+	// out when other nodes join
+	clusterNode := cluster.NewNode(cluster.Config{
+		ProxyURL:     "http://" + net.JoinHostPort(pikoProxyDialHost(cfg), strconv.Itoa(cfg.PikoProxyPort)),
+		UpstreamURL:  fmt.Sprintf("http://127.0.0.1:%d", cfg.PikoUpstreamPort),
+		PikoKey:      pikoKey,
+		Secret:       clusterSecret(cfg),
+		SyncInterval: cfg.ClusterSyncInterval,
+	}, pikoSrv.ClusterState(), sessionMgr, notificationSvc, sessionAuth, keyMgr)
+	notificationSvc.SetSessionTags(clusterNode.Tags)
+
+	// Create proxy manager
+	proxyMgr := proxy.NewManager(pikoProxyDialHost(cfg), cfg.PikoProxyPort, cfg.PikoUpstreamPort, cfg.PikoAdminPort, pikoKey)
+	if err := proxyMgr.SetTrustedProxies(cfg.TrustedProxies); err != nil {
+		fatal("Invalid TRUSTED_PROXIES", "error", err)
+	}
 
 	// Create HTTP handler
-	handler := handlers.NewHandler(cfg, sessionMgr, notificationSvc, proxyMgr)
+	serverMetrics := metrics.New(sessionMgr, notificationSvc, cfg.MetricsSessionLabels)
+	handler := handlers.NewHandler(cfg, sessionMgr, notificationSvc, proxyMgr, clusterNode, serverMetrics, sessionAuth, keyMgr)
 
 	// Create HTTP server
 	httpServer := &http.Server{
@@ -58,33 +207,86 @@ func main() {
 	// Create context for signal handling
 	ctx, cancel := context.WithCancel(context.Background())
 
-	// Start Piko server as a Go library
-	pikoSrv := startPikoServer(cfg)
+	// HTTPS with certificate files or ACME
+	var redirectHandler http.Handler
+	if cfg.EnableTLS {
+		redirectHandler = certs.RedirectHandler(cfg.ListenPort)
+		if len(cfg.ACMEDomains) > 0 {
+			acmeMgr, err := certs.NewACMEManager(certs.ACMEConfig{
+				Domains:      cfg.ACMEDomains,
+				Email:        cfg.ACMEEmail,
+				CacheDir:     cfg.ACMECacheDir,
+				DirectoryURL: cfg.ACMEDirectoryURL,
+				CAFile:       cfg.ACMECAFile,
+			})
+			if err != nil {
+				fatal("Failed to set up ACME", "error", err)
+			}
+			httpServer.TLSConfig = acmeMgr.TLSConfig()
+			redirectHandler = acmeMgr.HTTPHandler(redirectHandler)
+			slog.Info("Using ACME certificates", "domains", cfg.ACMEDomains)
+		} else {
+			if cfg.TLSCertFile == "" || cfg.TLSKeyFile == "" {
+				fatal("ENABLE_TLS needs TLS_CERT_FILE and TLS_KEY_FILE, or ACME_DOMAINS")
+			}
+			reloader, err := certs.NewReloader(cfg.TLSCertFile, cfg.TLSKeyFile)
+			if err != nil {
+				fatal("Failed to load TLS certificate", "error", err)
+			}
+			httpServer.TLSConfig = &tls.Config{GetCertificate: reloader.GetCertificate}
+
+			g.Add(func() error {
+				reloader.Watch(ctx, cfg.TLSReloadInterval)
+				return nil
+			}, func(error) {
+				cancel()
+			})
+		}
+	}
 
 	g.Add(func() error {
-		stdlog.Printf("Starting piko server on upstream port %d, proxy port 8023\n", cfg.PikoUpstreamPort)
+		slog.Info("Starting piko server", "node", cfg.NodeID, "upstream_port", cfg.PikoUpstreamPort,
+			"proxy_port", cfg.PikoProxyPort, "admin_port", cfg.PikoAdminPort)
 		if err := pikoSrv.Start(); err != nil {
-			stdlog.Printf("❌ Piko server error: %v\n", err)
 			return fmt.Errorf("piko server failed: %w", err)
 		}
-		stdlog.Println("✅ Piko server started successfully")
-		
+		slog.Info("Piko server started")
+
 		// Wait for context cancellation
 		<-ctx.Done()
 		return nil
 	}, func(error) {
-		stdlog.Println("Stopping piko server...")
+		slog.Info("Stopping piko server")
 		pikoSrv.Shutdown()
-		stdlog.Println("Piko server stopped")
+		slog.Info("Piko server stopped")
 	})
 
-	// Wait for piko to start
-	time.Sleep(2 * time.Second)
+	// Track upstream connections in the session manager
+	clusterState := pikoSrv.ClusterState()
+	clusterState.OnLocalEndpointUpdate(func(endpointID string) {
+		if cluster.IsInternalEndpoint(endpointID) {
+			return
+		}
+		sessionMgr.SyncEndpoint(endpointID, clusterState.LocalEndpointListeners(endpointID))
+	})
 
-	// HTTP server
+	// HTTP server, started once piko is ready
 	g.Add(func() error {
-		stdlog.Printf("Starting HTTP server on port %d\n", cfg.ListenPort)
-		if err := httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		readyCtx, readyCancel := context.WithTimeout(ctx, cfg.StartupTimeout)
+		err := proxyMgr.WaitReady(readyCtx)
+		readyCancel()
+		if err != nil {
+			return fmt.Errorf("piko server not ready: %w", err)
+		}
+
+		if httpServer.TLSConfig != nil {
+			slog.Info("Starting HTTPS server", "port", cfg.ListenPort)
+			err = httpServer.ListenAndServeTLS("", "")
+		} else {
+			slog.Info("Starting HTTP server", "port", cfg.ListenPort)
+			err = httpServer.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
 			return fmt.Errorf("HTTP server failed: %w", err)
 		}
 		return nil
@@ -94,6 +296,38 @@ func main() {
 		httpServer.Shutdown(shutdownCtx)
 	})
 
+	// HTTP to HTTPS redirect
+	if redirectHandler != nil && cfg.TLSRedirectPort > 0 {
+		redirectServer := &http.Server{
+			Addr:    fmt.Sprintf(":%d", cfg.TLSRedirectPort),
+			Handler: redirectHandler,
+		}
+		g.Add(func() error {
+			slog.Info("Redirecting HTTP to HTTPS", "port", cfg.TLSRedirectPort)
+			if err := redirectServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				return fmt.Errorf("HTTP redirect server failed: %w", err)
+			}
+			return nil
+		}, func(error) {
+			redirectServer.Close()
+		})
+	}
+
+	// Cluster node endpoint, once piko is ready
+	if cfg.ClusterGossipPort != 0 || len(cfg.ClusterJoin) > 0 {
+		g.Add(func() error {
+			readyCtx, readyCancel := context.WithTimeout(ctx, cfg.StartupTimeout)
+			err := proxyMgr.WaitReady(readyCtx)
+			readyCancel()
+			if err != nil {
+				return fmt.Errorf("piko server not ready: %w", err)
+			}
+			return clusterNode.Run(ctx)
+		}, func(error) {
+			cancel()
+		})
+	}
+
 	// Notification service
 	g.Add(func() error {
 		notificationSvc.Start()
@@ -103,12 +337,28 @@ func main() {
 		notificationSvc.Stop()
 	})
 
+	// Session cleanup
+	g.Add(func() error {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				sessionMgr.Cleanup(cfg.SessionTimeout)
+			case <-ctx.Done():
+				return nil
+			}
+		}
+	}, func(error) {
+		cancel()
+	})
+
 	// Signal handling
 	g.Add(func() error {
 		c := make(chan os.Signal, 1)
 		signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 		<-c
-		fmt.Println("\nReceived shutdown signal, stopping...")
+		slog.Info("Received shutdown signal, stopping")
 		cancel()
 		return nil
 	}, func(error) {
@@ -117,43 +367,241 @@ func main() {
 
 	// Run all services
 	if err := g.Run(); err != nil {
-		stdlog.Fatalf("Failed to run services: %v", err)
+		fatal("Failed to run services", "error", err)
 	}
 
-	stdlog.Println("Server stopped gracefully")
+	slog.Info("Server stopped gracefully")
+}
+
+// fatal logs an error and exits
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
 }
 
-// startPikoServer starts piko server as a Go library
-func startPikoServer(cfg *config.Config) *pikoserver.Server {
+// startPikoServer starts piko server as a Go library. Its proxy only accepts
+// requests with a token signed with key, and its admin port only listens on
+// loopback.
+func startPikoServer(cfg *config.Config, key []byte, logger *slog.Logger) *pikoserver.Server {
 	// Build piko server configuration
-	upstreamAddr := fmt.Sprintf(":%d", cfg.PikoUpstreamPort)
-	proxyAddr := ":8023"
+	upstreamAddr := fmt.Sprintf("127.0.0.1:%d", cfg.PikoUpstreamPort)
+	proxyAddr := net.JoinHostPort(pikoProxyBindHost(cfg), strconv.Itoa(cfg.PikoProxyPort))
 
-	// Create piko logger (use error level to reduce logs)
-	logger, _ := pikolog.NewLogger("error", nil)
+	// Log piko through the server logger, at its own level to reduce logs
+	pikoLogger, err := logging.NewPikoLogger(logger, cfg.PikoLogLevel)
+	if err != nil {
+		fatal("Invalid piko log level", "error", err)
+	}
 
 	// Get default config and customize it
 	pikoCfg := pikoconfig.Default()
-	pikoCfg.Cluster.NodeID = "clauded-server-1"
+	pikoCfg.Cluster.NodeID = cfg.NodeID
+	pikoCfg.Cluster.Join = cfg.ClusterJoin
 	pikoCfg.Cluster.JoinTimeout = 10 * time.Second
-	pikoCfg.Cluster.AbortIfJoinFails = false  // Don't abort if cluster join fails
-	pikoCfg.Cluster.Gossip.BindAddr = ":0"    // Disable gossip
+	pikoCfg.Cluster.AbortIfJoinFails = false // Keep retrying after boot if no node is up yet
+	pikoCfg.Cluster.Gossip.BindAddr = fmt.Sprintf(":%d", cfg.ClusterGossipPort)
+	if host := cfg.ClusterAdvertiseHost; host != "" {
+		pikoCfg.Cluster.Gossip.AdvertiseAddr = net.JoinHostPort(host, strconv.Itoa(cfg.ClusterGossipPort))
+		pikoCfg.Proxy.AdvertiseAddr = net.JoinHostPort(host, strconv.Itoa(cfg.PikoProxyPort))
+		pikoCfg.Admin.AdvertiseAddr = net.JoinHostPort(host, strconv.Itoa(cfg.PikoAdminPort))
+	}
 	pikoCfg.Upstream.BindAddr = upstreamAddr
-	pikoCfg.Upstream.Auth.HMACSecretKey = cfg.PikoUpstreamAuthHMACSecretKey
+	pikoCfg.Upstream.Auth.HMACSecretKey = string(key)
 	pikoCfg.Proxy.BindAddr = proxyAddr
-	pikoCfg.Admin.BindAddr = ":7070"
+	pikoCfg.Proxy.Auth.HMACSecretKey = string(key)
+	pikoCfg.Admin.BindAddr = fmt.Sprintf("127.0.0.1:%d", cfg.PikoAdminPort)
 	pikoCfg.GracePeriod = 30 * time.Second
 
 	// Validate config
 	if err := pikoCfg.Validate(); err != nil {
-		stdlog.Fatalf("❌ Invalid piko configuration: %v", err)
+		fatal("Invalid piko configuration", "error", err)
 	}
 
 	// Create piko server
-	pikoSrv, err := pikoserver.NewServer(pikoCfg, logger)
+	pikoSrv, err := pikoserver.NewServer(pikoCfg, pikoLogger)
 	if err != nil {
-		stdlog.Fatalf("❌ Failed to create piko server: %v", err)
+		fatal("Failed to create piko server", "error", err)
 	}
 
 	return pikoSrv
 }
+
+// pikoProxyBindHost returns the host the piko proxy listens on: loopback for
+// a single node, and for a cluster the advertised host, or every interface,
+// as the other nodes forward requests to it
+func pikoProxyBindHost(cfg *config.Config) string {
+	if cfg.PikoProxyBindHost != "" {
+		return cfg.PikoProxyBindHost
+	}
+	if cfg.ClusterGossipPort == 0 && len(cfg.ClusterJoin) == 0 {
+		return "127.0.0.1"
+	}
+	return cfg.ClusterAdvertiseHost
+}
+
+// pikoProxyDialHost returns the host this server reaches its piko proxy on
+func pikoProxyDialHost(cfg *config.Config) string {
+	if host := pikoProxyBindHost(cfg); host != "" && host != "0.0.0.0" && host != "::" {
+		return host
+	}
+	return "127.0.0.1"
+}
+
+// newPikoKey returns the key piko verifies tokens with. Only the server signs
+// with it; cluster nodes derive the same key from the cluster secret, and a
+// single node without one uses a random key.
+func newPikoKey(cfg *config.Config) []byte {
+	secret := clusterSecret(cfg)
+	if secret == "" {
+		key := make([]byte, 32)
+		rand.Read(key)
+		return key
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("gottyp-piko"))
+	return mac.Sum(nil)
+}
+
+// clusterSecret returns the secret signing requests between cluster nodes,
+// empty when neither CLUSTER_SECRET nor UPSTREAM_KEY is set
+func clusterSecret(cfg *config.Config) string {
+	if cfg.ClusterSecret != "" || cfg.PikoUpstreamAuthHMACSecretKey == "" {
+		return cfg.ClusterSecret
+	}
+	mac := hmac.New(sha256.New, []byte(cfg.PikoUpstreamAuthHMACSecretKey))
+	mac.Write([]byte("gottyp-cluster"))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// newSessionAuth creates the session access control selected in cfg
+func newSessionAuth(cfg *config.Config, store access.Store) (*access.Authenticator, error) {
+	return access.New(access.Config{
+		Mode:         cfg.SessionAuth,
+		Key:          sessionAuthKey(cfg),
+		AllowedUsers: cfg.OIDCAllowedUsers,
+		LoginTTL:     cfg.SessionAuthTTL,
+		OIDC: access.OIDCConfig{
+			Issuer:       cfg.OIDCIssuer,
+			ClientID:     cfg.OIDCClientID,
+			ClientSecret: cfg.OIDCClientSecret,
+			Scopes:       cfg.OIDCScopes,
+			UserClaim:    cfg.OIDCUserClaim,
+		},
+	}, store)
+}
+
+// newRegistrationStore creates the session registration store selected in
+// cfg
+func newRegistrationStore(cfg *config.Config) (access.Store, error) {
+	switch cfg.RegistrationStore {
+	case "memory":
+		return access.NewMemoryStore(), nil
+	case "", "bolt":
+		return openBolt(cfg, cfg.RegistrationDBPath, "registrations.db", access.NewBoltStore)
+	default:
+		return nil, fmt.Errorf("unknown registration store %q", cfg.RegistrationStore)
+	}
+}
+
+// sessionAuthKey returns the key signing session secrets and login cookies.
+// Without SESSION_AUTH_KEY or UPSTREAM_KEY to derive it from, a random key
+// is used, so logins and secrets don't survive a restart.
+func sessionAuthKey(cfg *config.Config) []byte {
+	if cfg.SessionAuthKey != "" {
+		return []byte(cfg.SessionAuthKey)
+	}
+	if cfg.PikoUpstreamAuthHMACSecretKey != "" {
+		mac := hmac.New(sha256.New, []byte(cfg.PikoUpstreamAuthHMACSecretKey))
+		mac.Write([]byte("gottyp-session-auth"))
+		return mac.Sum(nil)
+	}
+
+	key := make([]byte, 32)
+	rand.Read(key)
+	if cfg.SessionAuth != "" && cfg.SessionAuth != access.ModeNone {
+		slog.Warn("No SESSION_AUTH_KEY or UPSTREAM_KEY set, session secrets and logins won't survive a restart")
+	}
+	return key
+}
+
+// newNotificationStore creates the notification store selected in cfg
+func newNotificationStore(cfg *config.Config) (notification.Store, error) {
+	switch cfg.NotificationStore {
+	case "", "memory":
+		return notification.NewMemoryStore(cfg.NotificationRetention), nil
+	case "bolt":
+		return openBolt(cfg, cfg.NotificationDBPath, "notifications.db", func(path string) (*notification.BoltStore, error) {
+			return notification.NewBoltStore(path, cfg.NotificationRetention)
+		})
+	default:
+		return nil, fmt.Errorf("unknown notification store %q", cfg.NotificationStore)
+	}
+}
+
+// newSubscriptionStore creates the webhook subscription store selected in cfg
+func newSubscriptionStore(cfg *config.Config) (notification.SubscriptionStore, error) {
+	switch cfg.SubscriptionStore {
+	case "memory":
+		return notification.NewMemorySubscriptionStore(), nil
+	case "", "bolt":
+		return openBolt(cfg, cfg.SubscriptionDBPath, "subscriptions.db", notification.NewBoltSubscriptionStore)
+	default:
+		return nil, fmt.Errorf("unknown subscription store %q", cfg.SubscriptionStore)
+	}
+}
+
+// newKeyStore creates the upstream key store selected in cfg
+func newKeyStore(cfg *config.Config) (keys.Store, error) {
+	switch cfg.KeyStore {
+	case "memory":
+		return keys.NewMemoryStore(), nil
+	case "", "bolt":
+		return openBolt(cfg, cfg.KeyDBPath, "keys.db", keys.NewBoltStore)
+	default:
+		return nil, fmt.Errorf("unknown key store %q", cfg.KeyStore)
+	}
+}
+
+// openBolt opens a bolt database with open, at path or, when path is empty,
+// at name in the node's data dir
+func openBolt[T any](cfg *config.Config, path, name string, open func(path string) (T, error)) (T, error) {
+	if path == "" {
+		dir, err := dataDir(cfg)
+		if err != nil {
+			var store T
+			return store, err
+		}
+		path = filepath.Join(dir, name)
+		// Databases created before the data dir stay in the working
+		// directory until moved
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			if _, err := os.Stat(name); err == nil {
+				slog.Warn("Using database in the working directory, move it to the data dir", "path", name, "data_dir", dir)
+				path = name
+			}
+		}
+	}
+
+	store, err := open(path)
+	if errors.Is(err, bolt.ErrTimeout) {
+		// bolt waits for the file lock held by another process
+		err = fmt.Errorf("%w: is another server using it? Give each server on a host its own NODE_ID or DATA_DIR", err)
+	}
+	return store, err
+}
+
+// dataDir creates and returns the directory keeping the node's databases,
+// DATA_DIR or data/{NODE_ID}
+func dataDir(cfg *config.Config) (string, error) {
+	dir := cfg.DataDir
+	if dir == "" {
+		if cfg.NodeID == "" || cfg.NodeID == "." || cfg.NodeID == ".." || strings.ContainsAny(cfg.NodeID, `/\`) {
+			return "", fmt.Errorf("node ID %q can't name a data dir, set DATA_DIR", cfg.NodeID)
+		}
+		dir = filepath.Join("data", cfg.NodeID)
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", fmt.Errorf("create data dir: %w", err)
+	}
+	return dir, nil
+}
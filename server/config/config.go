@@ -1,55 +1,392 @@
 package config
 
 import (
+	"errors"
+	"fmt"
 	"os"
+	"sort"
 	"strconv"
+	"strings"
+	"time"
 )
 
 // Config server configuration
 type Config struct {
-	PikoUpstreamPort int
-	PikoToken        string
-	ListenPort       int
-	EnableTLS        bool
-	TLSCertFile              string
-	TLSKeyFile               string
+	PikoUpstreamPort              int
+	PikoToken                     string
+	ListenPort                    int
+	EnableTLS                     bool
+	TLSCertFile                   string
+	TLSKeyFile                    string
 	PikoUpstreamAuthHMACSecretKey string
+	// AllowSharedUpstreamKey accepts gottyp tokens signed with UPSTREAM_KEY
+	// itself. Turn it off once every user has a user key, so nobody can
+	// register a session under another user's name.
+	AllowSharedUpstreamKey bool
+	// SessionCollision selects what happens when a client connects to a
+	// session another client is connected to: "reject" or "flag" (let it in
+	// and mark the session as conflicting)
+	SessionCollision string
+	// SessionReservations ties sessions to the user of an upstream key, as
+	// session=user entries; sessions may be patterns such as "build-*"
+	SessionReservations []string
+	// RateLimitIP limits the requests of a client IP per minute, allowing
+	// bursts of as many; 0 disables it, as for every rate limit
+	RateLimitIP int
+	// RateLimitSession limits the proxied requests per minute and session
+	RateLimitSession int
+	// RateLimitPublish limits the published notifications per minute and
+	// session
+	RateLimitPublish int
+	// RateLimitUpstream limits the upstream connections per minute of a
+	// user key, or of a client IP using the shared key
+	RateLimitUpstream int
+	// MaxTerminalsPerSession caps the terminal WebSockets open on a session;
+	// 0 disables it, as for every cap
+	MaxTerminalsPerSession int
+	// MaxStreamsPerIP caps the notification SSE streams open by a client IP
+	MaxStreamsPerIP int
+	// MaxSessionsPerKey caps the sessions connected with one user key
+	MaxSessionsPerKey int
+	// SSEAllowedOrigins lists the browser origins (e.g. https://example.com)
+	// allowed to read notification streams cross-origin, "*" for any. Only
+	// pages served by this server can when empty.
+	SSEAllowedOrigins []string
+	// TrustedProxies lists the IPs and CIDRs whose X-Forwarded-For header is
+	// trusted for the client IP; none is trusted when empty
+	TrustedProxies []string
+	// KeyStore selects where user keys and their revocations are kept:
+	// "bolt" (survives restarts) or "memory"
+	KeyStore string
+	// DataDir keeps this node's bolt databases, data/{NodeID} when empty, so
+	// servers sharing a working directory don't share (and lock) them
+	DataDir string
+	// KeyDBPath is the database file used by the bolt key store,
+	// {DataDir}/keys.db when empty
+	KeyDBPath string
+	// RegistrationStore selects where session access registrations are kept:
+	// "bolt" (survives restarts) or "memory"
+	RegistrationStore string
+	// RegistrationDBPath is the database file used by the bolt registration
+	// store, {DataDir}/registrations.db when empty
+	RegistrationDBPath string
+	// PikoProxyPort is the local port of the embedded piko proxy
+	PikoProxyPort int
+	// PikoProxyBindHost is the host the piko proxy listens on: loopback for a
+	// single node, the advertised host (or every interface) in a cluster,
+	// whose nodes forward requests to each other's proxy
+	PikoProxyBindHost string
+	// PikoAdminPort is the local port of the embedded piko admin server
+	PikoAdminPort int
+	// NodeID identifies this server in piko
+	NodeID string
+	// ClusterGossipPort is the piko gossip port other nodes join. When 0, a
+	// random port is used and the server runs as a single node unless
+	// ClusterJoin is set.
+	ClusterGossipPort int
+	// ClusterJoin lists the gossip addresses (host:port) of cluster nodes to
+	// join
+	ClusterJoin []string
+	// ClusterAdvertiseHost is the host other nodes reach this node on,
+	// inferred from the private IP when empty
+	ClusterAdvertiseHost string
+	// ClusterSecret signs requests between nodes, derived from
+	// UPSTREAM_KEY when empty
+	ClusterSecret string
+	// ClusterSyncInterval is how often the session registries of the other
+	// nodes are pulled
+	ClusterSyncInterval time.Duration
+	// StartupTimeout is how long to wait for piko to become ready before
+	// giving up
+	StartupTimeout time.Duration
+	// TLSReloadInterval is how often TLSCertFile and TLSKeyFile are checked
+	// for changes
+	TLSReloadInterval time.Duration
+	// TLSRedirectPort serves a plain HTTP redirect to HTTPS (and ACME HTTP-01
+	// challenges) on this port, disabled when 0
+	TLSRedirectPort int
+	// ACMEDomains are the domains certificates are requested for through
+	// ACME instead of using the certificate files
+	ACMEDomains []string
+	// ACMEEmail is the contact address of the ACME account
+	ACMEEmail string
+	// ACMECacheDir keeps ACME account keys and certificates
+	ACMECacheDir string
+	// ACMEDirectoryURL is the ACME directory, Let's Encrypt when empty
+	ACMEDirectoryURL string
+	// ACMECAFile is a CA bundle trusted for the ACME directory, for test
+	// CAs such as Pebble
+	ACMECAFile string
+	// LogLevel is the minimum level logged: debug, info, warn or error
+	LogLevel string
+	// LogFormat selects the log output: "json" or "text"
+	LogFormat string
+	// PikoLogLevel is the minimum level logged by the embedded piko server
+	PikoLogLevel string
+	// SessionTimeout is how long a disconnected session is kept before
+	// being cleaned up
+	SessionTimeout time.Duration
+	// AdminToken protects the admin API, which is disabled when empty
+	AdminToken string
+	// EnableDashboard serves the admin dashboard at /admin/ when an admin
+	// token is set
+	EnableDashboard bool
+	// EnableMetrics serves Prometheus metrics at /metrics to requests
+	// carrying the metrics or admin token
+	EnableMetrics bool
+	// MetricsToken is the bearer token scrapers use for /metrics, besides
+	// the admin token
+	MetricsToken string
+	// MetricsSessionLabels reports traffic per session, labelled with the
+	// session ID
+	MetricsSessionLabels bool
+	// SessionAuth selects how access to sessions is controlled: "none"
+	// (gotty Basic Auth only), "secret" or "oidc"
+	SessionAuth string
+	// SessionAuthKey signs session secrets and login cookies, derived from
+	// UPSTREAM_KEY when empty
+	SessionAuthKey string
+	// SessionAuthTTL is how long a login or session secret cookie lasts
+	SessionAuthTTL time.Duration
+	// OIDCIssuer is the issuer URL of the OIDC provider
+	OIDCIssuer string
+	// OIDCClientID is the client ID registered with the OIDC provider
+	OIDCClientID string
+	// OIDCClientSecret is the client secret registered with the OIDC
+	// provider
+	OIDCClientSecret string
+	// OIDCRedirectURL is the login callback registered with the provider,
+	// {PUBLIC_URL}/_auth/callback when empty
+	OIDCRedirectURL string
+	// OIDCScopes are requested on login
+	OIDCScopes []string
+	// OIDCUserClaim is the ID token claim naming the user
+	OIDCUserClaim string
+	// OIDCAllowedUsers may access sessions that registered no allow-list
+	OIDCAllowedUsers []string
+	// NotificationStore selects where notifications are kept for replay:
+	// "memory" or "bolt"
+	NotificationStore string
+	// NotificationDBPath is the database file used by the bolt store,
+	// {DataDir}/notifications.db when empty
+	NotificationDBPath string
+	// NotificationRetention is how many notifications are kept for replay
+	NotificationRetention int
+	// SubscriptionStore selects where webhook subscriptions are kept:
+	// "bolt" (survives restarts) or "memory"
+	SubscriptionStore string
+	// SubscriptionDBPath is the database file used by the bolt store,
+	// {DataDir}/subscriptions.db when empty
+	SubscriptionDBPath string
+	// PublicURL is the server's external URL (e.g. https://example.com),
+	// used to link webhook notifications back to the session
+	PublicURL string
+	// SessionDomain serves every session on its own host,
+	// {session}.{SessionDomain}, so pages of one session can't reach
+	// another. Needs PublicURL for the main host.
+	SessionDomain string
+	// WebhookWorkers is the number of concurrent webhook deliveries
+	WebhookWorkers int
+	// WebhookTimeout is the timeout of a single webhook request
+	WebhookTimeout time.Duration
+	// WebhookMaxAttempts is how often a webhook delivery is tried before it
+	// is moved to the dead-letter list
+	WebhookMaxAttempts int
+	// WebhookInitialBackoff is the delay before the first retry, doubled on
+	// every further retry
+	WebhookInitialBackoff time.Duration
 }
 
-// Load loads configuration from environment variables
-func Load() *Config {
-	return &Config{
-		PikoUpstreamPort: getEnvInt("PIKO_UPSTREAM_PORT", 8022),
-		PikoToken:        getEnvOrDefault("PIKO_TOKEN", ""),
-		ListenPort:       getEnvInt("LISTEN_PORT", 80),
-		EnableTLS:                     getEnvBool("ENABLE_TLS", false),
-		TLSCertFile:                   getEnvOrDefault("TLS_CERT_FILE", ""),
-		TLSKeyFile:                    getEnvOrDefault("TLS_KEY_FILE", ""),
-		PikoUpstreamAuthHMACSecretKey: getEnvOrDefault("UPSTREAM_KEY", ""),
+// Load loads configuration from environment variables, failing on values
+// that don't parse
+func Load() (*Config, error) {
+	return load(nil)
+}
+
+// load reads the configuration from environment variables and then the
+// values of a config file
+func load(file map[string]string) (*Config, error) {
+	l := &loader{file: file, read: make(map[string]bool)}
+	cfg := &Config{
+		PikoUpstreamPort:              l.int("PIKO_UPSTREAM_PORT", 8022),
+		PikoToken:                     l.string("PIKO_TOKEN", ""),
+		ListenPort:                    l.int("LISTEN_PORT", 80),
+		EnableTLS:                     l.bool("ENABLE_TLS", false),
+		TLSCertFile:                   l.string("TLS_CERT_FILE", ""),
+		TLSKeyFile:                    l.string("TLS_KEY_FILE", ""),
+		TLSReloadInterval:             l.duration("TLS_RELOAD_INTERVAL", 30*time.Second),
+		TLSRedirectPort:               l.int("TLS_REDIRECT_PORT", 0),
+		ACMEDomains:                   l.list("ACME_DOMAINS"),
+		ACMEEmail:                     l.string("ACME_EMAIL", ""),
+		ACMECacheDir:                  l.string("ACME_CACHE_DIR", "acme-cache"),
+		ACMEDirectoryURL:              l.string("ACME_DIRECTORY_URL", ""),
+		ACMECAFile:                    l.string("ACME_CA_FILE", ""),
+		PikoUpstreamAuthHMACSecretKey: l.string("UPSTREAM_KEY", ""),
+		AllowSharedUpstreamKey:        l.bool("ALLOW_SHARED_UPSTREAM_KEY", true),
+		SessionCollision:              l.string("SESSION_COLLISION", "reject"),
+		SessionReservations:           l.list("SESSION_RESERVATIONS"),
+		RateLimitIP:                   l.int("RATE_LIMIT_IP", 0),
+		RateLimitSession:              l.int("RATE_LIMIT_SESSION", 0),
+		RateLimitPublish:              l.int("RATE_LIMIT_PUBLISH", 0),
+		RateLimitUpstream:             l.int("RATE_LIMIT_UPSTREAM", 0),
+		MaxTerminalsPerSession:        l.int("MAX_TERMINALS_PER_SESSION", 0),
+		MaxStreamsPerIP:               l.int("MAX_STREAMS_PER_IP", 0),
+		MaxSessionsPerKey:             l.int("MAX_SESSIONS_PER_KEY", 0),
+		SSEAllowedOrigins:             l.list("SSE_ALLOWED_ORIGINS"),
+		TrustedProxies:                l.list("TRUSTED_PROXIES"),
+		KeyStore:                      l.string("KEY_STORE", "bolt"),
+		DataDir:                       l.string("DATA_DIR", ""),
+		KeyDBPath:                     l.string("KEY_DB_PATH", ""),
+		RegistrationStore:             l.string("REGISTRATION_STORE", "bolt"),
+		RegistrationDBPath:            l.string("REGISTRATION_DB_PATH", ""),
+		PikoProxyPort:                 l.int("PIKO_PROXY_PORT", 8023),
+		PikoProxyBindHost:             l.string("PIKO_PROXY_BIND_HOST", ""),
+		PikoAdminPort:                 l.int("PIKO_ADMIN_PORT", 7070),
+		NodeID:                        l.string("NODE_ID", "clauded-server-1"),
+		ClusterGossipPort:             l.int("CLUSTER_GOSSIP_PORT", 0),
+		ClusterJoin:                   l.list("CLUSTER_JOIN"),
+		ClusterAdvertiseHost:          l.string("CLUSTER_ADVERTISE_HOST", ""),
+		ClusterSecret:                 l.string("CLUSTER_SECRET", ""),
+		ClusterSyncInterval:           l.duration("CLUSTER_SYNC_INTERVAL", 5*time.Second),
+		StartupTimeout:                l.duration("STARTUP_TIMEOUT", 30*time.Second),
+		LogLevel:                      l.string("LOG_LEVEL", "info"),
+		LogFormat:                     l.string("LOG_FORMAT", "json"),
+		PikoLogLevel:                  l.string("PIKO_LOG_LEVEL", "warn"),
+		SessionTimeout:                l.duration("SESSION_TIMEOUT", 10*time.Minute),
+		AdminToken:                    l.string("ADMIN_TOKEN", ""),
+		EnableDashboard:               l.bool("ENABLE_DASHBOARD", true),
+		EnableMetrics:                 l.bool("ENABLE_METRICS", true),
+		MetricsToken:                  l.string("METRICS_TOKEN", ""),
+		MetricsSessionLabels:          l.bool("METRICS_SESSION_LABELS", false),
+		SessionAuth:                   l.string("SESSION_AUTH", "none"),
+		SessionAuthKey:                l.string("SESSION_AUTH_KEY", ""),
+		SessionAuthTTL:                l.duration("SESSION_AUTH_TTL", 12*time.Hour),
+		OIDCIssuer:                    l.string("OIDC_ISSUER", ""),
+		OIDCClientID:                  l.string("OIDC_CLIENT_ID", ""),
+		OIDCClientSecret:              l.string("OIDC_CLIENT_SECRET", ""),
+		OIDCRedirectURL:               l.string("OIDC_REDIRECT_URL", ""),
+		OIDCScopes:                    l.listOrDefault("OIDC_SCOPES", []string{"openid", "email", "profile"}),
+		OIDCUserClaim:                 l.string("OIDC_USER_CLAIM", "email"),
+		OIDCAllowedUsers:              l.list("OIDC_ALLOWED_USERS"),
+		NotificationStore:             l.string("NOTIFICATION_STORE", "memory"),
+		NotificationDBPath:            l.string("NOTIFICATION_DB_PATH", ""),
+		NotificationRetention:         l.int("NOTIFICATION_RETENTION", 1000),
+		SubscriptionStore:             l.string("SUBSCRIPTION_STORE", "bolt"),
+		SubscriptionDBPath:            l.string("SUBSCRIPTION_DB_PATH", ""),
+		PublicURL:                     l.string("PUBLIC_URL", ""),
+		SessionDomain:                 strings.ToLower(strings.Trim(l.string("SESSION_DOMAIN", ""), ".")),
+		WebhookWorkers:                l.int("WEBHOOK_WORKERS", 4),
+		WebhookTimeout:                l.duration("WEBHOOK_TIMEOUT", 10*time.Second),
+		WebhookMaxAttempts:            l.int("WEBHOOK_MAX_ATTEMPTS", 5),
+		WebhookInitialBackoff:         l.duration("WEBHOOK_INITIAL_BACKOFF", time.Second),
 	}
+	return cfg, l.err()
+}
+
+// loader reads settings, collecting the values that don't parse
+type loader struct {
+	// file holds the settings read from the config file, keyed by their
+	// environment variable name
+	file map[string]string
+	// read records the settings looked up, to report unknown file keys
+	read map[string]bool
+	errs []error
 }
 
-func getEnvOrDefault(key, defaultValue string) string {
+// get returns an environment variable, falling back to the config file
+func (l *loader) get(key string) string {
+	l.read[key] = true
 	if value := os.Getenv(key); value != "" {
 		return value
 	}
-	return defaultValue
+	return l.file[key]
 }
 
-func getEnvInt(key string, defaultValue int) int {
-	if value := os.Getenv(key); value != "" {
-		if intValue, err := strconv.Atoi(value); err == nil {
-			return intValue
+// invalid records a value that doesn't parse, naming where it came from
+func (l *loader) invalid(key, value, want string) {
+	source := key
+	if os.Getenv(key) == "" {
+		source = fmt.Sprintf("config file key %s", strings.ToLower(key))
+	}
+	l.errs = append(l.errs, fmt.Errorf("invalid %s %q: want %s", source, value, want))
+}
+
+// unknown reports the config file keys that aren't settings
+func (l *loader) unknown() []error {
+	var errs []error
+	for key := range l.file {
+		if !l.read[key] {
+			errs = append(errs, fmt.Errorf("unknown config file key %s", strings.ToLower(key)))
 		}
 	}
+	sort.Slice(errs, func(i, j int) bool { return errs[i].Error() < errs[j].Error() })
+	return errs
+}
+
+func (l *loader) err() error {
+	return errors.Join(append(l.errs, l.unknown()...)...)
+}
+
+func (l *loader) string(key, defaultValue string) string {
+	if value := l.get(key); value != "" {
+		return value
+	}
 	return defaultValue
 }
 
-func getEnvBool(key string, defaultValue bool) bool {
-	if value := os.Getenv(key); value != "" {
-		if boolValue, err := strconv.ParseBool(value); err == nil {
-			return boolValue
+// list splits a comma separated variable, skipping empty items
+func (l *loader) list(key string) []string {
+	var list []string
+	for _, item := range strings.Split(l.get(key), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
 		}
 	}
+	return list
+}
+
+func (l *loader) listOrDefault(key string, defaultValue []string) []string {
+	if list := l.list(key); len(list) > 0 {
+		return list
+	}
 	return defaultValue
 }
+
+func (l *loader) int(key string, defaultValue int) int {
+	value := l.get(key)
+	if value == "" {
+		return defaultValue
+	}
+	intValue, err := strconv.Atoi(value)
+	if err != nil {
+		l.invalid(key, value, "an integer")
+		return defaultValue
+	}
+	return intValue
+}
+
+func (l *loader) bool(key string, defaultValue bool) bool {
+	value := l.get(key)
+	if value == "" {
+		return defaultValue
+	}
+	boolValue, err := strconv.ParseBool(value)
+	if err != nil {
+		l.invalid(key, value, "true or false")
+		return defaultValue
+	}
+	return boolValue
+}
+
+func (l *loader) duration(key string, defaultValue time.Duration) time.Duration {
+	value := l.get(key)
+	if value == "" {
+		return defaultValue
+	}
+	durationValue, err := time.ParseDuration(value)
+	if err != nil {
+		l.invalid(key, value, "a duration such as 30s")
+		return defaultValue
+	}
+	return durationValue
+}
@@ -0,0 +1,146 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeConfig writes a config file named name into a temp dir
+func writeConfig(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		content string
+	}{
+		{
+			name: "yaml",
+			file: "server.yaml",
+			content: `listen_port: 8080
+enable-tls: true
+session_timeout: 1m
+cluster_join: [a:7946, b:7946]
+data_dir: /var/lib/clauded
+node_id:
+`,
+		},
+		{
+			name: "toml",
+			file: "server.toml",
+			content: `listen_port = 8080
+enable_tls = true
+session_timeout = "1m"
+cluster_join = ["a:7946", "b:7946"]
+data_dir = "/var/lib/clauded"
+`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := LoadFile(writeConfig(t, tt.file, tt.content))
+			if err != nil {
+				t.Fatalf("LoadFile() error = %v", err)
+			}
+			if cfg.ListenPort != 8080 || !cfg.EnableTLS || cfg.SessionTimeout != time.Minute {
+				t.Fatalf("LoadFile() = port %d, TLS %v, timeout %v", cfg.ListenPort, cfg.EnableTLS, cfg.SessionTimeout)
+			}
+			if strings.Join(cfg.ClusterJoin, ",") != "a:7946,b:7946" {
+				t.Fatalf("ClusterJoin = %v", cfg.ClusterJoin)
+			}
+			if cfg.DataDir != "/var/lib/clauded" || cfg.KeyDBPath != "" || cfg.NodeID != "clauded-server-1" {
+				t.Fatalf("DataDir = %q, KeyDBPath = %q, NodeID = %q", cfg.DataDir, cfg.KeyDBPath, cfg.NodeID)
+			}
+		})
+	}
+}
+
+func TestLoadFileErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		env     map[string]string
+		want    []string
+	}{
+		{
+			name:    "unknown keys",
+			content: "listen_prot: 8080\nkey_db: keys.db\n",
+			want:    []string{"unknown config file key key_db", "unknown config file key listen_prot"},
+		},
+		{
+			name:    "invalid values",
+			content: "listen_port: eighty\nenable_tls: maybe\nsession_timeout: 10\n",
+			want: []string{
+				`invalid config file key listen_port "eighty": want an integer`,
+				`invalid config file key enable_tls "maybe": want true or false`,
+				`invalid config file key session_timeout "10": want a duration`,
+			},
+		},
+		{
+			name:    "invalid environment variable",
+			content: "listen_port: 8080\n",
+			env:     map[string]string{"RATE_LIMIT_IP": "many"},
+			want:    []string{`invalid RATE_LIMIT_IP "many": want an integer`},
+		},
+		{
+			name:    "table",
+			content: "tls:\n  cert: cert.pem\n",
+			want:    []string{"tls must not be a table"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for key, value := range tt.env {
+				t.Setenv(key, value)
+			}
+			_, err := LoadFile(writeConfig(t, "server.yaml", tt.content))
+			if err == nil {
+				t.Fatal("LoadFile() succeeded")
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("LoadFile() error = %v, want %q", err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestLoadFileEnvOverrides(t *testing.T) {
+	// A valid environment variable takes precedence over an invalid file
+	// value, which is never parsed
+	t.Setenv("LISTEN_PORT", "9090")
+	cfg, err := LoadFile(writeConfig(t, "server.yaml", "listen_port: eighty\n"))
+	if err != nil {
+		t.Fatalf("LoadFile() error = %v", err)
+	}
+	if cfg.ListenPort != 9090 {
+		t.Fatalf("ListenPort = %d, want 9090", cfg.ListenPort)
+	}
+}
+
+func TestLoad(t *testing.T) {
+	cfg, err := Load()
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if cfg.DataDir != "" || cfg.KeyDBPath != "" || cfg.RegistrationDBPath != "" || cfg.SubscriptionDBPath != "" || cfg.NotificationDBPath != "" {
+		t.Fatalf("Load() = data dir %q and database paths %q, %q, %q, %q, want them derived from the node ID",
+			cfg.DataDir, cfg.KeyDBPath, cfg.RegistrationDBPath, cfg.SubscriptionDBPath, cfg.NotificationDBPath)
+	}
+
+	t.Setenv("WEBHOOK_TIMEOUT", "soon")
+	if _, err := Load(); err == nil || !strings.Contains(err.Error(), `invalid WEBHOOK_TIMEOUT "soon"`) {
+		t.Fatalf("Load() error = %v, want the invalid WEBHOOK_TIMEOUT", err)
+	}
+}
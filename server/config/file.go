@@ -0,0 +1,56 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pelletier/go-toml/v2"
+	"gopkg.in/yaml.v3"
+)
+
+// LoadFile loads configuration from a YAML or TOML file (chosen by the
+// .toml extension) and environment variables, which take precedence. Keys
+// are the environment variable names in lower case, e.g. listen_port;
+// unknown keys and values that don't parse are errors.
+func LoadFile(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read config file: %w", err)
+	}
+
+	var values map[string]interface{}
+	if strings.EqualFold(filepath.Ext(path), ".toml") {
+		err = toml.Unmarshal(data, &values)
+	} else {
+		err = yaml.Unmarshal(data, &values)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parse config file %s: %w", path, err)
+	}
+
+	fileValues := make(map[string]string, len(values))
+	for name, value := range values {
+		key := strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+		switch value := value.(type) {
+		case nil:
+			fileValues[key] = ""
+		case []interface{}:
+			items := make([]string, len(value))
+			for i, item := range value {
+				items[i] = fmt.Sprint(item)
+			}
+			fileValues[key] = strings.Join(items, ",")
+		case map[string]interface{}:
+			return nil, fmt.Errorf("config file %s: %s must not be a table", path, name)
+		default:
+			fileValues[key] = fmt.Sprint(value)
+		}
+	}
+	cfg, err := load(fileValues)
+	if err != nil {
+		return nil, fmt.Errorf("config file %s: %w", path, err)
+	}
+	return cfg, nil
+}
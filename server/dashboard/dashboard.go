@@ -0,0 +1,8 @@
+package dashboard
+
+import "embed"
+
+// Assets holds the admin dashboard pages compiled into the server binary
+//
+//go:embed assets/*
+var Assets embed.FS
@@ -0,0 +1,164 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// adminCookie holds the dashboard login, a random value issued by this server
+// so the admin token itself is never stored in the browser
+const adminCookie = "gottyp_admin"
+
+// csrfCookie passes the CSRF token of a dashboard login to the dashboard's
+// scripts, which send it back in csrfHeader. It is only readable on /admin.
+const (
+	csrfCookie = "gottyp_csrf"
+	csrfHeader = "X-CSRF-Token"
+)
+
+// adminLoginTTL is how long a dashboard login lasts
+const adminLoginTTL = 7 * 24 * time.Hour
+
+// adminCookiePaths are the paths the dashboard login is sent to, so it never
+// reaches a session or the apps behind its forwarded ports
+var adminCookiePaths = []string{"/admin", "/api"}
+
+// RequireAdmin rejects requests that don't carry the configured admin token,
+// either as a bearer token or as the dashboard login cookie with its CSRF
+// token. The admin API is disabled entirely when no token is configured.
+func (h *Handler) RequireAdmin(c *gin.Context) {
+	if h.config.AdminToken == "" {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "admin API is disabled, set ADMIN_TOKEN to enable it"})
+		return
+	}
+
+	if !h.isAdmin(c) {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid admin token"})
+		return
+	}
+
+	c.Next()
+}
+
+// RequireMetrics rejects scrapes that carry neither the metrics token nor the
+// admin token. Metrics are refused entirely when neither is configured.
+func (h *Handler) RequireMetrics(c *gin.Context) {
+	if h.config.MetricsToken == "" && h.config.AdminToken == "" {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "metrics are disabled, set METRICS_TOKEN or ADMIN_TOKEN to enable them"})
+		return
+	}
+
+	if h.config.MetricsToken != "" {
+		header := c.GetHeader("Authorization")
+		if strings.HasPrefix(header, "Bearer ") &&
+			subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(header, "Bearer ")), []byte(h.config.MetricsToken)) == 1 {
+			c.Next()
+			return
+		}
+	}
+
+	if !h.isAdmin(c) {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid metrics token"})
+		return
+	}
+
+	c.Next()
+}
+
+// isAdmin reports whether the request carries valid admin credentials
+func (h *Handler) isAdmin(c *gin.Context) bool {
+	if h.config.AdminToken == "" {
+		return false
+	}
+
+	if header := c.GetHeader("Authorization"); strings.HasPrefix(header, "Bearer ") {
+		token := strings.TrimPrefix(header, "Bearer ")
+		return subtle.ConstantTimeCompare([]byte(token), []byte(h.config.AdminToken)) == 1
+	}
+
+	// The login cookie comes with every request from the dashboard's origin,
+	// where other pages may be served too, so the API also needs its CSRF
+	// token
+	login, ok := h.adminLogin(c)
+	return ok && subtle.ConstantTimeCompare([]byte(c.GetHeader(csrfHeader)), []byte(csrfToken(login))) == 1
+}
+
+// adminLogin returns the dashboard login of a request, if it is valid
+func (h *Handler) adminLogin(c *gin.Context) (string, bool) {
+	if h.config.AdminToken == "" {
+		return "", false
+	}
+	cookie, err := c.Cookie(adminCookie)
+	if err != nil || !h.adminLogins.valid(cookie) {
+		return "", false
+	}
+	return cookie, true
+}
+
+// csrfToken returns the CSRF token of a dashboard login. It can't be derived
+// without the login, which scripts can't read.
+func csrfToken(login string) string {
+	sum := sha256.Sum256([]byte("csrf:" + login))
+	return hex.EncodeToString(sum[:])
+}
+
+// adminLogins keeps the dashboard logins issued by this server, hashed, until
+// they expire or are logged out. They don't survive a restart and aren't
+// shared between cluster nodes.
+type adminLogins struct {
+	mu     sync.Mutex
+	logins map[string]time.Time
+}
+
+func newAdminLogins() *adminLogins {
+	return &adminLogins{logins: make(map[string]time.Time)}
+}
+
+// create issues a new login
+func (l *adminLogins) create() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	value := hex.EncodeToString(b)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	for key, expires := range l.logins {
+		if now.After(expires) {
+			delete(l.logins, key)
+		}
+	}
+	l.logins[hashLogin(value)] = now.Add(adminLoginTTL)
+	return value, nil
+}
+
+// valid reports whether a login was issued and hasn't expired or been logged out
+func (l *adminLogins) valid(value string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	expires, ok := l.logins[hashLogin(value)]
+	return ok && time.Now().Before(expires)
+}
+
+// delete revokes a login
+func (l *adminLogins) delete(value string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.logins, hashLogin(value))
+}
+
+// hashLogin hashes a login so lookups don't compare the value itself
+func hashLogin(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,180 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"clauded-server/config"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestAdminLogins(t *testing.T) {
+	logins := newAdminLogins()
+
+	login, err := logins.create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := logins.create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if login == other {
+		t.Fatal("logins are not random")
+	}
+	if !logins.valid(login) || !logins.valid(other) {
+		t.Fatal("issued login is not valid")
+	}
+	if logins.valid("forged") {
+		t.Fatal("forged login is valid")
+	}
+
+	logins.delete(login)
+	if logins.valid(login) {
+		t.Fatal("logged out login is still valid")
+	}
+	if !logins.valid(other) {
+		t.Fatal("logout revoked another login")
+	}
+}
+
+func TestStripServerCookies(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/session/3000/", nil)
+	for _, name := range append(serverCookies, "app") {
+		r.AddCookie(&http.Cookie{Name: name, Value: "v"})
+	}
+
+	stripCookies(r, serverCookies...)
+
+	cookies := r.Cookies()
+	if len(cookies) != 1 || cookies[0].Name != "app" {
+		t.Fatalf("cookies after stripping = %v, want only app", cookies)
+	}
+}
+
+func TestRequireMetrics(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	tests := []struct {
+		name         string
+		metricsToken string
+		adminToken   string
+		bearer       string
+		want         int
+	}{
+		{name: "no tokens configured", bearer: "anything", want: http.StatusForbidden},
+		{name: "metrics token", metricsToken: "scrape", adminToken: "adm", bearer: "scrape", want: http.StatusOK},
+		{name: "admin token", metricsToken: "scrape", adminToken: "adm", bearer: "adm", want: http.StatusOK},
+		{name: "admin token only", adminToken: "adm", bearer: "adm", want: http.StatusOK},
+		{name: "wrong token", metricsToken: "scrape", adminToken: "adm", bearer: "wrong", want: http.StatusUnauthorized},
+		{name: "no token", metricsToken: "scrape", want: http.StatusUnauthorized},
+		{name: "empty bearer", adminToken: "adm", bearer: "", want: http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &Handler{
+				config:      &config.Config{MetricsToken: tt.metricsToken, AdminToken: tt.adminToken},
+				adminLogins: newAdminLogins(),
+			}
+			router := gin.New()
+			router.GET("/metrics", h.RequireMetrics, func(c *gin.Context) { c.Status(http.StatusOK) })
+
+			r := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+			if tt.bearer != "" {
+				r.Header.Set("Authorization", "Bearer "+tt.bearer)
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, r)
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsAdmin(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	h := &Handler{config: &config.Config{AdminToken: "adm"}, adminLogins: newAdminLogins()}
+	login, err := h.adminLogins.create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := h.adminLogins.create()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		bearer string
+		cookie string
+		csrf   string
+		want   bool
+	}{
+		{name: "admin token", bearer: "adm", want: true},
+		{name: "wrong token", bearer: "wrong"},
+		{name: "login with CSRF token", cookie: login, csrf: csrfToken(login), want: true},
+		// Any page on the dashboard's origin gets the cookie sent along
+		{name: "login without CSRF token", cookie: login},
+		{name: "CSRF token of another login", cookie: login, csrf: csrfToken(other)},
+		{name: "CSRF token without login", csrf: csrfToken(login)},
+		{name: "forged login", cookie: "forged", csrf: csrfToken("forged")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := gin.CreateTestContext(httptest.NewRecorder())
+			c.Request = httptest.NewRequest(http.MethodDelete, "/api/v1/sessions/alice", nil)
+			if tt.bearer != "" {
+				c.Request.Header.Set("Authorization", "Bearer "+tt.bearer)
+			}
+			if tt.cookie != "" {
+				c.Request.AddCookie(&http.Cookie{Name: adminCookie, Value: tt.cookie})
+			}
+			if tt.csrf != "" {
+				c.Request.Header.Set(csrfHeader, tt.csrf)
+			}
+
+			if got := h.isAdmin(c); got != tt.want {
+				t.Fatalf("isAdmin() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDashboardCSRFCookie(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	h := &Handler{config: &config.Config{AdminToken: "adm", EnableDashboard: true}, adminLogins: newAdminLogins()}
+	login, err := h.adminLogins.create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	router := gin.New()
+	router.GET("/admin/", h.Dashboard)
+
+	r := httptest.NewRequest(http.MethodGet, "/admin/", nil)
+	r.AddCookie(&http.Cookie{Name: adminCookie, Value: login})
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200", w.Code)
+	}
+
+	var csrf *http.Cookie
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == csrfCookie {
+			csrf = cookie
+		}
+	}
+	if csrf == nil || csrf.Value != csrfToken(login) {
+		t.Fatalf("CSRF cookie = %v, want the token of the login", csrf)
+	}
+	// Only the dashboard's scripts may read it
+	if csrf.Path != "/admin" || csrf.HttpOnly {
+		t.Fatalf("CSRF cookie path %q, HttpOnly %v, want a script-readable cookie on /admin", csrf.Path, csrf.HttpOnly)
+	}
+	if w.Header().Get("X-Frame-Options") != "DENY" {
+		t.Fatal("dashboard can be framed")
+	}
+}
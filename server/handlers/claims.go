@@ -0,0 +1,155 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	"clauded-server/session"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Query parameters gottyp adds to its upstream URL to identify itself
+const (
+	instanceParam  = "instance"
+	multiHostParam = "multi_host"
+)
+
+// Session collision policies
+const (
+	CollisionReject = "reject"
+	CollisionFlag   = "flag"
+)
+
+// upstreamClient identifies the client connecting an upstream
+func upstreamClient(c *gin.Context, owner string) session.Upstream {
+	multiHost, _ := strconv.ParseBool(c.Query(multiHostParam))
+	return session.Upstream{
+		Owner:      owner,
+		Instance:   c.Query(instanceParam),
+		MultiHost:  multiHost,
+		RemoteAddr: c.ClientIP(),
+	}
+}
+
+// reservation returns the user a session is reserved for. SESSION_RESERVATIONS
+// lists session=user entries; sessions may be glob patterns such as
+// "build-*".
+func (h *Handler) reservation(sessionID string) (string, bool) {
+	for _, entry := range h.config.SessionReservations {
+		pattern, owner, ok := strings.Cut(entry, "=")
+		if !ok {
+			continue
+		}
+		if matched, _ := path.Match(strings.TrimSpace(pattern), sessionID); matched {
+			return strings.TrimSpace(owner), true
+		}
+	}
+	return "", false
+}
+
+// checkReservation checks that an endpoint isn't reserved for another user
+// than the owner of a client
+func (h *Handler) checkReservation(endpointID string, up session.Upstream) error {
+	if owner, reserved := h.reservation(endpointID); reserved && owner != up.Owner {
+		return fmt.Errorf("session %s is reserved for %s", endpointID, owner)
+	}
+	return nil
+}
+
+// errCollision refuses a client colliding with another one on an endpoint
+func errCollision(endpointID string) error {
+	return fmt.Errorf("session %s is already connected by another client", endpointID)
+}
+
+// checkClaim checks whether a client may listen on an endpoint: the endpoint
+// must not be reserved for another user, and every client already listening
+// on it must be one the new client may join. It returns the HTTP status to
+// refuse the client with.
+func (h *Handler) checkClaim(ctx context.Context, endpointID string, up session.Upstream) (int, error) {
+	if err := h.checkReservation(endpointID, up); err != nil {
+		return http.StatusForbidden, err
+	}
+	for _, other := range h.cluster.Upstreams(ctx, endpointID) {
+		if !up.Joins(other) {
+			return http.StatusConflict, errCollision(endpointID)
+		}
+	}
+	return http.StatusOK, nil
+}
+
+// claimEndpoint checks a client connecting an upstream and records its
+// connection, closed with cancel, in one step, so that clients connecting at
+// once can't all pass the check. The client's owner may not connect more
+// sessions than MAX_SESSIONS_PER_KEY, and with SESSION_COLLISION=flag a
+// client colliding with another one is let in and the session is marked as
+// conflicting. It writes an error response and returns false if the client
+// may not listen on the endpoint. release must be called once the
+// connection has closed.
+func (h *Handler) claimEndpoint(c *gin.Context, endpointID string, up session.Upstream, cancel context.CancelFunc) (release func(), ok bool) {
+	if err := h.checkReservation(endpointID, up); err != nil {
+		requestLogger(c).Warn("Upstream refused", "endpoint", endpointID, "owner", up.Owner, "error", err)
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return nil, false
+	}
+
+	opts := session.ClaimOptions{
+		Remote:        h.cluster.RemoteUpstreams(c.Request.Context(), endpointID),
+		AllowConflict: h.config.SessionCollision == CollisionFlag,
+		MaxOwned:      h.limits.sessionsPerKey,
+	}
+	if opts.MaxOwned > 0 && up.Owner != "" {
+		opts.RemoteOwned = h.cluster.RemoteOwnedSessions(up.Owner)
+	}
+	release, conflict, err := h.sessionManager.Claim(endpointID, up, cancel, opts)
+	var capErr *session.CapError
+	switch {
+	case errors.As(err, &capErr):
+		h.tooManyRequests(c, limitSessions, capRetryAfter, err.Error())
+		return nil, false
+	case err != nil:
+		err = errCollision(endpointID)
+		requestLogger(c).Warn("Upstream refused", "endpoint", endpointID, "owner", up.Owner, "error", err)
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return nil, false
+	case conflict:
+		requestLogger(c).Warn("Session collision", "endpoint", endpointID, "owner", up.Owner, "error", errCollision(endpointID))
+	}
+	return release, true
+}
+
+// ClaimSession reports whether gottyp may connect a session, so it can
+// offer another name before starting. It takes the same upstream token and
+// query parameters as the upstream connection.
+func (h *Handler) ClaimSession(c *gin.Context) {
+	id := c.Param("id")
+	if !session.ValidID(id) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "session IDs may not contain " + session.PortSeparator})
+		return
+	}
+
+	var owner string
+	if header := c.GetHeader("Authorization"); strings.HasPrefix(header, "Bearer ") {
+		token, err := h.parseUpstreamToken(strings.TrimPrefix(header, "Bearer "))
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+			return
+		}
+		if !token.permits(id) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "upstream token doesn't permit session " + id})
+			return
+		}
+		owner = token.owner()
+	}
+
+	if status, err := h.checkClaim(c.Request.Context(), id, upstreamClient(c, owner)); err != nil {
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"session_id": id, "available": true})
+}
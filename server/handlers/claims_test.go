@@ -0,0 +1,119 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+
+	"clauded-server/cluster"
+	"clauded-server/config"
+	"clauded-server/metrics"
+	"clauded-server/session"
+
+	"github.com/andydunstall/piko/pkg/log"
+	pikocluster "github.com/andydunstall/piko/server/cluster"
+	"github.com/gin-gonic/gin"
+)
+
+// newClaimHandler returns a handler with a session manager on a single
+// cluster node
+func newClaimHandler(cfg *config.Config) *Handler {
+	sessions := session.NewManager()
+	state := pikocluster.NewState(&pikocluster.Node{ID: "node"}, log.NewNopLogger())
+	return &Handler{
+		config:         cfg,
+		sessionManager: sessions,
+		cluster:        cluster.NewNode(cluster.Config{}, state, sessions, nil, nil, nil),
+		metrics:        metrics.New(sessions, nil, false),
+		limits:         newLimits(cfg),
+	}
+}
+
+func TestClaimEndpoint(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	alice := session.Upstream{Owner: "alice", Instance: "a1"}
+	bob := session.Upstream{Owner: "bob", Instance: "b1"}
+	// carol has as many sessions connected as a key may
+	carol := session.Upstream{Owner: "carol", Instance: "c1"}
+
+	tests := []struct {
+		name       string
+		collision  string
+		connected  []session.Upstream
+		endpoint   string
+		up         session.Upstream
+		want       int
+		retryAfter string
+	}{
+		{name: "free", endpoint: "alice", up: alice, want: http.StatusOK},
+		{name: "reconnect", connected: []session.Upstream{alice}, endpoint: "alice", up: alice, want: http.StatusOK},
+		{name: "collision", connected: []session.Upstream{alice}, endpoint: "alice", up: bob, want: http.StatusConflict},
+		{name: "flagged collision", collision: CollisionFlag, connected: []session.Upstream{alice}, endpoint: "alice", up: bob, want: http.StatusOK},
+		{name: "reserved", endpoint: "build-1", up: alice, want: http.StatusForbidden},
+		{name: "reserved collision", collision: CollisionFlag, endpoint: "build-1", up: alice, want: http.StatusForbidden},
+		{name: "reservation owner", endpoint: "build-1", up: session.Upstream{Owner: "ci"}, want: http.StatusOK},
+		{name: "sessions per key", endpoint: "carol-2", up: carol, want: http.StatusTooManyRequests, retryAfter: "30"},
+		{name: "port forward past the sessions per key", endpoint: "carol-1:3000", up: carol, want: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newClaimHandler(&config.Config{SessionCollision: tt.collision, SessionReservations: []string{"build-*=ci"}, MaxSessionsPerKey: 2})
+			h.sessionManager.Claim("carol-0", carol, func() {}, session.ClaimOptions{})
+			h.sessionManager.Claim("carol-1", carol, func() {}, session.ClaimOptions{})
+			for _, up := range tt.connected {
+				h.sessionManager.Claim(tt.endpoint, up, func() {}, session.ClaimOptions{AllowConflict: true})
+			}
+
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request = httptest.NewRequest(http.MethodGet, "/piko/v1/upstream/"+tt.endpoint, nil)
+			release, ok := h.claimEndpoint(c, tt.endpoint, tt.up, func() {})
+			if ok != (tt.want == http.StatusOK) || w.Code != tt.want {
+				t.Fatalf("claimEndpoint() = %v with status %d, want %d", ok, w.Code, tt.want)
+			}
+			if retryAfter := w.Header().Get("Retry-After"); retryAfter != tt.retryAfter {
+				t.Fatalf("Retry-After = %q, want %q", retryAfter, tt.retryAfter)
+			}
+			if ok {
+				release()
+			}
+		})
+	}
+}
+
+func TestClaimEndpointConcurrent(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	h := newClaimHandler(&config.Config{SessionCollision: CollisionReject})
+	const clients = 50
+
+	var wg sync.WaitGroup
+	statuses := make([]int, clients)
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request = httptest.NewRequest(http.MethodGet, "/piko/v1/upstream/alice", nil)
+			up := session.Upstream{Owner: "user-" + strconv.Itoa(i), Instance: strconv.Itoa(i)}
+			h.claimEndpoint(c, "alice", up, func() {})
+			statuses[i] = w.Code
+		}(i)
+	}
+	wg.Wait()
+
+	claimed := 0
+	for _, status := range statuses {
+		if status == http.StatusOK {
+			claimed++
+		}
+	}
+	if claimed != 1 {
+		t.Fatalf("%d of %d clients connecting at once claimed the session, want 1", claimed, clients)
+	}
+	if upstreams := h.sessionManager.Upstreams("alice"); len(upstreams) != 1 {
+		t.Fatalf("%d upstreams recorded, want 1", len(upstreams))
+	}
+}
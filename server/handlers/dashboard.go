@@ -0,0 +1,78 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"net/http"
+
+	"clauded-server/dashboard"
+	"clauded-server/metrics"
+
+	"github.com/gin-gonic/gin"
+)
+
+// dashboardEnabled reports whether the admin dashboard is served, which
+// requires an admin token to log in with
+func (h *Handler) dashboardEnabled() bool {
+	return h.config.EnableDashboard && h.config.AdminToken != ""
+}
+
+// Root serves "/": it redirects to the dashboard when one is configured and
+// otherwise proxies to the piko "root-service" endpoint
+func (h *Handler) Root(c *gin.Context) {
+	if h.dashboardEnabled() {
+		c.Redirect(http.StatusFound, "/admin/")
+		return
+	}
+	h.proxy(c, metrics.RouteRoot, "", "", h.proxyManager.ProxyRootRequest())
+}
+
+func (h *Handler) Dashboard(c *gin.Context) {
+	login, ok := h.adminLogin(c)
+	if !ok {
+		c.Redirect(http.StatusFound, "/admin/login")
+		return
+	}
+	// Readable by the dashboard's scripts, unlike the login
+	c.SetSameSite(http.SameSiteStrictMode)
+	c.SetCookie(csrfCookie, csrfToken(login), int(adminLoginTTL.Seconds()), "/admin", "", c.Request.TLS != nil, false)
+	c.Header("Cache-Control", "no-store")
+	c.Header("X-Frame-Options", "DENY")
+	c.FileFromFS("assets/", http.FS(dashboard.Assets))
+}
+
+func (h *Handler) DashboardLogin(c *gin.Context) {
+	c.FileFromFS("assets/login.html", http.FS(dashboard.Assets))
+}
+
+func (h *Handler) DashboardLoginSubmit(c *gin.Context) {
+	token := c.PostForm("token")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(h.config.AdminToken)) != 1 {
+		c.Redirect(http.StatusFound, "/admin/login?error=1")
+		return
+	}
+
+	login, err := h.adminLogins.create()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	h.setAdminCookie(c, login, int(adminLoginTTL.Seconds()))
+	c.Redirect(http.StatusFound, "/admin/")
+}
+
+func (h *Handler) DashboardLogout(c *gin.Context) {
+	if cookie, err := c.Cookie(adminCookie); err == nil {
+		h.adminLogins.delete(cookie)
+	}
+	h.setAdminCookie(c, "", -1)
+	c.SetCookie(csrfCookie, "", -1, "/admin", "", c.Request.TLS != nil, false)
+	c.Redirect(http.StatusFound, "/admin/login")
+}
+
+// setAdminCookie sets the dashboard login on the dashboard and API paths only
+func (h *Handler) setAdminCookie(c *gin.Context, value string, maxAge int) {
+	c.SetSameSite(http.SameSiteStrictMode)
+	for _, path := range adminCookiePaths {
+		c.SetCookie(adminCookie, value, maxAge, path, "", c.Request.TLS != nil, true)
+	}
+}
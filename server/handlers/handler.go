@@ -1,19 +1,25 @@
 package handlers
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"io"
-	"log"
 	"net/http"
 	"strconv"
 	"strings"
 	"time"
 
+	"clauded-server/access"
+	"clauded-server/cluster"
 	"clauded-server/config"
+	"clauded-server/keys"
+	"clauded-server/metrics"
 	"clauded-server/notification"
 	"clauded-server/proxy"
 	"clauded-server/session"
 
+	"github.com/gin-contrib/sse"
 	"github.com/gin-gonic/gin"
 )
 
@@ -22,22 +28,44 @@ type Handler struct {
 	sessionManager  *session.Manager
 	notificationSvc *notification.Service
 	proxyManager    *proxy.Manager
+	cluster         *cluster.Node
+	metrics         *metrics.Metrics
+	access          *access.Authenticator
+	keys            *keys.Manager
+	limits          *limits
+	adminLogins     *adminLogins
 }
 
-func NewHandler(cfg *config.Config, sm *session.Manager, ns *notification.Service, pm *proxy.Manager) *Handler {
+func NewHandler(cfg *config.Config, sm *session.Manager, ns *notification.Service, pm *proxy.Manager, cn *cluster.Node, m *metrics.Metrics, a *access.Authenticator, km *keys.Manager) *Handler {
 	return &Handler{
 		config:          cfg,
 		sessionManager:  sm,
 		notificationSvc: ns,
 		proxyManager:    pm,
+		cluster:         cn,
+		metrics:         m,
+		access:          a,
+		keys:            km,
+		limits:          newLimits(cfg),
+		adminLogins:     newAdminLogins(),
 	}
 }
 
 func (h *Handler) SetupRoutes() *gin.Engine {
-	router := gin.Default()
+	router := gin.New()
+	// Validated at startup. Without trusted proxies X-Forwarded-For is
+	// ignored and the client IP is the peer address.
+	router.SetTrustedProxies(h.config.TrustedProxies)
+	router.Use(RequestID, AccessLog, gin.Recovery(), h.LimitIP, h.SessionHost)
 
 	// Health check
 	router.GET("/health", h.HealthCheck)
+	router.GET("/ready", h.ReadyCheck)
+
+	// Prometheus metrics
+	if h.config.EnableMetrics {
+		router.GET("/metrics", h.RequireMetrics, gin.WrapH(h.metrics.Handler()))
+	}
 
 	// SSE notifications
 	router.GET("/api/v1/notifications/stream", h.SSEStream)
@@ -49,18 +77,70 @@ func (h *Handler) SetupRoutes() *gin.Engine {
 		api.POST("/publish", h.PublishNotification)
 		api.DELETE("/unsubscribe", h.UnsubscribeWebhook)
 		api.GET("/subscriptions", h.GetSubscriptions)
+		api.GET("/subscriptions/:id", h.GetSubscription)
+		api.PATCH("/subscriptions/:id", h.UpdateSubscription)
+		api.DELETE("/subscriptions/:id", h.DeleteSubscription)
+		api.GET("/recent", h.RequireAdmin, h.RecentNotifications)
+		api.POST("/tokens", h.RequireAdmin, h.CreateToken)
+		api.GET("/deliveries", h.GetDeliveries)
+		api.GET("/dead-letters", h.GetDeadLetters)
+		api.POST("/dead-letters/:id/replay", h.ReplayDeadLetter)
+	}
+
+	// Session admin API
+	sessions := router.Group("/api/v1/sessions", h.RequireAdmin)
+	{
+		sessions.GET("", h.ListSessions)
+		sessions.GET("/:id", h.GetSession)
+		sessions.DELETE("/:id", h.DisconnectSession)
+		sessions.PUT("/:id/tags", h.SetSessionTags)
+		sessions.GET("/:id/access", h.GetSessionAccess)
 	}
 
-	// Root path "/" -> proxy to piko as "root-service"
-	router.Any("/", gin.WrapH(h.proxyManager.ProxyRootRequest()))
+	// Upstream key admin API
+	keyAPI := router.Group("/api/v1/keys", h.RequireAdmin)
+	{
+		keyAPI.POST("", h.CreateKey)
+		keyAPI.GET("", h.ListKeys)
+		keyAPI.DELETE("/:id", h.RevokeKey)
+	}
+
+	// Session registration and name checks by gottyp, with its upstream token
+	router.POST("/api/v1/sessions/:id/access", h.RegisterSession)
+	router.GET("/api/v1/sessions/:id/claim", h.ClaimSession)
+
+	// OIDC login for session access
+	if h.access.Mode() == access.ModeOIDC {
+		auth := router.Group("/_auth")
+		{
+			auth.GET("/login", h.Login)
+			auth.GET("/callback", h.LoginCallback)
+			auth.GET("/logout", h.Logout)
+			auth.POST("/logout", h.Logout)
+		}
+	}
+
+	// Admin dashboard
+	if h.dashboardEnabled() {
+		dashboard := router.Group("/admin")
+		{
+			dashboard.GET("/", h.Dashboard)
+			dashboard.GET("/login", h.DashboardLogin)
+			dashboard.POST("/login", h.DashboardLoginSubmit)
+			dashboard.POST("/logout", h.DashboardLogout)
+		}
+	}
+
+	// Root path "/" -> dashboard, or proxy to piko as "root-service"
+	router.Any("/", h.Root)
 
 	// Piko Upstream (Agent) connection path
 	// This handles direct connections to /v1/upstream/... without /piko prefix
-	router.Any("/v1/upstream/*path", gin.WrapH(h.proxyManager.ProxyUpstreamRequest()))
+	router.Any("/v1/upstream/*path", h.ProxyUpstream)
 
 	// /piko path -> proxy to piko upstream (legacy/compatibility)
-	router.Any("/piko/*path", gin.WrapH(h.proxyManager.ProxyUpstreamRequest()))
-	router.Any("/piko", gin.WrapH(h.proxyManager.ProxyUpstreamRequest()))
+	router.Any("/piko/*path", h.ProxyUpstream)
+	router.Any("/piko", h.ProxyUpstream)
 
 	// Catch-all: Proxy all other requests
 	// This intelligently handles:
@@ -73,29 +153,86 @@ func (h *Handler) SetupRoutes() *gin.Engine {
 
 func (h *Handler) HealthCheck(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{
-		"status": "ok",
-		"time":   time.Now().Format(time.RFC3339),
+		"status":       "ok",
+		"time":         time.Now().Format(time.RFC3339),
+		"session_auth": h.access.Mode(),
 	})
 }
 
+// ReadyCheck reports whether the embedded piko server accepts connections
+func (h *Handler) ReadyCheck(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 2*time.Second)
+	defer cancel()
+
+	if err := h.proxyManager.Ready(ctx); err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"status": "not ready", "error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ready"})
+}
+
 func (h *Handler) SSEStream(c *gin.Context) {
-	sessionID := c.Query("session_id")
-	if sessionID == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "session_id is required"})
+	target := targetFromQuery(c)
+	if err := target.Validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !h.authorizeTarget(c, target, ScopeSubscribe) {
+		return
+	}
+	release, ok := h.acquire(c, h.limits.streams, limitStreams, c.ClientIP(), "too many notification streams open")
+	if !ok {
+		return
+	}
+	defer release()
+	rules, err := rulesFromQuery(c)
+	if err == nil {
+		err = rules.Validate()
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	var eventTypes []notification.NotificationType
+	if events := c.Query("events"); events != "" {
+		eventTypes = toEventTypes(strings.Split(events, ","))
+	}
+
+	// Subscribe to notifications before replaying, so nothing published in
+	// between is missed
+	sub, err := h.notificationSvc.SubscribeSSE(target, eventTypes, rules)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	defer h.notificationSvc.Unsubscribe(sub.ID)
+	ch := sub.Channel
 
 	// Set SSE headers
 	c.Writer.Header().Set("Content-Type", "text/event-stream")
 	c.Writer.Header().Set("Cache-Control", "no-cache")
 	c.Writer.Header().Set("Connection", "keep-alive")
-	c.Writer.Header().Set("Access-Control-Allow-Origin", "*")
+	h.allowOrigin(c)
 
-	// Subscribe to notifications
-	ch := h.notificationSvc.SubscribeSSE(sessionID)
-	defer func() {
-		// Unsubscribe will be handled by session manager
-	}()
+	// Replay notifications missed since the client's last event
+	lastEventID := c.GetHeader("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = c.Query("last_event_id")
+	}
+	replayed := make(map[string]struct{})
+	if lastEventID != "" {
+		missed, err := h.notificationSvc.Since(target, lastEventID)
+		if err != nil {
+			requestLogger(c).Error("Failed to load missed notifications", "target", target.String(), "error", err)
+		}
+		for _, notif := range missed {
+			if !sub.Accepts(notif) {
+				continue
+			}
+			writeSSE(c, notif)
+			replayed[notif.ID] = struct{}{}
+		}
+	}
 
 	// Flush headers
 	c.Writer.Flush()
@@ -107,10 +244,12 @@ func (h *Handler) SSEStream(c *gin.Context) {
 			if !ok {
 				return false
 			}
+			if _, ok := replayed[notif.ID]; ok {
+				delete(replayed, notif.ID)
+				return true
+			}
 
-			// Format SSE message
-			data, _ := json.Marshal(notif)
-			c.SSEvent(string(notif.Type), string(data))
+			writeSSE(c, notif)
 			return true
 		case <-c.Request.Context().Done():
 			return false
@@ -118,16 +257,106 @@ func (h *Handler) SSEStream(c *gin.Context) {
 	})
 }
 
+// targetFromQuery reads a subscription target from the session_id,
+// session_pattern and tag query parameters
+func targetFromQuery(c *gin.Context) notification.Target {
+	return notification.Target{
+		SessionID:      c.Query("session_id"),
+		SessionPattern: c.Query("session_pattern"),
+		Tag:            c.Query("tag"),
+	}
+}
+
+// rulesFromQuery reads subscriber rules from the filter, min_severity,
+// throttle (e.g. "progress:10s,system_status:1m") and dedup query parameters
+func rulesFromQuery(c *gin.Context) (notification.Rules, error) {
+	rules := notification.Rules{
+		Filter:      c.Query("filter"),
+		MinSeverity: notification.Severity(c.Query("min_severity")),
+		Dedup:       c.Query("dedup"),
+	}
+	if throttle := c.Query("throttle"); throttle != "" {
+		rules.Throttle = make(map[notification.NotificationType]string)
+		for _, item := range strings.Split(throttle, ",") {
+			t, interval, ok := strings.Cut(item, ":")
+			if !ok {
+				return rules, errors.New("invalid throttle: " + item)
+			}
+			rules.Throttle[notification.NotificationType(t)] = interval
+		}
+	}
+	return rules, nil
+}
+
+func toEventTypes(events []string) []notification.NotificationType {
+	eventTypes := make([]notification.NotificationType, 0, len(events))
+	for _, e := range events {
+		if e = strings.TrimSpace(e); e != "" {
+			eventTypes = append(eventTypes, notification.NotificationType(e))
+		}
+	}
+	return eventTypes
+}
+
+// allowOrigin lets pages on the configured origins read a notification
+// stream from another origin. Without SSE_ALLOWED_ORIGINS only pages served
+// by this server can.
+func (h *Handler) allowOrigin(c *gin.Context) {
+	c.Writer.Header().Add("Vary", "Origin")
+	origin := c.GetHeader("Origin")
+	if origin == "" {
+		return
+	}
+	for _, allowed := range h.config.SSEAllowedOrigins {
+		if allowed == "*" {
+			c.Writer.Header().Set("Access-Control-Allow-Origin", "*")
+			return
+		}
+		if strings.EqualFold(strings.TrimSuffix(allowed, "/"), origin) {
+			c.Writer.Header().Set("Access-Control-Allow-Origin", origin)
+			return
+		}
+	}
+}
+
+// writeSSE writes a notification as an SSE event, using the notification ID
+// as the event ID so clients can resume with Last-Event-ID
+func writeSSE(c *gin.Context, notif notification.Notification) {
+	data, _ := json.Marshal(notif)
+	c.Render(-1, sse.Event{
+		Id:    notif.ID,
+		Event: string(notif.Type),
+		Data:  string(data),
+	})
+}
+
 type SubscribeRequest struct {
-	SessionID  string                    `json:"session_id" binding:"required"`
-	WebhookURL string                    `json:"webhook_url" binding:"required"`
-	Events     []string                  `json:"events"`
+	// Exactly one of SessionID, SessionPattern (a glob such as "alice-*",
+	// "*" for every session) and Tag selects the sessions
+	SessionID      string `json:"session_id"`
+	SessionPattern string `json:"session_pattern"`
+	Tag            string `json:"tag"`
+	WebhookURL     string `json:"webhook_url" binding:"required"`
+	// Events lists the notification types delivered, all when empty
+	Events []string `json:"events"`
+	// Filter, MinSeverity, Throttle and Dedup narrow down the notifications
+	// delivered, see notification.Rules
+	notification.Rules
+	// Format selects how deliveries are rendered: feishu, dingtalk, wecom,
+	// slack, telegram or generic (the raw notification, default)
+	Format string `json:"format"`
+	// Secret signs every delivery in the X-Signature header
+	Secret string `json:"secret"`
+	// MaxAttempts and InitialBackoff (e.g. "2s") override the server's
+	// webhook retry defaults
+	MaxAttempts    int    `json:"max_attempts"`
+	InitialBackoff string `json:"initial_backoff"`
 }
 
 type SubscribeResponse struct {
 	SubscriptionID string `json:"subscription_id"`
-	SessionID      string `json:"session_id"`
-	WebhookURL     string `json:"webhook_url"`
+	notification.Target
+	WebhookURL string `json:"webhook_url"`
 }
 
 func (h *Handler) SubscribeWebhook(c *gin.Context) {
@@ -136,30 +365,68 @@ func (h *Handler) SubscribeWebhook(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	target := notification.Target{
+		SessionID:      req.SessionID,
+		SessionPattern: req.SessionPattern,
+		Tag:            req.Tag,
+	}
+	if err := target.Validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !h.authorizeTarget(c, target, ScopeSubscribe) {
+		return
+	}
+
+	if err := req.Rules.Validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	eventTypes := toEventTypes(req.Events)
+
+	if _, ok := notification.LookupFormatter(req.Format); !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "unknown format: " + req.Format, "formats": notification.Formats()})
+		return
+	}
 
-	// Convert string events to NotificationType
-	eventTypes := make([]notification.NotificationType, len(req.Events))
-	for i, e := range req.Events {
-		eventTypes[i] = notification.NotificationType(e)
+	opts := notification.WebhookOptions{
+		Rules:       req.Rules,
+		Format:      req.Format,
+		Secret:      req.Secret,
+		MaxAttempts: req.MaxAttempts,
+	}
+	if req.InitialBackoff != "" {
+		backoff, err := time.ParseDuration(req.InitialBackoff)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid initial_backoff: " + err.Error()})
+			return
+		}
+		opts.InitialBackoff = backoff
 	}
 
 	// Subscribe webhook
-	if err := h.notificationSvc.SubscribeWebhook(req.SessionID, req.WebhookURL, eventTypes); err != nil {
+	sub, err := h.notificationSvc.SubscribeWebhook(target, req.WebhookURL, eventTypes, opts)
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
-	log.Printf("Webhook subscribed: session=%s, url=%s", req.SessionID, req.WebhookURL)
+	requestLogger(c).Info("Webhook subscribed", "target", target.String(), "url", notification.RedactURL(req.WebhookURL), "subscription", sub.ID)
 
-	c.JSON(http.StatusOK, gin.H{
-		"message": "Webhook subscribed successfully",
+	c.JSON(http.StatusOK, SubscribeResponse{
+		SubscriptionID: sub.ID,
+		Target:         sub.Target,
+		WebhookURL:     sub.WebhookURL,
 	})
 }
 
 type PublishRequest struct {
-	SessionID string                 `json:"session_id" binding:"required"`
-	Type      string                 `json:"type" binding:"required"`
-	Data      map[string]interface{} `json:"data"`
+	SessionID string `json:"session_id" binding:"required"`
+	Type      string `json:"type" binding:"required"`
+	// Severity is debug, info, warning, error or critical, defaulting to the
+	// severity of the type
+	Severity string                 `json:"severity"`
+	Data     map[string]interface{} `json:"data"`
 }
 
 func (h *Handler) PublishNotification(c *gin.Context) {
@@ -168,11 +435,22 @@ func (h *Handler) PublishNotification(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	if !h.authorizeSession(c, req.SessionID, ScopePublish) {
+		return
+	}
+	if !h.allow(c, h.limits.publish, limitPublish, req.SessionID) {
+		return
+	}
+	severity := notification.Severity(req.Severity)
+	if severity != "" && !severity.Valid() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "unknown severity: " + req.Severity})
+		return
+	}
 
 	// Publish notification to the service
-	h.notificationSvc.Publish(req.SessionID, notification.NotificationType(req.Type), req.Data)
+	h.notificationSvc.Publish(req.SessionID, notification.NotificationType(req.Type), severity, req.Data)
 
-	log.Printf("Notification published: session=%s, type=%s", req.SessionID, req.Type)
+	requestLogger(c).Info("Notification published", "session", req.SessionID, "type", req.Type)
 
 	c.JSON(http.StatusOK, gin.H{
 		"status":  "published",
@@ -181,35 +459,300 @@ func (h *Handler) PublishNotification(c *gin.Context) {
 	})
 }
 
+func (h *Handler) RecentNotifications(c *gin.Context) {
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "50"))
+
+	notifications, err := h.notificationSvc.Recent(limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"notifications": notifications,
+	})
+}
+
 func (h *Handler) UnsubscribeWebhook(c *gin.Context) {
-	sessionID := c.Query("session_id")
+	if id := c.Query("subscription_id"); id != "" {
+		h.deleteSubscription(c, id)
+		return
+	}
+
+	target := targetFromQuery(c)
 	webhookURL := c.Query("webhook_url")
 
-	if sessionID == "" || webhookURL == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "session_id and webhook_url are required"})
+	if target.Validate() != nil || webhookURL == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "subscription_id, or webhook_url and one of session_id, session_pattern and tag are required"})
+		return
+	}
+	if !h.authorizeTarget(c, target, ScopeSubscribe) {
+		return
+	}
+
+	removed, err := h.notificationSvc.UnsubscribeWebhook(target, webhookURL)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if removed == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "subscription not found"})
 		return
 	}
 
-	// Note: We need to implement unsubscribe by webhook URL
-	// For now, just return success
+	requestLogger(c).Info("Webhook unsubscribed", "target", target.String(), "url", webhookURL, "count", removed)
+
 	c.JSON(http.StatusOK, gin.H{
 		"message": "Webhook unsubscribed successfully",
+		"removed": removed,
 	})
 }
 
 func (h *Handler) GetSubscriptions(c *gin.Context) {
-	sessionID := c.Query("session_id")
-	if sessionID == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "session_id is required"})
+	target := targetFromQuery(c)
+	if err := target.Validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !h.authorizeTarget(c, target, ScopeSubscribe) {
 		return
 	}
 
-	subs := h.notificationSvc.GetSubscribers(sessionID)
+	subs := h.notificationSvc.GetSubscribers(target)
 	c.JSON(http.StatusOK, gin.H{
 		"subscriptions": subs,
 	})
 }
 
+func (h *Handler) GetSubscription(c *gin.Context) {
+	sub, exists := h.notificationSvc.Subscription(c.Param("id"))
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "subscription not found"})
+		return
+	}
+	if !h.authorizeTarget(c, sub.Target, ScopeSubscribe) {
+		return
+	}
+
+	c.JSON(http.StatusOK, sub)
+}
+
+// UpdateSubscriptionRequest changes a webhook subscription. Omitted fields
+// are left unchanged.
+type UpdateSubscriptionRequest struct {
+	WebhookURL  *string                                   `json:"webhook_url"`
+	Events      *[]string                                 `json:"events"`
+	Filter      *string                                   `json:"filter"`
+	MinSeverity *notification.Severity                    `json:"min_severity"`
+	Throttle    *map[notification.NotificationType]string `json:"throttle"`
+	Dedup       *string                                   `json:"dedup"`
+	Format      *string                                   `json:"format"`
+}
+
+func (h *Handler) UpdateSubscription(c *gin.Context) {
+	if !h.authorizeSubscription(c, c.Param("id")) {
+		return
+	}
+
+	var req UpdateSubscriptionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.WebhookURL != nil && *req.WebhookURL == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "webhook_url must not be empty"})
+		return
+	}
+
+	if req.Format != nil {
+		if _, ok := notification.LookupFormatter(*req.Format); !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "unknown format: " + *req.Format, "formats": notification.Formats()})
+			return
+		}
+	}
+
+	update := notification.SubscriptionUpdate{
+		WebhookURL: req.WebhookURL,
+		Format:     req.Format,
+	}
+	if req.Events != nil {
+		update.EventTypes = toEventTypes(*req.Events)
+	}
+	if req.Filter != nil || req.MinSeverity != nil || req.Throttle != nil || req.Dedup != nil {
+		current, exists := h.notificationSvc.Subscription(c.Param("id"))
+		if !exists {
+			c.JSON(http.StatusNotFound, gin.H{"error": notification.ErrSubscriptionNotFound.Error()})
+			return
+		}
+		rules := current.Rules
+		if req.Filter != nil {
+			rules.Filter = *req.Filter
+		}
+		if req.MinSeverity != nil {
+			rules.MinSeverity = *req.MinSeverity
+		}
+		if req.Throttle != nil {
+			rules.Throttle = *req.Throttle
+		}
+		if req.Dedup != nil {
+			rules.Dedup = *req.Dedup
+		}
+		if err := rules.Validate(); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		update.Rules = &rules
+	}
+
+	sub, err := h.notificationSvc.UpdateSubscription(c.Param("id"), update)
+	if errors.Is(err, notification.ErrSubscriptionNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	requestLogger(c).Info("Webhook subscription updated", "subscription", sub.ID, "url", notification.RedactURL(sub.WebhookURL))
+
+	c.JSON(http.StatusOK, sub)
+}
+
+func (h *Handler) DeleteSubscription(c *gin.Context) {
+	h.deleteSubscription(c, c.Param("id"))
+}
+
+func (h *Handler) deleteSubscription(c *gin.Context, id string) {
+	if !h.authorizeSubscription(c, id) {
+		return
+	}
+
+	err := h.notificationSvc.Unsubscribe(id)
+	if errors.Is(err, notification.ErrSubscriptionNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	requestLogger(c).Info("Subscription removed", "subscription", id)
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Webhook unsubscribed successfully",
+	})
+}
+
+// GetDeliveries returns the deliveries of the subscription_id subscription,
+// or of every subscription for a token covering every session
+func (h *Handler) GetDeliveries(c *gin.Context) {
+	subscriptionID := c.Query("subscription_id")
+	if !h.authorizeDeliveries(c, subscriptionID) {
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"deliveries": h.notificationSvc.Deliveries(subscriptionID),
+	})
+}
+
+// GetDeadLetters returns the dead letters of the subscription_id
+// subscription, or of every subscription for a token covering every session
+func (h *Handler) GetDeadLetters(c *gin.Context) {
+	subscriptionID := c.Query("subscription_id")
+	if !h.authorizeDeliveries(c, subscriptionID) {
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"dead_letters": h.notificationSvc.DeadLetters(subscriptionID),
+	})
+}
+
+// authorizeDeliveries checks that the request may read the deliveries of a
+// subscription. They are authorized by the subscription's target rather than
+// the notification's session, as a session's notifications also go to the
+// subscriptions of other users.
+func (h *Handler) authorizeDeliveries(c *gin.Context, subscriptionID string) bool {
+	if subscriptionID == "" {
+		return h.authorizeSession(c, notification.AllSessions, ScopeSubscribe)
+	}
+	return h.authorizeSubscription(c, subscriptionID)
+}
+
+func (h *Handler) ReplayDeadLetter(c *gin.Context) {
+	id := c.Param("id")
+	dl, exists := h.notificationSvc.DeadLetter(id)
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "dead letter not found"})
+		return
+	}
+	// Once its subscription is gone, only a token covering every session
+	// may replay a dead letter
+	if _, exists := h.notificationSvc.Subscription(dl.SubscriberID); exists {
+		if !h.authorizeSubscription(c, dl.SubscriberID) {
+			return
+		}
+	} else if !h.authorizeSession(c, notification.AllSessions, ScopeSubscribe) {
+		return
+	}
+
+	if !h.notificationSvc.ReplayDeadLetter(id) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "dead letter not found"})
+		return
+	}
+
+	requestLogger(c).Info("Dead letter replayed", "delivery", id)
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Dead letter scheduled for delivery",
+	})
+}
+
+// ProxyUpstream proxies agent connections to the piko upstream server and
+// tracks them in the session manager so they can be listed and disconnected
+func (h *Handler) ProxyUpstream(c *gin.Context) {
+	endpointID := upstreamEndpointID(c.Request.URL.Path)
+	if cluster.IsInternalEndpoint(endpointID) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "reserved endpoint"})
+		return
+	}
+	if endpointID != "" {
+		if !session.ValidEndpoint(endpointID) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "session IDs may not contain " + session.PortSeparator + ", port forwards connect as {session}" + session.PortSeparator + "{port}"})
+			return
+		}
+		owner, ok := h.authorizeUpstream(c, endpointID)
+		if !ok || !h.limitUpstream(c, owner) {
+			return
+		}
+		ctx, cancel := context.WithCancel(c.Request.Context())
+		defer cancel()
+
+		release, ok := h.claimEndpoint(c, endpointID, upstreamClient(c, owner), cancel)
+		if !ok {
+			return
+		}
+		defer release()
+
+		c.Request = c.Request.WithContext(ctx)
+	}
+
+	h.proxy(c, metrics.RouteUpstream, "", "", h.proxyManager.ProxyUpstreamRequest())
+}
+
+// upstreamEndpointID extracts the endpoint ID from /piko/v1/upstream/:endpointID
+// or /v1/upstream/:endpointID
+func upstreamEndpointID(path string) string {
+	path = strings.TrimPrefix(path, "/piko")
+	if !strings.HasPrefix(path, "/v1/upstream/") {
+		return ""
+	}
+	return strings.Trim(strings.TrimPrefix(path, "/v1/upstream/"), "/")
+}
+
 // ProxyRequest intelligently routes requests to either port forwarding or regular session
 func (h *Handler) ProxyRequest(c *gin.Context) {
 	path := c.Request.URL.Path
@@ -217,18 +760,52 @@ func (h *Handler) ProxyRequest(c *gin.Context) {
 	path = strings.TrimPrefix(path, "/")
 	parts := strings.Split(path, "/")
 
+	if cluster.IsInternalEndpoint(parts[0]) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "session not found"})
+		return
+	}
+	if h.config.SessionDomain != "" && parts[0] != "" {
+		h.toSessionHost(c, parts[0])
+		return
+	}
+	h.proxySession(c, parts)
+}
+
+// proxySession proxies a request to the session of the first path segment,
+// its files or its ports
+func (h *Handler) proxySession(c *gin.Context, parts []string) {
+	if parts[0] != "" {
+		if !session.ValidID(parts[0]) {
+			// A port forward is only served under the path of its session
+			c.JSON(http.StatusNotFound, gin.H{"error": "session not found"})
+			return
+		}
+		// Authorize first, so unauthenticated requests can't use up the
+		// session's rate limit
+		if !h.authorizeProxy(c, parts[0]) || !h.allow(c, h.limits.session, limitSession, parts[0]) {
+			return
+		}
+		h.sessionManager.Touch(parts[0])
+	}
+
 	// Check if this is a port forwarding request: /:session/:port/*
 	// The second segment should be a valid port number
 	if len(parts) >= 2 {
 		// Try to parse the second segment as a port number
 		if _, err := strconv.Atoi(parts[1]); err == nil {
 			// It's a valid port number, use port forwarding
-			h.proxyManager.ProxyPortRequest()(c.Writer, c.Request)
+			h.proxy(c, metrics.RoutePort, parts[0], parts[1], h.proxyManager.ProxyPortRequest())
 			return
 		}
 	}
 
-	// Otherwise, use regular session proxy
-	h.proxyManager.ProxyRequest()(c.Writer, c.Request)
+	// Otherwise, use regular session proxy, capping the terminals open on it
+	if isWebSocket(c) {
+		release, ok := h.acquire(c, h.limits.terminals, limitTerminals, parts[0], "too many terminals open on session "+parts[0])
+		if !ok {
+			return
+		}
+		defer release()
+	}
+	h.proxy(c, metrics.RouteSession, parts[0], "", h.proxyManager.ProxyRequest())
 }
-
@@ -0,0 +1,47 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"clauded-server/config"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestAllowOrigin(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	tests := []struct {
+		name    string
+		allowed []string
+		origin  string
+		want    string
+	}{
+		{name: "no origins configured", origin: "https://evil.example.com"},
+		{name: "same origin request", allowed: []string{"https://app.example.com"}},
+		{name: "allowed", allowed: []string{"https://other.example.com", "https://app.example.com/"}, origin: "https://app.example.com", want: "https://app.example.com"},
+		{name: "not allowed", allowed: []string{"https://app.example.com"}, origin: "https://evil.example.com"},
+		{name: "any origin", allowed: []string{"*"}, origin: "https://evil.example.com", want: "*"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &Handler{config: &config.Config{SSEAllowedOrigins: tt.allowed}}
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request = httptest.NewRequest(http.MethodGet, "/api/v1/notifications/stream", nil)
+			if tt.origin != "" {
+				c.Request.Header.Set("Origin", tt.origin)
+			}
+
+			h.allowOrigin(c)
+			if got := w.Header().Get("Access-Control-Allow-Origin"); got != tt.want {
+				t.Fatalf("Access-Control-Allow-Origin = %q, want %q", got, tt.want)
+			}
+			if w.Header().Get("Vary") != "Origin" {
+				t.Fatal("response doesn't vary by origin")
+			}
+		})
+	}
+}
@@ -0,0 +1,186 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"clauded-server/keys"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// upstreamToken is a verified token of a gottyp client: a user key, or a
+// token signed with the shared UPSTREAM_KEY listing its endpoints
+type upstreamToken struct {
+	key       *keys.Key
+	endpoints []string
+	// expires is when the token or key expires, zero if never
+	expires time.Time
+}
+
+// permits reports whether the token may use a session
+func (t *upstreamToken) permits(sessionID string) bool {
+	if t.key != nil {
+		return t.key.Permits(sessionID)
+	}
+	return contains(t.endpoints, sessionID)
+}
+
+// owner returns the user of a user key, or "" for the shared key
+func (t *upstreamToken) owner() string {
+	if t.key != nil {
+		return t.key.User
+	}
+	return ""
+}
+
+// errSharedKeyDisabled is returned for tokens signed with the shared
+// UPSTREAM_KEY when only user keys are accepted
+var errSharedKeyDisabled = errors.New("shared upstream key is disabled, use a user key")
+
+// parseUpstreamToken verifies a user key, or a token signed with the shared
+// UPSTREAM_KEY unless ALLOW_SHARED_UPSTREAM_KEY is off
+func (h *Handler) parseUpstreamToken(token string) (*upstreamToken, error) {
+	key, err := h.keys.Verify(token)
+	if err == nil {
+		upstream := &upstreamToken{key: &key}
+		if key.ExpiresAt != nil {
+			upstream.expires = *key.ExpiresAt
+		}
+		return upstream, nil
+	}
+	if !errors.Is(err, keys.ErrInvalid) {
+		return nil, err
+	}
+	if h.config.PikoUpstreamAuthHMACSecretKey == "" {
+		return nil, keys.ErrInvalid
+	}
+
+	var claims notifyClaims
+	_, err = jwt.ParseWithClaims(token, &claims, func(*jwt.Token) (interface{}, error) {
+		return []byte(h.config.PikoUpstreamAuthHMACSecretKey), nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
+	if err != nil || claims.Notify != nil {
+		return nil, keys.ErrInvalid
+	}
+	if !h.config.AllowSharedUpstreamKey {
+		return nil, errSharedKeyDisabled
+	}
+	upstream := &upstreamToken{endpoints: claims.Piko.Endpoints}
+	if claims.ExpiresAt != nil {
+		upstream.expires = claims.ExpiresAt.Time
+	}
+	return upstream, nil
+}
+
+// authorizeUpstream checks the token of an agent connecting to a piko
+// endpoint and returns the user of its key, writing an error response and
+// returning false if it may not connect. A user key must be unrevoked and
+// cover the endpoint, a token signed with the shared key must list it.
+// Without UPSTREAM_KEY every agent may connect. The token is replaced by a
+// piko token for that endpoint alone, which only this server can sign.
+func (h *Handler) authorizeUpstream(c *gin.Context, endpointID string) (string, bool) {
+	var (
+		owner   string
+		expires time.Time
+	)
+	if h.config.PikoUpstreamAuthHMACSecretKey != "" {
+		upstream, err := h.parseUpstreamToken(strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer "))
+		if err != nil {
+			requestLogger(c).Warn("Upstream token refused", "endpoint", endpointID, "error", err)
+			c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+			return "", false
+		}
+		if !upstream.permits(endpointID) {
+			if upstream.key != nil {
+				requestLogger(c).Warn("Upstream endpoint not permitted", "endpoint", endpointID, "user", upstream.key.User, "key", upstream.key.ID)
+				c.JSON(http.StatusForbidden, gin.H{"error": "key of " + upstream.key.User + " only permits sessions starting with " + upstream.key.Prefix})
+				return "", false
+			}
+			c.JSON(http.StatusForbidden, gin.H{"error": "upstream token doesn't permit endpoint " + endpointID})
+			return "", false
+		}
+		owner, expires = upstream.owner(), upstream.expires
+	}
+
+	pikoToken, err := h.proxyManager.UpstreamToken(endpointID, expires)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return "", false
+	}
+	c.Request.Header.Set("Authorization", "Bearer "+pikoToken)
+	if owner != "" {
+		c.Set(userKey, owner)
+	}
+	return owner, true
+}
+
+type CreateKeyRequest struct {
+	User string `json:"user" binding:"required"`
+	// Prefix defaults to "{user}-"
+	Prefix string `json:"prefix"`
+	// TTL (e.g. "720h") defaults to no expiry
+	TTL string `json:"ttl"`
+}
+
+// CreateKey mints an upstream key for a user
+func (h *Handler) CreateKey(c *gin.Context) {
+	var req CreateKeyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var ttl time.Duration
+	if req.TTL != "" {
+		d, err := time.ParseDuration(req.TTL)
+		if err != nil || d <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid ttl: " + req.TTL})
+			return
+		}
+		ttl = d
+	}
+
+	key, token, err := h.keys.Mint(req.User, req.Prefix, ttl)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	h.cluster.ShareKey(key)
+
+	requestLogger(c).Info("Upstream key created", "key", key.ID, "user", key.User, "prefix", key.Prefix)
+
+	c.JSON(http.StatusOK, gin.H{
+		"key":   key,
+		"token": token,
+	})
+}
+
+func (h *Handler) ListKeys(c *gin.Context) {
+	list := h.keys.List()
+	c.JSON(http.StatusOK, gin.H{
+		"keys":  list,
+		"count": len(list),
+	})
+}
+
+// RevokeKey revokes an upstream key on every node
+func (h *Handler) RevokeKey(c *gin.Context) {
+	key, err := h.keys.Revoke(c.Param("id"))
+	if errors.Is(err, keys.ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	h.cluster.ShareKey(key)
+
+	requestLogger(c).Info("Upstream key revoked", "key", key.ID, "user", key.User)
+
+	c.JSON(http.StatusOK, key)
+}
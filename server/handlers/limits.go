@@ -0,0 +1,110 @@
+package handlers
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"clauded-server/config"
+	"clauded-server/ratelimit"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Limits, as reported in the rate limit metric
+const (
+	limitIP        = "ip"
+	limitSession   = "session"
+	limitPublish   = "publish"
+	limitUpstream  = "upstream"
+	limitTerminals = "terminals"
+	limitStreams   = "streams"
+	limitSessions  = "sessions"
+)
+
+// capRetryAfter is the Retry-After sent when a cap on concurrent terminals,
+// streams or sessions is reached, as there is no telling when a slot frees
+const capRetryAfter = 30 * time.Second
+
+// limits are the rate limits and caps of the server, each disabled when
+// configured as 0
+type limits struct {
+	ip       *ratelimit.Limiter
+	session  *ratelimit.Limiter
+	publish  *ratelimit.Limiter
+	upstream *ratelimit.Limiter
+
+	terminals *ratelimit.Counter
+	streams   *ratelimit.Counter
+	// sessionsPerKey caps the sessions connected with one user key
+	sessionsPerKey int
+}
+
+func newLimits(cfg *config.Config) *limits {
+	return &limits{
+		ip:             ratelimit.New(cfg.RateLimitIP, time.Minute),
+		session:        ratelimit.New(cfg.RateLimitSession, time.Minute),
+		publish:        ratelimit.New(cfg.RateLimitPublish, time.Minute),
+		upstream:       ratelimit.New(cfg.RateLimitUpstream, time.Minute),
+		terminals:      ratelimit.NewCounter(cfg.MaxTerminalsPerSession),
+		streams:        ratelimit.NewCounter(cfg.MaxStreamsPerIP),
+		sessionsPerKey: cfg.MaxSessionsPerKey,
+	}
+}
+
+// LimitIP rate limits the requests of every client IP, except health checks
+func (h *Handler) LimitIP(c *gin.Context) {
+	if path := c.Request.URL.Path; path == "/health" || path == "/ready" {
+		c.Next()
+		return
+	}
+	if !h.allow(c, h.limits.ip, limitIP, c.ClientIP()) {
+		return
+	}
+	c.Next()
+}
+
+// allow takes a token from limiter for key, responding with 429 and
+// returning false when there is none
+func (h *Handler) allow(c *gin.Context, limiter *ratelimit.Limiter, limit, key string) bool {
+	ok, wait := limiter.Allow(key)
+	if !ok {
+		h.tooManyRequests(c, limit, wait, "rate limit exceeded, retry in "+retryAfter(wait)+"s")
+	}
+	return ok
+}
+
+// acquire takes a slot from counter for key, responding with 429 and
+// returning false when all are taken
+func (h *Handler) acquire(c *gin.Context, counter *ratelimit.Counter, limit, key, msg string) (func(), bool) {
+	release, ok := counter.Acquire(key)
+	if !ok {
+		h.tooManyRequests(c, limit, capRetryAfter, msg)
+	}
+	return release, ok
+}
+
+// limitUpstream rate limits the upstream connections of a user key, or of
+// the client IP for the shared key. The sessions of a user key are capped
+// when the upstream claims its endpoint.
+func (h *Handler) limitUpstream(c *gin.Context, owner string) bool {
+	key := "ip:" + c.ClientIP()
+	if owner != "" {
+		key = "user:" + owner
+	}
+	return h.allow(c, h.limits.upstream, limitUpstream, key)
+}
+
+func (h *Handler) tooManyRequests(c *gin.Context, limit string, wait time.Duration, msg string) {
+	h.metrics.ObserveRateLimited(limit)
+	requestLogger(c).Debug("Rate limited", "limit", limit, "retry_after", wait)
+
+	c.Header("Retry-After", retryAfter(wait))
+	c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": msg})
+}
+
+// retryAfter formats a wait as whole seconds, at least 1
+func retryAfter(wait time.Duration) string {
+	return strconv.Itoa(int(math.Max(1, math.Ceil(wait.Seconds()))))
+}
@@ -0,0 +1,105 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"clauded-server/config"
+	"clauded-server/metrics"
+	"clauded-server/session"
+
+	"github.com/gin-gonic/gin"
+)
+
+func newLimitHandler(cfg *config.Config) *Handler {
+	return &Handler{
+		config:  cfg,
+		metrics: metrics.New(session.NewManager(), nil, false),
+		limits:  newLimits(cfg),
+	}
+}
+
+func TestLimitIP(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	h := newLimitHandler(&config.Config{RateLimitIP: 2})
+	router := gin.New()
+	router.Use(h.LimitIP)
+	router.GET("/health", func(c *gin.Context) { c.Status(http.StatusOK) })
+	router.GET("/alice/", func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	request := func(path, ip string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		r.RemoteAddr = ip + ":1234"
+		router.ServeHTTP(w, r)
+		return w
+	}
+
+	for i := 0; i < 2; i++ {
+		if w := request("/alice/", "203.0.113.1"); w.Code != http.StatusOK {
+			t.Fatalf("request %d = %d, want 200", i, w.Code)
+		}
+	}
+	w := request("/alice/", "203.0.113.1")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("request past the limit = %d, want 429", w.Code)
+	}
+	// The bucket refills a token every 30s
+	if retryAfter := w.Header().Get("Retry-After"); retryAfter != "30" {
+		t.Fatalf("Retry-After = %q, want 30", retryAfter)
+	}
+
+	if w := request("/health", "203.0.113.1"); w.Code != http.StatusOK {
+		t.Fatalf("health check = %d, want it exempt", w.Code)
+	}
+	if w := request("/alice/", "203.0.113.2"); w.Code != http.StatusOK {
+		t.Fatalf("request of another IP = %d, want 200", w.Code)
+	}
+}
+
+func TestAcquire(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	h := newLimitHandler(&config.Config{MaxTerminalsPerSession: 1})
+
+	acquire := func() (*httptest.ResponseRecorder, func(), bool) {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest(http.MethodGet, "/alice/ws", nil)
+		release, ok := h.acquire(c, h.limits.terminals, limitTerminals, "alice", "too many terminals")
+		return w, release, ok
+	}
+
+	_, release, ok := acquire()
+	if !ok {
+		t.Fatal("first terminal refused")
+	}
+	w, _, ok := acquire()
+	if ok || w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "30" {
+		t.Fatalf("terminal past the cap = %v with status %d and Retry-After %q, want 429 after 30s", ok, w.Code, w.Header().Get("Retry-After"))
+	}
+
+	release()
+	if _, _, ok := acquire(); !ok {
+		t.Fatal("terminal refused after one was released")
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	tests := []struct {
+		wait time.Duration
+		want string
+	}{
+		{wait: 0, want: "1"},
+		{wait: 300 * time.Millisecond, want: "1"},
+		{wait: time.Second, want: "1"},
+		{wait: 1200 * time.Millisecond, want: "2"},
+		{wait: time.Minute, want: "60"},
+	}
+	for _, tt := range tests {
+		if got := retryAfter(tt.wait); got != tt.want {
+			t.Errorf("retryAfter(%v) = %q, want %q", tt.wait, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package handlers
+
+import (
+	"log/slog"
+	"net/http"
+	"time"
+
+	"clauded-server/logging"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// Context keys set for the access log
+const (
+	requestIDKey = "request_id"
+	proxyInfoKey = "proxy_info"
+)
+
+// maxRequestIDLength bounds request IDs accepted from clients
+const maxRequestIDLength = 128
+
+// RequestID takes the request ID from the X-Request-ID header, or generates
+// one, and sets it on the request forwarded to piko, the request context and
+// the response
+func RequestID(c *gin.Context) {
+	id := c.GetHeader(logging.RequestIDHeader)
+	if !validRequestID(id) {
+		id = uuid.NewString()
+	}
+	c.Request.Header.Set(logging.RequestIDHeader, id)
+	c.Request = c.Request.WithContext(logging.WithRequestID(c.Request.Context(), id))
+	c.Header(logging.RequestIDHeader, id)
+	c.Set(requestIDKey, id)
+	c.Next()
+}
+
+// validRequestID accepts IDs of printable ASCII characters
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// AccessLog logs every request once it has been served, with the session,
+// port and proxied bytes of requests proxied to a client. Health checks and
+// metric scrapes are logged at debug level.
+func AccessLog(c *gin.Context) {
+	start := time.Now()
+	c.Next()
+
+	status := c.Writer.Status()
+	level := slog.LevelInfo
+	switch c.Request.URL.Path {
+	case "/health", "/ready", "/metrics":
+		if status < 500 {
+			level = slog.LevelDebug
+		}
+	}
+
+	bytesIn := c.Request.ContentLength
+	if bytesIn < 0 {
+		bytesIn = 0
+	}
+	bytesOut := int64(c.Writer.Size())
+	if bytesOut < 0 {
+		bytesOut = 0
+	}
+
+	attrs := []slog.Attr{
+		slog.String("request_id", c.GetString(requestIDKey)),
+		slog.String("method", c.Request.Method),
+		slog.String("path", c.Request.URL.Path),
+		slog.String("client_ip", c.ClientIP()),
+	}
+	if value, ok := c.Get(proxyInfoKey); ok {
+		info := value.(*proxyInfo)
+		attrs = append(attrs, slog.String("route", info.route))
+		if info.session != "" {
+			attrs = append(attrs, slog.String("session", info.session))
+		}
+		if info.port != "" {
+			attrs = append(attrs, slog.String("port", info.port))
+		}
+		if info.hijacked {
+			status = http.StatusSwitchingProtocols
+		}
+		bytesIn = info.traffic.in.Load()
+		bytesOut = info.traffic.out.Load()
+	}
+	if user := c.GetString(userKey); user != "" {
+		attrs = append(attrs, slog.String("user", user))
+	}
+	attrs = append(attrs,
+		slog.Int("status", status),
+		slog.Int64("bytes_in", bytesIn),
+		slog.Int64("bytes_out", bytesOut),
+		slog.Duration("duration", time.Since(start)),
+	)
+	if len(c.Errors) > 0 {
+		attrs = append(attrs, slog.String("error", c.Errors.String()))
+	}
+
+	slog.LogAttrs(c.Request.Context(), level, "HTTP request", attrs...)
+}
+
+// requestLogger returns the default logger with the ID of the request
+func requestLogger(c *gin.Context) *slog.Logger {
+	return slog.With("request_id", c.GetString(requestIDKey))
+}
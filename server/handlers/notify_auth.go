@@ -0,0 +1,224 @@
+package handlers
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"clauded-server/notification"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Notification token scopes
+const (
+	ScopePublish   = "publish"
+	ScopeSubscribe = "subscribe"
+)
+
+// notifyClaims are the claims of a notification API token. The upstream
+// token of gottyp, a user key or a token signed with UPSTREAM_KEY carrying
+// piko.endpoints, covers every scope for its sessions. Tokens minted by the
+// server carry a notify claim restricting sessions and scopes and are signed
+// with a key derived from UPSTREAM_KEY, so piko never accepts them as
+// upstream tokens (it treats a token without endpoints as valid for all).
+type notifyClaims struct {
+	Piko struct {
+		Endpoints []string `json:"endpoints"`
+	} `json:"piko"`
+	Notify *notifyClaim `json:"notify,omitempty"`
+	jwt.RegisteredClaims
+
+	upstream *upstreamToken
+}
+
+type notifyClaim struct {
+	Sessions []string `json:"sessions"`
+	Scopes   []string `json:"scopes"`
+}
+
+// covers reports whether the claims grant scope on a session. Minted tokens
+// may list session patterns such as "alice-*"; matching a pattern against
+// another pattern treats the latter's wildcards literally, so "alice-*"
+// covers the subscription pattern "alice-dev-*" but not "*".
+func (c *notifyClaims) covers(sessionID, scope string) bool {
+	if c.Notify != nil {
+		if !contains(c.Notify.Scopes, scope) {
+			return false
+		}
+		for _, pattern := range c.Notify.Sessions {
+			if ok, _ := path.Match(pattern, sessionID); ok {
+				return true
+			}
+		}
+		return false
+	}
+	return c.upstream != nil && c.upstream.permits(sessionID)
+}
+
+// notifyTokenKey returns the key signing minted notification tokens
+func (h *Handler) notifyTokenKey() []byte {
+	mac := hmac.New(sha256.New, []byte(h.config.PikoUpstreamAuthHMACSecretKey))
+	mac.Write([]byte("gottyp-notify"))
+	return mac.Sum(nil)
+}
+
+// parseNotifyToken verifies a minted notification token or a gottyp upstream
+// token
+func (h *Handler) parseNotifyToken(token string) (*notifyClaims, bool) {
+	var claims notifyClaims
+	_, err := jwt.ParseWithClaims(token, &claims, func(*jwt.Token) (interface{}, error) {
+		return h.notifyTokenKey(), nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
+	if err == nil && claims.Notify != nil {
+		return &claims, true
+	}
+
+	// Upstream tokens only grant access to the sessions they may register
+	upstream, err := h.parseUpstreamToken(token)
+	if err != nil {
+		return nil, false
+	}
+	return &notifyClaims{upstream: upstream}, true
+}
+
+// authorizeSession checks that the request carries a token granting scope on
+// a session, writing an error response and returning false if it doesn't.
+// Tokens are HS256 JWTs derived from UPSTREAM_KEY, passed as a bearer token or
+// in the token query parameter (for EventSource, which can't set headers).
+// The admin token grants everything. Without UPSTREAM_KEY the notification
+// API is open, like the upstream.
+func (h *Handler) authorizeSession(c *gin.Context, sessionID, scope string) bool {
+	if h.config.PikoUpstreamAuthHMACSecretKey == "" || h.isAdmin(c) {
+		return true
+	}
+
+	token := c.Query("token")
+	if header := c.GetHeader("Authorization"); strings.HasPrefix(header, "Bearer ") {
+		token = strings.TrimPrefix(header, "Bearer ")
+	}
+	if token == "" {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "notification token required"})
+		return false
+	}
+
+	claims, ok := h.parseNotifyToken(token)
+	if !ok {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid notification token"})
+		return false
+	}
+
+	if !claims.covers(sessionID, scope) {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "token does not grant " + scope + " on session " + sessionID})
+		return false
+	}
+	return true
+}
+
+// authorizeSubscription checks that the request may manage a subscription,
+// writing an error response and returning false if it may not or the
+// subscription doesn't exist
+func (h *Handler) authorizeSubscription(c *gin.Context, id string) bool {
+	sub, exists := h.notificationSvc.Subscription(id)
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "subscription not found"})
+		return false
+	}
+	return h.authorizeTarget(c, sub.Target, ScopeSubscribe)
+}
+
+// authorizeTarget checks that the request may use scope on every session a
+// target selects. A pattern must be covered by a token session pattern, and
+// tags may select any session, so they need a token covering "*".
+func (h *Handler) authorizeTarget(c *gin.Context, target notification.Target, scope string) bool {
+	switch {
+	case target.SessionPattern != "":
+		return h.authorizeSession(c, target.SessionPattern, scope)
+	case target.Tag != "":
+		return h.authorizeSession(c, notification.AllSessions, scope)
+	default:
+		return h.authorizeSession(c, target.SessionID, scope)
+	}
+}
+
+type TokenRequest struct {
+	// SessionIDs may contain glob patterns such as "alice-*"
+	SessionIDs []string `json:"session_ids" binding:"required"`
+	// Scopes defaults to publish and subscribe
+	Scopes []string `json:"scopes"`
+	// TTL (e.g. "24h") defaults to 24 hours
+	TTL string `json:"ttl"`
+}
+
+// CreateToken mints a notification token for sessions, for example a
+// subscribe-only token for a browser
+func (h *Handler) CreateToken(c *gin.Context) {
+	if h.config.PikoUpstreamAuthHMACSecretKey == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "notification tokens require UPSTREAM_KEY"})
+		return
+	}
+
+	var req TokenRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	scopes := req.Scopes
+	if len(scopes) == 0 {
+		scopes = []string{ScopePublish, ScopeSubscribe}
+	}
+	for _, scope := range scopes {
+		if scope != ScopePublish && scope != ScopeSubscribe {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "unknown scope: " + scope})
+			return
+		}
+	}
+
+	ttl := 24 * time.Hour
+	if req.TTL != "" {
+		d, err := time.ParseDuration(req.TTL)
+		if err != nil || d <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid ttl: " + req.TTL})
+			return
+		}
+		ttl = d
+	}
+
+	expiresAt := time.Now().Add(ttl)
+	claims := notifyClaims{
+		Notify: &notifyClaim{
+			Sessions: req.SessionIDs,
+			Scopes:   scopes,
+		},
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+		},
+	}
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(h.notifyTokenKey())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"token":      token,
+		"sessions":   req.SessionIDs,
+		"scopes":     scopes,
+		"expires_at": expiresAt.Format(time.RFC3339),
+	})
+}
+
+func contains(list []string, value string) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
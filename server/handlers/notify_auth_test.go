@@ -0,0 +1,210 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"clauded-server/config"
+	"clauded-server/keys"
+	"clauded-server/notification"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestNotifyClaimsCovers(t *testing.T) {
+	minted := func(scopes []string, sessions ...string) *notifyClaims {
+		return &notifyClaims{Notify: &notifyClaim{Sessions: sessions, Scopes: scopes}}
+	}
+	both := []string{ScopePublish, ScopeSubscribe}
+
+	tests := []struct {
+		name    string
+		claims  *notifyClaims
+		session string
+		scope   string
+		want    bool
+	}{
+		{name: "minted session", claims: minted(both, "alice"), session: "alice", scope: ScopePublish, want: true},
+		{name: "minted other session", claims: minted(both, "alice"), session: "bob", scope: ScopePublish},
+		{name: "minted scope", claims: minted([]string{ScopeSubscribe}, "alice"), session: "alice", scope: ScopeSubscribe, want: true},
+		{name: "minted other scope", claims: minted([]string{ScopeSubscribe}, "alice"), session: "alice", scope: ScopePublish},
+		{name: "pattern covers session", claims: minted(both, "alice-*"), session: "alice-dev", scope: ScopeSubscribe, want: true},
+		{name: "pattern covers narrower pattern", claims: minted(both, "alice-*"), session: "alice-dev-*", scope: ScopeSubscribe, want: true},
+		{name: "pattern doesn't cover all sessions", claims: minted(both, "alice-*"), session: notification.AllSessions, scope: ScopeSubscribe},
+		{name: "pattern doesn't cover other sessions", claims: minted(both, "alice-*"), session: "bob-dev", scope: ScopeSubscribe},
+		{name: "all sessions", claims: minted(both, "*"), session: notification.AllSessions, scope: ScopeSubscribe, want: true},
+		{name: "one of several", claims: minted(both, "alice", "bob"), session: "bob", scope: ScopeSubscribe, want: true},
+		{name: "upstream endpoint", claims: &notifyClaims{upstream: &upstreamToken{endpoints: []string{"alice"}}}, session: "alice", scope: ScopePublish, want: true},
+		{name: "upstream endpoint isn't a pattern", claims: &notifyClaims{upstream: &upstreamToken{endpoints: []string{"alice"}}}, session: "alice*", scope: ScopePublish},
+		{name: "upstream other endpoint", claims: &notifyClaims{upstream: &upstreamToken{endpoints: []string{"alice"}}}, session: "bob", scope: ScopeSubscribe},
+		{name: "user key prefix", claims: &notifyClaims{upstream: &upstreamToken{key: &keys.Key{Prefix: "alice-"}}}, session: "alice-dev", scope: ScopeSubscribe, want: true},
+		{name: "user key bare prefix", claims: &notifyClaims{upstream: &upstreamToken{key: &keys.Key{Prefix: "alice-"}}}, session: "alice-", scope: ScopeSubscribe},
+		{name: "user key all sessions", claims: &notifyClaims{upstream: &upstreamToken{key: &keys.Key{Prefix: "alice-"}}}, session: notification.AllSessions, scope: ScopeSubscribe},
+		{name: "no grant", claims: &notifyClaims{}, session: "alice", scope: ScopeSubscribe},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.claims.covers(tt.session, tt.scope); got != tt.want {
+				t.Fatalf("covers(%q, %q) = %v, want %v", tt.session, tt.scope, got, tt.want)
+			}
+		})
+	}
+}
+
+// newNotifyAuthHandler returns a handler with an UPSTREAM_KEY, unless
+// upstreamKey is empty, and the admin token "admin"
+func newNotifyAuthHandler(t *testing.T, upstreamKey string, allowShared bool) *Handler {
+	t.Helper()
+	km, err := keys.NewManager(upstreamKey, keys.NewMemoryStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Handler{
+		config: &config.Config{
+			PikoUpstreamAuthHMACSecretKey: upstreamKey,
+			AllowSharedUpstreamKey:        allowShared,
+			AdminToken:                    "admin",
+		},
+		keys: km,
+	}
+}
+
+func signToken(t *testing.T, claims notifyClaims, key []byte) string {
+	t.Helper()
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestAuthorizeTarget(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	h := newNotifyAuthHandler(t, "upstream-key", true)
+	expires := jwt.NewNumericDate(time.Now().Add(time.Hour))
+
+	minted := func(scopes []string, sessions ...string) string {
+		return signToken(t, notifyClaims{
+			Notify:           &notifyClaim{Sessions: sessions, Scopes: scopes},
+			RegisteredClaims: jwt.RegisteredClaims{ExpiresAt: expires},
+		}, h.notifyTokenKey())
+	}
+	both := []string{ScopePublish, ScopeSubscribe}
+	expired := signToken(t, notifyClaims{
+		Notify:           &notifyClaim{Sessions: []string{"*"}, Scopes: both},
+		RegisteredClaims: jwt.RegisteredClaims{ExpiresAt: jwt.NewNumericDate(time.Now().Add(-time.Minute))},
+	}, h.notifyTokenKey())
+	foreign := signToken(t, notifyClaims{
+		Notify:           &notifyClaim{Sessions: []string{"*"}, Scopes: both},
+		RegisteredClaims: jwt.RegisteredClaims{ExpiresAt: expires},
+	}, []byte("other-key"))
+	var sharedClaims notifyClaims
+	sharedClaims.Piko.Endpoints = []string{"alice"}
+	sharedClaims.ExpiresAt = expires
+	shared := signToken(t, sharedClaims, []byte("upstream-key"))
+	// A minted token signed with UPSTREAM_KEY itself isn't one the server
+	// issued
+	mintedWithUpstreamKey := signToken(t, notifyClaims{
+		Notify:           &notifyClaim{Sessions: []string{"*"}, Scopes: both},
+		RegisteredClaims: jwt.RegisteredClaims{ExpiresAt: expires},
+	}, []byte("upstream-key"))
+	_, userKey, err := h.keys.Mint("alice", "alice-", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	revokedKey, revoked, err := h.keys.Mint("bob", "bob-", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.keys.Revoke(revokedKey.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		token  string
+		query  bool
+		target notification.Target
+		scope  string
+		want   int
+	}{
+		{name: "no token", target: notification.Target{SessionID: "alice"}, scope: ScopeSubscribe, want: http.StatusUnauthorized},
+		{name: "admin", token: "admin", target: notification.Target{Tag: "team"}, scope: ScopePublish, want: http.StatusOK},
+		{name: "session", token: minted(both, "alice"), target: notification.Target{SessionID: "alice"}, scope: ScopePublish, want: http.StatusOK},
+		{name: "session in query", token: minted(both, "alice"), query: true, target: notification.Target{SessionID: "alice"}, scope: ScopeSubscribe, want: http.StatusOK},
+		{name: "other session", token: minted(both, "alice"), target: notification.Target{SessionID: "bob"}, scope: ScopePublish, want: http.StatusForbidden},
+		{name: "scope", token: minted([]string{ScopeSubscribe}, "alice"), target: notification.Target{SessionID: "alice"}, scope: ScopePublish, want: http.StatusForbidden},
+		{name: "pattern token, session", token: minted(both, "alice-*"), target: notification.Target{SessionID: "alice-dev"}, scope: ScopeSubscribe, want: http.StatusOK},
+		{name: "pattern token, narrower pattern", token: minted(both, "alice-*"), target: notification.Target{SessionPattern: "alice-dev-*"}, scope: ScopeSubscribe, want: http.StatusOK},
+		{name: "pattern token, wider pattern", token: minted(both, "alice-*"), target: notification.Target{SessionPattern: "*"}, scope: ScopeSubscribe, want: http.StatusForbidden},
+		{name: "session token, pattern", token: minted(both, "alice"), target: notification.Target{SessionPattern: "alice*"}, scope: ScopeSubscribe, want: http.StatusForbidden},
+		{name: "pattern token, tag", token: minted(both, "alice-*"), target: notification.Target{Tag: "team"}, scope: ScopeSubscribe, want: http.StatusForbidden},
+		{name: "all sessions token, tag", token: minted(both, "*"), target: notification.Target{Tag: "team"}, scope: ScopeSubscribe, want: http.StatusOK},
+		{name: "expired", token: expired, target: notification.Target{SessionID: "alice"}, scope: ScopeSubscribe, want: http.StatusUnauthorized},
+		{name: "foreign", token: foreign, target: notification.Target{SessionID: "alice"}, scope: ScopeSubscribe, want: http.StatusUnauthorized},
+		{name: "minted with the upstream key", token: mintedWithUpstreamKey, target: notification.Target{SessionID: "alice"}, scope: ScopeSubscribe, want: http.StatusUnauthorized},
+		{name: "shared upstream token", token: shared, target: notification.Target{SessionID: "alice"}, scope: ScopePublish, want: http.StatusOK},
+		{name: "shared upstream token, other session", token: shared, target: notification.Target{SessionID: "bob"}, scope: ScopePublish, want: http.StatusForbidden},
+		{name: "shared upstream token, tag", token: shared, target: notification.Target{Tag: "team"}, scope: ScopeSubscribe, want: http.StatusForbidden},
+		{name: "user key", token: userKey, target: notification.Target{SessionID: "alice-dev"}, scope: ScopePublish, want: http.StatusOK},
+		{name: "user key, other prefix", token: userKey, target: notification.Target{SessionID: "bob-dev"}, scope: ScopePublish, want: http.StatusForbidden},
+		// Every session a pattern under the prefix matches is the user's
+		{name: "user key, pattern under the prefix", token: userKey, target: notification.Target{SessionPattern: "alice-*"}, scope: ScopeSubscribe, want: http.StatusOK},
+		{name: "user key, wider pattern", token: userKey, target: notification.Target{SessionPattern: "al*"}, scope: ScopeSubscribe, want: http.StatusForbidden},
+		{name: "user key, tag", token: userKey, target: notification.Target{Tag: "team"}, scope: ScopeSubscribe, want: http.StatusForbidden},
+		{name: "revoked user key", token: revoked, target: notification.Target{SessionID: "bob-dev"}, scope: ScopeSubscribe, want: http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			target := "/api/v1/notifications/stream"
+			if tt.query {
+				target += "?token=" + url.QueryEscape(tt.token)
+			}
+			c.Request = httptest.NewRequest(http.MethodGet, target, nil)
+			if tt.token != "" && !tt.query {
+				c.Request.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+
+			ok := h.authorizeTarget(c, tt.target, tt.scope)
+			if ok != (tt.want == http.StatusOK) || w.Code != tt.want {
+				t.Fatalf("authorizeTarget() = %v with status %d, want %d: %s", ok, w.Code, tt.want, w.Body)
+			}
+		})
+	}
+}
+
+func TestAuthorizeTargetSharedKeyDisabled(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	h := newNotifyAuthHandler(t, "upstream-key", false)
+	var claims notifyClaims
+	claims.Piko.Endpoints = []string{"alice"}
+	shared := signToken(t, claims, []byte("upstream-key"))
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodGet, "/", nil)
+	c.Request.Header.Set("Authorization", "Bearer "+shared)
+	if h.authorizeTarget(c, notification.Target{SessionID: "alice"}, ScopeSubscribe) || w.Code != http.StatusUnauthorized {
+		t.Fatalf("shared upstream token accepted with the shared key disabled: %d", w.Code)
+	}
+}
+
+func TestAuthorizeTargetOpen(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	h := newNotifyAuthHandler(t, "", true)
+
+	for _, target := range []notification.Target{{SessionID: "alice"}, {SessionPattern: "*"}, {Tag: "team"}} {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest(http.MethodGet, "/", nil)
+		if !h.authorizeTarget(c, target, ScopePublish) {
+			t.Fatalf("target %s refused without UPSTREAM_KEY: %d", target, w.Code)
+		}
+	}
+}
@@ -0,0 +1,351 @@
+package handlers
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"clauded-server/access"
+	"clauded-server/session"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Session access credentials. The session secret is passed once in the query,
+// for example in the URL printed by gottyp, and then kept in a cookie scoped
+// to the session. Neither cookie is forwarded to the client, see
+// serverCookies.
+const (
+	sessionTokenParam  = "gottyp_token"
+	sessionTokenHeader = "X-Gottyp-Token"
+	sessionTokenCookie = "gottyp_token"
+	userCookie         = "gottyp_user"
+	loginCookie        = "gottyp_login"
+	userKey            = "user"
+)
+
+// loginTimeout is how long a user has to log in with the OIDC provider
+const loginTimeout = 10 * time.Minute
+
+// authorizeProxy enforces the session access mode on a request to a session,
+// its files or its ports, writing an error response or login redirect and
+// returning false if the request may not be proxied. Requests the browser
+// sends with the session's cookies from another page are refused, unless
+// they pass the secret themselves.
+func (h *Handler) authorizeProxy(c *gin.Context, sessionID string) bool {
+	switch h.access.Mode() {
+	case access.ModeSecret:
+		explicit := c.Query(sessionTokenParam) != "" || c.GetHeader(sessionTokenHeader) != ""
+		if !explicit && h.foreignRequest(c, sessionID) {
+			refuseForeign(c, sessionID)
+			return false
+		}
+		if !h.authorizeSecret(c, sessionID) {
+			return false
+		}
+	case access.ModeOIDC:
+		if h.foreignRequest(c, sessionID) {
+			refuseForeign(c, sessionID)
+			return false
+		}
+		if !h.authorizeUser(c, sessionID) {
+			return false
+		}
+	}
+	return true
+}
+
+// authorizeSecret checks the session secret passed in the query, the
+// X-Gottyp-Token header or the session cookie. A secret passed in the query
+// is moved into the cookie, redirecting page loads to the URL without it.
+func (h *Handler) authorizeSecret(c *gin.Context, sessionID string) bool {
+	if secret := c.Query(sessionTokenParam); secret != "" {
+		if !h.access.VerifySecret(sessionID, secret) {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid session token"})
+			return false
+		}
+		c.SetSameSite(http.SameSiteLaxMode)
+		c.SetCookie(sessionTokenCookie, secret, int(h.access.LoginTTL().Seconds()), "/"+sessionID, "", c.Request.TLS != nil, true)
+
+		query := c.Request.URL.Query()
+		query.Del(sessionTokenParam)
+		c.Request.URL.RawQuery = query.Encode()
+		if c.Request.Method == http.MethodGet && !isWebSocket(c) {
+			c.Redirect(http.StatusFound, c.Request.URL.RequestURI())
+			c.Abort()
+			return false
+		}
+		return true
+	}
+
+	secret := c.GetHeader(sessionTokenHeader)
+	if secret != "" {
+		c.Request.Header.Del(sessionTokenHeader)
+	} else if cookie, err := c.Cookie(sessionTokenCookie); err == nil {
+		secret = cookie
+	}
+	if secret == "" {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "session token required"})
+		return false
+	}
+	if !h.access.VerifySecret(sessionID, secret) {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid session token"})
+		return false
+	}
+	return true
+}
+
+// authorizeUser checks that the request comes from a logged in user on the
+// session's allow-list. Page loads without a login are redirected to it.
+func (h *Handler) authorizeUser(c *gin.Context, sessionID string) bool {
+	cookie, _ := c.Cookie(userCookie)
+	user, ok := h.access.ParseUser(cookie)
+	if !ok {
+		if c.Request.Method == http.MethodGet && !isWebSocket(c) && strings.Contains(c.GetHeader("Accept"), "text/html") {
+			c.Redirect(http.StatusFound, h.loginURL(c, sessionID))
+			c.Abort()
+			return false
+		}
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "login required"})
+		return false
+	}
+
+	c.Set(userKey, user)
+	if !h.access.Allowed(sessionID, user) {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "user " + user + " may not access session " + sessionID})
+		return false
+	}
+	return true
+}
+
+// loginURL returns the login page returning to the request afterwards. On a
+// session host the login happens on the main host, which the OIDC provider
+// redirects back to.
+func (h *Handler) loginURL(c *gin.Context, sessionID string) string {
+	rd := c.Request.URL.RequestURI()
+	if h.config.SessionDomain == "" {
+		return "/_auth/login?rd=" + url.QueryEscape(rd)
+	}
+	// Sessions are only served on their hosts, which sessionURL accepts
+	base, _ := h.sessionURL(sessionID)
+	return strings.TrimSuffix(h.config.PublicURL, "/") + "/_auth/login?rd=" + url.QueryEscape(base+rd)
+}
+
+// Login starts an OIDC login, returning to the rd query parameter afterwards.
+// Users logged in on the main host go straight on to a session host.
+func (h *Handler) Login(c *gin.Context) {
+	rd := h.loginRedirect(c.Query("rd"))
+	if cookie, err := c.Cookie(userCookie); err == nil {
+		// rd is a session host when it isn't a local path
+		if user, ok := h.access.ParseUser(cookie); ok && rd != localRedirect(rd) {
+			h.redirectAfterLogin(c, user, rd)
+			return
+		}
+	}
+
+	state := access.NewLoginState(rd)
+	authURL, err := h.access.OIDC().AuthURL(c.Request.Context(), state, h.callbackURL(c))
+	if err != nil {
+		requestLogger(c).Error("OIDC login failed", "error", err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "identity provider unavailable"})
+		return
+	}
+
+	cookie, err := h.access.SignLoginState(state, loginTimeout)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(loginCookie, cookie, int(loginTimeout.Seconds()), "/_auth/", "", c.Request.TLS != nil, true)
+	c.Redirect(http.StatusFound, authURL)
+}
+
+// LoginCallback completes an OIDC login and sets the login cookie
+func (h *Handler) LoginCallback(c *gin.Context) {
+	if errCode := c.Query("error"); errCode != "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "login failed: " + errCode + " " + c.Query("error_description")})
+		return
+	}
+
+	cookie, _ := c.Cookie(loginCookie)
+	state, ok := h.access.ParseLoginState(cookie)
+	if !ok || c.Query("state") != state.State {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "login expired or invalid, try again"})
+		return
+	}
+	c.SetCookie(loginCookie, "", -1, "/_auth/", "", c.Request.TLS != nil, true)
+
+	user, err := h.access.OIDC().Exchange(c.Request.Context(), state, c.Query("code"), h.callbackURL(c))
+	if err != nil {
+		requestLogger(c).Warn("OIDC login failed", "error", err)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "login failed"})
+		return
+	}
+
+	login, err := h.access.SignUser(user)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(userCookie, login, int(h.access.LoginTTL().Seconds()), "/", "", c.Request.TLS != nil, true)
+
+	requestLogger(c).Info("User logged in", "user", user)
+	h.redirectAfterLogin(c, user, state.Redirect)
+}
+
+// redirectAfterLogin sends a logged in user on to rd, see afterLogin
+func (h *Handler) redirectAfterLogin(c *gin.Context, user, rd string) {
+	target, err := h.afterLogin(user, rd)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.Redirect(http.StatusFound, target)
+}
+
+// Logout clears the login cookie
+func (h *Handler) Logout(c *gin.Context) {
+	c.SetCookie(userCookie, "", -1, "/", "", c.Request.TLS != nil, true)
+	if rd := c.Query("rd"); rd != "" {
+		c.Redirect(http.StatusFound, localRedirect(rd))
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Logged out"})
+}
+
+// callbackURL returns the OIDC redirect URL, under PUBLIC_URL when set and
+// otherwise on the host the request came to
+func (h *Handler) callbackURL(c *gin.Context) string {
+	if h.config.OIDCRedirectURL != "" {
+		return h.config.OIDCRedirectURL
+	}
+	base := strings.TrimSuffix(h.config.PublicURL, "/")
+	if base == "" {
+		scheme := "http"
+		if c.Request.TLS != nil {
+			scheme = "https"
+		}
+		base = scheme + "://" + c.Request.Host
+	}
+	return base + "/_auth/callback"
+}
+
+// localRedirect only allows redirects to paths on this server
+func localRedirect(rd string) string {
+	if !strings.HasPrefix(rd, "/") || strings.HasPrefix(rd, "//") || strings.HasPrefix(rd, "/\\") {
+		return "/"
+	}
+	return rd
+}
+
+type SessionAccessRequest struct {
+	// AllowedUsers may log in to the session in oidc mode, see
+	// access.MatchUser
+	AllowedUsers []string `json:"allowed_users"`
+	// Secret is the session's current secret, kept when registering again
+	Secret string `json:"secret"`
+}
+
+// RegisterSession registers the access configuration of a session and issues
+// its secret. gottyp calls it on start and after every reconnect with its
+// upstream token, which must cover the session; the admin token may register
+// any session. Without UPSTREAM_KEY only the admin can register sessions, as
+// anyone could otherwise take over their access.
+func (h *Handler) RegisterSession(c *gin.Context) {
+	id := c.Param("id")
+	if !session.ValidID(id) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "session IDs may not contain " + session.PortSeparator})
+		return
+	}
+	if !h.isAdmin(c) && !h.isUpstreamFor(c, id) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "upstream token for session " + id + " required"})
+		return
+	}
+
+	var req SessionAccessRequest
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	reg, secret, err := h.access.Register(id, req.AllowedUsers, req.Secret)
+	if err != nil {
+		requestLogger(c).Error("Failed to register session", "session", id, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	h.cluster.ShareRegistration(reg)
+
+	requestLogger(c).Info("Session registered", "session", id, "mode", h.access.Mode(), "allowed_users", reg.AllowedUsers)
+
+	resp := gin.H{
+		"session_id":    id,
+		"mode":          h.access.Mode(),
+		"allowed_users": reg.AllowedUsers,
+		"path":          "/" + id + "/",
+	}
+	if h.access.Mode() == access.ModeSecret {
+		resp["secret"] = secret
+		resp["path"] = "/" + id + "/?" + sessionTokenParam + "=" + url.QueryEscape(secret)
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// GetSessionAccess returns the access configuration of a session
+func (h *Handler) GetSessionAccess(c *gin.Context) {
+	id := c.Param("id")
+	reg, exists := h.access.Registration(id)
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "session not registered"})
+		return
+	}
+	reg.Nonce = ""
+	c.JSON(http.StatusOK, gin.H{
+		"mode":         h.access.Mode(),
+		"registration": reg,
+	})
+}
+
+// isUpstreamFor reports whether the request carries a gottyp upstream token
+// covering a session, and the session isn't reserved for another user
+func (h *Handler) isUpstreamFor(c *gin.Context, sessionID string) bool {
+	header := c.GetHeader("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return false
+	}
+
+	token, err := h.parseUpstreamToken(strings.TrimPrefix(header, "Bearer "))
+	if err != nil || !token.permits(sessionID) {
+		return false
+	}
+	owner, reserved := h.reservation(sessionID)
+	return !reserved || owner == token.owner()
+}
+
+// serverCookies are the cookies of this server, stripped from every proxied
+// request so sessions and the apps behind their ports never see them
+var serverCookies = []string{adminCookie, csrfCookie, loginCookie, sessionTokenCookie, userCookie}
+
+// stripCookies removes cookies from a request before it is proxied
+func stripCookies(r *http.Request, names ...string) {
+	cookies := r.Cookies()
+	if len(cookies) == 0 {
+		return
+	}
+
+	r.Header.Del("Cookie")
+	for _, cookie := range cookies {
+		if !contains(names, cookie.Name) {
+			r.AddCookie(cookie)
+		}
+	}
+}
+
+func isWebSocket(c *gin.Context) bool {
+	return strings.EqualFold(c.GetHeader("Upgrade"), "websocket")
+}
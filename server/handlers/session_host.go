@@ -0,0 +1,227 @@
+package handlers
+
+import (
+	"html/template"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"clauded-server/access"
+	"clauded-server/cluster"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Sessions served under /{session}/ share one origin, so a page of one
+// session can script another once it has the browser's credentials. With
+// SESSION_DOMAIN every session is served on its own host instead, where its
+// cookies are host-only; without it foreignRequest refuses what it can tell
+// apart.
+
+// sessionHostLabel matches the session IDs that can be served on their own
+// host: a lower case DNS label
+var sessionHostLabel = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+// SessionHost serves requests to the host of a session when SESSION_DOMAIN
+// is set. Only that session, its files and its ports are proxied there,
+// under the same paths as on the main host, and OIDC logins are handed over
+// from the main host with a ticket. Requests to other hosts go on to the
+// routes.
+func (h *Handler) SessionHost(c *gin.Context) {
+	sessionID, ok := h.hostSession(c.Request.Host)
+	if !ok {
+		c.Next()
+		return
+	}
+	defer c.Abort()
+
+	path := c.Request.URL.Path
+	if h.access.Mode() == access.ModeOIDC {
+		switch path {
+		case "/_auth/session":
+			h.redeemTicket(c, sessionID)
+			return
+		case "/_auth/logout":
+			h.Logout(c)
+			return
+		}
+	}
+
+	parts := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	if parts[0] != sessionID {
+		if path == "/" {
+			c.Redirect(http.StatusFound, "/"+sessionID+"/")
+			return
+		}
+		c.JSON(http.StatusNotFound, gin.H{"error": "only session " + sessionID + " is served on this host"})
+		return
+	}
+	h.proxySession(c, parts)
+}
+
+// hostSession returns the session a host serves, if it is a session host
+func (h *Handler) hostSession(host string) (string, bool) {
+	if h.config.SessionDomain == "" {
+		return "", false
+	}
+	if name, _, err := net.SplitHostPort(host); err == nil {
+		host = name
+	}
+	sessionID, ok := strings.CutSuffix(strings.ToLower(host), "."+h.config.SessionDomain)
+	if !ok || !sessionHostLabel.MatchString(sessionID) || cluster.IsInternalEndpoint(sessionID) {
+		return "", false
+	}
+	return sessionID, true
+}
+
+// sessionURL returns the scheme and host a session is served on, with the
+// scheme and port of PUBLIC_URL
+func (h *Handler) sessionURL(sessionID string) (string, bool) {
+	public, err := url.Parse(h.config.PublicURL)
+	if err != nil || !sessionHostLabel.MatchString(sessionID) {
+		return "", false
+	}
+	host := sessionID + "." + h.config.SessionDomain
+	if port := public.Port(); port != "" {
+		host = net.JoinHostPort(host, port)
+	}
+	return public.Scheme + "://" + host, true
+}
+
+// toSessionHost answers a session request to the main host when sessions
+// are served on their own hosts, redirecting page loads there
+func (h *Handler) toSessionHost(c *gin.Context, sessionID string) {
+	base, ok := h.sessionURL(sessionID)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "session " + sessionID + " can't be served on its own host, session IDs must be lower case DNS labels"})
+		return
+	}
+	if c.Request.Method == http.MethodGet && !isWebSocket(c) {
+		c.Redirect(http.StatusFound, base+c.Request.URL.RequestURI())
+		return
+	}
+	c.JSON(http.StatusNotFound, gin.H{"error": "session " + sessionID + " is served at " + base + "/" + sessionID + "/"})
+}
+
+// loginRedirect returns where a login may return to: a path on this server
+// or a URL on a session host
+func (h *Handler) loginRedirect(rd string) string {
+	if u, err := url.Parse(rd); err == nil && u.IsAbs() && u.User == nil {
+		if sessionID, ok := h.hostSession(u.Host); ok {
+			if base, _ := h.sessionURL(sessionID); base == u.Scheme+"://"+u.Host {
+				return rd
+			}
+		}
+	}
+	return localRedirect(rd)
+}
+
+// afterLogin returns where a logged in user goes to: the login redirect, or
+// for a session host the ticket that logs the user in there
+func (h *Handler) afterLogin(user, rd string) (string, error) {
+	u, err := url.Parse(rd)
+	if err != nil || !u.IsAbs() {
+		return rd, nil
+	}
+	// loginRedirect only lets session hosts through
+	sessionID, _ := h.hostSession(u.Host)
+	ticket, err := h.access.SignTicket(user, sessionID)
+	if err != nil {
+		return "", err
+	}
+	redeem := url.URL{
+		Scheme:   u.Scheme,
+		Host:     u.Host,
+		Path:     "/_auth/session",
+		RawQuery: url.Values{"ticket": {ticket}, "rd": {u.RequestURI()}}.Encode(),
+	}
+	return redeem.String(), nil
+}
+
+// redeemTicket logs the user of a ticket in on the host of a session
+func (h *Handler) redeemTicket(c *gin.Context, sessionID string) {
+	user, ok := h.access.ParseTicket(c.Query("ticket"), sessionID)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "login expired or invalid, try again"})
+		return
+	}
+
+	login, err := h.access.SignUser(user)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(userCookie, login, int(h.access.LoginTTL().Seconds()), "/", "", c.Request.TLS != nil, true)
+	c.Redirect(http.StatusFound, localRedirect(c.Query("rd")))
+}
+
+// foreignRequest reports whether a browser request to a session comes from a
+// page other than the session's own, going by the Fetch Metadata, Origin and
+// Referer headers browsers set. Links from elsewhere are followed. On a
+// shared origin it can't tell the WebSocket of a page that sends no Referer
+// apart, which only a session host isolates.
+func (h *Handler) foreignRequest(c *gin.Context, sessionID string) bool {
+	r := c.Request
+	if origin := r.Header.Get("Origin"); origin != "" && isWebSocket(c) {
+		if u, err := url.Parse(origin); err != nil || u.Host != r.Host {
+			return true
+		}
+	}
+
+	referer, err := url.Parse(r.Referer())
+	if err != nil {
+		return true
+	}
+	site := r.Header.Get("Sec-Fetch-Site")
+	if site == "" && referer.Host == r.Host {
+		// Browsers without Fetch Metadata
+		site = "same-origin"
+	}
+
+	switch site {
+	case "same-site", "cross-site":
+		return r.Header.Get("Sec-Fetch-Mode") != "navigate"
+	case "same-origin":
+		if h.config.SessionDomain != "" {
+			return false
+		}
+		if referer.Host == "" {
+			return !isWebSocket(c)
+		}
+		return referer.Path != "/"+sessionID && !strings.HasPrefix(referer.Path, "/"+sessionID+"/")
+	}
+	return false
+}
+
+// foreignPage is served instead of a session page opened by another page.
+// It is sandboxed, so the opener can't script it, and only the user can
+// follow its link into a new tab without an opener.
+var foreignPage = template.Must(template.New("foreign").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>{{.Session}}</title></head>
+<body>
+<p>Session {{.Session}} was opened by another page on this server.</p>
+<p><a href="{{.URL}}" target="_blank" rel="noopener noreferrer">Open session {{.Session}}</a></p>
+</body>
+</html>
+`))
+
+// refuseForeign answers a request refused by foreignRequest. Its response is
+// sandboxed: it's on the session's path, where a page able to script it
+// would pass the Referer check.
+func refuseForeign(c *gin.Context, sessionID string) {
+	c.Header("Content-Security-Policy", "sandbox allow-popups allow-popups-to-escape-sandbox")
+	c.Header("X-Frame-Options", "DENY")
+	c.Header("Cache-Control", "no-store")
+	if c.GetHeader("Sec-Fetch-Dest") == "document" {
+		c.Header("Content-Type", "text/html; charset=utf-8")
+		c.Status(http.StatusForbidden)
+		foreignPage.Execute(c.Writer, map[string]string{"Session": sessionID, "URL": c.Request.URL.RequestURI()})
+		c.Abort()
+		return
+	}
+	c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "request from another page to session " + sessionID + " refused"})
+}
@@ -0,0 +1,262 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"clauded-server/access"
+	"clauded-server/config"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestForeignRequest(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	tests := []struct {
+		name          string
+		sessionDomain string
+		websocket     bool
+		headers       map[string]string
+		want          bool
+	}{
+		{name: "typed URL", headers: map[string]string{"Sec-Fetch-Site": "none", "Sec-Fetch-Mode": "navigate"}},
+		{name: "own page", headers: map[string]string{"Sec-Fetch-Site": "same-origin", "Referer": "http://example.com/alice/"}},
+		{name: "own page without slash", headers: map[string]string{"Sec-Fetch-Site": "same-origin", "Referer": "http://example.com/alice"}},
+		{name: "own port", headers: map[string]string{"Sec-Fetch-Site": "same-origin", "Referer": "http://example.com/alice/3000/"}},
+		{name: "other session", headers: map[string]string{"Sec-Fetch-Site": "same-origin", "Referer": "http://example.com/bob/"}, want: true},
+		{name: "session sharing the prefix", headers: map[string]string{"Sec-Fetch-Site": "same-origin", "Referer": "http://example.com/alice-2/"}, want: true},
+		{name: "dashboard link", headers: map[string]string{"Sec-Fetch-Site": "same-origin", "Sec-Fetch-Mode": "navigate", "Referer": "http://example.com/admin/"}, want: true},
+		{name: "no referer", headers: map[string]string{"Sec-Fetch-Site": "same-origin"}, want: true},
+		{name: "websocket without referer", websocket: true, headers: map[string]string{"Sec-Fetch-Site": "same-origin", "Origin": "http://example.com"}},
+		{name: "websocket from other session", websocket: true, headers: map[string]string{"Sec-Fetch-Site": "same-origin", "Origin": "http://example.com", "Referer": "http://example.com/bob/"}, want: true},
+		{name: "websocket from other site", websocket: true, headers: map[string]string{"Origin": "https://evil.example.net"}, want: true},
+		{name: "link from other site", headers: map[string]string{"Sec-Fetch-Site": "cross-site", "Sec-Fetch-Mode": "navigate"}},
+		{name: "fetch from other site", headers: map[string]string{"Sec-Fetch-Site": "cross-site", "Sec-Fetch-Mode": "cors"}, want: true},
+		{name: "fetch from sibling host", headers: map[string]string{"Sec-Fetch-Site": "same-site", "Sec-Fetch-Mode": "no-cors"}, want: true},
+		{name: "without fetch metadata", headers: map[string]string{"Referer": "http://example.com/bob/"}, want: true},
+		{name: "without fetch metadata from other site", headers: map[string]string{"Referer": "https://evil.example.net/"}},
+		{name: "session host", sessionDomain: "s.example.com", headers: map[string]string{"Sec-Fetch-Site": "same-origin"}},
+		{name: "session host from sibling", sessionDomain: "s.example.com", headers: map[string]string{"Sec-Fetch-Site": "same-site", "Sec-Fetch-Mode": "cors"}, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &Handler{config: &config.Config{SessionDomain: tt.sessionDomain}}
+			c, _ := gin.CreateTestContext(httptest.NewRecorder())
+			c.Request = httptest.NewRequest(http.MethodGet, "http://example.com/alice/", nil)
+			if tt.websocket {
+				c.Request.Header.Set("Upgrade", "websocket")
+			}
+			for key, value := range tt.headers {
+				c.Request.Header.Set(key, value)
+			}
+
+			if got := h.foreignRequest(c, "alice"); got != tt.want {
+				t.Fatalf("foreignRequest() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRefuseForeign(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	for _, dest := range []string{"document", "iframe", "empty"} {
+		t.Run(dest, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request = httptest.NewRequest(http.MethodGet, "/alice/", nil)
+			c.Request.Header.Set("Sec-Fetch-Dest", dest)
+
+			refuseForeign(c, "alice")
+			if w.Code != http.StatusForbidden {
+				t.Fatalf("status = %d, want 403", w.Code)
+			}
+			// An unsandboxed response on the session's path could be
+			// scripted by the page that opened it
+			if csp := w.Header().Get("Content-Security-Policy"); !strings.HasPrefix(csp, "sandbox") {
+				t.Fatalf("Content-Security-Policy = %q, want a sandbox", csp)
+			}
+			if html := strings.HasPrefix(w.Header().Get("Content-Type"), "text/html"); html != (dest == "document") {
+				t.Fatalf("Content-Type = %q for %s", w.Header().Get("Content-Type"), dest)
+			}
+		})
+	}
+}
+
+// newSessionHostHandler returns a handler serving sessions on hosts under
+// s.example.com, with OIDC logins on https://example.com
+func newSessionHostHandler(t *testing.T) *Handler {
+	t.Helper()
+	a, err := access.New(access.Config{
+		Mode:     access.ModeOIDC,
+		Key:      []byte("test-key"),
+		LoginTTL: time.Hour,
+		OIDC:     access.OIDCConfig{Issuer: "https://idp.example.com", ClientID: "gottyp"},
+	}, access.NewMemoryStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Handler{
+		config: &config.Config{SessionDomain: "s.example.com", PublicURL: "https://example.com"},
+		access: a,
+	}
+}
+
+func TestSessionHost(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	h := newSessionHostHandler(t)
+	router := gin.New()
+	router.Use(h.SessionHost)
+	router.NoRoute(h.ProxyRequest)
+	router.GET("/health", func(c *gin.Context) { c.String(http.StatusOK, "main") })
+
+	tests := []struct {
+		name     string
+		method   string
+		url      string
+		want     int
+		location string
+	}{
+		{name: "main host route", url: "https://example.com/health", want: http.StatusOK},
+		{name: "not a session host", url: "https://x.alice.s.example.com/health", want: http.StatusOK},
+		{name: "session host root", url: "https://alice.s.example.com/", want: http.StatusFound, location: "/alice/"},
+		{name: "session host with port", url: "https://Alice.s.example.com:8443/", want: http.StatusFound, location: "/alice/"},
+		{name: "other session on session host", url: "https://alice.s.example.com/bob/", want: http.StatusNotFound},
+		{name: "main host route on session host", url: "https://alice.s.example.com/health", want: http.StatusNotFound},
+		{name: "session on main host", url: "https://example.com/alice/files/?a=1", want: http.StatusFound, location: "https://alice.s.example.com/alice/files/?a=1"},
+		{name: "session post on main host", method: http.MethodPost, url: "https://example.com/alice/", want: http.StatusNotFound},
+		{name: "session without host name", url: "https://example.com/Alice_1/", want: http.StatusNotFound},
+		{name: "invalid ticket", url: "https://alice.s.example.com/_auth/session?ticket=forged", want: http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			method := tt.method
+			if method == "" {
+				method = http.MethodGet
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest(method, tt.url, nil))
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+			if location := w.Header().Get("Location"); location != tt.location {
+				t.Fatalf("Location = %q, want %q", location, tt.location)
+			}
+		})
+	}
+}
+
+func TestLoginRedirect(t *testing.T) {
+	h := newSessionHostHandler(t)
+
+	tests := []struct {
+		rd   string
+		want string
+	}{
+		{rd: "/alice/", want: "/alice/"},
+		{rd: "https://alice.s.example.com/alice/?x=1", want: "https://alice.s.example.com/alice/?x=1"},
+		{rd: "http://alice.s.example.com/alice/", want: "/"},
+		{rd: "https://alice.s.example.com:8443/alice/", want: "/"},
+		{rd: "https://user@alice.s.example.com/alice/", want: "/"},
+		{rd: "https://evil.example.net/", want: "/"},
+		{rd: "//evil.example.net/", want: "/"},
+	}
+	for _, tt := range tests {
+		if got := h.loginRedirect(tt.rd); got != tt.want {
+			t.Errorf("loginRedirect(%q) = %q, want %q", tt.rd, got, tt.want)
+		}
+	}
+}
+
+func TestSessionHostLogin(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	h := newSessionHostHandler(t)
+	router := gin.New()
+	router.Use(h.SessionHost)
+
+	target, err := h.afterLogin("alice@example.com", "https://alice.s.example.com/alice/?x=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(target, "https://alice.s.example.com/_auth/session?") {
+		t.Fatalf("afterLogin() = %q, want the ticket on the session host", target)
+	}
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "/alice/?x=1" {
+		t.Fatalf("redeeming = %d to %q, want a redirect to /alice/?x=1", w.Code, w.Header().Get("Location"))
+	}
+	var login string
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == userCookie {
+			login = cookie.Value
+			if cookie.Domain != "" {
+				t.Fatalf("login cookie domain = %q, want a host-only cookie", cookie.Domain)
+			}
+		}
+	}
+	if user, ok := h.access.ParseUser(login); !ok || user != "alice@example.com" {
+		t.Fatalf("login cookie user = %q, %v", user, ok)
+	}
+
+	// The ticket only logs in on the host it was issued for
+	other := strings.Replace(target, "alice.s.example.com", "bob.s.example.com", 1)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, other, nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("redeeming on another session host = %d, want 401", w.Code)
+	}
+
+	// Local redirects need no ticket
+	if target, err := h.afterLogin("alice@example.com", "/alice/"); err != nil || target != "/alice/" {
+		t.Fatalf("afterLogin() = %q, %v, want /alice/", target, err)
+	}
+}
+
+func TestAuthorizeProxyRefusesOtherSessions(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	a, err := access.New(access.Config{Mode: access.ModeSecret, Key: []byte("test-key"), LoginTTL: time.Hour}, access.NewMemoryStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, secret, err := a.Register("alice", nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &Handler{config: &config.Config{}, access: a}
+
+	tests := []struct {
+		name   string
+		cookie bool
+		header string
+		want   bool
+	}{
+		{name: "cookie", cookie: true},
+		{name: "secret header", header: secret, want: true},
+		{name: "cookie and wrong header", cookie: true, header: "guess"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request = httptest.NewRequest(http.MethodGet, "http://example.com/alice/", nil)
+			c.Request.Header.Set("Sec-Fetch-Site", "same-origin")
+			c.Request.Header.Set("Referer", "http://example.com/bob/")
+			if tt.cookie {
+				c.Request.AddCookie(&http.Cookie{Name: sessionTokenCookie, Value: secret})
+			}
+			if tt.header != "" {
+				c.Request.Header.Set(sessionTokenHeader, tt.header)
+			}
+
+			if got := h.authorizeProxy(c, "alice"); got != tt.want {
+				t.Fatalf("authorizeProxy() = %v, want %v (status %d)", got, tt.want, w.Code)
+			}
+		})
+	}
+}
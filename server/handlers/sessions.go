@@ -0,0 +1,120 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+
+	"clauded-server/cluster"
+	"clauded-server/session"
+
+	"github.com/gin-gonic/gin"
+)
+
+// SessionForward is a port forwarded by a session as a {session}:{port}
+// piko endpoint
+type SessionForward struct {
+	Port       string `json:"port"`
+	EndpointID string `json:"endpoint_id"`
+	Path       string `json:"path"`
+}
+
+// SessionResponse describes a connected session
+type SessionResponse struct {
+	session.Info
+	Path     string           `json:"path"`
+	Forwards []SessionForward `json:"forwards"`
+}
+
+func newSessionResponse(info session.Info) SessionResponse {
+	resp := SessionResponse{
+		Info:     info,
+		Path:     "/" + info.ID + "/",
+		Forwards: make([]SessionForward, 0, len(info.Ports)),
+	}
+	for _, port := range info.Ports {
+		resp.Forwards = append(resp.Forwards, SessionForward{
+			Port:       port,
+			EndpointID: session.PortEndpoint(info.ID, port),
+			Path:       "/" + info.ID + "/" + port + "/",
+		})
+	}
+	return resp
+}
+
+func (h *Handler) ListSessions(c *gin.Context) {
+	infos := h.cluster.Sessions()
+
+	sessions := make([]SessionResponse, 0, len(infos))
+	for _, info := range infos {
+		sessions = append(sessions, newSessionResponse(info))
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"sessions": sessions,
+		"count":    len(sessions),
+	})
+}
+
+func (h *Handler) GetSession(c *gin.Context) {
+	info, exists := h.cluster.Session(c.Request.Context(), c.Param("id"))
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "session not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, newSessionResponse(info))
+}
+
+func (h *Handler) DisconnectSession(c *gin.Context) {
+	id := c.Param("id")
+	result, err := h.cluster.Disconnect(c.Request.Context(), id)
+	if errors.Is(err, cluster.ErrSessionNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "session not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+		return
+	}
+
+	closed := result.Connections
+	if closed == 0 && result.Session.Connected {
+		c.JSON(http.StatusConflict, gin.H{"error": "session is not connected through this server's upstream proxy"})
+		return
+	}
+
+	requestLogger(c).Info("Session disconnected by admin", "session", id, "connections", closed)
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":     "Session disconnected",
+		"session":     id,
+		"connections": closed,
+	})
+}
+
+type SessionTagsRequest struct {
+	Tags []string `json:"tags"`
+}
+
+func (h *Handler) SetSessionTags(c *gin.Context) {
+	var req SessionTagsRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	id := c.Param("id")
+	info, err := h.cluster.SetTags(c.Request.Context(), id, req.Tags)
+	if errors.Is(err, cluster.ErrSessionNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "session not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+		return
+	}
+
+	requestLogger(c).Info("Session tags set by admin", "session", id, "tags", req.Tags)
+
+	c.JSON(http.StatusOK, newSessionResponse(info))
+}
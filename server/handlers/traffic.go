@@ -0,0 +1,133 @@
+package handlers
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"clauded-server/session"
+
+	"github.com/gin-gonic/gin"
+)
+
+// proxyInfo describes a proxied request for the access log
+type proxyInfo struct {
+	route    string
+	session  string
+	port     string
+	traffic  *traffic
+	hijacked bool
+}
+
+// proxy serves a request with a piko proxy handler, recording it in the
+// metrics and access log and counting the bytes proxied for sessionID (none
+// when empty). This server's cookies are never proxied.
+func (h *Handler) proxy(c *gin.Context, route, sessionID, port string, serve http.HandlerFunc) {
+	start := time.Now()
+	stripCookies(c.Request, serverCookies...)
+
+	t := &traffic{session: sessionID, sessions: h.sessionManager}
+	w := &trafficWriter{ResponseWriter: c.Writer, traffic: t}
+	c.Writer = w
+	if c.Request.Body != nil && c.Request.Body != http.NoBody {
+		c.Request.Body = &trafficBody{ReadCloser: c.Request.Body, traffic: t}
+	}
+	info := &proxyInfo{route: route, session: sessionID, port: port, traffic: t}
+	c.Set(proxyInfoKey, info)
+
+	if !strings.EqualFold(c.GetHeader("Upgrade"), "websocket") {
+		serve(w, c.Request)
+		h.metrics.ObserveRequest(route, w.Status(), time.Since(start))
+		return
+	}
+
+	closed := h.metrics.WebSocketOpened(route)
+	serve(w, c.Request)
+	info.hijacked = w.hijacked
+	code := w.Status()
+	if w.hijacked {
+		code = http.StatusSwitchingProtocols
+	}
+	closed(code)
+}
+
+// traffic counts the bytes proxied for a request, adding them to its
+// session as they are copied
+type traffic struct {
+	session  string
+	sessions *session.Manager
+	in       atomic.Int64
+	out      atomic.Int64
+}
+
+func (t *traffic) add(in, out int) {
+	t.in.Add(int64(in))
+	t.out.Add(int64(out))
+	if t.session != "" {
+		t.sessions.AddTraffic(t.session, in, out)
+	}
+}
+
+// trafficWriter counts the bytes written to the client, including those of
+// a hijacked WebSocket connection
+type trafficWriter struct {
+	gin.ResponseWriter
+	traffic  *traffic
+	hijacked bool
+}
+
+func (w *trafficWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	w.traffic.add(0, n)
+	return n, err
+}
+
+func (w *trafficWriter) WriteString(s string) (int, error) {
+	n, err := w.ResponseWriter.WriteString(s)
+	w.traffic.add(0, n)
+	return n, err
+}
+
+func (w *trafficWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := w.ResponseWriter.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	w.hijacked = true
+	return &trafficConn{Conn: conn, traffic: w.traffic}, rw, nil
+}
+
+// trafficBody counts the bytes of a request body
+type trafficBody struct {
+	io.ReadCloser
+	traffic *traffic
+}
+
+func (b *trafficBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.traffic.add(n, 0)
+	return n, err
+}
+
+// trafficConn counts the bytes read from and written to a hijacked
+// connection
+type trafficConn struct {
+	net.Conn
+	traffic *traffic
+}
+
+func (c *trafficConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.traffic.add(n, 0)
+	return n, err
+}
+
+func (c *trafficConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.traffic.add(0, n)
+	return n, err
+}
@@ -0,0 +1,286 @@
+package keys
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+var (
+	// ErrDisabled is returned when minting keys without UPSTREAM_KEY
+	ErrDisabled = errors.New("user keys require UPSTREAM_KEY")
+	// ErrNotFound is returned for unknown key IDs
+	ErrNotFound = errors.New("key not found")
+	// ErrInvalid is returned for tokens that aren't valid user keys
+	ErrInvalid = errors.New("invalid user key")
+	// ErrExpired is returned for expired user keys
+	ErrExpired = errors.New("user key expired")
+	// ErrRevoked is returned for revoked user keys
+	ErrRevoked = errors.New("user key revoked")
+)
+
+// validPrefix restricts session prefixes to characters valid in session IDs
+var validPrefix = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+
+// Key is a user's upstream credential. It lets the user's gottyp register
+// sessions whose ID starts with Prefix, and no others.
+type Key struct {
+	ID        string     `json:"id"`
+	User      string     `json:"user"`
+	Prefix    string     `json:"prefix"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+}
+
+// Permits reports whether the key may use a session ID, or a session pattern
+// such as "alice-*"
+func (k Key) Permits(sessionID string) bool {
+	return len(sessionID) > len(k.Prefix) && strings.HasPrefix(sessionID, k.Prefix)
+}
+
+// Revoked reports whether the key has been revoked
+func (k Key) Revoked() bool {
+	return k.RevokedAt != nil
+}
+
+// claims are the claims of a user key token
+type claims struct {
+	Gottyp struct {
+		User   string `json:"user"`
+		Prefix string `json:"prefix"`
+	} `json:"gottyp"`
+	jwt.RegisteredClaims
+}
+
+// Manager mints, verifies and revokes user keys. Keys are JWTs signed with a
+// key derived from UPSTREAM_KEY, so piko never accepts them as upstream
+// tokens itself: the server checks the prefix and revocation list and hands
+// piko a token for the one session instead.
+type Manager struct {
+	signingKey []byte
+	store      Store
+
+	mu   sync.RWMutex
+	keys map[string]Key
+	// fetch looks up a key unknown to this node on the other nodes
+	fetch func(id string) (Key, bool)
+}
+
+// NewManager creates a manager for keys derived from upstreamKey, loading
+// the keys in store
+func NewManager(upstreamKey string, store Store) (*Manager, error) {
+	m := &Manager{
+		store: store,
+		keys:  make(map[string]Key),
+	}
+	if upstreamKey != "" {
+		mac := hmac.New(sha256.New, []byte(upstreamKey))
+		mac.Write([]byte("gottyp-user-key"))
+		m.signingKey = mac.Sum(nil)
+	}
+
+	stored, err := store.List()
+	if err != nil {
+		return nil, fmt.Errorf("load keys: %w", err)
+	}
+	for _, key := range stored {
+		m.keys[key.ID] = key
+	}
+	return m, nil
+}
+
+// Enabled reports whether user keys can be minted and verified
+func (m *Manager) Enabled() bool {
+	return m.signingKey != nil
+}
+
+// SetFetcher sets a function looking up keys minted on other nodes that
+// haven't reached this one yet, used when verifying them
+func (m *Manager) SetFetcher(fn func(id string) (Key, bool)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.fetch = fn
+}
+
+// Mint issues a key for user restricted to sessions starting with prefix,
+// valid for ttl (forever when 0). A prefix may not overlap the prefix of
+// another user's active key, so no user can claim another's session names.
+func (m *Manager) Mint(user, prefix string, ttl time.Duration) (Key, string, error) {
+	if !m.Enabled() {
+		return Key{}, "", ErrDisabled
+	}
+	if user == "" {
+		return Key{}, "", errors.New("user is required")
+	}
+	if prefix == "" {
+		prefix = user + "-"
+	}
+	if !validPrefix.MatchString(prefix) {
+		return Key{}, "", fmt.Errorf("invalid session prefix %q, set one of letters, digits, '.', '_' and '-'", prefix)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, other := range m.keys {
+		if other.User == user || other.Revoked() || other.expired() {
+			continue
+		}
+		if strings.HasPrefix(prefix, other.Prefix) || strings.HasPrefix(other.Prefix, prefix) {
+			return Key{}, "", fmt.Errorf("session prefix %q overlaps %q of user %s", prefix, other.Prefix, other.User)
+		}
+	}
+
+	id := make([]byte, 8)
+	rand.Read(id)
+	key := Key{
+		ID:        hex.EncodeToString(id),
+		User:      user,
+		Prefix:    prefix,
+		CreatedAt: time.Now().UTC().Truncate(time.Second),
+	}
+	if ttl > 0 {
+		expiresAt := key.CreatedAt.Add(ttl)
+		key.ExpiresAt = &expiresAt
+	}
+
+	var c claims
+	c.Gottyp.User = user
+	c.Gottyp.Prefix = prefix
+	c.ID = key.ID
+	c.Subject = user
+	c.IssuedAt = jwt.NewNumericDate(key.CreatedAt)
+	if key.ExpiresAt != nil {
+		c.ExpiresAt = jwt.NewNumericDate(*key.ExpiresAt)
+	}
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, c).SignedString(m.signingKey)
+	if err != nil {
+		return Key{}, "", err
+	}
+
+	if err := m.store.Save(key); err != nil {
+		return Key{}, "", fmt.Errorf("save key: %w", err)
+	}
+	m.keys[key.ID] = key
+	return key, token, nil
+}
+
+// List returns every key, newest first
+func (m *Manager) List() []Key {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	result := make([]Key, 0, len(m.keys))
+	for _, key := range m.keys {
+		result = append(result, key)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].CreatedAt.After(result[j].CreatedAt)
+	})
+	return result
+}
+
+// Get returns a key by ID
+func (m *Manager) Get(id string) (Key, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	key, exists := m.keys[id]
+	return key, exists
+}
+
+// Revoke revokes a key. Connections opened with it stay up, but it is
+// refused on every further connect.
+func (m *Manager) Revoke(id string) (Key, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key, exists := m.keys[id]
+	if !exists {
+		return Key{}, ErrNotFound
+	}
+	if key.Revoked() {
+		return key, nil
+	}
+
+	revokedAt := time.Now().UTC().Truncate(time.Second)
+	key.RevokedAt = &revokedAt
+	if err := m.store.Save(key); err != nil {
+		return Key{}, fmt.Errorf("save key: %w", err)
+	}
+	m.keys[id] = key
+	return key, nil
+}
+
+// Merge adds keys minted or revoked on other nodes. A revocation is never
+// undone.
+func (m *Manager) Merge(keys []Key) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, key := range keys {
+		local, exists := m.keys[key.ID]
+		if exists && (local.Revoked() || !key.Revoked()) {
+			continue
+		}
+		if err := m.store.Save(key); err != nil {
+			continue
+		}
+		m.keys[key.ID] = key
+	}
+}
+
+// Verify checks a user key token and returns its key. It returns ErrInvalid
+// for tokens that aren't user keys, such as tokens signed with the shared
+// UPSTREAM_KEY, and ErrNotFound for keys neither this node nor its peers
+// know, e.g. keys of a lost database that can't be revoked anymore.
+func (m *Manager) Verify(token string) (Key, error) {
+	if !m.Enabled() {
+		return Key{}, ErrInvalid
+	}
+
+	var c claims
+	_, err := jwt.ParseWithClaims(token, &c, func(*jwt.Token) (interface{}, error) {
+		return m.signingKey, nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
+	if errors.Is(err, jwt.ErrTokenExpired) {
+		return Key{}, ErrExpired
+	}
+	if err != nil || c.ID == "" || c.Gottyp.Prefix == "" {
+		return Key{}, ErrInvalid
+	}
+
+	m.mu.RLock()
+	key, exists := m.keys[c.ID]
+	fetch := m.fetch
+	m.mu.RUnlock()
+	if !exists && fetch != nil {
+		if fetched, ok := fetch(c.ID); ok && fetched.ID == c.ID && fetched.Prefix == c.Gottyp.Prefix {
+			m.Merge([]Key{fetched})
+			key, exists = m.Get(c.ID)
+		}
+	}
+	if !exists {
+		return Key{}, ErrNotFound
+	}
+	if key.Revoked() {
+		return Key{}, ErrRevoked
+	}
+	return key, nil
+}
+
+func (k Key) expired() bool {
+	return k.ExpiresAt != nil && time.Now().After(*k.ExpiresAt)
+}
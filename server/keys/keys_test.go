@@ -0,0 +1,82 @@
+package keys
+
+import (
+	"errors"
+	"testing"
+)
+
+func newTestManager(t *testing.T) *Manager {
+	t.Helper()
+	m, err := NewManager("upstream-key", NewMemoryStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestVerify(t *testing.T) {
+	m := newTestManager(t)
+	key, token, err := m.Mint("alice", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := m.Verify(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != key.ID || !got.Permits("alice-dev") || got.Permits("bob-dev") {
+		t.Fatalf("Verify() = %+v", got)
+	}
+
+	if _, err := m.Revoke(key.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Verify(token); !errors.Is(err, ErrRevoked) {
+		t.Fatalf("Verify() of a revoked key = %v, want %v", err, ErrRevoked)
+	}
+
+	other, err := NewManager("other-key", NewMemoryStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := other.Verify(token); !errors.Is(err, ErrInvalid) {
+		t.Fatalf("Verify() with another upstream key = %v, want %v", err, ErrInvalid)
+	}
+}
+
+func TestVerifyUnknownKey(t *testing.T) {
+	minted := newTestManager(t)
+	key, token, err := minted.Mint("alice", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A node that never heard of the key, e.g. after losing its database
+	m := newTestManager(t)
+	if _, err := m.Verify(token); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Verify() of an unknown key = %v, want %v", err, ErrNotFound)
+	}
+
+	m.SetFetcher(minted.Get)
+	if _, err := m.Verify(token); err != nil {
+		t.Fatalf("Verify() of a key fetched from a peer: %v", err)
+	}
+
+	if _, err := minted.Revoke(key.ID); err != nil {
+		t.Fatal(err)
+	}
+	late := newTestManager(t)
+	late.SetFetcher(minted.Get)
+	if _, err := late.Verify(token); !errors.Is(err, ErrRevoked) {
+		t.Fatalf("Verify() of a key revoked on a peer = %v, want %v", err, ErrRevoked)
+	}
+
+	forged := newTestManager(t)
+	forged.SetFetcher(func(string) (Key, bool) {
+		return Key{ID: key.ID, User: "alice", Prefix: "a"}, true
+	})
+	if _, err := forged.Verify(token); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Verify() of a fetched key with another prefix = %v, want %v", err, ErrNotFound)
+	}
+}
@@ -0,0 +1,120 @@
+package keys
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// keysBucket maps a key ID to a user key
+var keysBucket = []byte("keys")
+
+// Store persists user keys and their revocation, so revoked keys stay
+// revoked across restarts. The key tokens themselves are never stored.
+type Store interface {
+	// Save creates or replaces a key
+	Save(key Key) error
+	// List returns every stored key
+	List() ([]Key, error)
+	// Close releases the store's resources
+	Close() error
+}
+
+// MemoryStore keeps keys in memory only
+type MemoryStore struct {
+	keys map[string]Key
+	mu   sync.RWMutex
+}
+
+// NewMemoryStore creates an empty memory key store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		keys: make(map[string]Key),
+	}
+}
+
+// Save creates or replaces a key
+func (s *MemoryStore) Save(key Key) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.keys[key.ID] = key
+	return nil
+}
+
+// List returns every stored key
+func (s *MemoryStore) List() ([]Key, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	result := make([]Key, 0, len(s.keys))
+	for _, key := range s.keys {
+		result = append(result, key)
+	}
+	return result, nil
+}
+
+// Close is a no-op for the memory store
+func (s *MemoryStore) Close() error {
+	return nil
+}
+
+// BoltStore persists keys to an embedded bbolt database
+type BoltStore struct {
+	db *bolt.DB
+}
+
+// NewBoltStore opens (or creates) the database at path
+func NewBoltStore(path string) (*BoltStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("open key store %s: %w", path, err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(keysBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("init key store: %w", err)
+	}
+
+	return &BoltStore{db: db}, nil
+}
+
+// Save creates or replaces a key
+func (s *BoltStore) Save(key Key) error {
+	data, err := json.Marshal(key)
+	if err != nil {
+		return fmt.Errorf("marshal key: %w", err)
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(keysBucket).Put([]byte(key.ID), data)
+	})
+}
+
+// List returns every stored key
+func (s *BoltStore) List() ([]Key, error) {
+	var result []Key
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(keysBucket).ForEach(func(k, v []byte) error {
+			var key Key
+			if err := json.Unmarshal(v, &key); err != nil {
+				return nil
+			}
+			result = append(result, key)
+			return nil
+		})
+	})
+	return result, err
+}
+
+// Close closes the database
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,119 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	stdlog "log"
+	"log/slog"
+	"sort"
+	"strings"
+
+	pikolog "github.com/andydunstall/piko/pkg/log"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// pikoLogger writes the logs of the embedded piko server to a slog logger,
+// so piko and the server share one output format
+type pikoLogger struct {
+	logger    *slog.Logger
+	level     slog.Level
+	subsystem string
+	attrs     []slog.Attr
+}
+
+// NewPikoLogger returns a piko logger writing piko records at level and
+// above to logger, with their piko subsystem
+func NewPikoLogger(logger *slog.Logger, level string) (pikolog.Logger, error) {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("invalid piko log level %q", level)
+	}
+	return &pikoLogger{logger: logger, level: lvl, subsystem: "main"}, nil
+}
+
+func (l *pikoLogger) Subsystem() string {
+	return l.subsystem
+}
+
+func (l *pikoLogger) WithSubsystem(s string) pikolog.Logger {
+	clone := *l
+	clone.subsystem = s
+	return &clone
+}
+
+func (l *pikoLogger) With(fields ...zap.Field) pikolog.Logger {
+	clone := *l
+	clone.attrs = append(append([]slog.Attr(nil), l.attrs...), fieldAttrs(fields)...)
+	return &clone
+}
+
+func (l *pikoLogger) Debug(msg string, fields ...zap.Field) {
+	l.log(slog.LevelDebug, msg, fields)
+}
+
+func (l *pikoLogger) Info(msg string, fields ...zap.Field) {
+	l.log(slog.LevelInfo, msg, fields)
+}
+
+func (l *pikoLogger) Warn(msg string, fields ...zap.Field) {
+	l.log(slog.LevelWarn, msg, fields)
+}
+
+func (l *pikoLogger) Error(msg string, fields ...zap.Field) {
+	l.log(slog.LevelError, msg, fields)
+}
+
+func (l *pikoLogger) Sync() error {
+	return nil
+}
+
+func (l *pikoLogger) StdLogger(level zapcore.Level) *stdlog.Logger {
+	return slog.NewLogLogger(l.logger.With("subsystem", l.subsystem).Handler(), slogLevel(level))
+}
+
+func (l *pikoLogger) log(level slog.Level, msg string, fields []zap.Field) {
+	// Piko's access log dumps the request headers, credentials included,
+	// and is covered by the access log of the server
+	if level < l.level || strings.HasSuffix(l.subsystem, ".access") {
+		return
+	}
+	attrs := make([]slog.Attr, 0, 1+len(l.attrs)+len(fields))
+	attrs = append(attrs, slog.String("subsystem", l.subsystem))
+	attrs = append(attrs, l.attrs...)
+	attrs = append(attrs, fieldAttrs(fields)...)
+	l.logger.LogAttrs(context.Background(), level, msg, attrs...)
+}
+
+// fieldAttrs converts zap fields to attributes ordered by key
+func fieldAttrs(fields []zap.Field) []slog.Attr {
+	if len(fields) == 0 {
+		return nil
+	}
+	enc := zapcore.NewMapObjectEncoder()
+	for _, field := range fields {
+		field.AddTo(enc)
+	}
+	attrs := make([]slog.Attr, 0, len(enc.Fields))
+	for key, value := range enc.Fields {
+		attrs = append(attrs, slog.Any(key, value))
+	}
+	sort.Slice(attrs, func(i, j int) bool {
+		return attrs[i].Key < attrs[j].Key
+	})
+	return attrs
+}
+
+// slogLevel maps a zap level to the nearest slog level
+func slogLevel(level zapcore.Level) slog.Level {
+	switch {
+	case level <= zapcore.DebugLevel:
+		return slog.LevelDebug
+	case level == zapcore.InfoLevel:
+		return slog.LevelInfo
+	case level == zapcore.WarnLevel:
+		return slog.LevelWarn
+	default:
+		return slog.LevelError
+	}
+}
@@ -0,0 +1,125 @@
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"clauded-server/notification"
+	"clauded-server/session"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Namespace prefixes every metric of the server. Piko's own metrics are
+// served separately on the piko admin port.
+const Namespace = "clauded"
+
+// Route types of proxied requests
+const (
+	RouteSession  = "session"
+	RoutePort     = "port"
+	RouteRoot     = "root"
+	RouteUpstream = "upstream"
+)
+
+// Metrics holds the Prometheus metrics of the server
+type Metrics struct {
+	registry *prometheus.Registry
+
+	requests        *prometheus.CounterVec
+	requestDuration *prometheus.HistogramVec
+	websockets      *prometheus.GaugeVec
+	websocketsTotal *prometheus.CounterVec
+	websocketLength *prometheus.HistogramVec
+	rateLimited     *prometheus.CounterVec
+}
+
+// New creates the server metrics, reporting the state of sessions and
+// notifications when they are scraped. Traffic is reported per session only
+// when sessionLabels is set, since session IDs are part of their URLs.
+func New(sessions *session.Manager, notifs *notification.Service, sessionLabels bool) *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: Namespace,
+			Name:      "proxy_requests_total",
+			Help:      "Proxied requests by route type and status code.",
+		}, []string{"route", "code"}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: Namespace,
+			Name:      "proxy_request_duration_seconds",
+			Help:      "Duration of proxied requests other than WebSockets by route type.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"route"}),
+		websockets: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: Namespace,
+			Name:      "websocket_connections",
+			Help:      "Open proxied WebSocket connections by route type.",
+		}, []string{"route"}),
+		websocketsTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: Namespace,
+			Name:      "websocket_connections_total",
+			Help:      "Proxied WebSocket connections by route type.",
+		}, []string{"route"}),
+		websocketLength: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: Namespace,
+			Name:      "websocket_connection_duration_seconds",
+			Help:      "How long proxied WebSocket connections stayed open by route type.",
+			Buckets:   []float64{1, 10, 60, 300, 900, 3600, 4 * 3600, 12 * 3600, 24 * 3600},
+		}, []string{"route"}),
+		rateLimited: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: Namespace,
+			Name:      "rate_limited_total",
+			Help:      "Requests refused with 429 by the limit that refused them.",
+		}, []string{"limit"}),
+	}
+
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.requests,
+		m.requestDuration,
+		m.websockets,
+		m.websocketsTotal,
+		m.websocketLength,
+		m.rateLimited,
+		newStateCollector(sessions, notifs, sessionLabels),
+	)
+	return m
+}
+
+// Handler returns the handler serving the metrics
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{Registry: m.registry})
+}
+
+// ObserveRequest records a proxied request that took d
+func (m *Metrics) ObserveRequest(route string, code int, d time.Duration) {
+	m.requests.WithLabelValues(route, strconv.Itoa(code)).Inc()
+	m.requestDuration.WithLabelValues(route).Observe(d.Seconds())
+}
+
+// WebSocketOpened records a proxied WebSocket connection. The returned
+// function must be called with the response status code once the
+// connection has closed, or the upgrade has failed.
+func (m *Metrics) WebSocketOpened(route string) func(code int) {
+	start := time.Now()
+	m.websockets.WithLabelValues(route).Inc()
+
+	return func(code int) {
+		m.websockets.WithLabelValues(route).Dec()
+		m.requests.WithLabelValues(route, strconv.Itoa(code)).Inc()
+		if code == http.StatusSwitchingProtocols {
+			m.websocketsTotal.WithLabelValues(route).Inc()
+			m.websocketLength.WithLabelValues(route).Observe(time.Since(start).Seconds())
+		}
+	}
+}
+
+// ObserveRateLimited records a request refused by a rate limit or cap
+func (m *Metrics) ObserveRateLimited(limit string) {
+	m.rateLimited.WithLabelValues(limit).Inc()
+}
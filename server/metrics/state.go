@@ -0,0 +1,101 @@
+package metrics
+
+import (
+	"clauded-server/notification"
+	"clauded-server/session"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// stateCollector reports the session registry and notification queues as
+// they are when scraped, so sessions that have been cleaned up disappear
+// from the per-session metrics
+type stateCollector struct {
+	sessions      *session.Manager
+	notifs        *notification.Service
+	sessionLabels bool
+
+	activeSessions      *prometheus.Desc
+	upstreamConnects    *prometheus.Desc
+	upstreamDisconnects *prometheus.Desc
+	sessionBytesIn      *prometheus.Desc
+	sessionBytesOut     *prometheus.Desc
+	queueDepth          *prometheus.Desc
+	webhookQueueDepth   *prometheus.Desc
+	dropped             *prometheus.Desc
+	webhookFailures     *prometheus.Desc
+	webhookDeadLetters  *prometheus.Desc
+}
+
+func newStateCollector(sessions *session.Manager, notifs *notification.Service, sessionLabels bool) *stateCollector {
+	name := func(name string) string {
+		return prometheus.BuildFQName(Namespace, "", name)
+	}
+	return &stateCollector{
+		sessions:      sessions,
+		notifs:        notifs,
+		sessionLabels: sessionLabels,
+		activeSessions: prometheus.NewDesc(name("sessions_active"),
+			"Sessions with at least one upstream connected to this node.", nil, nil),
+		upstreamConnects: prometheus.NewDesc(name("upstream_connects_total"),
+			"Upstream listeners connected to this node.", nil, nil),
+		upstreamDisconnects: prometheus.NewDesc(name("upstream_disconnects_total"),
+			"Upstream listeners disconnected from this node.", nil, nil),
+		sessionBytesIn: prometheus.NewDesc(name("session_received_bytes_total"),
+			"Bytes proxied to a session.", []string{"session"}, nil),
+		sessionBytesOut: prometheus.NewDesc(name("session_sent_bytes_total"),
+			"Bytes proxied from a session.", []string{"session"}, nil),
+		queueDepth: prometheus.NewDesc(name("notification_queue_depth"),
+			"Published notifications waiting to be distributed.", nil, nil),
+		webhookQueueDepth: prometheus.NewDesc(name("webhook_queue_depth"),
+			"Webhook deliveries waiting for a worker.", nil, nil),
+		dropped: prometheus.NewDesc(name("notifications_dropped_total"),
+			"Notifications dropped because the queue (queue_full) or an SSE subscriber (subscriber_full) was full.", []string{"reason"}, nil),
+		webhookFailures: prometheus.NewDesc(name("webhook_failures_total"),
+			"Failed webhook delivery attempts.", nil, nil),
+		webhookDeadLetters: prometheus.NewDesc(name("webhook_dead_letters_total"),
+			"Webhook deliveries given up on and moved to the dead-letter list.", nil, nil),
+	}
+}
+
+func (c *stateCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.activeSessions
+	ch <- c.upstreamConnects
+	ch <- c.upstreamDisconnects
+	if c.sessionLabels {
+		ch <- c.sessionBytesIn
+		ch <- c.sessionBytesOut
+	}
+	ch <- c.queueDepth
+	ch <- c.webhookQueueDepth
+	ch <- c.dropped
+	ch <- c.webhookFailures
+	ch <- c.webhookDeadLetters
+}
+
+func (c *stateCollector) Collect(ch chan<- prometheus.Metric) {
+	active := 0
+	for _, info := range c.sessions.List() {
+		if info.Connected {
+			active++
+		}
+		if !c.sessionLabels {
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(c.sessionBytesIn, prometheus.CounterValue, float64(info.BytesIn), info.ID)
+		ch <- prometheus.MustNewConstMetric(c.sessionBytesOut, prometheus.CounterValue, float64(info.BytesOut), info.ID)
+	}
+	ch <- prometheus.MustNewConstMetric(c.activeSessions, prometheus.GaugeValue, float64(active))
+
+	sessionStats := c.sessions.Stats()
+	ch <- prometheus.MustNewConstMetric(c.upstreamConnects, prometheus.CounterValue, float64(sessionStats.Connects))
+	ch <- prometheus.MustNewConstMetric(c.upstreamDisconnects, prometheus.CounterValue, float64(sessionStats.Disconnects))
+
+	stats := c.notifs.Stats()
+	ch <- prometheus.MustNewConstMetric(c.queueDepth, prometheus.GaugeValue, float64(stats.QueueDepth))
+	ch <- prometheus.MustNewConstMetric(c.webhookQueueDepth, prometheus.GaugeValue, float64(stats.WebhookQueueDepth))
+	ch <- prometheus.MustNewConstMetric(c.dropped, prometheus.CounterValue, float64(stats.Dropped), "queue_full")
+	ch <- prometheus.MustNewConstMetric(c.dropped, prometheus.CounterValue, float64(stats.SubscriberDropped), "subscriber_full")
+	ch <- prometheus.MustNewConstMetric(c.webhookFailures, prometheus.CounterValue, float64(stats.WebhookFailures))
+	ch <- prometheus.MustNewConstMetric(c.webhookDeadLetters, prometheus.CounterValue, float64(stats.WebhookDeadLetters))
+}
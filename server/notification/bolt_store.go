@@ -0,0 +1,151 @@
+package notification
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	// notificationsBucket maps a sequence number to a notification
+	notificationsBucket = []byte("notifications")
+	// notificationIDsBucket maps a notification ID to its sequence number
+	notificationIDsBucket = []byte("notification_ids")
+)
+
+// BoltStore persists notifications to an embedded bbolt database so they
+// survive server restarts
+type BoltStore struct {
+	db        *bolt.DB
+	retention int
+}
+
+// NewBoltStore opens (or creates) the database at path, retaining up to
+// retention notifications
+func NewBoltStore(path string, retention int) (*BoltStore, error) {
+	if retention <= 0 {
+		retention = 1000
+	}
+
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("open notification store %s: %w", path, err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(notificationsBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(notificationIDsBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("init notification store: %w", err)
+	}
+
+	return &BoltStore{db: db, retention: retention}, nil
+}
+
+// Append stores a notification, removing the oldest beyond the retention
+func (s *BoltStore) Append(notif Notification) error {
+	data, err := json.Marshal(notif)
+	if err != nil {
+		return fmt.Errorf("marshal notification: %w", err)
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		notifications := tx.Bucket(notificationsBucket)
+		ids := tx.Bucket(notificationIDsBucket)
+
+		seq, err := notifications.NextSequence()
+		if err != nil {
+			return err
+		}
+		key := seqKey(seq)
+		if err := notifications.Put(key, data); err != nil {
+			return err
+		}
+		if err := ids.Put([]byte(notif.ID), key); err != nil {
+			return err
+		}
+
+		// Trim the oldest notifications beyond the retention. Sequence
+		// numbers are contiguous as only the oldest are ever removed.
+		c := notifications.Cursor()
+		k, v := c.First()
+		excess := int(seq-binary.BigEndian.Uint64(k)) + 1 - s.retention
+		for ; k != nil && excess > 0; k, v = c.Next() {
+			var old Notification
+			if err := json.Unmarshal(v, &old); err == nil {
+				ids.Delete([]byte(old.ID))
+			}
+			if err := c.Delete(); err != nil {
+				return err
+			}
+			excess--
+		}
+		return nil
+	})
+}
+
+// Since returns the notifications selected by match published after afterID
+func (s *BoltStore) Since(afterID string, match func(Notification) bool) ([]Notification, error) {
+	var result []Notification
+	err := s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(notificationsBucket).Cursor()
+
+		k, v := c.First()
+		if afterID != "" {
+			if seq := tx.Bucket(notificationIDsBucket).Get([]byte(afterID)); seq != nil {
+				k, v = c.Seek(seq)
+				if k != nil {
+					k, v = c.Next()
+				}
+			}
+		}
+
+		for ; k != nil; k, v = c.Next() {
+			var notif Notification
+			if err := json.Unmarshal(v, &notif); err != nil {
+				continue
+			}
+			if match(notif) {
+				result = append(result, notif)
+			}
+		}
+		return nil
+	})
+	return result, err
+}
+
+// Recent returns up to limit of the most recent notifications, newest first
+func (s *BoltStore) Recent(limit int) ([]Notification, error) {
+	var result []Notification
+	err := s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(notificationsBucket).Cursor()
+		for k, v := c.Last(); k != nil && (limit <= 0 || len(result) < limit); k, v = c.Prev() {
+			var notif Notification
+			if err := json.Unmarshal(v, &notif); err != nil {
+				continue
+			}
+			result = append(result, notif)
+		}
+		return nil
+	})
+	return result, err
+}
+
+// Close closes the database
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
+
+func seqKey(seq uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, seq)
+	return key
+}
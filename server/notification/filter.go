@@ -0,0 +1,407 @@
+package notification
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Filter is a compiled filter expression over a notification, for example
+//
+//	data.exit_code != 0 && (data.tool == "claude" || severity >= "error")
+//
+// Fields are type, session_id, severity and data.<key>, where nested data
+// objects are reached with further dots. Operators are ==, !=, <, <=, >, >=
+// and ~= (substring), combined with &&, || and !. A field on its own tests
+// that it is set and not false, zero or empty. Field names may use letters
+// and digits of any script, such as data.状态. Values are double or single
+// quoted strings, numbers, true, false and null. Severities compare by level.
+type Filter struct {
+	expr filterExpr
+	src  string
+}
+
+// ParseFilter compiles a filter expression
+func ParseFilter(src string) (*Filter, error) {
+	p := &filterParser{src: src}
+	if err := p.tokenize(); err != nil {
+		return nil, err
+	}
+	expr, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q in filter", p.tokens[p.pos].text)
+	}
+	return &Filter{expr: expr, src: src}, nil
+}
+
+// Match reports whether a notification satisfies the filter
+func (f *Filter) Match(notif Notification) bool {
+	return f.expr.eval(notif)
+}
+
+// String returns the filter's source
+func (f *Filter) String() string {
+	return f.src
+}
+
+type filterExpr interface {
+	eval(notif Notification) bool
+}
+
+type orExpr struct{ left, right filterExpr }
+
+func (e orExpr) eval(n Notification) bool { return e.left.eval(n) || e.right.eval(n) }
+
+type andExpr struct{ left, right filterExpr }
+
+func (e andExpr) eval(n Notification) bool { return e.left.eval(n) && e.right.eval(n) }
+
+type notExpr struct{ expr filterExpr }
+
+func (e notExpr) eval(n Notification) bool { return !e.expr.eval(n) }
+
+// truthyExpr tests that a field is set and not false, zero or empty
+type truthyExpr struct{ field []string }
+
+func (e truthyExpr) eval(n Notification) bool {
+	v, ok := lookupField(n, e.field)
+	if !ok || v == nil {
+		return false
+	}
+	switch v := v.(type) {
+	case bool:
+		return v
+	case string:
+		return v != ""
+	case float64:
+		return v != 0
+	default:
+		return true
+	}
+}
+
+type compareExpr struct {
+	field []string
+	op    string
+	value interface{}
+}
+
+func (e compareExpr) eval(n Notification) bool {
+	v, ok := lookupField(n, e.field)
+	if !ok {
+		v = nil
+	}
+
+	if e.op == "~=" {
+		s, ok1 := v.(string)
+		sub, ok2 := e.value.(string)
+		return ok1 && ok2 && strings.Contains(s, sub)
+	}
+
+	// Severities compare by level rather than alphabetically
+	if len(e.field) == 1 && e.field[0] == "severity" {
+		if s, ok := e.value.(string); ok {
+			return compareOrdered(Severity(v.(string)).rank(), Severity(s).rank(), e.op)
+		}
+	}
+
+	switch want := e.value.(type) {
+	case nil:
+		return (v == nil) == (e.op == "==")
+	case float64:
+		got, ok := toNumber(v)
+		if !ok {
+			return e.op == "!="
+		}
+		return compareOrdered(got, want, e.op)
+	case bool:
+		got, ok := v.(bool)
+		return (ok && got == want) == (e.op == "==")
+	case string:
+		got, ok := v.(string)
+		if !ok {
+			if v == nil {
+				return e.op == "!="
+			}
+			got = fmt.Sprint(v)
+		}
+		return compareOrdered(got, want, e.op)
+	}
+	return false
+}
+
+func compareOrdered[T int | float64 | string](a, b T, op string) bool {
+	switch op {
+	case "==":
+		return a == b
+	case "!=":
+		return a != b
+	case "<":
+		return a < b
+	case "<=":
+		return a <= b
+	case ">":
+		return a > b
+	case ">=":
+		return a >= b
+	}
+	return false
+}
+
+func toNumber(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case float64:
+		return v, true
+	case int:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case string:
+		f, err := strconv.ParseFloat(v, 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// lookupField resolves a field path against a notification
+func lookupField(n Notification, field []string) (interface{}, bool) {
+	switch field[0] {
+	case "type":
+		return string(n.Type), len(field) == 1
+	case "session_id":
+		return n.SessionID, len(field) == 1
+	case "severity":
+		return string(n.Level()), len(field) == 1
+	case "data":
+		var v interface{} = n.Data
+		for _, key := range field[1:] {
+			m, ok := v.(map[string]interface{})
+			if !ok {
+				return nil, false
+			}
+			if v, ok = m[key]; !ok {
+				return nil, false
+			}
+		}
+		return v, len(field) > 1
+	}
+	return nil, false
+}
+
+type filterToken struct {
+	kind string // "ident", "string", "number", "op" or "paren"
+	text string
+}
+
+type filterParser struct {
+	src    string
+	tokens []filterToken
+	pos    int
+}
+
+func (p *filterParser) tokenize() error {
+	s := p.src
+	for i := 0; i < len(s); {
+		c, size := utf8.DecodeRuneInString(s[i:])
+		switch {
+		case c == utf8.RuneError && size == 1:
+			return fmt.Errorf("invalid UTF-8 in filter")
+		case unicode.IsSpace(c):
+			i += size
+		case c == '(' || c == ')':
+			p.tokens = append(p.tokens, filterToken{"paren", string(c)})
+			i += size
+		case c == '"' || c == '\'':
+			end := strings.IndexByte(s[i+1:], s[i])
+			if end < 0 {
+				return fmt.Errorf("unterminated string in filter")
+			}
+			p.tokens = append(p.tokens, filterToken{"string", s[i+1 : i+1+end]})
+			i += end + 2
+		case c == '-' || isDigit(c):
+			j := i + 1
+			for j < len(s) && (isDigit(rune(s[j])) || s[j] == '.') {
+				j++
+			}
+			p.tokens = append(p.tokens, filterToken{"number", s[i:j]})
+			i = j
+		case unicode.IsLetter(c) || c == '_':
+			j := i + size
+			for j < len(s) {
+				r, n := utf8.DecodeRuneInString(s[j:])
+				if !isIdentRune(r) {
+					break
+				}
+				j += n
+			}
+			p.tokens = append(p.tokens, filterToken{"ident", s[i:j]})
+			i = j
+		default:
+			op := ""
+			for _, candidate := range []string{"&&", "||", "==", "!=", "<=", ">=", "~=", "<", ">", "!"} {
+				if strings.HasPrefix(s[i:], candidate) {
+					op = candidate
+					break
+				}
+			}
+			if op == "" {
+				return fmt.Errorf("unexpected %q in filter", c)
+			}
+			p.tokens = append(p.tokens, filterToken{"op", op})
+			i += len(op)
+		}
+	}
+	return nil
+}
+
+// isDigit reports whether c is an ASCII digit; numbers are ASCII only
+func isDigit(c rune) bool {
+	return c >= '0' && c <= '9'
+}
+
+// isIdentRune reports whether c may continue a field name. Letters and
+// digits of any script are allowed so data keys need not be ASCII
+func isIdentRune(c rune) bool {
+	return unicode.IsLetter(c) || unicode.IsDigit(c) || unicode.IsMark(c) || c == '_' || c == '.' || c == '-'
+}
+
+func (p *filterParser) peek() (filterToken, bool) {
+	if p.pos >= len(p.tokens) {
+		return filterToken{}, false
+	}
+	return p.tokens[p.pos], true
+}
+
+func (p *filterParser) accept(kind, text string) bool {
+	if tok, ok := p.peek(); ok && tok.kind == kind && tok.text == text {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *filterParser) parseOr() (filterExpr, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("op", "||") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = orExpr{left, right}
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseAnd() (filterExpr, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("op", "&&") {
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = andExpr{left, right}
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseUnary() (filterExpr, error) {
+	if p.accept("op", "!") {
+		expr, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return notExpr{expr}, nil
+	}
+	if p.accept("paren", "(") {
+		expr, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if !p.accept("paren", ")") {
+			return nil, fmt.Errorf("missing ) in filter")
+		}
+		return expr, nil
+	}
+	return p.parseComparison()
+}
+
+func (p *filterParser) parseComparison() (filterExpr, error) {
+	tok, ok := p.peek()
+	if !ok {
+		return nil, fmt.Errorf("unexpected end of filter")
+	}
+	if tok.kind != "ident" {
+		return nil, fmt.Errorf("expected a field, got %q", tok.text)
+	}
+	p.pos++
+
+	field := strings.Split(tok.text, ".")
+	switch field[0] {
+	case "type", "session_id", "severity":
+		if len(field) != 1 {
+			return nil, fmt.Errorf("unknown field %q", tok.text)
+		}
+	case "data":
+		if len(field) < 2 {
+			return nil, fmt.Errorf("expected data.<key>, got %q", tok.text)
+		}
+	default:
+		return nil, fmt.Errorf("unknown field %q", tok.text)
+	}
+
+	op, ok := p.peek()
+	if !ok || op.kind != "op" || op.text == "&&" || op.text == "||" || op.text == "!" {
+		return truthyExpr{field}, nil
+	}
+	p.pos++
+
+	valueTok, ok := p.peek()
+	if !ok {
+		return nil, fmt.Errorf("expected a value after %s", op.text)
+	}
+	p.pos++
+
+	var value interface{}
+	switch {
+	case valueTok.kind == "string":
+		value = valueTok.text
+	case valueTok.kind == "number":
+		f, err := strconv.ParseFloat(valueTok.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q in filter", valueTok.text)
+		}
+		value = f
+	case valueTok.kind == "ident" && valueTok.text == "true":
+		value = true
+	case valueTok.kind == "ident" && valueTok.text == "false":
+		value = false
+	case valueTok.kind == "ident" && valueTok.text == "null":
+		value = nil
+	default:
+		return nil, fmt.Errorf("expected a value after %s, got %q", op.text, valueTok.text)
+	}
+
+	switch value.(type) {
+	case bool, nil:
+		if op.text != "==" && op.text != "!=" {
+			return nil, fmt.Errorf("%s cannot compare %v", op.text, value)
+		}
+	}
+	if op.text == "~=" {
+		if _, ok := value.(string); !ok {
+			return nil, fmt.Errorf("~= needs a string")
+		}
+	}
+	return compareExpr{field: field, op: op.text, value: value}, nil
+}
@@ -0,0 +1,155 @@
+package notification
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseFilter(t *testing.T) {
+	tests := []struct {
+		src     string
+		wantErr string
+	}{
+		{src: `type == "error"`},
+		{src: `data.exit_code != 0 && (data.tool == "claude" || severity >= "error")`},
+		{src: `!data.done`},
+		{src: `data.message ~= 'fail'`},
+		{src: `data.result.code == -1.5`},
+		{src: `data.状态 == "失败"`},
+		{src: `data.ツール名 ~= "クロード" || data.naïve`},
+		{src: `data.x == null && data.y != true`},
+		{src: ``, wantErr: "unexpected end of filter"},
+		{src: `data`, wantErr: "expected data.<key>"},
+		{src: `status == 1`, wantErr: "unknown field"},
+		{src: `type.name == "x"`, wantErr: "unknown field"},
+		{src: `数据.x == 1`, wantErr: "unknown field"},
+		{src: `data.x ==`, wantErr: "expected a value after =="},
+		{src: `data.x == "open`, wantErr: "unterminated string"},
+		{src: `(data.x`, wantErr: "missing )"},
+		{src: `data.x == 1)`, wantErr: `unexpected ")"`},
+		{src: `data.x < true`, wantErr: "cannot compare"},
+		{src: `data.x ~= 1`, wantErr: "~= needs a string"},
+		{src: `data.x == 1.2.3`, wantErr: "invalid number"},
+		{src: `data.x # 1`, wantErr: "unexpected '#'"},
+		{src: `data.x == "ok" ＆＆ data.y`, wantErr: "unexpected '＆'"},
+		{src: "data.x == \xff", wantErr: "invalid UTF-8"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.src, func(t *testing.T) {
+			f, err := ParseFilter(tt.src)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("ParseFilter() error = %v", err)
+				}
+				if f.String() != tt.src {
+					t.Fatalf("String() = %q, want %q", f.String(), tt.src)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("ParseFilter() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestFilterMatch(t *testing.T) {
+	notif := Notification{
+		SessionID: "alice",
+		Type:      TaskCompleted,
+		Data: map[string]interface{}{
+			"exit_code": float64(1),
+			"tool":      "claude",
+			"message":   "build failed",
+			"done":      true,
+			"empty":     "",
+			"zero":      float64(0),
+			"missing":   nil,
+			"count":     "12",
+			"状态":        "失败",
+			"result":    map[string]interface{}{"code": float64(-1.5)},
+		},
+	}
+	tests := []struct {
+		src  string
+		want bool
+	}{
+		{src: `type == "task_completed"`, want: true},
+		{src: `type != "task_completed"`, want: false},
+		{src: `session_id == "alice"`, want: true},
+		{src: `data.exit_code != 0`, want: true},
+		{src: `data.exit_code > 0 && data.exit_code <= 1`, want: true},
+		{src: `data.exit_code < 1`, want: false},
+		{src: `data.count >= 10`, want: true},
+		{src: `data.tool == "claude" || data.tool == "codex"`, want: true},
+		{src: `data.tool == "codex" || data.exit_code == 0`, want: false},
+		{src: `data.exit_code != 0 && (data.tool == "codex" || severity >= "info")`, want: true},
+		{src: `!(data.tool == "claude")`, want: false},
+		{src: `data.message ~= "fail"`, want: true},
+		{src: `data.message ~= "pass"`, want: false},
+		{src: `data.exit_code ~= "1"`, want: false},
+		{src: `data.done`, want: true},
+		{src: `data.done == true`, want: true},
+		{src: `data.done != false`, want: true},
+		{src: `data.empty`, want: false},
+		{src: `data.zero`, want: false},
+		{src: `data.missing`, want: false},
+		{src: `data.absent`, want: false},
+		{src: `!data.absent`, want: true},
+		{src: `data.missing == null`, want: true},
+		{src: `data.absent == null`, want: true},
+		{src: `data.tool != null`, want: true},
+		{src: `data.absent != "x"`, want: true},
+		{src: `data.absent == 1`, want: false},
+		{src: `data.absent != 1`, want: true},
+		{src: `data.result.code == -1.5`, want: true},
+		{src: `data.result.code.deeper == 1`, want: false},
+		{src: `data.tool.name == "claude"`, want: false},
+		{src: `data.状态 == "失败"`, want: true},
+		{src: `data.状态 ~= "败"`, want: true},
+		{src: `data.状态 != '失败'`, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.src, func(t *testing.T) {
+			f, err := ParseFilter(tt.src)
+			if err != nil {
+				t.Fatalf("ParseFilter() error = %v", err)
+			}
+			if got := f.Match(notif); got != tt.want {
+				t.Fatalf("Match() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFilterSeverity(t *testing.T) {
+	tests := []struct {
+		notif Notification
+		src   string
+		want  bool
+	}{
+		{notif: Notification{Type: Progress, Severity: SeverityCritical}, src: `severity >= "error"`, want: true},
+		{notif: Notification{Type: Progress, Severity: SeverityWarning}, src: `severity >= "error"`, want: false},
+		// Alphabetically "debug" < "critical", by level it is the other way
+		{notif: Notification{Type: Progress, Severity: SeverityDebug}, src: `severity < "critical"`, want: true},
+		{notif: Notification{Type: Progress, Severity: SeverityCritical}, src: `severity > "debug"`, want: true},
+		{notif: Notification{Type: Progress, Severity: SeverityInfo}, src: `severity == "info"`, want: true},
+		// Notifications without a severity use their type's default
+		{notif: Notification{Type: Error}, src: `severity == "error"`, want: true},
+		{notif: Notification{Type: SystemStatus}, src: `severity >= "warning"`, want: true},
+		{notif: Notification{Type: TaskCompleted}, src: `severity >= "warning"`, want: false},
+		// An unknown severity ranks below every known one
+		{notif: Notification{Type: Progress, Severity: SeverityDebug}, src: `severity > "urgent"`, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.src, func(t *testing.T) {
+			f, err := ParseFilter(tt.src)
+			if err != nil {
+				t.Fatalf("ParseFilter() error = %v", err)
+			}
+			if got := f.Match(tt.notif); got != tt.want {
+				t.Fatalf("Match(%s) = %v, want %v", tt.notif.Level(), got, tt.want)
+			}
+		})
+	}
+}
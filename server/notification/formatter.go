@@ -0,0 +1,305 @@
+package notification
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Formatter renders a notification into the JSON body expected by a webhook
+// target. link is the URL of the session's terminal, or empty when the
+// server has no public URL configured.
+type Formatter interface {
+	Format(notif Notification, webhookURL, link string) ([]byte, error)
+}
+
+// FormatterFunc adapts a function to a Formatter
+type FormatterFunc func(notif Notification, webhookURL, link string) ([]byte, error)
+
+// Format calls f
+func (f FormatterFunc) Format(notif Notification, webhookURL, link string) ([]byte, error) {
+	return f(notif, webhookURL, link)
+}
+
+// GenericFormat posts the raw notification JSON
+const GenericFormat = "generic"
+
+var (
+	formatters = map[string]Formatter{
+		GenericFormat: FormatterFunc(formatGeneric),
+		"feishu":      FormatterFunc(formatFeishu),
+		"dingtalk":    FormatterFunc(formatDingTalk),
+		"wecom":       FormatterFunc(formatWeCom),
+		"slack":       FormatterFunc(formatSlack),
+		"telegram":    FormatterFunc(formatTelegram),
+	}
+	formattersMu sync.RWMutex
+)
+
+// RegisterFormatter registers a formatter under name, replacing any
+// formatter already registered under it
+func RegisterFormatter(name string, f Formatter) {
+	formattersMu.Lock()
+	defer formattersMu.Unlock()
+
+	formatters[name] = f
+}
+
+// LookupFormatter returns the formatter registered under name. An empty
+// name selects the generic formatter.
+func LookupFormatter(name string) (Formatter, bool) {
+	if name == "" {
+		name = GenericFormat
+	}
+
+	formattersMu.RLock()
+	defer formattersMu.RUnlock()
+
+	f, ok := formatters[name]
+	return f, ok
+}
+
+// Formats returns the names of the registered formatters
+func Formats() []string {
+	formattersMu.RLock()
+	defer formattersMu.RUnlock()
+
+	names := make([]string, 0, len(formatters))
+	for name := range formatters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// SessionLink returns the URL of a session's terminal under publicURL, or an
+// empty string when publicURL is empty
+func SessionLink(publicURL, sessionID string) string {
+	if publicURL == "" {
+		return ""
+	}
+	return strings.TrimRight(publicURL, "/") + "/" + url.PathEscape(sessionID) + "/"
+}
+
+// message is the human readable form of a notification shared by the chat
+// formatters
+type message struct {
+	Title   string
+	Text    string
+	Session string
+	Level   string
+}
+
+// newMessage takes the title and text from the notification's "title" and
+// "message" (or "body"/"text") data fields, falling back to the type and a
+// listing of the data
+func newMessage(notif Notification) message {
+	msg := message{
+		Title:   typeTitle(notif.Type),
+		Session: notif.SessionID,
+		Level:   messageLevel(notif),
+	}
+	if title, ok := notif.Data["title"].(string); ok && title != "" {
+		msg.Title = title
+	}
+	for _, key := range []string{"message", "body", "text"} {
+		if text, ok := notif.Data[key].(string); ok && text != "" {
+			msg.Text = text
+			return msg
+		}
+	}
+
+	keys := make([]string, 0, len(notif.Data))
+	for key := range notif.Data {
+		if key != "title" {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	lines := make([]string, 0, len(keys))
+	for _, key := range keys {
+		lines = append(lines, fmt.Sprintf("%s: %v", key, notif.Data[key]))
+	}
+	msg.Text = strings.Join(lines, "\n")
+	return msg
+}
+
+func typeTitle(t NotificationType) string {
+	switch t {
+	case TaskCompleted:
+		return "✅ Task completed"
+	case Error:
+		return "❌ Error"
+	case Progress:
+		return "⏳ Progress"
+	case SystemStatus:
+		return "ℹ️ System status"
+	default:
+		return string(t)
+	}
+}
+
+// messageLevel returns "success", "error", "info" or "warning" from the
+// notification's severity
+func messageLevel(notif Notification) string {
+	switch notif.Level() {
+	case SeverityError, SeverityCritical:
+		return "error"
+	case SeverityWarning:
+		return "warning"
+	}
+	if notif.Type == TaskCompleted {
+		return "success"
+	}
+	return "info"
+}
+
+func formatGeneric(notif Notification, webhookURL, link string) ([]byte, error) {
+	return json.Marshal(notif)
+}
+
+// formatFeishu renders a Feishu/Lark interactive card
+func formatFeishu(notif Notification, webhookURL, link string) ([]byte, error) {
+	msg := newMessage(notif)
+	colors := map[string]string{"success": "green", "error": "red", "warning": "orange", "info": "blue"}
+
+	elements := []interface{}{
+		map[string]interface{}{
+			"tag":  "div",
+			"text": map[string]string{"tag": "lark_md", "content": msg.Text},
+		},
+		map[string]interface{}{
+			"tag":      "note",
+			"elements": []interface{}{map[string]string{"tag": "plain_text", "content": "Session: " + msg.Session}},
+		},
+	}
+	if link != "" {
+		elements = append(elements, map[string]interface{}{
+			"tag": "action",
+			"actions": []interface{}{map[string]interface{}{
+				"tag":  "button",
+				"text": map[string]string{"tag": "plain_text", "content": "Open terminal"},
+				"url":  link,
+				"type": "primary",
+			}},
+		})
+	}
+
+	return json.Marshal(map[string]interface{}{
+		"msg_type": "interactive",
+		"card": map[string]interface{}{
+			"header": map[string]interface{}{
+				"title":    map[string]string{"tag": "plain_text", "content": msg.Title},
+				"template": colors[msg.Level],
+			},
+			"elements": elements,
+		},
+	})
+}
+
+// formatDingTalk renders a DingTalk action card, or markdown without a link
+func formatDingTalk(notif Notification, webhookURL, link string) ([]byte, error) {
+	msg := newMessage(notif)
+	text := fmt.Sprintf("### %s\n\n%s\n\n> Session: %s", msg.Title, msg.Text, msg.Session)
+
+	if link == "" {
+		return json.Marshal(map[string]interface{}{
+			"msgtype":  "markdown",
+			"markdown": map[string]string{"title": msg.Title, "text": text},
+		})
+	}
+	return json.Marshal(map[string]interface{}{
+		"msgtype": "actionCard",
+		"actionCard": map[string]string{
+			"title":       msg.Title,
+			"text":        text,
+			"singleTitle": "Open terminal",
+			"singleURL":   link,
+		},
+	})
+}
+
+// formatWeCom renders a WeCom (WeChat Work) markdown message
+func formatWeCom(notif Notification, webhookURL, link string) ([]byte, error) {
+	msg := newMessage(notif)
+	colors := map[string]string{"success": "info", "error": "warning", "warning": "comment", "info": "comment"}
+
+	content := fmt.Sprintf("**<font color=\"%s\">%s</font>**\n%s\n> Session: %s",
+		colors[msg.Level], msg.Title, msg.Text, msg.Session)
+	if link != "" {
+		content += fmt.Sprintf("\n[Open terminal](%s)", link)
+	}
+
+	return json.Marshal(map[string]interface{}{
+		"msgtype":  "markdown",
+		"markdown": map[string]string{"content": content},
+	})
+}
+
+// formatSlack renders a Slack incoming webhook message with blocks
+func formatSlack(notif Notification, webhookURL, link string) ([]byte, error) {
+	msg := newMessage(notif)
+
+	blocks := []interface{}{
+		map[string]interface{}{
+			"type": "header",
+			"text": map[string]string{"type": "plain_text", "text": msg.Title},
+		},
+		map[string]interface{}{
+			"type": "section",
+			"text": map[string]string{"type": "mrkdwn", "text": msg.Text},
+		},
+		map[string]interface{}{
+			"type":     "context",
+			"elements": []interface{}{map[string]string{"type": "mrkdwn", "text": "Session: `" + msg.Session + "`"}},
+		},
+	}
+	if link != "" {
+		blocks = append(blocks, map[string]interface{}{
+			"type": "actions",
+			"elements": []interface{}{map[string]interface{}{
+				"type": "button",
+				"text": map[string]string{"type": "plain_text", "text": "Open terminal"},
+				"url":  link,
+			}},
+		})
+	}
+
+	return json.Marshal(map[string]interface{}{
+		"text":   msg.Title + ": " + msg.Text,
+		"blocks": blocks,
+	})
+}
+
+// formatTelegram renders a Bot API sendMessage request. The chat is taken
+// from the chat_id query parameter of the webhook URL, e.g.
+// https://api.telegram.org/bot<token>/sendMessage?chat_id=<chat>.
+func formatTelegram(notif Notification, webhookURL, link string) ([]byte, error) {
+	msg := newMessage(notif)
+
+	u, err := url.Parse(webhookURL)
+	if err != nil {
+		return nil, fmt.Errorf("parse webhook URL: %w", err)
+	}
+	chatID := u.Query().Get("chat_id")
+	if chatID == "" {
+		return nil, fmt.Errorf("telegram webhook URL has no chat_id query parameter")
+	}
+
+	text := fmt.Sprintf("<b>%s</b>\n%s\n<i>Session: %s</i>",
+		html.EscapeString(msg.Title), html.EscapeString(msg.Text), html.EscapeString(msg.Session))
+	if link != "" {
+		text += fmt.Sprintf("\n<a href=\"%s\">Open terminal</a>", html.EscapeString(link))
+	}
+
+	return json.Marshal(map[string]interface{}{
+		"chat_id":                  chatID,
+		"text":                     text,
+		"parse_mode":               "HTML",
+		"disable_web_page_preview": true,
+	})
+}
@@ -0,0 +1,149 @@
+package notification
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFormatters(t *testing.T) {
+	bodies := make(chan []byte, 1)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("webhook got %s with Content-Type %q", r.Method, r.Header.Get("Content-Type"))
+		}
+		bodies <- body
+	}))
+	defer hook.Close()
+
+	const publicURL = "https://term.example.com/"
+	timestamp := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	done := Notification{ID: "n1", SessionID: "demo", Type: TaskCompleted, Timestamp: timestamp,
+		Data: map[string]interface{}{"title": "Build done", "message": "All 42 tests passed & pushed"}}
+	// No message, so the data is listed
+	failed := Notification{ID: "n2", SessionID: "demo", Type: Error, Timestamp: timestamp,
+		Data: map[string]interface{}{"step": "build", "code": 1}}
+
+	tests := []struct {
+		name      string
+		format    string
+		query     string
+		publicURL string
+		notif     Notification
+		want      string
+		wantErr   string
+	}{
+		{
+			name: "generic", format: GenericFormat, publicURL: publicURL, notif: done,
+			want: `{"id": "n1", "session_id": "demo", "type": "task_completed", "timestamp": "2026-01-02T03:04:05Z",
+				"data": {"title": "Build done", "message": "All 42 tests passed & pushed"}}`,
+		},
+		{
+			name: "feishu", format: "feishu", publicURL: publicURL, notif: done,
+			want: `{"msg_type": "interactive", "card": {
+				"header": {"title": {"tag": "plain_text", "content": "Build done"}, "template": "green"},
+				"elements": [
+					{"tag": "div", "text": {"tag": "lark_md", "content": "All 42 tests passed & pushed"}},
+					{"tag": "note", "elements": [{"tag": "plain_text", "content": "Session: demo"}]},
+					{"tag": "action", "actions": [{"tag": "button", "text": {"tag": "plain_text", "content": "Open terminal"},
+						"url": "https://term.example.com/demo/", "type": "primary"}]}
+				]}}`,
+		},
+		{
+			name: "feishu without link", format: "feishu", notif: failed,
+			want: `{"msg_type": "interactive", "card": {
+				"header": {"title": {"tag": "plain_text", "content": "❌ Error"}, "template": "red"},
+				"elements": [
+					{"tag": "div", "text": {"tag": "lark_md", "content": "code: 1\nstep: build"}},
+					{"tag": "note", "elements": [{"tag": "plain_text", "content": "Session: demo"}]}
+				]}}`,
+		},
+		{
+			name: "dingtalk", format: "dingtalk", publicURL: publicURL, notif: done,
+			want: `{"msgtype": "actionCard", "actionCard": {"title": "Build done",
+				"text": "### Build done\n\nAll 42 tests passed & pushed\n\n> Session: demo",
+				"singleTitle": "Open terminal", "singleURL": "https://term.example.com/demo/"}}`,
+		},
+		{
+			name: "dingtalk without link", format: "dingtalk", notif: failed,
+			want: `{"msgtype": "markdown", "markdown": {"title": "❌ Error",
+				"text": "### ❌ Error\n\ncode: 1\nstep: build\n\n> Session: demo"}}`,
+		},
+		{
+			name: "wecom", format: "wecom", publicURL: publicURL, notif: done,
+			want: `{"msgtype": "markdown", "markdown": {"content":
+				"**<font color=\"info\">Build done</font>**\nAll 42 tests passed & pushed\n> Session: demo\n[Open terminal](https://term.example.com/demo/)"}}`,
+		},
+		{
+			name: "wecom without link", format: "wecom", notif: failed,
+			want: `{"msgtype": "markdown", "markdown": {"content":
+				"**<font color=\"warning\">❌ Error</font>**\ncode: 1\nstep: build\n> Session: demo"}}`,
+		},
+		{
+			name: "slack", format: "slack", publicURL: publicURL, notif: done,
+			want: `{"text": "Build done: All 42 tests passed & pushed", "blocks": [
+				{"type": "header", "text": {"type": "plain_text", "text": "Build done"}},
+				{"type": "section", "text": {"type": "mrkdwn", "text": "All 42 tests passed & pushed"}},
+				{"type": "context", "elements": [{"type": "mrkdwn", "text": "Session: ` + "`demo`" + `"}]},
+				{"type": "actions", "elements": [{"type": "button", "text": {"type": "plain_text", "text": "Open terminal"},
+					"url": "https://term.example.com/demo/"}]}
+			]}`,
+		},
+		{
+			name: "telegram", format: "telegram", query: "?chat_id=42", publicURL: publicURL, notif: done,
+			want: `{"chat_id": "42", "parse_mode": "HTML", "disable_web_page_preview": true,
+				"text": "<b>Build done</b>\nAll 42 tests passed &amp; pushed\n<i>Session: demo</i>\n<a href=\"https://term.example.com/demo/\">Open terminal</a>"}`,
+		},
+		{
+			name: "telegram without chat", format: "telegram", publicURL: publicURL, notif: done,
+			wantErr: "no chat_id",
+		},
+		{
+			name: "unknown format", format: "teams", notif: done,
+			wantErr: `unknown format "teams"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, subs := newTestDispatcher(t, WebhookConfig{Workers: 1, MaxAttempts: 1, PublicURL: tt.publicURL})
+			d.start()
+
+			d.enqueue(subs.set(&Subscriber{ID: "alice", WebhookURL: hook.URL + "/hook" + tt.query, Format: tt.format}), tt.notif)
+			waitDeliveries(t, d, 1)
+
+			delivery := d.deliveries("")[0]
+			if tt.wantErr != "" {
+				if delivery.Status != DeliveryFailed || !strings.Contains(delivery.Attempts[0].Error, tt.wantErr) {
+					t.Fatalf("delivery = %+v, want an error containing %q", delivery, tt.wantErr)
+				}
+				select {
+				case body := <-bodies:
+					t.Fatalf("webhook got %s", body)
+				default:
+				}
+				return
+			}
+			if delivery.Status != DeliveryDelivered {
+				t.Fatalf("delivery = %+v", delivery)
+			}
+
+			var got, want interface{}
+			if err := json.Unmarshal(<-bodies, &got); err != nil {
+				t.Fatal(err)
+			}
+			if err := json.Unmarshal([]byte(tt.want), &want); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				gotJSON, _ := json.MarshalIndent(got, "", "  ")
+				t.Fatalf("webhook got\n%s", gotJSON)
+			}
+		})
+	}
+}
@@ -0,0 +1,184 @@
+package notification
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Severity notification severity level
+type Severity string
+
+const (
+	SeverityDebug    Severity = "debug"
+	SeverityInfo     Severity = "info"
+	SeverityWarning  Severity = "warning"
+	SeverityError    Severity = "error"
+	SeverityCritical Severity = "critical"
+)
+
+// rank orders severities, returning -1 for an unknown one
+func (s Severity) rank() int {
+	switch s {
+	case SeverityDebug:
+		return 0
+	case SeverityInfo:
+		return 1
+	case SeverityWarning:
+		return 2
+	case SeverityError:
+		return 3
+	case SeverityCritical:
+		return 4
+	}
+	return -1
+}
+
+// Valid reports whether s is a known severity
+func (s Severity) Valid() bool {
+	return s.rank() >= 0
+}
+
+// DefaultSeverity returns the severity of a notification published without
+// one
+func DefaultSeverity(t NotificationType) Severity {
+	switch t {
+	case Error:
+		return SeverityError
+	case SystemStatus:
+		return SeverityWarning
+	default:
+		return SeverityInfo
+	}
+}
+
+// Level returns the notification's severity, falling back to the default
+// for its type for notifications stored before severities existed
+func (n Notification) Level() Severity {
+	if n.Severity != "" {
+		return n.Severity
+	}
+	return DefaultSeverity(n.Type)
+}
+
+// Rules narrow down the notifications a subscriber receives beyond its
+// event types
+type Rules struct {
+	// Filter is a filter expression, see Filter
+	Filter string `json:"filter,omitempty"`
+	// MinSeverity drops notifications below this severity
+	MinSeverity Severity `json:"min_severity,omitempty"`
+	// Throttle limits notification types to one per interval (e.g.
+	// {"progress": "10s"}); types not listed are never throttled
+	Throttle map[NotificationType]string `json:"throttle,omitempty"`
+	// Dedup (e.g. "1m") drops notifications with the same type and data as
+	// one delivered within the window
+	Dedup string `json:"dedup,omitempty"`
+}
+
+// compile validates the rules and returns their matcher
+func (r Rules) compile() (*matcher, error) {
+	m := &matcher{
+		throttle: make(map[NotificationType]time.Duration, len(r.Throttle)),
+		lastSent: make(map[NotificationType]time.Time),
+		seen:     make(map[string]time.Time),
+		now:      time.Now,
+	}
+
+	if r.Filter != "" {
+		filter, err := ParseFilter(r.Filter)
+		if err != nil {
+			return nil, err
+		}
+		m.filter = filter
+	}
+	if r.MinSeverity != "" {
+		if !r.MinSeverity.Valid() {
+			return nil, fmt.Errorf("unknown severity %q", r.MinSeverity)
+		}
+		m.minRank = r.MinSeverity.rank()
+	}
+	for t, interval := range r.Throttle {
+		d, err := time.ParseDuration(interval)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid throttle for %s: %q", t, interval)
+		}
+		m.throttle[t] = d
+	}
+	if r.Dedup != "" {
+		d, err := time.ParseDuration(r.Dedup)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid dedup window: %q", r.Dedup)
+		}
+		m.dedup = d
+	}
+	return m, nil
+}
+
+// Validate checks that the rules compile
+func (r Rules) Validate() error {
+	_, err := r.compile()
+	return err
+}
+
+// matcher applies a subscriber's rules, keeping the throttle and dedup state
+type matcher struct {
+	filter   *Filter
+	minRank  int
+	throttle map[NotificationType]time.Duration
+	dedup    time.Duration
+	now      func() time.Time
+
+	mu       sync.Mutex
+	lastSent map[NotificationType]time.Time
+	seen     map[string]time.Time
+}
+
+// matches applies the stateless rules: filter and severity
+func (m *matcher) matches(notif Notification) bool {
+	if notif.Level().rank() < m.minRank {
+		return false
+	}
+	return m.filter == nil || m.filter.Match(notif)
+}
+
+// allow applies every rule, recording the notification for throttling and
+// dedup when it passes
+func (m *matcher) allow(notif Notification) bool {
+	if !m.matches(notif) {
+		return false
+	}
+
+	interval, throttled := m.throttle[notif.Type]
+	if !throttled && m.dedup == 0 {
+		return true
+	}
+
+	now := m.now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if throttled && now.Sub(m.lastSent[notif.Type]) < interval {
+		return false
+	}
+
+	var key string
+	if m.dedup > 0 {
+		data, _ := json.Marshal(notif.Data)
+		key = string(notif.Type) + "\x00" + string(data)
+		if at, ok := m.seen[key]; ok && now.Sub(at) < m.dedup {
+			return false
+		}
+		for k, at := range m.seen {
+			if now.Sub(at) >= m.dedup {
+				delete(m.seen, k)
+			}
+		}
+		m.seen[key] = now
+	}
+	if throttled {
+		m.lastSent[notif.Type] = now
+	}
+	return true
+}
@@ -0,0 +1,188 @@
+package notification
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestMatcher compiles rules into a matcher on a manual clock, returning
+// a function that advances it
+func newTestMatcher(t *testing.T, rules Rules) (*matcher, func(time.Duration)) {
+	t.Helper()
+	m, err := rules.compile()
+	if err != nil {
+		t.Fatalf("compile() error = %v", err)
+	}
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	m.now = func() time.Time { return now }
+	return m, func(d time.Duration) { now = now.Add(d) }
+}
+
+func TestRulesValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		rules   Rules
+		wantErr string
+	}{
+		{name: "empty", rules: Rules{}},
+		{name: "all", rules: Rules{Filter: `data.状态 == "失败"`, MinSeverity: SeverityWarning, Throttle: map[NotificationType]string{Progress: "10s"}, Dedup: "1m"}},
+		{name: "filter", rules: Rules{Filter: `data.x ==`}, wantErr: "expected a value"},
+		{name: "severity", rules: Rules{MinSeverity: "urgent"}, wantErr: `unknown severity "urgent"`},
+		{name: "throttle", rules: Rules{Throttle: map[NotificationType]string{Progress: "often"}}, wantErr: "invalid throttle for progress"},
+		{name: "zero throttle", rules: Rules{Throttle: map[NotificationType]string{Progress: "0s"}}, wantErr: "invalid throttle for progress"},
+		{name: "dedup", rules: Rules{Dedup: "-1m"}, wantErr: "invalid dedup window"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.rules.Validate()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("Validate() error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("Validate() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestMinSeverity(t *testing.T) {
+	m, _ := newTestMatcher(t, Rules{MinSeverity: SeverityWarning})
+	tests := []struct {
+		notif Notification
+		want  bool
+	}{
+		{notif: Notification{Type: Progress, Severity: SeverityInfo}, want: false},
+		{notif: Notification{Type: Progress, Severity: SeverityWarning}, want: true},
+		{notif: Notification{Type: Progress, Severity: SeverityCritical}, want: true},
+		{notif: Notification{Type: TaskCompleted}, want: false},
+		{notif: Notification{Type: SystemStatus}, want: true},
+		{notif: Notification{Type: Error}, want: true},
+	}
+	for _, tt := range tests {
+		if got := m.allow(tt.notif); got != tt.want {
+			t.Errorf("allow(%s %s) = %v, want %v", tt.notif.Type, tt.notif.Level(), got, tt.want)
+		}
+	}
+}
+
+func TestRulesFilter(t *testing.T) {
+	m, _ := newTestMatcher(t, Rules{Filter: `data.状态 == "失败"`, MinSeverity: SeverityInfo})
+	if !m.allow(Notification{Type: TaskCompleted, Data: map[string]interface{}{"状态": "失败"}}) {
+		t.Fatal("matching notification dropped")
+	}
+	if m.allow(Notification{Type: TaskCompleted, Data: map[string]interface{}{"状态": "成功"}}) {
+		t.Fatal("notification not matching the filter allowed")
+	}
+	if m.allow(Notification{Type: TaskCompleted, Severity: SeverityDebug, Data: map[string]interface{}{"状态": "失败"}}) {
+		t.Fatal("notification below the minimum severity allowed")
+	}
+}
+
+func TestThrottle(t *testing.T) {
+	m, advance := newTestMatcher(t, Rules{Throttle: map[NotificationType]string{Progress: "10s"}})
+	progress := Notification{Type: Progress, Data: map[string]interface{}{"percent": float64(10)}}
+
+	type step struct {
+		advance time.Duration
+		notif   Notification
+		want    bool
+	}
+	steps := []step{
+		{notif: progress, want: true},
+		{advance: 3 * time.Second, notif: progress, want: false},
+		// Types not listed are never throttled
+		{notif: Notification{Type: TaskCompleted}, want: true},
+		{notif: Notification{Type: TaskCompleted}, want: true},
+		// The window counts from the last notification sent, not the last
+		// one dropped
+		{advance: 6 * time.Second, notif: progress, want: false},
+		{advance: time.Second, notif: progress, want: true},
+		{advance: 9 * time.Second, notif: progress, want: false},
+		{advance: 10 * time.Second, notif: progress, want: true},
+	}
+	for i, s := range steps {
+		advance(s.advance)
+		if got := m.allow(s.notif); got != s.want {
+			t.Fatalf("step %d: allow(%s) = %v, want %v", i, s.notif.Type, got, s.want)
+		}
+	}
+}
+
+func TestThrottleFiltered(t *testing.T) {
+	// Notifications the filter drops don't start a throttle window
+	m, _ := newTestMatcher(t, Rules{Filter: `data.percent >= 50`, Throttle: map[NotificationType]string{Progress: "10s"}})
+	if m.allow(Notification{Type: Progress, Data: map[string]interface{}{"percent": float64(10)}}) {
+		t.Fatal("filtered notification allowed")
+	}
+	if !m.allow(Notification{Type: Progress, Data: map[string]interface{}{"percent": float64(50)}}) {
+		t.Fatal("notification throttled by a filtered one")
+	}
+}
+
+func TestDedup(t *testing.T) {
+	m, advance := newTestMatcher(t, Rules{Dedup: "1m"})
+	failed := Notification{Type: Error, SessionID: "alice", Data: map[string]interface{}{"message": "build failed", "状态": "失败"}}
+
+	type step struct {
+		advance time.Duration
+		notif   Notification
+		want    bool
+	}
+	steps := []step{
+		{notif: failed, want: true},
+		{advance: 30 * time.Second, notif: failed, want: false},
+		// The same data under another type or with other data is not a
+		// duplicate
+		{notif: Notification{Type: TaskCompleted, Data: failed.Data}, want: true},
+		{notif: Notification{Type: Error, Data: map[string]interface{}{"message": "test failed"}}, want: true},
+		// Sessions aren't part of the key, only type and data
+		{notif: Notification{Type: Error, SessionID: "bob", Data: failed.Data}, want: false},
+		// Dropped duplicates don't extend the window
+		{advance: 30 * time.Second, notif: failed, want: true},
+		{advance: 59 * time.Second, notif: failed, want: false},
+		{advance: time.Second, notif: failed, want: true},
+	}
+	for i, s := range steps {
+		advance(s.advance)
+		if got := m.allow(s.notif); got != s.want {
+			t.Fatalf("step %d: allow(%s %v) = %v, want %v", i, s.notif.Type, s.notif.Data, got, s.want)
+		}
+	}
+}
+
+func TestDedupPrunes(t *testing.T) {
+	m, advance := newTestMatcher(t, Rules{Dedup: "1m"})
+	for i := 0; i < 3; i++ {
+		m.allow(Notification{Type: Progress, Data: map[string]interface{}{"step": float64(i)}})
+	}
+	advance(time.Minute)
+	m.allow(Notification{Type: Progress, Data: map[string]interface{}{"step": float64(3)}})
+	if len(m.seen) != 1 {
+		t.Fatalf("%d notifications remembered after the window, want 1", len(m.seen))
+	}
+}
+
+func TestThrottleAndDedup(t *testing.T) {
+	m, advance := newTestMatcher(t, Rules{Throttle: map[NotificationType]string{Progress: "10s"}, Dedup: "1m"})
+	first := Notification{Type: Progress, Data: map[string]interface{}{"percent": float64(10)}}
+	second := Notification{Type: Progress, Data: map[string]interface{}{"percent": float64(20)}}
+
+	if !m.allow(first) {
+		t.Fatal("first notification dropped")
+	}
+	// A throttled notification isn't remembered for dedup
+	if m.allow(second) {
+		t.Fatal("notification inside the throttle window allowed")
+	}
+	advance(10 * time.Second)
+	if m.allow(first) {
+		t.Fatal("duplicate allowed once the throttle window passed")
+	}
+	if !m.allow(second) {
+		t.Fatal("notification dropped as a duplicate of a throttled one")
+	}
+}
@@ -1,12 +1,12 @@
 package notification
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
-	"log"
-	"net/http"
+	"errors"
+	"log/slog"
+	"path"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/uuid"
@@ -26,59 +26,195 @@ const (
 type Notification struct {
 	ID        string                 `json:"id"`
 	SessionID string                 `json:"session_id"`
-	Type      NotificationType        `json:"type"`
+	Type      NotificationType       `json:"type"`
+	Severity  Severity               `json:"severity,omitempty"`
 	Data      map[string]interface{} `json:"data"`
 	Timestamp time.Time              `json:"timestamp"`
 }
 
 // Subscriber notification subscriber
 type Subscriber struct {
-	ID       string
-	SessionID string
-	Channel  chan Notification
-	WebhookURL string
+	ID string `json:"id"`
+	Target
+	Channel    chan Notification `json:"-"`
+	WebhookURL string            `json:"webhook_url,omitempty"`
+	// EventTypes lists the notification types delivered, all when empty
+	EventTypes []NotificationType `json:"events"`
+	Rules
+	matcher *matcher
+	// Format selects the formatter that renders webhook requests
+	Format string `json:"format,omitempty"`
+	// Secret signs webhook requests in the X-Signature header, together
+	// with their X-Signature-Timestamp
+	Secret string `json:"-"`
+	// MaxAttempts and InitialBackoff override the webhook retry defaults
+	MaxAttempts    int           `json:"max_attempts,omitempty"`
+	InitialBackoff time.Duration `json:"-"`
+	CreatedAt      time.Time     `json:"created_at"`
+}
+
+// ErrSubscriptionNotFound is returned for an unknown subscription ID
+var ErrSubscriptionNotFound = errors.New("subscription not found")
+
+// WebhookOptions per-subscription webhook delivery options
+type WebhookOptions struct {
+	Rules          Rules
+	Format         string
+	Secret         string
+	MaxAttempts    int
+	InitialBackoff time.Duration
+}
+
+// SubscriptionUpdate changes a webhook subscription. Nil fields are left
+// unchanged.
+type SubscriptionUpdate struct {
+	WebhookURL *string
 	EventTypes []NotificationType
+	Rules      *Rules
+	Format     *string
+}
+
+// Stats reports the queues and drops of the notification service
+type Stats struct {
+	// QueueDepth is the number of published notifications waiting to be
+	// distributed
+	QueueDepth int
+	// WebhookQueueDepth is the number of webhook deliveries waiting for a
+	// worker
+	WebhookQueueDepth int
+	// Dropped counts notifications dropped because the queue was full
+	Dropped uint64
+	// SubscriberDropped counts notifications not sent to an SSE subscriber
+	// whose channel was full
+	SubscriberDropped uint64
+	// WebhookFailures counts failed webhook delivery attempts
+	WebhookFailures uint64
+	// WebhookDeadLetters counts deliveries moved to the dead-letter list
+	WebhookDeadLetters uint64
 }
 
 // Service notification service
 type Service struct {
-	subscribers map[string][]*Subscriber
+	// subscribers are indexed by their target, so distributing a
+	// notification only looks up its session, its tags and the distinct
+	// patterns
+	sessions    subscriberIndex
+	patterns    subscriberIndex
+	tags        subscriberIndex
+	sessionTags func(sessionID string) []string
+	forward     func(Notification)
+	store       Store
+	subStore    SubscriptionStore
 	mu          sync.RWMutex
 	notifyQueue chan Notification
+	dropped     atomic.Uint64
+	subDropped  atomic.Uint64
+	webhooks    *webhookDispatcher
 	ctx         context.Context
 	cancel      context.CancelFunc
 }
 
-// NewService creates a new notification service
-func NewService() *Service {
+// NewService creates a new notification service backed by store, restoring
+// the webhook subscriptions kept in subStore. Memory stores are used when
+// either is nil.
+func NewService(store Store, subStore SubscriptionStore, webhookConfig WebhookConfig) *Service {
+	if store == nil {
+		store = NewMemoryStore(1000)
+	}
+	if subStore == nil {
+		subStore = NewMemorySubscriptionStore()
+	}
 	ctx, cancel := context.WithCancel(context.Background())
-	return &Service{
-		subscribers: make(map[string][]*Subscriber),
+	s := &Service{
+		sessions:    make(subscriberIndex),
+		patterns:    make(subscriberIndex),
+		tags:        make(subscriberIndex),
+		store:       store,
+		subStore:    subStore,
 		notifyQueue: make(chan Notification, 1000),
 		ctx:         ctx,
 		cancel:      cancel,
 	}
+	s.webhooks = newWebhookDispatcher(ctx, webhookConfig, s.Subscription)
+
+	subs, err := subStore.List()
+	if err != nil {
+		slog.Error("Failed to load webhook subscriptions", "error", err)
+	}
+	for _, sub := range subs {
+		if err := sub.Target.Validate(); err != nil {
+			slog.Warn("Skipping webhook subscription", "subscription", sub.ID, "error", err)
+			continue
+		}
+		if sub.matcher, err = sub.Rules.compile(); err != nil {
+			slog.Warn("Skipping webhook subscription", "subscription", sub.ID, "error", err)
+			continue
+		}
+		s.add(sub)
+	}
+	if len(subs) > 0 {
+		slog.Info("Restored webhook subscriptions", "count", len(subs))
+	}
+	return s
+}
+
+// SetSessionTags sets the function returning the tags of a session, used to
+// match tag subscriptions
+func (s *Service) SetSessionTags(fn func(sessionID string) []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sessionTags = fn
+}
+
+// SetForwarder sets a function called with every notification published on
+// this server after it has been distributed locally, used to fan
+// notifications out to the other nodes of a cluster
+func (s *Service) SetForwarder(fn func(Notification)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.forward = fn
+}
+
+// Receive distributes a notification published on another cluster node to
+// the subscribers of this server without forwarding it again
+func (s *Service) Receive(notif Notification) {
+	s.distributeNotification(notif)
 }
 
 // Start starts the notification service
 func (s *Service) Start() {
-	log.Println("Starting notification service...")
+	slog.Info("Starting notification service")
 	go s.processNotifications()
+	s.webhooks.start()
 }
 
 // Stop stops the notification service
 func (s *Service) Stop() {
-	log.Println("Stopping notification service...")
+	slog.Info("Stopping notification service")
 	s.cancel()
 	close(s.notifyQueue)
+	s.webhooks.wait()
+	if err := s.store.Close(); err != nil {
+		slog.Error("Failed to close notification store", "error", err)
+	}
+	if err := s.subStore.Close(); err != nil {
+		slog.Error("Failed to close subscription store", "error", err)
+	}
 }
 
-// Publish publishes a notification
-func (s *Service) Publish(sessionID string, notifType NotificationType, data map[string]interface{}) {
+// Publish publishes a notification. An empty severity defaults to the
+// severity of the type.
+func (s *Service) Publish(sessionID string, notifType NotificationType, severity Severity, data map[string]interface{}) {
+	if severity == "" {
+		severity = DefaultSeverity(notifType)
+	}
 	notification := Notification{
 		ID:        uuid.New().String(),
 		SessionID: sessionID,
 		Type:      notifType,
+		Severity:  severity,
 		Data:      data,
 		Timestamp: time.Now(),
 	}
@@ -86,58 +222,208 @@ func (s *Service) Publish(sessionID string, notifType NotificationType, data map
 	select {
 	case s.notifyQueue <- notification:
 	default:
-		log.Printf("Notification queue full, dropping notification for session %s", sessionID)
+		s.dropped.Add(1)
+		slog.Warn("Notification queue full, dropping notification", "session", sessionID)
 	}
 }
 
-// SubscribeSSE subscribes to notifications via SSE
-func (s *Service) SubscribeSSE(sessionID string) chan Notification {
+// SubscribeSSE subscribes to notifications via SSE. The subscriber must be
+// removed with Unsubscribe when the stream ends.
+func (s *Service) SubscribeSSE(target Target, eventTypes []NotificationType, rules Rules) (*Subscriber, error) {
+	if err := target.Validate(); err != nil {
+		return nil, err
+	}
+	m, err := rules.compile()
+	if err != nil {
+		return nil, err
+	}
+
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	ch := make(chan Notification, 100)
 	subscriber := &Subscriber{
-		ID:        uuid.New().String(),
-		SessionID: sessionID,
-		Channel:   ch,
-		EventTypes: []NotificationType{TaskCompleted, Error, Progress, SystemStatus},
+		ID:         uuid.New().String(),
+		Target:     target,
+		Channel:    make(chan Notification, 100),
+		EventTypes: eventTypes,
+		Rules:      rules,
+		matcher:    m,
+		CreatedAt:  time.Now(),
 	}
 
-	s.subscribers[sessionID] = append(s.subscribers[sessionID], subscriber)
-	return ch
+	s.add(subscriber)
+	return subscriber, nil
 }
 
-// SubscribeWebhook subscribes to notifications via webhook
-func (s *Service) SubscribeWebhook(sessionID, webhookURL string, eventTypes []NotificationType) error {
+// SubscribeWebhook subscribes to notifications via webhook and persists the
+// subscription
+func (s *Service) SubscribeWebhook(target Target, webhookURL string, eventTypes []NotificationType, opts WebhookOptions) (*Subscriber, error) {
+	if err := target.Validate(); err != nil {
+		return nil, err
+	}
+	m, err := opts.Rules.compile()
+	if err != nil {
+		return nil, err
+	}
+
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	subscriber := &Subscriber{
-		ID:         uuid.New().String(),
-		SessionID:  sessionID,
-		WebhookURL: webhookURL,
-		EventTypes: eventTypes,
+		ID:             uuid.New().String(),
+		Target:         target,
+		WebhookURL:     webhookURL,
+		EventTypes:     eventTypes,
+		Rules:          opts.Rules,
+		matcher:        m,
+		Format:         opts.Format,
+		Secret:         opts.Secret,
+		MaxAttempts:    opts.MaxAttempts,
+		InitialBackoff: opts.InitialBackoff,
+		CreatedAt:      time.Now(),
 	}
 
-	s.subscribers[sessionID] = append(s.subscribers[sessionID], subscriber)
-	log.Printf("Subscribed webhook for session %s: %s", sessionID, webhookURL)
-	return nil
+	if err := s.subStore.Save(subscriber); err != nil {
+		return nil, err
+	}
+
+	s.add(subscriber)
+	slog.Debug("Subscribed webhook", "target", target.String(), "url", webhookURL)
+	return subscriber, nil
+}
+
+// Subscription returns a subscription by ID
+func (s *Service) Subscription(id string) (*Subscriber, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	idx, key, i := s.find(id)
+	if i < 0 {
+		return nil, false
+	}
+	return idx[key][i], true
+}
+
+// UpdateSubscription changes the URL, event types, rules or format of a webhook
+// subscription and persists it
+func (s *Service) UpdateSubscription(id string, update SubscriptionUpdate) (*Subscriber, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	idx, key, i := s.find(id)
+	if i < 0 || idx[key][i].WebhookURL == "" {
+		return nil, ErrSubscriptionNotFound
+	}
+
+	// Replace rather than modify the subscriber, as callers of
+	// GetSubscribers and Subscription may still be reading the old one
+	updated := *idx[key][i]
+	if update.WebhookURL != nil {
+		updated.WebhookURL = *update.WebhookURL
+	}
+	if update.EventTypes != nil {
+		updated.EventTypes = update.EventTypes
+	}
+	if update.Rules != nil {
+		m, err := update.Rules.compile()
+		if err != nil {
+			return nil, err
+		}
+		updated.Rules = *update.Rules
+		updated.matcher = m
+	}
+	if update.Format != nil {
+		updated.Format = *update.Format
+	}
+
+	if err := s.subStore.Save(&updated); err != nil {
+		return nil, err
+	}
+	idx[key][i] = &updated
+	return &updated, nil
+}
+
+// Unsubscribe removes a subscriber by ID
+func (s *Service) Unsubscribe(subscriberID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	idx, key, i := s.find(subscriberID)
+	if i < 0 {
+		return ErrSubscriptionNotFound
+	}
+	return s.remove(idx, key, i)
 }
 
-// Unsubscribe removes a subscriber
-func (s *Service) Unsubscribe(sessionID, subscriberID string) {
+// UnsubscribeWebhook removes every webhook subscription of a target to
+// webhookURL and returns how many were removed
+func (s *Service) UnsubscribeWebhook(target Target, webhookURL string) (int, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	subs := s.subscribers[sessionID]
-	for i, sub := range subs {
-		if sub.ID == subscriberID {
-			// Remove subscriber from slice
-			s.subscribers[sessionID] = append(subs[:i], subs[i+1:]...)
-			close(sub.Channel)
-			break
+	idx, key := s.indexFor(target)
+	removed := 0
+	for i := len(idx[key]) - 1; i >= 0; i-- {
+		if idx[key][i].WebhookURL != webhookURL {
+			continue
+		}
+		if err := s.remove(idx, key, i); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+// indexFor returns the index and key holding a target's subscribers
+func (s *Service) indexFor(target Target) (subscriberIndex, string) {
+	switch {
+	case target.SessionPattern != "":
+		return s.patterns, target.SessionPattern
+	case target.Tag != "":
+		return s.tags, target.Tag
+	default:
+		return s.sessions, target.SessionID
+	}
+}
+
+// add indexes a subscriber. The caller must hold s.mu.
+func (s *Service) add(sub *Subscriber) {
+	idx, key := s.indexFor(sub.Target)
+	idx.add(key, sub)
+}
+
+// find returns the index, key and position of a subscriber, or -1 if there
+// is no subscriber with that ID. The caller must hold s.mu.
+func (s *Service) find(subscriberID string) (subscriberIndex, string, int) {
+	for _, idx := range []subscriberIndex{s.sessions, s.patterns, s.tags} {
+		for key, subs := range idx {
+			for i, sub := range subs {
+				if sub.ID == subscriberID {
+					return idx, key, i
+				}
+			}
 		}
 	}
+	return nil, "", -1
+}
+
+// remove deletes a subscriber, closing its SSE channel or deleting its
+// persisted webhook subscription. The caller must hold s.mu.
+func (s *Service) remove(idx subscriberIndex, key string, i int) error {
+	sub := idx[key][i]
+
+	if sub.WebhookURL != "" {
+		if err := s.subStore.Delete(sub.ID); err != nil {
+			return err
+		}
+	}
+	if sub.Channel != nil {
+		close(sub.Channel)
+	}
+
+	idx.remove(key, i)
+	return nil
 }
 
 // processNotifications processes notifications from the queue
@@ -149,6 +435,13 @@ func (s *Service) processNotifications() {
 				return
 			}
 			s.distributeNotification(notif)
+
+			s.mu.RLock()
+			forward := s.forward
+			s.mu.RUnlock()
+			if forward != nil {
+				forward(notif)
+			}
 		case <-s.ctx.Done():
 			return
 		}
@@ -160,14 +453,29 @@ func (s *Service) distributeNotification(notif Notification) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
-	subs, exists := s.subscribers[notif.SessionID]
-	if !exists {
-		return
+	if err := s.store.Append(notif); err != nil {
+		slog.Error("Failed to store notification", "notification", notif.ID, "error", err)
+	}
+
+	s.deliver(s.sessions[notif.SessionID], notif)
+	for pattern, subs := range s.patterns {
+		if ok, _ := path.Match(pattern, notif.SessionID); ok {
+			s.deliver(subs, notif)
+		}
 	}
+	if len(s.tags) > 0 && s.sessionTags != nil {
+		for _, tag := range s.sessionTags(notif.SessionID) {
+			s.deliver(s.tags[tag], notif)
+		}
+	}
+}
 
+// deliver sends a notification to subscribers interested in its type. The
+// caller must hold s.mu.
+func (s *Service) deliver(subs []*Subscriber, notif Notification) {
 	for _, sub := range subs {
-		// Check if subscriber is interested in this event type
-		if !s.isEventTypeMatch(notif.Type, sub.EventTypes) {
+		// Check if subscriber is interested in this notification
+		if !s.isEventTypeMatch(notif.Type, sub.EventTypes) || !sub.matcher.allow(notif) {
 			continue
 		}
 
@@ -176,19 +484,23 @@ func (s *Service) distributeNotification(notif Notification) {
 			select {
 			case sub.Channel <- notif:
 			default:
-				log.Printf("Subscriber channel full for session %s", sub.SessionID)
+				s.subDropped.Add(1)
+				slog.Warn("Subscriber channel full", "target", sub.Target.String(), "subscription", sub.ID)
 			}
 		}
 
 		// Send to webhook subscribers
 		if sub.WebhookURL != "" {
-			go s.sendWebhook(sub.WebhookURL, notif)
+			s.webhooks.enqueue(sub, notif)
 		}
 	}
 }
 
 // isEventTypeMatch checks if event type matches subscriber's interests
 func (s *Service) isEventTypeMatch(eventType NotificationType, eventTypes []NotificationType) bool {
+	if len(eventTypes) == 0 {
+		return true
+	}
 	for _, et := range eventTypes {
 		if et == eventType {
 			return true
@@ -197,36 +509,32 @@ func (s *Service) isEventTypeMatch(eventType NotificationType, eventTypes []Noti
 	return false
 }
 
-// sendWebhook sends notification to webhook URL
-func (s *Service) sendWebhook(url string, notif Notification) {
-	client := &http.Client{
-		Timeout: 10 * time.Second,
-	}
-
-	data, err := json.Marshal(notif)
-	if err != nil {
-		log.Printf("Failed to marshal notification: %v", err)
-		return
+// Accepts reports whether the subscriber's event types, filter and severity
+// select a notification, ignoring throttling and dedup. It is used to filter
+// replayed notifications.
+func (sub *Subscriber) Accepts(notif Notification) bool {
+	if len(sub.EventTypes) > 0 && !contains(sub.EventTypes, notif.Type) {
+		return false
 	}
+	return sub.matcher == nil || sub.matcher.matches(notif)
+}
 
-	resp, err := client.Post(url, "application/json", bytes.NewReader(data))
-	if err != nil {
-		log.Printf("Failed to send webhook to %s: %v", url, err)
-		return
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		log.Printf("Webhook returned non-OK status: %d", resp.StatusCode)
+func contains(list []NotificationType, t NotificationType) bool {
+	for _, v := range list {
+		if v == t {
+			return true
+		}
 	}
+	return false
 }
 
-// GetSubscribers returns all subscribers for a session
-func (s *Service) GetSubscribers(sessionID string) []*Subscriber {
+// GetSubscribers returns all subscribers of a target
+func (s *Service) GetSubscribers(target Target) []*Subscriber {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
-	subs, exists := s.subscribers[sessionID]
+	idx, key := s.indexFor(target)
+	subs, exists := idx[key]
 	if !exists {
 		return []*Subscriber{}
 	}
@@ -236,3 +544,59 @@ func (s *Service) GetSubscribers(sessionID string) []*Subscriber {
 	copy(result, subs)
 	return result
 }
+
+// Stats returns the queue depths and drop counters of the service
+func (s *Service) Stats() Stats {
+	return Stats{
+		QueueDepth:         len(s.notifyQueue),
+		WebhookQueueDepth:  len(s.webhooks.queue),
+		Dropped:            s.dropped.Load(),
+		SubscriberDropped:  s.subDropped.Load(),
+		WebhookFailures:    s.webhooks.failures.Load(),
+		WebhookDeadLetters: s.webhooks.deadLettered.Load(),
+	}
+}
+
+// Recent returns up to limit of the most recent notifications, newest first
+func (s *Service) Recent(limit int) ([]Notification, error) {
+	return s.store.Recent(limit)
+}
+
+// Since returns the notifications selected by a target published after the
+// notification with the given ID, oldest first. Tags are matched against the
+// sessions' current tags.
+func (s *Service) Since(target Target, afterID string) ([]Notification, error) {
+	s.mu.RLock()
+	sessionTags := s.sessionTags
+	s.mu.RUnlock()
+
+	return s.store.Since(afterID, func(notif Notification) bool {
+		var tags []string
+		if target.Tag != "" && sessionTags != nil {
+			tags = sessionTags(notif.SessionID)
+		}
+		return target.Matches(notif.SessionID, tags)
+	})
+}
+
+// Deliveries returns the finished deliveries of a webhook subscription,
+// newest first, including the status code and latency of every attempt
+func (s *Service) Deliveries(subscriptionID string) []Delivery {
+	return s.webhooks.deliveries(subscriptionID)
+}
+
+// DeadLetters returns the deliveries of a webhook subscription that failed
+// after all their attempts, newest first
+func (s *Service) DeadLetters(subscriptionID string) []Delivery {
+	return s.webhooks.deadLetterList(subscriptionID)
+}
+
+// DeadLetter returns a dead letter by ID
+func (s *Service) DeadLetter(id string) (Delivery, bool) {
+	return s.webhooks.deadLetter(id)
+}
+
+// ReplayDeadLetter schedules a dead letter for delivery again
+func (s *Service) ReplayDeadLetter(id string) bool {
+	return s.webhooks.replay(id)
+}
@@ -0,0 +1,105 @@
+package notification
+
+import (
+	"sync"
+)
+
+// Store persists published notifications so they can be replayed to
+// subscribers that were disconnected when they were published
+type Store interface {
+	// Append stores a notification
+	Append(notif Notification) error
+	// Since returns the notifications selected by match published after the
+	// notification with the given ID, oldest first. If the ID is empty or no
+	// longer retained, every retained notification selected by match is
+	// returned.
+	Since(afterID string, match func(Notification) bool) ([]Notification, error)
+	// Recent returns up to limit of the most recent notifications across all
+	// sessions, newest first
+	Recent(limit int) ([]Notification, error)
+	// Close releases the store's resources
+	Close() error
+}
+
+// MemoryStore keeps the most recent notifications in a ring buffer
+type MemoryStore struct {
+	buf   []Notification
+	start int
+	size  int
+	mu    sync.RWMutex
+}
+
+// NewMemoryStore creates a memory store retaining up to capacity notifications
+func NewMemoryStore(capacity int) *MemoryStore {
+	if capacity <= 0 {
+		capacity = 1000
+	}
+	return &MemoryStore{
+		buf: make([]Notification, capacity),
+	}
+}
+
+// Append stores a notification, evicting the oldest when the buffer is full
+func (s *MemoryStore) Append(notif Notification) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	idx := (s.start + s.size) % len(s.buf)
+	s.buf[idx] = notif
+	if s.size < len(s.buf) {
+		s.size++
+	} else {
+		s.start = (s.start + 1) % len(s.buf)
+	}
+	return nil
+}
+
+// Since returns the notifications selected by match published after afterID
+func (s *MemoryStore) Since(afterID string, match func(Notification) bool) ([]Notification, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	from := 0
+	if afterID != "" {
+		for i := 0; i < s.size; i++ {
+			if s.at(i).ID == afterID {
+				from = i + 1
+				break
+			}
+		}
+	}
+
+	var result []Notification
+	for i := from; i < s.size; i++ {
+		if notif := s.at(i); match(notif) {
+			result = append(result, notif)
+		}
+	}
+	return result, nil
+}
+
+// Recent returns up to limit of the most recent notifications, newest first
+func (s *MemoryStore) Recent(limit int) ([]Notification, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if limit <= 0 || limit > s.size {
+		limit = s.size
+	}
+
+	result := make([]Notification, 0, limit)
+	for i := s.size - 1; i >= s.size-limit; i-- {
+		result = append(result, s.at(i))
+	}
+	return result, nil
+}
+
+// Close is a no-op for the memory store
+func (s *MemoryStore) Close() error {
+	return nil
+}
+
+// at returns the i-th oldest notification in the buffer
+func (s *MemoryStore) at(i int) Notification {
+	return s.buf[(s.start+i)%len(s.buf)]
+}
@@ -0,0 +1,192 @@
+package notification
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// subscriptionsBucket maps a subscription ID to a webhook subscription
+var subscriptionsBucket = []byte("subscriptions")
+
+// SubscriptionStore persists webhook subscriptions so they survive server
+// restarts. SSE subscriptions only live as long as their stream and are
+// never stored.
+type SubscriptionStore interface {
+	// Save creates or replaces a subscription
+	Save(sub *Subscriber) error
+	// Delete removes a subscription by ID
+	Delete(id string) error
+	// List returns every stored subscription
+	List() ([]*Subscriber, error)
+	// Close releases the store's resources
+	Close() error
+}
+
+// subscriptionRecord is the stored form of a webhook subscription. Unlike
+// the API form of Subscriber it includes the secret.
+type subscriptionRecord struct {
+	ID             string             `json:"id"`
+	SessionID      string             `json:"session_id,omitempty"`
+	SessionPattern string             `json:"session_pattern,omitempty"`
+	Tag            string             `json:"tag,omitempty"`
+	WebhookURL     string             `json:"webhook_url"`
+	EventTypes     []NotificationType `json:"events"`
+	Rules
+	Format         string        `json:"format,omitempty"`
+	Secret         string        `json:"secret,omitempty"`
+	MaxAttempts    int           `json:"max_attempts,omitempty"`
+	InitialBackoff time.Duration `json:"initial_backoff,omitempty"`
+	CreatedAt      time.Time     `json:"created_at"`
+}
+
+func newSubscriptionRecord(sub *Subscriber) subscriptionRecord {
+	return subscriptionRecord{
+		ID:             sub.ID,
+		SessionID:      sub.SessionID,
+		SessionPattern: sub.SessionPattern,
+		Tag:            sub.Tag,
+		WebhookURL:     sub.WebhookURL,
+		EventTypes:     sub.EventTypes,
+		Rules:          sub.Rules,
+		Format:         sub.Format,
+		Secret:         sub.Secret,
+		MaxAttempts:    sub.MaxAttempts,
+		InitialBackoff: sub.InitialBackoff,
+		CreatedAt:      sub.CreatedAt,
+	}
+}
+
+func (r subscriptionRecord) subscriber() *Subscriber {
+	return &Subscriber{
+		ID: r.ID,
+		Target: Target{
+			SessionID:      r.SessionID,
+			SessionPattern: r.SessionPattern,
+			Tag:            r.Tag,
+		},
+		WebhookURL:     r.WebhookURL,
+		EventTypes:     r.EventTypes,
+		Rules:          r.Rules,
+		Format:         r.Format,
+		Secret:         r.Secret,
+		MaxAttempts:    r.MaxAttempts,
+		InitialBackoff: r.InitialBackoff,
+		CreatedAt:      r.CreatedAt,
+	}
+}
+
+// MemorySubscriptionStore keeps subscriptions in memory only
+type MemorySubscriptionStore struct {
+	records map[string]subscriptionRecord
+	mu      sync.RWMutex
+}
+
+// NewMemorySubscriptionStore creates an empty memory subscription store
+func NewMemorySubscriptionStore() *MemorySubscriptionStore {
+	return &MemorySubscriptionStore{
+		records: make(map[string]subscriptionRecord),
+	}
+}
+
+// Save creates or replaces a subscription
+func (s *MemorySubscriptionStore) Save(sub *Subscriber) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.records[sub.ID] = newSubscriptionRecord(sub)
+	return nil
+}
+
+// Delete removes a subscription by ID
+func (s *MemorySubscriptionStore) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.records, id)
+	return nil
+}
+
+// List returns every stored subscription
+func (s *MemorySubscriptionStore) List() ([]*Subscriber, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	result := make([]*Subscriber, 0, len(s.records))
+	for _, record := range s.records {
+		result = append(result, record.subscriber())
+	}
+	return result, nil
+}
+
+// Close is a no-op for the memory store
+func (s *MemorySubscriptionStore) Close() error {
+	return nil
+}
+
+// BoltSubscriptionStore persists subscriptions to an embedded bbolt database
+type BoltSubscriptionStore struct {
+	db *bolt.DB
+}
+
+// NewBoltSubscriptionStore opens (or creates) the database at path
+func NewBoltSubscriptionStore(path string) (*BoltSubscriptionStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("open subscription store %s: %w", path, err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(subscriptionsBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("init subscription store: %w", err)
+	}
+
+	return &BoltSubscriptionStore{db: db}, nil
+}
+
+// Save creates or replaces a subscription
+func (s *BoltSubscriptionStore) Save(sub *Subscriber) error {
+	data, err := json.Marshal(newSubscriptionRecord(sub))
+	if err != nil {
+		return fmt.Errorf("marshal subscription: %w", err)
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(subscriptionsBucket).Put([]byte(sub.ID), data)
+	})
+}
+
+// Delete removes a subscription by ID
+func (s *BoltSubscriptionStore) Delete(id string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(subscriptionsBucket).Delete([]byte(id))
+	})
+}
+
+// List returns every stored subscription
+func (s *BoltSubscriptionStore) List() ([]*Subscriber, error) {
+	var result []*Subscriber
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(subscriptionsBucket).ForEach(func(k, v []byte) error {
+			var record subscriptionRecord
+			if err := json.Unmarshal(v, &record); err != nil {
+				return nil
+			}
+			result = append(result, record.subscriber())
+			return nil
+		})
+	})
+	return result, err
+}
+
+// Close closes the database
+func (s *BoltSubscriptionStore) Close() error {
+	return s.db.Close()
+}
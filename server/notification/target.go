@@ -0,0 +1,94 @@
+package notification
+
+import (
+	"errors"
+	"path"
+)
+
+// AllSessions is the session pattern matching every session
+const AllSessions = "*"
+
+// Target selects the sessions a subscription receives notifications from.
+// Exactly one field is set.
+type Target struct {
+	// SessionID matches a single session
+	SessionID string `json:"session_id,omitempty"`
+	// SessionPattern matches session IDs against a glob such as "alice-*";
+	// AllSessions matches every session
+	SessionPattern string `json:"session_pattern,omitempty"`
+	// Tag matches every session carrying the tag
+	Tag string `json:"tag,omitempty"`
+}
+
+// Validate checks that exactly one field is set and the pattern is valid
+func (t Target) Validate() error {
+	set := 0
+	for _, v := range []string{t.SessionID, t.SessionPattern, t.Tag} {
+		if v != "" {
+			set++
+		}
+	}
+	if set != 1 {
+		return errors.New("exactly one of session_id, session_pattern and tag is required")
+	}
+	if t.SessionPattern != "" {
+		if _, err := path.Match(t.SessionPattern, ""); err != nil {
+			return errors.New("invalid session_pattern: " + t.SessionPattern)
+		}
+	}
+	return nil
+}
+
+// String describes the target for logs
+func (t Target) String() string {
+	switch {
+	case t.SessionPattern != "":
+		return "pattern " + t.SessionPattern
+	case t.Tag != "":
+		return "tag " + t.Tag
+	default:
+		return "session " + t.SessionID
+	}
+}
+
+// Matches reports whether a notification from a session carrying tags is
+// selected by the target
+func (t Target) Matches(sessionID string, tags []string) bool {
+	switch {
+	case t.SessionID != "":
+		return t.SessionID == sessionID
+	case t.SessionPattern != "":
+		ok, _ := path.Match(t.SessionPattern, sessionID)
+		return ok
+	default:
+		for _, tag := range tags {
+			if tag == t.Tag {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// subscriberIndex groups subscribers by the session ID, pattern or tag of
+// their target
+type subscriberIndex map[string][]*Subscriber
+
+// add appends a subscriber under key
+func (idx subscriberIndex) add(key string, sub *Subscriber) {
+	idx[key] = append(idx[key], sub)
+}
+
+// remove deletes the i-th subscriber under key. A new slice is built, as
+// callers of GetSubscribers may hold the old one.
+func (idx subscriberIndex) remove(key string, i int) {
+	subs := idx[key]
+	if len(subs) == 1 {
+		delete(idx, key)
+		return
+	}
+	remaining := make([]*Subscriber, 0, len(subs)-1)
+	remaining = append(remaining, subs[:i]...)
+	remaining = append(remaining, subs[i+1:]...)
+	idx[key] = remaining
+}
@@ -0,0 +1,447 @@
+package notification
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// DeliveryStatus webhook delivery status
+type DeliveryStatus string
+
+const (
+	DeliveryPending   DeliveryStatus = "pending"
+	DeliveryDelivered DeliveryStatus = "delivered"
+	DeliveryFailed    DeliveryStatus = "failed"
+	// DeliveryDropped is a delivery whose subscription was deleted before
+	// it got through
+	DeliveryDropped DeliveryStatus = "dropped"
+)
+
+// Webhook signature headers. SignatureHeader carries the HMAC-SHA256 of the
+// timestamp, a newline and the request body, computed with the subscription
+// secret, as "sha256=<hex>". TimestampHeader carries the Unix time of the
+// attempt, so receivers can refuse requests replayed later.
+const (
+	SignatureHeader = "X-Signature"
+	TimestampHeader = "X-Signature-Timestamp"
+)
+
+// WebhookConfig configures webhook delivery
+type WebhookConfig struct {
+	// Workers is the number of concurrent deliveries
+	Workers int
+	// Timeout is the timeout of a single delivery attempt
+	Timeout time.Duration
+	// MaxAttempts is the default number of attempts before a delivery is
+	// moved to the dead-letter list
+	MaxAttempts int
+	// InitialBackoff is the default delay before the first retry, doubled
+	// on every further retry up to MaxBackoff
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// HistoryLimit is how many finished deliveries and dead letters are kept
+	HistoryLimit int
+	// PublicURL is the server's external URL, used to link notifications
+	// back to the session's terminal
+	PublicURL string
+}
+
+// DefaultWebhookConfig returns the default webhook delivery configuration
+func DefaultWebhookConfig() WebhookConfig {
+	return WebhookConfig{
+		Workers:        4,
+		Timeout:        10 * time.Second,
+		MaxAttempts:    5,
+		InitialBackoff: time.Second,
+		MaxBackoff:     5 * time.Minute,
+		HistoryLimit:   1000,
+	}
+}
+
+// DeliveryAttempt a single webhook request
+type DeliveryAttempt struct {
+	Time       time.Time `json:"time"`
+	StatusCode int       `json:"status_code,omitempty"`
+	LatencyMs  int64     `json:"latency_ms"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// Delivery a notification being delivered to a webhook subscriber. Every
+// attempt goes to the subscription as it is then, so WebhookURL and Format
+// are those of the last attempt. The deliveries the service returns have
+// their WebhookURL redacted, as webhook URLs often embed their credentials.
+type Delivery struct {
+	ID             string            `json:"id"`
+	SubscriberID   string            `json:"subscriber_id"`
+	SessionID      string            `json:"session_id"`
+	WebhookURL     string            `json:"webhook_url"`
+	Format         string            `json:"format,omitempty"`
+	Notification   Notification      `json:"notification"`
+	Status         DeliveryStatus    `json:"status"`
+	Attempts       []DeliveryAttempt `json:"attempts"`
+	MaxAttempts    int               `json:"max_attempts"`
+	CreatedAt      time.Time         `json:"created_at"`
+	initialBackoff time.Duration
+}
+
+// RedactURL returns the scheme and host of a URL, hiding the path, query and
+// user info that chat webhooks such as Slack, Feishu or Telegram put their
+// tokens in
+func RedactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		return "[redacted]"
+	}
+	redacted := u.Scheme + "://" + u.Host
+	if u.User != nil || (u.Path != "" && u.Path != "/") || u.RawQuery != "" || u.Fragment != "" {
+		redacted += "/[redacted]"
+	}
+	return redacted
+}
+
+// redactError returns the message of a request error without the webhook URL
+func redactError(err error) string {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		return fmt.Sprintf("%s %q: %v", urlErr.Op, RedactURL(urlErr.URL), urlErr.Err)
+	}
+	return err.Error()
+}
+
+// webhookDispatcher delivers notifications to webhooks from a worker pool,
+// retrying failed deliveries with exponential backoff
+type webhookDispatcher struct {
+	config WebhookConfig
+	client *http.Client
+	// subscription looks up the subscription of a delivery before every
+	// attempt
+	subscription func(id string) (*Subscriber, bool)
+	// afterFunc schedules retries, replaced in tests
+	afterFunc   func(time.Duration, func())
+	queue       chan *Delivery
+	history     []*Delivery
+	deadLetters []*Delivery
+	// failures counts failed attempts and deadLettered the deliveries given
+	// up on
+	failures     atomic.Uint64
+	deadLettered atomic.Uint64
+	mu           sync.RWMutex
+	ctx          context.Context
+	wg           sync.WaitGroup
+}
+
+func newWebhookDispatcher(ctx context.Context, config WebhookConfig, subscription func(id string) (*Subscriber, bool)) *webhookDispatcher {
+	defaults := DefaultWebhookConfig()
+	if config.Workers <= 0 {
+		config.Workers = defaults.Workers
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = defaults.Timeout
+	}
+	if config.MaxAttempts <= 0 {
+		config.MaxAttempts = defaults.MaxAttempts
+	}
+	if config.InitialBackoff <= 0 {
+		config.InitialBackoff = defaults.InitialBackoff
+	}
+	if config.MaxBackoff <= 0 {
+		config.MaxBackoff = defaults.MaxBackoff
+	}
+	if config.HistoryLimit <= 0 {
+		config.HistoryLimit = defaults.HistoryLimit
+	}
+
+	return &webhookDispatcher{
+		config: config,
+		client: &http.Client{
+			Timeout: config.Timeout,
+		},
+		subscription: subscription,
+		afterFunc:    func(d time.Duration, f func()) { time.AfterFunc(d, f) },
+		queue:        make(chan *Delivery, 1000),
+		ctx:          ctx,
+	}
+}
+
+// start starts the delivery workers
+func (d *webhookDispatcher) start() {
+	for i := 0; i < d.config.Workers; i++ {
+		d.wg.Add(1)
+		go func() {
+			defer d.wg.Done()
+			for {
+				select {
+				case delivery := <-d.queue:
+					d.deliver(delivery)
+				case <-d.ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+}
+
+// wait waits for the workers to exit once the context is cancelled
+func (d *webhookDispatcher) wait() {
+	d.wg.Wait()
+}
+
+// enqueue schedules delivery of a notification to a webhook subscriber
+func (d *webhookDispatcher) enqueue(sub *Subscriber, notif Notification) {
+	maxAttempts := sub.MaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = d.config.MaxAttempts
+	}
+	initialBackoff := sub.InitialBackoff
+	if initialBackoff <= 0 {
+		initialBackoff = d.config.InitialBackoff
+	}
+
+	d.submit(&Delivery{
+		ID:             uuid.New().String(),
+		SubscriberID:   sub.ID,
+		SessionID:      notif.SessionID,
+		WebhookURL:     sub.WebhookURL,
+		Format:         sub.Format,
+		Notification:   notif,
+		Status:         DeliveryPending,
+		MaxAttempts:    maxAttempts,
+		CreatedAt:      time.Now(),
+		initialBackoff: initialBackoff,
+	})
+}
+
+func (d *webhookDispatcher) submit(delivery *Delivery) {
+	select {
+	case d.queue <- delivery:
+	default:
+		slog.Warn("Webhook queue full, moving delivery to dead letters", "delivery", delivery.ID)
+		d.finish(delivery, DeliveryFailed)
+	}
+}
+
+// deliver makes one delivery attempt to the subscription as it is now and
+// schedules a retry on failure. A delivery whose subscription is gone is
+// dropped.
+func (d *webhookDispatcher) deliver(delivery *Delivery) {
+	sub, ok := d.subscription(delivery.SubscriberID)
+	if !ok || sub.WebhookURL == "" {
+		slog.Debug("Webhook subscription gone, dropping delivery", "delivery", delivery.ID, "subscription", delivery.SubscriberID)
+		d.finish(delivery, DeliveryDropped)
+		return
+	}
+
+	d.mu.Lock()
+	delivery.WebhookURL = sub.WebhookURL
+	delivery.Format = sub.Format
+	d.mu.Unlock()
+
+	attempt := d.send(delivery, sub.Secret)
+
+	d.mu.Lock()
+	delivery.Attempts = append(delivery.Attempts, attempt)
+	attempts := len(delivery.Attempts)
+	d.mu.Unlock()
+
+	if attempt.Error == "" {
+		d.finish(delivery, DeliveryDelivered)
+		return
+	}
+
+	d.failures.Add(1)
+	slog.Warn("Webhook delivery failed", "delivery", delivery.ID, "url", RedactURL(delivery.WebhookURL),
+		"attempt", attempts, "max_attempts", delivery.MaxAttempts, "error", attempt.Error)
+
+	if attempts >= delivery.MaxAttempts {
+		d.finish(delivery, DeliveryFailed)
+		return
+	}
+
+	backoff := delivery.initialBackoff << (attempts - 1)
+	if backoff <= 0 || backoff > d.config.MaxBackoff {
+		backoff = d.config.MaxBackoff
+	}
+	d.afterFunc(backoff, func() {
+		if d.ctx.Err() != nil {
+			return
+		}
+		d.submit(delivery)
+	})
+}
+
+// send POSTs the notification to the webhook, signed with secret if set, and
+// records the attempt
+func (d *webhookDispatcher) send(delivery *Delivery, secret string) DeliveryAttempt {
+	attempt := DeliveryAttempt{Time: time.Now()}
+
+	formatter, ok := LookupFormatter(delivery.Format)
+	if !ok {
+		attempt.Error = fmt.Sprintf("unknown format %q", delivery.Format)
+		return attempt
+	}
+	link := SessionLink(d.config.PublicURL, delivery.SessionID)
+	body, err := formatter.Format(delivery.Notification, delivery.WebhookURL, link)
+	if err != nil {
+		attempt.Error = fmt.Sprintf("format notification: %v", err)
+		return attempt
+	}
+
+	req, err := http.NewRequestWithContext(d.ctx, http.MethodPost, delivery.WebhookURL, bytes.NewReader(body))
+	if err != nil {
+		attempt.Error = "create request: " + redactError(err)
+		return attempt
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Notification-ID", delivery.Notification.ID)
+	req.Header.Set("X-Delivery-ID", delivery.ID)
+	req.Header.Set("X-Delivery-Attempt", strconv.Itoa(len(delivery.Attempts)+1))
+	if secret != "" {
+		timestamp := strconv.FormatInt(attempt.Time.Unix(), 10)
+		req.Header.Set(TimestampHeader, timestamp)
+		req.Header.Set(SignatureHeader, Sign(secret, SignedBody(timestamp, body)))
+	}
+
+	resp, err := d.client.Do(req)
+	attempt.LatencyMs = time.Since(attempt.Time).Milliseconds()
+	if err != nil {
+		attempt.Error = redactError(err)
+		return attempt
+	}
+	defer resp.Body.Close()
+
+	attempt.StatusCode = resp.StatusCode
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		attempt.Error = fmt.Sprintf("webhook returned status %d", resp.StatusCode)
+	}
+	return attempt
+}
+
+// finish records a delivery that will not be retried
+func (d *webhookDispatcher) finish(delivery *Delivery, status DeliveryStatus) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	delivery.Status = status
+	d.history = appendLimited(d.history, delivery, d.config.HistoryLimit)
+	if status == DeliveryFailed {
+		d.deadLettered.Add(1)
+		d.deadLetters = appendLimited(d.deadLetters, delivery, d.config.HistoryLimit)
+	}
+}
+
+// deliveries returns copies of the finished deliveries of a subscriber,
+// newest first. An empty subscriber ID returns every delivery.
+func (d *webhookDispatcher) deliveries(subscriberID string) []Delivery {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	return copyDeliveries(d.history, subscriberID)
+}
+
+// deadLetterList returns copies of the dead letters of a subscriber, newest
+// first
+func (d *webhookDispatcher) deadLetterList(subscriberID string) []Delivery {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	return copyDeliveries(d.deadLetters, subscriberID)
+}
+
+// deadLetter returns a copy of a dead letter by ID
+func (d *webhookDispatcher) deadLetter(id string) (Delivery, bool) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	for _, delivery := range d.deadLetters {
+		if delivery.ID == id {
+			return copyDelivery(delivery), true
+		}
+	}
+	return Delivery{}, false
+}
+
+// replay removes a dead letter and schedules it for delivery again with a
+// fresh set of attempts
+func (d *webhookDispatcher) replay(id string) bool {
+	d.mu.Lock()
+	var delivery *Delivery
+	for i, dl := range d.deadLetters {
+		if dl.ID == id {
+			delivery = dl
+			d.deadLetters = append(d.deadLetters[:i], d.deadLetters[i+1:]...)
+			break
+		}
+	}
+	if delivery == nil {
+		d.mu.Unlock()
+		return false
+	}
+	replayed := &Delivery{
+		ID:             uuid.New().String(),
+		SubscriberID:   delivery.SubscriberID,
+		SessionID:      delivery.SessionID,
+		WebhookURL:     delivery.WebhookURL,
+		Format:         delivery.Format,
+		Notification:   delivery.Notification,
+		Status:         DeliveryPending,
+		MaxAttempts:    delivery.MaxAttempts,
+		CreatedAt:      time.Now(),
+		initialBackoff: delivery.initialBackoff,
+	}
+	d.mu.Unlock()
+
+	d.submit(replayed)
+	return true
+}
+
+// SignedBody returns what the X-Signature of a webhook request signs: the
+// X-Signature-Timestamp, a newline and the body
+func SignedBody(timestamp string, body []byte) []byte {
+	return append([]byte(timestamp+"\n"), body...)
+}
+
+// Sign returns the X-Signature value for body signed with secret
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func appendLimited(list []*Delivery, delivery *Delivery, limit int) []*Delivery {
+	list = append(list, delivery)
+	if len(list) > limit {
+		list = list[len(list)-limit:]
+	}
+	return list
+}
+
+func copyDeliveries(list []*Delivery, subscriberID string) []Delivery {
+	result := []Delivery{}
+	for i := len(list) - 1; i >= 0; i-- {
+		if subscriberID == "" || list[i].SubscriberID == subscriberID {
+			result = append(result, copyDelivery(list[i]))
+		}
+	}
+	return result
+}
+
+func copyDelivery(delivery *Delivery) Delivery {
+	c := *delivery
+	c.WebhookURL = RedactURL(delivery.WebhookURL)
+	c.Attempts = append([]DeliveryAttempt(nil), delivery.Attempts...)
+	return c
+}
@@ -2,281 +2,252 @@ package proxy
 
 import (
 	"fmt"
-	"log"
+	"log/slog"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"strconv"
 	"strings"
 	"time"
+
+	"clauded-server/logging"
+	"clauded-server/session"
 )
 
-// Manager manages the proxy connections to piko
+// Manager manages the proxy connections to piko. The reverse proxies are
+// built once and share a transport that keeps connections to the local piko
+// ports alive, so requests don't pay for a new proxy and TCP handshake each.
+// Requests can't be handed to piko in-process: piko v0.7.0 serves its proxy
+// only on a listener it opens itself. See the benchmarks in manager_test.go.
 type Manager struct {
+	key             []byte
 	pikoProxyURL    string
 	pikoUpstreamURL string
-	proxyPort       int
-	upstreamPort    int
+	pikoAdminURL    string
+	// trustedProxies are the networks whose X-Forwarded headers are passed on
+	trustedProxies []*net.IPNet
+
+	transport     *http.Transport
+	sessionProxy  *httputil.ReverseProxy
+	rootProxy     *httputil.ReverseProxy
+	portProxy     *httputil.ReverseProxy
+	upstreamProxy *httputil.ReverseProxy
 }
 
-// NewManager creates a new proxy manager
-func NewManager(proxyPort, upstreamPort int) *Manager {
-	return &Manager{
-		proxyPort:       proxyPort,
-		upstreamPort:    upstreamPort,
-		pikoProxyURL:    fmt.Sprintf("http://127.0.0.1:%d", proxyPort),
+// NewManager creates a new proxy manager for the piko proxy on proxyHost and
+// the local upstream and admin ports. Requests through the proxy carry a
+// token signed with key, which piko requires.
+func NewManager(proxyHost string, proxyPort, upstreamPort, adminPort int, key []byte) *Manager {
+	m := &Manager{
+		key:             key,
+		pikoProxyURL:    "http://" + net.JoinHostPort(proxyHost, strconv.Itoa(proxyPort)),
 		pikoUpstreamURL: fmt.Sprintf("http://127.0.0.1:%d", upstreamPort),
+		pikoAdminURL:    fmt.Sprintf("http://127.0.0.1:%d", adminPort),
+		transport: &http.Transport{
+			DialContext: (&net.Dialer{
+				Timeout:   5 * time.Second,
+				KeepAlive: 30 * time.Second,
+			}).DialContext,
+			// Every request goes to one of two local ports, so keep enough
+			// idle connections for bursts of terminal traffic
+			MaxIdleConns:        512,
+			MaxIdleConnsPerHost: 256,
+			IdleConnTimeout:     90 * time.Second,
+		},
 	}
-}
 
-// ProxyRequest creates a handler that proxies requests to piko
-func (m *Manager) ProxyRequest() http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		log.Printf("DEBUG: ProxyRequest hit. URL: %s", r.URL.Path)
-		
-		// Extract session ID from URL path (the first segment)
-		path := strings.TrimPrefix(r.URL.Path, "/")
-		parts := strings.Split(path, "/")
-		
-		if parts[0] == "" {
-			http.Error(w, "Session ID is required", http.StatusBadRequest)
-			return
+	pikoProxyURL, _ := url.Parse(m.pikoProxyURL)
+	pikoUpstreamURL, _ := url.Parse(m.pikoUpstreamURL)
+
+	m.sessionProxy = m.newProxy(pikoProxyURL, func(r *http.Request) (string, string) {
+		return sessionEndpoint(r.URL.Path), r.URL.Path
+	})
+	m.rootProxy = m.newProxy(pikoProxyURL, func(r *http.Request) (string, string) {
+		return "root-service", r.URL.Path
+	})
+	m.portProxy = m.newProxy(pikoProxyURL, portEndpoint)
+	m.upstreamProxy = m.newProxy(pikoUpstreamURL, func(r *http.Request) (string, string) {
+		// Ensure path starts with /piko (for /v1/upstream routes)
+		path := r.URL.Path
+		if !strings.HasPrefix(path, "/piko") {
+			path = "/piko/" + strings.TrimPrefix(path, "/")
 		}
+		return "", path
+	})
+	m.upstreamProxy.ModifyResponse = nil
+	return m
+}
 
-		sessionID := parts[0]
-		
-		// Create proxy director
-		targetURL, _ := url.Parse(m.pikoProxyURL)
-		proxy := &httputil.ReverseProxy{
-			Rewrite: func(pr *httputil.ProxyRequest) {
-				// Set the target URL
-				pr.Out.URL = targetURL
-				pr.Out.URL.Path = r.URL.Path
-				pr.Out.URL.RawQuery = r.URL.RawQuery
-
-				// Set piko endpoint header
-				pr.Out.Header.Set("X-Piko-Endpoint", sessionID)
-				log.Printf("DEBUG: Setting X-Piko-Endpoint header: %s", sessionID)
-
-				// Copy other headers
-				pr.Out.Header.Set("X-Forwarded-Host", r.Host)
-				pr.Out.Header.Set("X-Forwarded-Proto", scheme(r))
-
-				// Handle WebSocket upgrade
-				if strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
-					pr.Out.Header.Set("Upgrade", "websocket")
-					pr.Out.Header.Set("Connection", "Upgrade")
-				}
-			},
-			ModifyResponse: func(resp *http.Response) error {
-				// If Piko returns 502, it means the upstream (client) is not connected.
-				// We map this to 404 to indicate "Session Not Found".
-				if resp.StatusCode == http.StatusBadGateway {
-					resp.StatusCode = http.StatusNotFound
+// route returns the piko endpoint a request is sent to (none for the
+// upstream) and the path to send it to
+type route func(r *http.Request) (endpointID, path string)
+
+// newProxy creates a reverse proxy to target routing requests with route
+func (m *Manager) newProxy(target *url.URL, route route) *httputil.ReverseProxy {
+	return &httputil.ReverseProxy{
+		Transport: m.transport,
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			endpointID, path := route(pr.In)
+
+			// Set the target URL
+			pr.Out.URL.Scheme = target.Scheme
+			pr.Out.URL.Host = target.Host
+			pr.Out.URL.Path = path
+			pr.Out.URL.RawPath = ""
+			pr.Out.URL.RawQuery = pr.In.URL.RawQuery
+
+			// Set piko endpoint header and the token piko's proxy requires
+			pr.Out.Header.Del("X-Piko-Authorization")
+			if endpointID != "" {
+				pr.Out.Header.Set("X-Piko-Endpoint", endpointID)
+				if token, err := RequestToken(m.key, endpointID); err == nil {
+					pr.Out.Header.Set("X-Piko-Authorization", "Bearer "+token)
 				}
-				return nil
-			},
-			ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
-				log.Printf("Proxy error for session %s: %v", sessionID, err)
-				// If we can't connect to Piko proxy (localhost), that's a 502.
-				// If Piko returns 502 (handled in ModifyResponse), it's a 404.
-				http.Error(w, "Proxy error", http.StatusBadGateway)
-			},
-		}
+			}
+
+			// Tell the client who is connecting. The X-Forwarded headers a
+			// request arrives with are only kept from a trusted proxy.
+			trusted := m.trusted(pr.In)
+			if trusted {
+				pr.Out.Header["X-Forwarded-For"] = pr.In.Header["X-Forwarded-For"]
+			}
+			pr.SetXForwarded()
+			if proto := pr.In.Header.Get("X-Forwarded-Proto"); trusted && proto != "" {
+				pr.Out.Header.Set("X-Forwarded-Proto", proto)
+			}
+
+			// Handle WebSocket upgrade
+			if strings.EqualFold(pr.In.Header.Get("Upgrade"), "websocket") {
+				pr.Out.Header.Set("Upgrade", "websocket")
+				pr.Out.Header.Set("Connection", "Upgrade")
+			}
+		},
+		ModifyResponse: func(resp *http.Response) error {
+			// If Piko returns 502, it means the upstream (client) is not connected.
+			// We map this to 404 to indicate "Session Not Found".
+			if resp.StatusCode == http.StatusBadGateway {
+				resp.StatusCode = http.StatusNotFound
+			}
+			return nil
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			endpointID, _ := route(r)
+			if endpointID == "" {
+				endpointID = "upstream"
+			}
+			slog.Warn("Proxy error", "endpoint", endpointID, "request_id", logging.RequestID(r.Context()), "error", err)
+			// If we can't connect to Piko proxy (localhost), that's a 502.
+			// If Piko returns 502 (handled in ModifyResponse), it's a 404.
+			http.Error(w, "Proxy error", http.StatusBadGateway)
+		},
+		// Flush every write straight away so terminal output isn't held back
+		FlushInterval: -1,
+	}
+}
 
-		// Flush the response after writing to support SSE/WebSocket
-		proxy.FlushInterval = 100 * time.Millisecond
+// SetTrustedProxies sets the IPs and CIDRs of the reverse proxies in front of
+// the server, whose X-Forwarded-For and X-Forwarded-Proto headers are passed
+// on to clients. Other requests' headers are replaced.
+func (m *Manager) SetTrustedProxies(proxies []string) error {
+	networks := make([]*net.IPNet, 0, len(proxies))
+	for _, proxy := range proxies {
+		if ip := net.ParseIP(proxy); ip != nil {
+			bits := 8 * len(ip.To16())
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 32
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return fmt.Errorf("invalid trusted proxy %q", proxy)
+		}
+		networks = append(networks, network)
+	}
+	m.trustedProxies = networks
+	return nil
+}
 
-		// Serve the proxy
-		proxy.ServeHTTP(w, r)
+// trusted reports whether r comes straight from a trusted proxy
+func (m *Manager) trusted(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	for _, network := range m.trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
 	}
+	return false
 }
 
-// ProxyRootRequest creates a handler that proxies requests to piko as root-service
-// This is used for "/" and "/piko" paths
-func (m *Manager) ProxyRootRequest() http.HandlerFunc {
+// ProxyRequest returns a handler that proxies /:session/* requests to piko
+func (m *Manager) ProxyRequest() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		// Create proxy director
-		targetURL, _ := url.Parse(m.pikoProxyURL)
-		proxy := &httputil.ReverseProxy{
-			Rewrite: func(pr *httputil.ProxyRequest) {
-				// Set the target URL
-				pr.Out.URL = targetURL
-				pr.Out.URL.Path = r.URL.Path
-				pr.Out.URL.RawQuery = r.URL.RawQuery
-
-				// Set piko endpoint header to root-service
-				pr.Out.Header.Set("X-Piko-Endpoint", "root-service")
-
-				// Copy other headers
-				pr.Out.Header.Set("X-Forwarded-Host", r.Host)
-				pr.Out.Header.Set("X-Forwarded-Proto", scheme(r))
-
-				// Handle WebSocket upgrade
-				if strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
-					pr.Out.Header.Set("Upgrade", "websocket")
-					pr.Out.Header.Set("Connection", "Upgrade")
-				}
-			},
-			ModifyResponse: func(resp *http.Response) error {
-				// If Piko returns 502, it means the upstream (client) is not connected.
-				// We map this to 404 to indicate "Session Not Found".
-				if resp.StatusCode == http.StatusBadGateway {
-					resp.StatusCode = http.StatusNotFound
-				}
-				return nil
-			},
-			ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
-				log.Printf("Proxy error for root service: %v", err)
-				// If we can't connect to Piko proxy (localhost), that's a 502.
-				// If Piko returns 502 (handled in ModifyResponse), it's a 404.
-				http.Error(w, "Proxy error", http.StatusBadGateway)
-			},
+		if sessionEndpoint(r.URL.Path) == "" {
+			http.Error(w, "Session ID is required", http.StatusBadRequest)
+			return
 		}
+		m.sessionProxy.ServeHTTP(w, r)
+	}
+}
 
-		// Flush the response after writing to support SSE/WebSocket
-		proxy.FlushInterval = 100 * time.Millisecond
+// ProxyRootRequest returns a handler that proxies requests to piko as root-service
+// This is used for "/" and "/piko" paths
+func (m *Manager) ProxyRootRequest() http.HandlerFunc {
+	return m.rootProxy.ServeHTTP
+}
 
-		// Serve the proxy
-		proxy.ServeHTTP(w, r)
-	}
+// UpstreamToken signs the piko token letting a client the server verified
+// listen on one endpoint, expiring at expires unless it is zero
+func (m *Manager) UpstreamToken(endpointID string, expires time.Time) (string, error) {
+	return Token(m.key, endpointID, expires)
 }
 
-// ProxyUpstreamRequest creates a handler that proxies requests to piko upstream
+// ProxyUpstreamRequest returns a handler that proxies requests to piko upstream
 // This is used for "/piko" paths when acting as an agent connection endpoint
 func (m *Manager) ProxyUpstreamRequest() http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		log.Printf("DEBUG: ProxyUpstreamRequest hit. URL: %s", r.URL.Path)
-		// Create proxy director
-		targetURL, _ := url.Parse(m.pikoUpstreamURL)
-		proxy := &httputil.ReverseProxy{
-			Rewrite: func(pr *httputil.ProxyRequest) {
-				// Set the target URL
-				pr.Out.URL = targetURL
-
-				// Ensure path starts with /piko
-				newPath := r.URL.Path
-				if !strings.HasPrefix(newPath, "/piko") {
-					// Prepend /piko if missing (for /v1/upstream routes)
-					if strings.HasPrefix(newPath, "/") {
-						newPath = "/piko" + newPath
-					} else {
-						newPath = "/piko/" + newPath
-					}
-				}
-
-				pr.Out.URL.Path = newPath
-				pr.Out.URL.RawQuery = r.URL.RawQuery
-
-				// Copy other headers
-				pr.Out.Header.Set("X-Forwarded-Host", r.Host)
-				pr.Out.Header.Set("X-Forwarded-Proto", scheme(r))
-
-				// Handle WebSocket upgrade
-				if strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
-					pr.Out.Header.Set("Upgrade", "websocket")
-					pr.Out.Header.Set("Connection", "Upgrade")
-				}
-			},
-			ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
-				log.Printf("Proxy error for upstream service: %v", err)
-				http.Error(w, "Proxy error", http.StatusBadGateway)
-			},
-		}
-
-		// Flush the response after writing to support SSE/WebSocket
-		proxy.FlushInterval = 100 * time.Millisecond
-
-		// Serve the proxy
-		proxy.ServeHTTP(w, r)
-	}
+	return m.upstreamProxy.ServeHTTP
 }
 
-// ProxyPortRequest creates a handler that proxies requests for attached ports
+// ProxyPortRequest returns a handler that proxies requests for attached ports
 // This handles /:session/:port paths where port is a forwarded port
 func (m *Manager) ProxyPortRequest() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		log.Printf("DEBUG: ProxyPortRequest hit. URL: %s", r.URL.Path)
-
-		// Extract session ID and port from URL path
-		path := strings.TrimPrefix(r.URL.Path, "/")
-		parts := strings.Split(path, "/")
-
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/"), "/")
 		if len(parts) < 2 {
 			http.Error(w, "Invalid request format", http.StatusBadRequest)
 			return
 		}
 
-		sessionID := parts[0]
-		port := parts[1]
-
 		// Validate port is numeric
-		if _, err := fmt.Sscanf(port, "%d", new(int)); err != nil {
+		if _, err := fmt.Sscanf(parts[1], "%d", new(int)); err != nil {
 			http.Error(w, "Invalid port number", http.StatusBadRequest)
 			return
 		}
-
-		// Create endpoint ID: {sessionID}-{port}
-		endpointID := fmt.Sprintf("%s-%s", sessionID, port)
-
-		// Create proxy director
-		targetURL, _ := url.Parse(m.pikoProxyURL)
-		proxy := &httputil.ReverseProxy{
-			Rewrite: func(pr *httputil.ProxyRequest) {
-				// Set the target URL
-				pr.Out.URL = targetURL
-				// Keep original path (strip /session/port prefix)
-				if len(parts) > 2 {
-					pr.Out.URL.Path = "/" + strings.Join(parts[2:], "/")
-				} else {
-					pr.Out.URL.Path = "/"
-				}
-				pr.Out.URL.RawQuery = r.URL.RawQuery
-
-				// Set piko endpoint header
-				pr.Out.Header.Set("X-Piko-Endpoint", endpointID)
-				log.Printf("DEBUG: Setting X-Piko-Endpoint header: %s", endpointID)
-
-				// Copy other headers
-				pr.Out.Header.Set("X-Forwarded-Host", r.Host)
-				pr.Out.Header.Set("X-Forwarded-Proto", scheme(r))
-
-				// Handle WebSocket upgrade
-				if strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
-					pr.Out.Header.Set("Upgrade", "websocket")
-					pr.Out.Header.Set("Connection", "Upgrade")
-				}
-			},
-			ModifyResponse: func(resp *http.Response) error {
-				// If Piko returns 502, it means the upstream (client) is not connected.
-				// We map this to 404 to indicate "Session Not Found".
-				if resp.StatusCode == http.StatusBadGateway {
-					resp.StatusCode = http.StatusNotFound
-				}
-				return nil
-			},
-			ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
-				log.Printf("Proxy error for session %s port %s: %v", sessionID, port, err)
-				http.Error(w, "Proxy error", http.StatusBadGateway)
-			},
-		}
-
-		// Flush the response after writing to support SSE/WebSocket
-		proxy.FlushInterval = 100 * time.Millisecond
-
-		// Serve the proxy
-		proxy.ServeHTTP(w, r)
+		m.portProxy.ServeHTTP(w, r)
 	}
 }
 
+// sessionEndpoint returns the session ID, the first segment of the path
+func sessionEndpoint(path string) string {
+	return strings.SplitN(strings.TrimPrefix(path, "/"), "/", 2)[0]
+}
 
-// scheme returns the scheme of the request (http or https)
-func scheme(r *http.Request) string {
-	if r.TLS != nil {
-		return "https"
+// portEndpoint routes /:session/:port/* to the {session}:{port} endpoint,
+// stripping the prefix from the path
+func portEndpoint(r *http.Request) (string, string) {
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 3)
+	if len(parts) < 2 {
+		return "", "/"
 	}
-	if scheme := r.Header.Get("X-Forwarded-Proto"); scheme != "" {
-		return scheme
+	path := "/"
+	if len(parts) == 3 {
+		path += parts[2]
 	}
-	return "http"
+	return session.PortEndpoint(parts[0], parts[1]), path
 }
-
@@ -0,0 +1,230 @@
+package proxy
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testKey = []byte("test-key")
+
+// newTestManager returns a manager whose piko proxy is handler
+func newTestManager(t testing.TB, handler http.Handler) *Manager {
+	t.Helper()
+	piko := httptest.NewServer(handler)
+	t.Cleanup(piko.Close)
+
+	host, port, err := net.SplitHostPort(strings.TrimPrefix(piko.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxyPort, _ := strconv.Atoi(port)
+	return NewManager(host, proxyPort, 0, 0, testKey)
+}
+
+func TestProxyRouting(t *testing.T) {
+	var endpoint, path, token string
+	m := newTestManager(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		endpoint, path = r.Header.Get("X-Piko-Endpoint"), r.URL.RequestURI()
+		token = r.Header.Get("X-Piko-Authorization")
+		if endpoint == "gone" {
+			// piko answers 502 when no upstream listens on the endpoint
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+
+	tests := []struct {
+		name         string
+		handler      http.HandlerFunc
+		path         string
+		wantEndpoint string
+		wantPath     string
+		wantCode     int
+	}{
+		{"session", m.ProxyRequest(), "/demo/ws?x=1", "demo", "/demo/ws?x=1", http.StatusOK},
+		{"port", m.ProxyPortRequest(), "/demo/3000/app/", "demo:3000", "/app/", http.StatusOK},
+		{"port root", m.ProxyPortRequest(), "/demo/3000", "demo:3000", "/", http.StatusOK},
+		{"root", m.ProxyRootRequest(), "/index.html", "root-service", "/index.html", http.StatusOK},
+		{"not connected", m.ProxyRequest(), "/gone/", "gone", "/gone/", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			// A client can't pick the token piko checks
+			r.Header.Set("X-Piko-Authorization", "Bearer forged")
+			w := httptest.NewRecorder()
+			tt.handler(w, r)
+
+			if w.Code != tt.wantCode {
+				t.Fatalf("status = %d, want %d", w.Code, tt.wantCode)
+			}
+			if endpoint != tt.wantEndpoint || path != tt.wantPath {
+				t.Fatalf("proxied to %s %s, want %s %s", endpoint, path, tt.wantEndpoint, tt.wantPath)
+			}
+			if !strings.HasPrefix(token, "Bearer ") || token == "Bearer forged" {
+				t.Fatalf("piko token = %q", token)
+			}
+		})
+	}
+}
+
+// perRequestProxy proxies like the manager used to: a new ReverseProxy per
+// request on the default transport, which keeps only two idle connections
+// per host, flushing streamed responses every 100ms
+func perRequestProxy(target string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		targetURL, _ := url.Parse(target)
+		endpointID := sessionEndpoint(r.URL.Path)
+		proxy := &httputil.ReverseProxy{
+			Rewrite: func(pr *httputil.ProxyRequest) {
+				pr.Out.URL = targetURL
+				pr.Out.URL.Path = r.URL.Path
+				pr.Out.URL.RawQuery = r.URL.RawQuery
+				pr.Out.Header.Set("X-Piko-Endpoint", endpointID)
+				if token, err := RequestToken(testKey, endpointID); err == nil {
+					pr.Out.Header.Set("X-Piko-Authorization", "Bearer "+token)
+				}
+			},
+			FlushInterval: 100 * time.Millisecond,
+		}
+		proxy.ServeHTTP(w, r)
+	}
+}
+
+// benchmarkProxies runs bench against a server proxying to piko through the
+// manager, through a new proxy per request, and in-process, handing requests
+// straight to piko's handler. piko v0.7.0 only serves its proxy on a listener
+// it opens itself and doesn't export the handler, so the in-process variant
+// only bounds what skipping the loopback hop would save.
+func benchmarkProxies(b *testing.B, piko http.HandlerFunc, bench func(b *testing.B, server string)) {
+	m := newTestManager(b, piko)
+	proxies := []struct {
+		name    string
+		handler http.HandlerFunc
+	}{
+		{"pooled", m.ProxyRequest()},
+		{"per-request", perRequestProxy(m.pikoProxyURL)},
+		{"in-process", piko},
+	}
+	for _, p := range proxies {
+		b.Run(p.name, func(b *testing.B) {
+			server := httptest.NewServer(p.handler)
+			defer server.Close()
+			bench(b, server.URL)
+		})
+	}
+}
+
+// BenchmarkProxyRequest measures short requests, such as the static assets
+// of a terminal page, from concurrent browsers
+func BenchmarkProxyRequest(b *testing.B) {
+	piko := func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}
+	benchmarkProxies(b, piko, func(b *testing.B, server string) {
+		client := &http.Client{Transport: &http.Transport{MaxIdleConnsPerHost: 64}}
+		defer client.CloseIdleConnections()
+
+		// Many browsers at once, whatever GOMAXPROCS is
+		b.SetParallelism(32)
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				resp, err := client.Get(server + "/demo/static/app.js")
+				if err != nil {
+					b.Error(err)
+					return
+				}
+				io.Copy(io.Discard, resp.Body)
+				resp.Body.Close()
+			}
+		})
+	})
+}
+
+// BenchmarkProxyKeystroke measures the round trip of a keystroke and its echo
+// over an open terminal WebSocket
+func BenchmarkProxyKeystroke(b *testing.B) {
+	piko := func(w http.ResponseWriter, r *http.Request) {
+		conn, rw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+		rw.Flush()
+		io.Copy(conn, rw)
+	}
+	benchmarkProxies(b, piko, func(b *testing.B, server string) {
+		conn, err := net.Dial("tcp", strings.TrimPrefix(server, "http://"))
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer conn.Close()
+		io.WriteString(conn, "GET /demo/ws HTTP/1.1\r\nHost: localhost\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+		reader := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(reader, nil)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusSwitchingProtocols {
+			b.Fatalf("upgrade: %s", resp.Status)
+		}
+
+		key := []byte("x")
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if _, err := conn.Write(key); err != nil {
+				b.Fatal(err)
+			}
+			if _, err := reader.ReadByte(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestProxyForwardedHeaders(t *testing.T) {
+	var forwardedFor, forwardedProto string
+	m := newTestManager(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwardedFor, forwardedProto = r.Header.Get("X-Forwarded-For"), r.Header.Get("X-Forwarded-Proto")
+	}))
+	if err := m.SetTrustedProxies([]string{"10.0.0.0/8", "192.0.2.7"}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		wantFor    string
+		wantProto  string
+	}{
+		{"client", "198.51.100.1:1234", "198.51.100.1", "http"},
+		{"trusted proxy", "192.0.2.7:1234", "203.0.113.9, 192.0.2.7", "https"},
+		{"trusted network", "10.1.2.3:1234", "203.0.113.9, 10.1.2.3", "https"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/demo/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			r.Header.Set("X-Forwarded-For", "203.0.113.9")
+			r.Header.Set("X-Forwarded-Proto", "https")
+			m.ProxyRequest()(httptest.NewRecorder(), r)
+
+			if forwardedFor != tt.wantFor || forwardedProto != tt.wantProto {
+				t.Fatalf("X-Forwarded-For %q, X-Forwarded-Proto %q, want %q, %q", forwardedFor, forwardedProto, tt.wantFor, tt.wantProto)
+			}
+		})
+	}
+
+	if err := m.SetTrustedProxies([]string{"proxy.example.com"}); err == nil {
+		t.Fatal("SetTrustedProxies() accepted a host name")
+	}
+}
@@ -0,0 +1,56 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Ready checks that piko has finished starting: its admin server reports
+// ready and the proxy and upstream ports accept connections
+func (m *Manager) Ready(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, m.pikoAdminURL+"/ready", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("piko admin: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("piko admin: not ready (%s)", resp.Status)
+	}
+
+	var dialer net.Dialer
+	for _, u := range []string{m.pikoProxyURL, m.pikoUpstreamURL} {
+		addr := strings.TrimPrefix(u, "http://")
+		conn, err := dialer.DialContext(ctx, "tcp", addr)
+		if err != nil {
+			return fmt.Errorf("piko %s: %w", addr, err)
+		}
+		conn.Close()
+	}
+	return nil
+}
+
+// WaitReady polls Ready until it succeeds or ctx is done
+func (m *Manager) WaitReady(ctx context.Context) error {
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		err := m.Ready(ctx)
+		if err == nil {
+			return nil
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return fmt.Errorf("%w: %v", ctx.Err(), err)
+		}
+	}
+}
@@ -0,0 +1,32 @@
+package proxy
+
+import (
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// requestTokenTTL is how long the piko token of a proxied request is valid.
+// piko checks it when the request, or WebSocket, opens.
+const requestTokenTTL = time.Minute
+
+// Token signs a piko token for one endpoint with the server's piko key,
+// expiring at expires unless it is zero. Only this server holds the key, so
+// piko's ports can't be used around the server's checks.
+func Token(key []byte, endpointID string, expires time.Time) (string, error) {
+	claims := jwt.MapClaims{
+		"piko": map[string]interface{}{
+			"endpoints": []string{endpointID},
+		},
+	}
+	if !expires.IsZero() {
+		claims["exp"] = expires.Unix()
+	}
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(key)
+}
+
+// RequestToken signs a short lived piko token for a request to an endpoint
+// through the piko proxy
+func RequestToken(key []byte, endpointID string) (string, error) {
+	return Token(key, endpointID, time.Now().Add(requestTokenTTL))
+}
@@ -0,0 +1,141 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// Limiter limits events per key, such as a client IP or session, with a
+// token bucket per key. A bucket holds up to limit tokens and refills at
+// limit tokens per interval, so a key may burst up to limit events and
+// then sustain limit events per interval.
+type Limiter struct {
+	limit    float64
+	interval time.Duration
+	// now is the clock of the limiter, replaced in tests
+	now func() time.Time
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastPrune time.Time
+}
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// New creates a limiter allowing limit events per interval and key. A limit
+// of 0 or less allows every event.
+func New(limit int, interval time.Duration) *Limiter {
+	return &Limiter{
+		limit:     float64(limit),
+		interval:  interval,
+		now:       time.Now,
+		buckets:   make(map[string]*bucket),
+		lastPrune: time.Now(),
+	}
+}
+
+// Enabled reports whether the limiter limits anything
+func (l *Limiter) Enabled() bool {
+	return l.limit > 0
+}
+
+// Allow takes a token for an event of key. When the bucket is empty it
+// returns false and how long until a token is available.
+func (l *Limiter) Allow(key string) (bool, time.Duration) {
+	if !l.Enabled() {
+		return true, 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.pruneLocked(now)
+
+	b, exists := l.buckets[key]
+	if !exists {
+		b = &bucket{tokens: l.limit, updated: now}
+		l.buckets[key] = b
+	}
+	b.tokens = l.refill(b, now)
+	b.updated = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / l.limit * float64(l.interval))
+}
+
+// refill returns the tokens of a bucket at now
+func (l *Limiter) refill(b *bucket, now time.Time) float64 {
+	tokens := b.tokens + now.Sub(b.updated).Seconds()/l.interval.Seconds()*l.limit
+	if tokens > l.limit {
+		return l.limit
+	}
+	return tokens
+}
+
+// pruneLocked drops full buckets once per interval, so keys that went away
+// don't hold memory
+func (l *Limiter) pruneLocked(now time.Time) {
+	if now.Sub(l.lastPrune) < l.interval {
+		return
+	}
+	l.lastPrune = now
+
+	for key, b := range l.buckets {
+		if l.refill(b, now) >= l.limit {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// Counter caps concurrent holders per key, such as open WebSockets of a
+// session
+type Counter struct {
+	max int
+
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+// NewCounter creates a counter allowing max concurrent holders per key. A
+// max of 0 or less allows any number.
+func NewCounter(max int) *Counter {
+	return &Counter{
+		max:    max,
+		counts: make(map[string]int),
+	}
+}
+
+// Acquire takes a slot for key, returning false when all are taken. The
+// returned function releases the slot and must be called exactly once.
+func (c *Counter) Acquire(key string) (func(), bool) {
+	if c.max <= 0 {
+		return func() {}, true
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.counts[key] >= c.max {
+		return nil, false
+	}
+	c.counts[key]++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+
+			if c.counts[key]--; c.counts[key] <= 0 {
+				delete(c.counts, key)
+			}
+		})
+	}, true
+}
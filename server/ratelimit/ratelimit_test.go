@@ -0,0 +1,192 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+// clock is a manual clock for a limiter
+type clock struct {
+	now time.Time
+}
+
+func (c *clock) Now() time.Time {
+	return c.now
+}
+
+func (c *clock) Advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+// newTestLimiter returns a limiter on a manual clock
+func newTestLimiter(limit int, interval time.Duration) (*Limiter, *clock) {
+	c := &clock{now: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)}
+	l := New(limit, interval)
+	l.now = c.Now
+	l.lastPrune = c.now
+	return l, c
+}
+
+func TestLimiter(t *testing.T) {
+	type step struct {
+		advance time.Duration
+		key     string
+		allowed bool
+		wait    time.Duration
+	}
+	tests := []struct {
+		name  string
+		limit int
+		steps []step
+	}{
+		{
+			name:  "burst",
+			limit: 3,
+			steps: []step{
+				{key: "a", allowed: true},
+				{key: "a", allowed: true},
+				{key: "a", allowed: true},
+				{key: "a", wait: 20 * time.Second},
+			},
+		},
+		{
+			name:  "retry after shrinks",
+			limit: 3,
+			steps: []step{
+				{key: "a", allowed: true},
+				{key: "a", allowed: true},
+				{key: "a", allowed: true},
+				{advance: 5 * time.Second, key: "a", wait: 15 * time.Second},
+				{advance: 14 * time.Second, key: "a", wait: time.Second},
+				{advance: time.Second, key: "a", allowed: true},
+			},
+		},
+		{
+			name:  "refill",
+			limit: 2,
+			steps: []step{
+				{key: "a", allowed: true},
+				{key: "a", allowed: true},
+				{key: "a", wait: 30 * time.Second},
+				{advance: 30 * time.Second, key: "a", allowed: true},
+				{key: "a", wait: 30 * time.Second},
+			},
+		},
+		{
+			name:  "burst capped after idling",
+			limit: 2,
+			steps: []step{
+				{key: "a", allowed: true},
+				{advance: time.Hour, key: "a", allowed: true},
+				{key: "a", allowed: true},
+				{key: "a", wait: 30 * time.Second},
+			},
+		},
+		{
+			name:  "keys",
+			limit: 1,
+			steps: []step{
+				{key: "a", allowed: true},
+				{key: "b", allowed: true},
+				{key: "a", wait: time.Minute},
+				{key: "b", wait: time.Minute},
+			},
+		},
+		{
+			name:  "disabled",
+			limit: 0,
+			steps: []step{
+				{key: "a", allowed: true},
+				{key: "a", allowed: true},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, c := newTestLimiter(tt.limit, time.Minute)
+			for i, s := range tt.steps {
+				c.Advance(s.advance)
+				allowed, wait := l.Allow(s.key)
+				if allowed != s.allowed || wait.Round(time.Millisecond) != s.wait {
+					t.Fatalf("step %d: Allow(%q) = %v, %v, want %v, %v", i, s.key, allowed, wait, s.allowed, s.wait)
+				}
+			}
+		})
+	}
+}
+
+func TestLimiterPrune(t *testing.T) {
+	l, c := newTestLimiter(2, time.Minute)
+	l.Allow("full")
+	c.Advance(50 * time.Second)
+	l.Allow("used")
+	l.Allow("used")
+
+	// Pruning waits for an interval since the last one
+	c.Advance(5 * time.Second)
+	l.Allow("other")
+	if len(l.buckets) != 3 {
+		t.Fatalf("%d buckets before an interval passed, want 3", len(l.buckets))
+	}
+
+	// full and other have refilled by now, used hasn't
+	c.Advance(30 * time.Second)
+	l.Allow("used")
+	if _, ok := l.buckets["full"]; ok {
+		t.Fatal("full bucket kept")
+	}
+	if _, ok := l.buckets["other"]; ok {
+		t.Fatal("refilled bucket kept")
+	}
+	if b, ok := l.buckets["used"]; !ok || b.tokens >= 1 {
+		t.Fatalf("used bucket = %+v, %v, want it kept with no token left", b, ok)
+	}
+}
+
+func TestCounter(t *testing.T) {
+	c := NewCounter(2)
+
+	releaseA1, ok := c.Acquire("a")
+	if !ok {
+		t.Fatal("first slot refused")
+	}
+	if _, ok := c.Acquire("a"); !ok {
+		t.Fatal("second slot refused")
+	}
+	if _, ok := c.Acquire("a"); ok {
+		t.Fatal("third slot acquired past the cap")
+	}
+	if _, ok := c.Acquire("b"); !ok {
+		t.Fatal("slot of another key refused")
+	}
+
+	// Releasing twice frees one slot only
+	releaseA1()
+	releaseA1()
+	if _, ok := c.Acquire("a"); !ok {
+		t.Fatal("released slot refused")
+	}
+	if _, ok := c.Acquire("a"); ok {
+		t.Fatal("slot acquired past the cap after a double release")
+	}
+}
+
+func TestCounterRelease(t *testing.T) {
+	c := NewCounter(1)
+	release, _ := c.Acquire("a")
+	release()
+	if _, ok := c.counts["a"]; ok {
+		t.Fatal("key kept after releasing its last slot")
+	}
+}
+
+func TestCounterDisabled(t *testing.T) {
+	c := NewCounter(0)
+	for i := 0; i < 3; i++ {
+		release, ok := c.Acquire("a")
+		if !ok {
+			t.Fatalf("slot %d refused by a disabled counter", i)
+		}
+		release()
+	}
+}
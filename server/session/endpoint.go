@@ -0,0 +1,61 @@
+package session
+
+import "strings"
+
+// PortSeparator joins a session ID and a forwarded port into the piko
+// endpoint of the port forward, e.g. alice:3000. Session IDs may not contain
+// it, so a port forward always names the session it belongs to.
+const PortSeparator = ":"
+
+// PortEndpoint returns the piko endpoint a session forwards a port on
+func PortEndpoint(sessionID, port string) string {
+	return sessionID + PortSeparator + port
+}
+
+// SplitPortEndpoint splits the endpoint of a port forward into its session
+// and port. It returns false for an endpoint that isn't a port forward.
+func SplitPortEndpoint(endpointID string) (sessionID, port string, ok bool) {
+	sessionID, port, ok = strings.Cut(endpointID, PortSeparator)
+	if !ok || !ValidID(sessionID) || !validPort(port) {
+		return "", "", false
+	}
+	return sessionID, port, true
+}
+
+// ValidID reports whether id can name a session
+func ValidID(id string) bool {
+	return id != "" && !strings.Contains(id, PortSeparator)
+}
+
+// ValidEndpoint reports whether an upstream may listen on a piko endpoint: a
+// session or the port forward of one
+func ValidEndpoint(endpointID string) bool {
+	if _, _, ok := SplitPortEndpoint(endpointID); ok {
+		return true
+	}
+	return ValidID(endpointID)
+}
+
+// SessionOf returns the session an endpoint belongs to: the session of a
+// port forward, otherwise the endpoint itself
+func SessionOf(endpointID string) string {
+	if sessionID, _, ok := SplitPortEndpoint(endpointID); ok {
+		return sessionID
+	}
+	return endpointID
+}
+
+// validPort reports whether port is a TCP port number
+func validPort(port string) bool {
+	if port == "" || len(port) > 5 || port[0] == '0' {
+		return false
+	}
+	n := 0
+	for _, r := range port {
+		if r < '0' || r > '9' {
+			return false
+		}
+		n = n*10 + int(r-'0')
+	}
+	return n <= 65535
+}
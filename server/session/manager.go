@@ -1,48 +1,370 @@
 package session
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
-
-	"github.com/google/uuid"
 )
 
-// Session session information
+// Session session information for a connected gottyp client
 type Session struct {
-	ID        string
+	// ID is the piko endpoint ID the client registered (its --session)
+	ID string
+	// CreatedAt is when the first upstream for the session connected
 	CreatedAt time.Time
-	LastSeen  time.Time
-	Metadata  map[string]interface{}
-	mu        sync.RWMutex
+	// LastSeen is the last upstream change or proxied request
+	LastSeen time.Time
+	// DisconnectedAt is set once the last upstream has gone away
+	DisconnectedAt time.Time
+	// RemoteAddr is the address the client connected from, if known
+	RemoteAddr string
+	// Owner is the user whose key the client connected with, if known
+	Owner string
+	// Conflict is set while upstreams that may not share the session are
+	// connected to it, e.g. two clients that picked the same name
+	Conflict bool
+	// Endpoints maps every piko endpoint owned by the session (the session
+	// itself and its {session}:{port} forwards) to its listener count
+	Endpoints map[string]int
+	// Tags label the session, e.g. by team, for tag notification
+	// subscriptions
+	Tags     []string
+	Metadata map[string]interface{}
+	// bytesIn and bytesOut count the traffic proxied to and from the session
+	bytesIn  atomic.Uint64
+	bytesOut atomic.Uint64
+	mu       sync.RWMutex
+}
+
+// Info is a point-in-time copy of a session that is safe to share
+type Info struct {
+	ID             string                 `json:"id"`
+	ConnectedAt    time.Time              `json:"connected_at"`
+	LastSeen       time.Time              `json:"last_seen"`
+	DisconnectedAt *time.Time             `json:"disconnected_at,omitempty"`
+	RemoteAddr     string                 `json:"remote_addr"`
+	Owner          string                 `json:"owner,omitempty"`
+	Conflict       bool                   `json:"conflict,omitempty"`
+	Connected      bool                   `json:"connected"`
+	Upstreams      int                    `json:"upstreams"`
+	Ports          []string               `json:"ports"`
+	Tags           []string               `json:"tags"`
+	Metadata       map[string]interface{} `json:"metadata,omitempty"`
+	// Node is the ID of the cluster node the session is connected to
+	Node string `json:"node,omitempty"`
+	// BytesIn and BytesOut count the traffic proxied to and from the session
+	// through this node
+	BytesIn  uint64 `json:"bytes_in"`
+	BytesOut uint64 `json:"bytes_out"`
+}
+
+// Stats counts upstream changes since the manager was created
+type Stats struct {
+	// Connects and Disconnects count upstream listeners added and removed
+	// across every endpoint
+	Connects    uint64
+	Disconnects uint64
+}
+
+// Upstream identifies a client connecting an upstream to an endpoint
+type Upstream struct {
+	// Owner is the user of the client's upstream key, empty for the shared
+	// UPSTREAM_KEY or no key
+	Owner string `json:"owner,omitempty"`
+	// Instance is a random ID of the client process, the same when it
+	// reconnects
+	Instance string `json:"instance,omitempty"`
+	// MultiHost is set when the client lets other clients of the same owner
+	// share its endpoint
+	MultiHost  bool   `json:"multi_host,omitempty"`
+	RemoteAddr string `json:"remote_addr"`
+}
+
+// Joins reports whether u may connect to an endpoint other already listens
+// on: when it is the same client reconnecting, or when both opted into
+// multi-host mode with the same owner
+func (u Upstream) Joins(other Upstream) bool {
+	if u.Instance != "" && u.Instance == other.Instance {
+		return true
+	}
+	return u.MultiHost && other.MultiHost && u.Owner == other.Owner
+}
+
+// upstreamConn is an upstream WebSocket proxied through this server
+type upstreamConn struct {
+	Upstream
+	cancel context.CancelFunc
 }
 
 // Manager session manager
 type Manager struct {
 	sessions map[string]*Session
-	mu       sync.RWMutex
+	// conns holds the upstream connections proxied through this server,
+	// keyed by endpoint ID
+	conns       map[string][]*upstreamConn
+	connects    atomic.Uint64
+	disconnects atomic.Uint64
+	mu          sync.RWMutex
 }
 
 // NewManager creates a new session manager
 func NewManager() *Manager {
 	return &Manager{
 		sessions: make(map[string]*Session),
+		conns:    make(map[string][]*upstreamConn),
 	}
 }
 
-// Create creates a new session
-func (m *Manager) Create() *Session {
+// SyncEndpoint records the number of upstream listeners piko currently has
+// for an endpoint. It is called whenever an upstream connects or disconnects.
+func (m *Manager) SyncEndpoint(endpointID string, listeners int) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	session := &Session{
-		ID:        uuid.New().String(),
-		CreatedAt: time.Now(),
-		LastSeen:  time.Now(),
-		Metadata:  make(map[string]interface{}),
+	now := time.Now()
+	sessionID := SessionOf(endpointID)
+	session, exists := m.sessions[sessionID]
+	if !exists {
+		if listeners <= 0 {
+			return
+		}
+		session = &Session{
+			ID:        sessionID,
+			CreatedAt: now,
+			Endpoints: make(map[string]int),
+			Metadata:  make(map[string]interface{}),
+		}
+		m.sessions[sessionID] = session
 	}
 
-	m.sessions[session.ID] = session
-	return session
+	session.mu.Lock()
+	defer session.mu.Unlock()
+
+	if _, tracked := session.Endpoints[endpointID]; !tracked && listeners <= 0 {
+		return
+	}
+	if delta := listeners - session.Endpoints[endpointID]; delta > 0 {
+		m.connects.Add(uint64(delta))
+	} else if delta < 0 {
+		m.disconnects.Add(uint64(-delta))
+	}
+
+	if listeners > 0 {
+		if !session.connectedLocked() {
+			// Reconnected after the grace period started
+			session.CreatedAt = now
+			session.DisconnectedAt = time.Time{}
+		}
+		session.Endpoints[endpointID] = listeners
+		if conns := m.conns[endpointID]; len(conns) > 0 {
+			session.RemoteAddr = conns[len(conns)-1].RemoteAddr
+			if endpointID == sessionID {
+				session.Owner = conns[0].Owner
+				session.Conflict = conflicting(conns)
+			}
+		}
+	} else {
+		delete(session.Endpoints, endpointID)
+		if !session.connectedLocked() {
+			session.DisconnectedAt = now
+		}
+		if endpointID == sessionID {
+			session.Conflict = false
+		}
+	}
+	session.LastSeen = now
+}
+
+// conflicting reports whether some of the connections may not share their
+// endpoint
+func conflicting(conns []*upstreamConn) bool {
+	for i, conn := range conns {
+		for _, other := range conns[:i] {
+			if !conn.Joins(other.Upstream) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ErrConflict is returned by Claim for a client that may not join the
+// clients already listening on an endpoint
+var ErrConflict = errors.New("already connected by another client")
+
+// CapError is returned by Claim when the owner of a client already has as
+// many sessions connected as it may
+type CapError struct {
+	Owner    string
+	Sessions int
+}
+
+func (e *CapError) Error() string {
+	return fmt.Sprintf("%s already has %d sessions connected", e.Owner, e.Sessions)
+}
+
+// ClaimOptions are what Claim checks a client against besides the clients
+// proxied through this server
+type ClaimOptions struct {
+	// Remote are the clients listening on the endpoint through other
+	// cluster nodes
+	Remote []Upstream
+	// AllowConflict lets a client that may not join the others in, for the
+	// session to be flagged as conflicting
+	AllowConflict bool
+	// MaxOwned caps the sessions connected with the key of an owner, 0 for
+	// no cap
+	MaxOwned int
+	// RemoteOwned are the sessions of the client's owner connected through
+	// other cluster nodes
+	RemoteOwned []string
+}
+
+// Claim records an upstream connection proxied through this server, so the
+// session can report the client and be disconnected later, once it has
+// checked that the client may connect: its owner must not exceed
+// opts.MaxOwned with a new session, and it must be able to join every
+// client already listening on the endpoint, those proxied through this
+// server, listeners piko has that can't be identified and opts.Remote.
+// Checking and recording under one lock lets only one of several clients
+// connecting at once take the last slot or the endpoint. conflict reports a
+// client that may not join; it is refused with ErrConflict unless
+// opts.AllowConflict is set. release must be called once the connection has
+// closed.
+func (m *Manager) Claim(endpointID string, up Upstream, cancel context.CancelFunc, opts ClaimOptions) (release func(), conflict bool, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if opts.MaxOwned > 0 && up.Owner != "" {
+		owned := m.ownedLocked(up.Owner)
+		for _, id := range opts.RemoteOwned {
+			owned[id] = true
+		}
+		if !owned[SessionOf(endpointID)] && len(owned) >= opts.MaxOwned {
+			return nil, false, &CapError{Owner: up.Owner, Sessions: len(owned)}
+		}
+	}
+
+	for _, other := range append(m.upstreamsLocked(endpointID), opts.Remote...) {
+		if !up.Joins(other) {
+			conflict = true
+			break
+		}
+	}
+	if conflict && !opts.AllowConflict {
+		return nil, true, ErrConflict
+	}
+
+	conn := &upstreamConn{Upstream: up, cancel: cancel}
+	m.conns[endpointID] = append(m.conns[endpointID], conn)
+
+	return func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+
+		conns := m.conns[endpointID]
+		for i, c := range conns {
+			if c == conn {
+				conns = append(conns[:i], conns[i+1:]...)
+				break
+			}
+		}
+		if len(conns) == 0 {
+			delete(m.conns, endpointID)
+		} else {
+			m.conns[endpointID] = conns
+		}
+	}, conflict, nil
+}
+
+// ownedLocked returns the sessions whose first client proxied through this
+// server connected with a key of owner, including clients piko hasn't
+// reported yet
+func (m *Manager) ownedLocked(owner string) map[string]bool {
+	owned := make(map[string]bool)
+	for endpointID, conns := range m.conns {
+		if SessionOf(endpointID) == endpointID && conns[0].Owner == owner {
+			owned[endpointID] = true
+		}
+	}
+	return owned
+}
+
+// upstreamsLocked returns the clients listening on an endpoint through this
+// server, with an empty Upstream for each listener piko has that isn't
+// proxied through it
+func (m *Manager) upstreamsLocked(endpointID string) []Upstream {
+	conns := m.conns[endpointID]
+	result := make([]Upstream, len(conns))
+	for i, conn := range conns {
+		result[i] = conn.Upstream
+	}
+
+	if session, exists := m.sessions[SessionOf(endpointID)]; exists {
+		session.mu.RLock()
+		listeners := session.Endpoints[endpointID]
+		session.mu.RUnlock()
+		for i := len(result); i < listeners; i++ {
+			result = append(result, Upstream{})
+		}
+	}
+	return result
+}
+
+// Upstreams returns the clients listening on an endpoint through this
+// server, with an empty Upstream for each listener that can't be identified
+func (m *Manager) Upstreams(endpointID string) []Upstream {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.upstreamsLocked(endpointID)
+}
+
+// Disconnect closes every upstream connection of a session that is proxied
+// through this server and returns how many were closed. Upstreams that
+// connected to the piko upstream port directly cannot be closed this way.
+func (m *Manager) Disconnect(id string) int {
+	m.mu.RLock()
+	var cancels []context.CancelFunc
+	for endpointID, conns := range m.conns {
+		if SessionOf(endpointID) != id {
+			continue
+		}
+		for _, conn := range conns {
+			cancels = append(cancels, conn.cancel)
+		}
+	}
+	m.mu.RUnlock()
+
+	for _, cancel := range cancels {
+		cancel()
+	}
+	return len(cancels)
+}
+
+// AddTraffic adds bytes proxied to (in) and from (out) a session, if it
+// exists
+func (m *Manager) AddTraffic(id string, in, out int) {
+	m.mu.RLock()
+	session, exists := m.sessions[id]
+	m.mu.RUnlock()
+	if !exists {
+		return
+	}
+	session.bytesIn.Add(uint64(in))
+	session.bytesOut.Add(uint64(out))
+}
+
+// Stats returns the upstream counters of the manager
+func (m *Manager) Stats() Stats {
+	return Stats{
+		Connects:    m.connects.Load(),
+		Disconnects: m.disconnects.Load(),
+	}
 }
 
 // Get gets a session by ID
@@ -63,6 +385,38 @@ func (m *Manager) Get(id string) (*Session, bool) {
 	return session, true
 }
 
+// Touch updates the last activity of a session, if it exists
+func (m *Manager) Touch(id string) {
+	m.Get(id)
+}
+
+// Info returns a snapshot of a session by ID
+func (m *Manager) Info(id string) (Info, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	session, exists := m.sessions[id]
+	if !exists {
+		return Info{}, false
+	}
+	return session.Info(), true
+}
+
+// List returns snapshots of all known sessions ordered by ID
+func (m *Manager) List() []Info {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	result := make([]Info, 0, len(m.sessions))
+	for _, session := range m.sessions {
+		result = append(result, session.Info())
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].ID < result[j].ID
+	})
+	return result
+}
+
 // Delete deletes a session
 func (m *Manager) Delete(id string) {
 	m.mu.Lock()
@@ -90,7 +444,41 @@ func (m *Manager) UpdateMetadata(id string, metadata map[string]interface{}) boo
 	return true
 }
 
-// Cleanup cleans up expired sessions
+// SetTags replaces the tags of a session
+func (m *Manager) SetTags(id string, tags []string) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	session, exists := m.sessions[id]
+	if !exists {
+		return false
+	}
+
+	session.mu.Lock()
+	defer session.mu.Unlock()
+
+	session.Tags = append([]string(nil), tags...)
+	return true
+}
+
+// Tags returns the tags of a session, or nil for an unknown session
+func (m *Manager) Tags(id string) []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	session, exists := m.sessions[id]
+	if !exists {
+		return nil
+	}
+
+	session.mu.RLock()
+	defer session.mu.RUnlock()
+
+	return append([]string(nil), session.Tags...)
+}
+
+// Cleanup removes sessions that have had no upstream connected for longer
+// than timeout
 func (m *Manager) Cleanup(timeout time.Duration) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
@@ -98,9 +486,57 @@ func (m *Manager) Cleanup(timeout time.Duration) {
 	now := time.Now()
 	for id, session := range m.sessions {
 		session.mu.RLock()
-		if now.Sub(session.LastSeen) > timeout {
+		expired := !session.connectedLocked() && now.Sub(session.LastSeen) > timeout
+		session.mu.RUnlock()
+		if expired {
 			delete(m.sessions, id)
 		}
-		session.mu.RUnlock()
 	}
 }
+
+// Info returns a snapshot of the session
+func (s *Session) Info() Info {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	info := Info{
+		ID:          s.ID,
+		ConnectedAt: s.CreatedAt,
+		LastSeen:    s.LastSeen,
+		RemoteAddr:  s.RemoteAddr,
+		Owner:       s.Owner,
+		Conflict:    s.Conflict,
+		Connected:   s.connectedLocked(),
+		Upstreams:   s.Endpoints[s.ID],
+		Ports:       []string{},
+		Tags:        append([]string{}, s.Tags...),
+		Metadata:    make(map[string]interface{}, len(s.Metadata)),
+		BytesIn:     s.bytesIn.Load(),
+		BytesOut:    s.bytesOut.Load(),
+	}
+	if !s.DisconnectedAt.IsZero() {
+		disconnectedAt := s.DisconnectedAt
+		info.DisconnectedAt = &disconnectedAt
+	}
+	for endpointID := range s.Endpoints {
+		if _, port, ok := SplitPortEndpoint(endpointID); ok {
+			info.Ports = append(info.Ports, port)
+		}
+	}
+	sort.Strings(info.Ports)
+	for k, v := range s.Metadata {
+		info.Metadata[k] = v
+	}
+	return info
+}
+
+// connectedLocked reports whether any endpoint of the session still has an
+// upstream listener
+func (s *Session) connectedLocked() bool {
+	for _, listeners := range s.Endpoints {
+		if listeners > 0 {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,443 @@
+package session
+
+import (
+	"errors"
+	"reflect"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// track records an upstream connection whether or not it conflicts
+func track(m *Manager, endpointID string, up Upstream, cancel func()) func() {
+	release, _, _ := m.Claim(endpointID, up, cancel, ClaimOptions{AllowConflict: true})
+	return release
+}
+
+func TestSplitPortEndpoint(t *testing.T) {
+	tests := []struct {
+		endpointID string
+		session    string
+		port       string
+		ok         bool
+	}{
+		{endpointID: "alice:3000", session: "alice", port: "3000", ok: true},
+		{endpointID: "alice-dev:8080", session: "alice-dev", port: "8080", ok: true},
+		{endpointID: "alice:65535", session: "alice", port: "65535", ok: true},
+		{endpointID: "alice"},
+		{endpointID: "alice-1234"},
+		{endpointID: "alice:"},
+		{endpointID: ":3000"},
+		{endpointID: "alice:03000"},
+		{endpointID: "alice:65536"},
+		{endpointID: "alice:-1"},
+		{endpointID: "alice:web"},
+		{endpointID: "alice:3000:4000"},
+	}
+	for _, tt := range tests {
+		session, port, ok := SplitPortEndpoint(tt.endpointID)
+		if session != tt.session || port != tt.port || ok != tt.ok {
+			t.Errorf("SplitPortEndpoint(%q) = %q, %q, %v, want %q, %q, %v", tt.endpointID, session, port, ok, tt.session, tt.port, tt.ok)
+		}
+		if ok && PortEndpoint(session, port) != tt.endpointID {
+			t.Errorf("PortEndpoint(%q, %q) = %q", session, port, PortEndpoint(session, port))
+		}
+	}
+}
+
+func TestSyncEndpoint(t *testing.T) {
+	type update struct {
+		endpointID string
+		listeners  int
+	}
+	type want struct {
+		connected bool
+		upstreams int
+		ports     []string
+	}
+	tests := []struct {
+		name        string
+		syncs       []update
+		sessions    map[string]want
+		connects    uint64
+		disconnects uint64
+	}{
+		{
+			name:     "session",
+			syncs:    []update{{"alice", 1}},
+			sessions: map[string]want{"alice": {connected: true, upstreams: 1, ports: []string{}}},
+			connects: 1,
+		},
+		{
+			name:        "listeners added and removed",
+			syncs:       []update{{"alice", 1}, {"alice", 3}, {"alice", 2}},
+			sessions:    map[string]want{"alice": {connected: true, upstreams: 2, ports: []string{}}},
+			connects:    3,
+			disconnects: 1,
+		},
+		{
+			name:        "disconnected",
+			syncs:       []update{{"alice", 2}, {"alice", 0}},
+			sessions:    map[string]want{"alice": {ports: []string{}}},
+			connects:    2,
+			disconnects: 2,
+		},
+		{
+			name:     "port forwards",
+			syncs:    []update{{"alice", 1}, {"alice:3000", 1}, {"alice:80", 2}},
+			sessions: map[string]want{"alice": {connected: true, upstreams: 1, ports: []string{"3000", "80"}}},
+			connects: 4,
+		},
+		{
+			name:     "port forward before its session",
+			syncs:    []update{{"alice:3000", 1}, {"alice", 1}},
+			sessions: map[string]want{"alice": {connected: true, upstreams: 1, ports: []string{"3000"}}},
+			connects: 2,
+		},
+		{
+			name:        "port forward gone",
+			syncs:       []update{{"alice", 1}, {"alice:3000", 1}, {"alice:3000", 0}},
+			sessions:    map[string]want{"alice": {connected: true, upstreams: 1, ports: []string{}}},
+			connects:    2,
+			disconnects: 1,
+		},
+		{
+			name:        "session gone with its port forward connected",
+			syncs:       []update{{"alice", 1}, {"alice:3000", 1}, {"alice", 0}},
+			sessions:    map[string]want{"alice": {connected: true, ports: []string{"3000"}}},
+			connects:    2,
+			disconnects: 1,
+		},
+		{
+			name:  "session named like a port forward",
+			syncs: []update{{"alice", 1}, {"alice-1234", 1}},
+			sessions: map[string]want{
+				"alice":      {connected: true, upstreams: 1, ports: []string{}},
+				"alice-1234": {connected: true, upstreams: 1, ports: []string{}},
+			},
+			connects: 2,
+		},
+		{
+			name:     "unknown endpoint gone",
+			syncs:    []update{{"alice", 1}, {"bob", 0}, {"alice:3000", 0}},
+			sessions: map[string]want{"alice": {connected: true, upstreams: 1, ports: []string{}}},
+			connects: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := NewManager()
+			for _, s := range tt.syncs {
+				m.SyncEndpoint(s.endpointID, s.listeners)
+			}
+
+			got := make(map[string]want)
+			for _, info := range m.List() {
+				got[info.ID] = want{connected: info.Connected, upstreams: info.Upstreams, ports: info.Ports}
+				if info.Connected != (info.DisconnectedAt == nil) {
+					t.Errorf("session %s connected = %v with disconnected_at %v", info.ID, info.Connected, info.DisconnectedAt)
+				}
+			}
+			if !reflect.DeepEqual(got, tt.sessions) {
+				t.Fatalf("sessions = %+v, want %+v", got, tt.sessions)
+			}
+			if stats := m.Stats(); stats.Connects != tt.connects || stats.Disconnects != tt.disconnects {
+				t.Fatalf("stats = %+v, want %d connects and %d disconnects", stats, tt.connects, tt.disconnects)
+			}
+		})
+	}
+}
+
+func TestSyncEndpointOwner(t *testing.T) {
+	alice := Upstream{Owner: "alice", Instance: "a1", RemoteAddr: "10.0.0.1"}
+	tests := []struct {
+		name       string
+		endpointID string
+		conns      []Upstream
+		owner      string
+		conflict   bool
+		remoteAddr string
+	}{
+		{name: "one client", endpointID: "alice", conns: []Upstream{alice}, owner: "alice", remoteAddr: "10.0.0.1"},
+		{
+			name:       "same client reconnecting",
+			endpointID: "alice",
+			conns:      []Upstream{alice, {Owner: "alice", Instance: "a1", RemoteAddr: "10.0.0.2"}},
+			owner:      "alice",
+			remoteAddr: "10.0.0.2",
+		},
+		{
+			name:       "multi-host clients of one owner",
+			endpointID: "alice",
+			conns: []Upstream{
+				{Owner: "alice", Instance: "a1", MultiHost: true},
+				{Owner: "alice", Instance: "a2", MultiHost: true},
+			},
+			owner: "alice",
+		},
+		{
+			name:       "clients picking the same name",
+			endpointID: "alice",
+			conns:      []Upstream{alice, {Owner: "bob", Instance: "b1"}},
+			owner:      "alice",
+			conflict:   true,
+		},
+		{
+			name:       "multi-host clients of two owners",
+			endpointID: "alice",
+			conns: []Upstream{
+				{Owner: "alice", Instance: "a1", MultiHost: true},
+				{Owner: "bob", Instance: "b1", MultiHost: true},
+			},
+			owner:    "alice",
+			conflict: true,
+		},
+		{
+			name:       "port forward",
+			endpointID: "alice:3000",
+			conns:      []Upstream{{Owner: "bob", Instance: "b1", RemoteAddr: "10.0.0.3"}},
+			remoteAddr: "10.0.0.3",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := NewManager()
+			for _, up := range tt.conns {
+				track(m, tt.endpointID, up, func() {})
+			}
+			m.SyncEndpoint(tt.endpointID, len(tt.conns))
+
+			info, ok := m.Info("alice")
+			if !ok {
+				t.Fatal("session alice not found")
+			}
+			if info.Owner != tt.owner || info.Conflict != tt.conflict || info.RemoteAddr != tt.remoteAddr {
+				t.Fatalf("owner = %q, conflict = %v, remote address = %q, want %q, %v, %q", info.Owner, info.Conflict, info.RemoteAddr, tt.owner, tt.conflict, tt.remoteAddr)
+			}
+
+			// The conflict ends with the session's listeners
+			m.SyncEndpoint(tt.endpointID, 0)
+			if info, _ := m.Info("alice"); info.Conflict {
+				t.Fatal("conflict kept after the session disconnected")
+			}
+		})
+	}
+}
+
+func TestClaim(t *testing.T) {
+	alice := Upstream{Owner: "alice", Instance: "a1"}
+	tests := []struct {
+		name          string
+		tracked       []Upstream
+		listeners     int
+		remote        []Upstream
+		up            Upstream
+		allowConflict bool
+		conflict      bool
+		recorded      bool
+	}{
+		{name: "free endpoint", up: alice, recorded: true},
+		{name: "same client", tracked: []Upstream{alice}, up: alice, recorded: true},
+		{name: "other client", tracked: []Upstream{alice}, up: Upstream{Owner: "bob", Instance: "b1"}, conflict: true},
+		{name: "other client flagged", tracked: []Upstream{alice}, up: Upstream{Owner: "bob", Instance: "b1"}, allowConflict: true, conflict: true, recorded: true},
+		{name: "unidentified listener", listeners: 1, up: alice, conflict: true},
+		{name: "identified listener", tracked: []Upstream{alice}, listeners: 1, up: alice, recorded: true},
+		{name: "remote client", remote: []Upstream{{Owner: "bob", Instance: "b1"}}, up: alice, conflict: true},
+		{
+			name:     "remote multi-host client of the owner",
+			remote:   []Upstream{{Owner: "alice", Instance: "a2", MultiHost: true}},
+			up:       Upstream{Owner: "alice", Instance: "a1", MultiHost: true},
+			recorded: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := NewManager()
+			for _, up := range tt.tracked {
+				track(m, "alice", up, func() {})
+			}
+			if tt.listeners > 0 {
+				m.SyncEndpoint("alice", tt.listeners)
+			}
+			before := len(m.conns["alice"])
+
+			release, conflict, err := m.Claim("alice", tt.up, func() {}, ClaimOptions{Remote: tt.remote, AllowConflict: tt.allowConflict})
+			if conflict != tt.conflict || (err == nil) != tt.recorded || (release != nil) != tt.recorded {
+				t.Fatalf("Claim() = release %v, conflict %v, error %v, want recorded %v, conflict %v", release != nil, conflict, err, tt.recorded, tt.conflict)
+			}
+			if err != nil && !errors.Is(err, ErrConflict) {
+				t.Fatalf("Claim() error = %v, want ErrConflict", err)
+			}
+			if recorded := len(m.conns["alice"]) - before; (recorded == 1) != tt.recorded {
+				t.Fatalf("%d connections recorded, want recorded %v", recorded, tt.recorded)
+			}
+		})
+	}
+}
+
+func TestClaimCap(t *testing.T) {
+	tests := []struct {
+		name        string
+		tracked     map[string]Upstream
+		remoteOwned []string
+		endpointID  string
+		up          Upstream
+		sessions    int
+	}{
+		{name: "below the cap", tracked: map[string]Upstream{"a": {Owner: "alice"}}, endpointID: "b", up: Upstream{Owner: "alice"}},
+		{name: "at the cap", tracked: map[string]Upstream{"a": {Owner: "alice"}, "b": {Owner: "alice"}}, endpointID: "c", up: Upstream{Owner: "alice"}, sessions: 2},
+		{name: "owned session", tracked: map[string]Upstream{"a": {Owner: "alice"}, "b": {Owner: "alice"}}, endpointID: "a", up: Upstream{Owner: "alice"}},
+		{name: "port forward of an owned session", tracked: map[string]Upstream{"a": {Owner: "alice"}, "b": {Owner: "alice"}}, endpointID: "a:3000", up: Upstream{Owner: "alice"}},
+		{name: "session named like a port forward", tracked: map[string]Upstream{"a": {Owner: "alice"}, "b": {Owner: "alice"}}, endpointID: "a-3000", up: Upstream{Owner: "alice"}, sessions: 2},
+		{name: "port forwards aren't sessions", tracked: map[string]Upstream{"a": {Owner: "alice"}, "x:3000": {Owner: "alice"}}, endpointID: "b", up: Upstream{Owner: "alice"}},
+		{name: "sessions of others", tracked: map[string]Upstream{"a": {Owner: "bob"}, "b": {Owner: "bob"}}, endpointID: "c", up: Upstream{Owner: "alice"}},
+		{name: "remote sessions", tracked: map[string]Upstream{"a": {Owner: "alice"}}, remoteOwned: []string{"r"}, endpointID: "c", up: Upstream{Owner: "alice"}, sessions: 2},
+		{name: "session on both nodes", tracked: map[string]Upstream{"a": {Owner: "alice"}}, remoteOwned: []string{"a"}, endpointID: "c", up: Upstream{Owner: "alice"}},
+		{name: "shared key", tracked: map[string]Upstream{"a": {}, "b": {}}, endpointID: "c", up: Upstream{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := NewManager()
+			for endpointID, up := range tt.tracked {
+				track(m, endpointID, up, func() {})
+			}
+
+			_, _, err := m.Claim(tt.endpointID, tt.up, func() {}, ClaimOptions{MaxOwned: 2, RemoteOwned: tt.remoteOwned, AllowConflict: true})
+			var capErr *CapError
+			if tt.sessions == 0 && err != nil {
+				t.Fatalf("Claim() = %v", err)
+			}
+			if tt.sessions > 0 && (!errors.As(err, &capErr) || capErr.Sessions != tt.sessions) {
+				t.Fatalf("Claim() = %v, want the cap of %d sessions", err, tt.sessions)
+			}
+		})
+	}
+}
+
+func TestClaimCapConcurrent(t *testing.T) {
+	m := NewManager()
+	const clients = 50
+
+	var wg sync.WaitGroup
+	var claimed atomic.Int32
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			endpointID := "session-" + strconv.Itoa(i)
+			if _, _, err := m.Claim(endpointID, Upstream{Owner: "alice"}, func() {}, ClaimOptions{MaxOwned: 3}); err == nil {
+				claimed.Add(1)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if n := claimed.Load(); n != 3 {
+		t.Fatalf("%d sessions connected at once with a cap of 3", n)
+	}
+}
+
+func TestClaimRelease(t *testing.T) {
+	m := NewManager()
+	alice := Upstream{Owner: "alice", Instance: "a1"}
+	bob := Upstream{Owner: "bob", Instance: "b1"}
+
+	releaseAlice := track(m, "alice", alice, func() {})
+	releaseBob := track(m, "alice", bob, func() {})
+	if got := m.Upstreams("alice"); !reflect.DeepEqual(got, []Upstream{alice, bob}) {
+		t.Fatalf("Upstreams() = %+v", got)
+	}
+
+	releaseAlice()
+	releaseAlice()
+	if got := m.Upstreams("alice"); !reflect.DeepEqual(got, []Upstream{bob}) {
+		t.Fatalf("Upstreams() after release = %+v, want bob only", got)
+	}
+
+	releaseBob()
+	if got := m.Upstreams("alice"); len(got) != 0 {
+		t.Fatalf("Upstreams() after releasing all = %+v", got)
+	}
+	if _, ok := m.conns["alice"]; ok {
+		t.Fatal("released endpoint still tracked")
+	}
+}
+
+func TestClaimConcurrent(t *testing.T) {
+	m := NewManager()
+	const clients = 50
+
+	var wg sync.WaitGroup
+	var claimed atomic.Int32
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			up := Upstream{Owner: "user", Instance: strconv.Itoa(i)}
+			if _, _, err := m.Claim("alice", up, func() {}, ClaimOptions{}); err == nil {
+				claimed.Add(1)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if n := claimed.Load(); n != 1 {
+		t.Fatalf("%d of %d clients connecting at once claimed the session, want 1", n, clients)
+	}
+}
+
+func TestDisconnect(t *testing.T) {
+	m := NewManager()
+	cancelled := make(map[string]int)
+	track := func(endpointID string) {
+		track(m, endpointID, Upstream{}, func() { cancelled[endpointID]++ })
+		m.SyncEndpoint(endpointID, len(m.Upstreams(endpointID)))
+	}
+	track("alice")
+	track("alice")
+	track("alice:3000")
+	track("alice-1234")
+	track("bob")
+
+	if n := m.Disconnect("alice"); n != 3 {
+		t.Fatalf("Disconnect() = %d, want 3", n)
+	}
+	want := map[string]int{"alice": 2, "alice:3000": 1}
+	if !reflect.DeepEqual(cancelled, want) {
+		t.Fatalf("cancelled = %v, want %v", cancelled, want)
+	}
+	if n := m.Disconnect("carol"); n != 0 {
+		t.Fatalf("Disconnect() of an unknown session = %d", n)
+	}
+}
+
+func TestCleanup(t *testing.T) {
+	m := NewManager()
+	m.SyncEndpoint("connected", 1)
+	m.SyncEndpoint("recent", 1)
+	m.SyncEndpoint("recent", 0)
+	m.SyncEndpoint("expired", 1)
+	m.SyncEndpoint("expired:3000", 1)
+	m.SyncEndpoint("expired", 0)
+	m.SyncEndpoint("expired:3000", 0)
+	m.sessions["connected"].LastSeen = time.Now().Add(-time.Hour)
+	m.sessions["expired"].LastSeen = time.Now().Add(-time.Hour)
+
+	m.Cleanup(time.Minute)
+
+	var ids []string
+	for _, info := range m.List() {
+		ids = append(ids, info.ID)
+	}
+	if want := []string{"connected", "recent"}; !reflect.DeepEqual(ids, want) {
+		t.Fatalf("sessions = %v, want %v", ids, want)
+	}
+
+	// An expired session starts afresh when it reconnects
+	m.SyncEndpoint("expired", 1)
+	if info, ok := m.Info("expired"); !ok || !info.Connected || len(info.Ports) != 0 {
+		t.Fatalf("reconnected session = %+v, %v", info, ok)
+	}
+}